@@ -2,14 +2,21 @@ package salesforce
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
+	"reconciler/apiclients/tokenstore"
 	"reconciler/config"
+	"reconciler/internal"
 
 	"golang.org/x/oauth2"
 )
@@ -18,6 +25,10 @@ import (
 // Salesforce API used for this client.
 const SalesforceAPIVersionNumber = "v65.0"
 
+// revocationTimeout is the longest a token revocation request may take, so that
+// disconnecting is not held up by an unresponsive endpoint.
+const revocationTimeout = 30 * time.Second
+
 // tokenCache is a helper struct to reliably save and load the OAuth2 token
 // and the critical instance_url from a file.
 type tokenCache struct {
@@ -25,37 +36,111 @@ type tokenCache struct {
 	InstanceURL string        `json:"instance_url"`
 }
 
-// NewClient handles the OAuth2 flow to return an authenticated Salesforce client.
+// ConnectionStatus describes the saved Salesforce connection.
+type ConnectionStatus struct {
+	Connected   bool
+	InstanceURL string
+	Expiry      time.Time // the expiry of the saved access token, if provided
+}
+
+// NewClient handles the OAuth2 flow to return an authenticated Salesforce client. The
+// token is refreshed if it has expired, and saved each time it is refreshed during the
+// life of the client.
 func NewClient(ctx context.Context, cfg *config.Config) (*Client, error) {
-	cache, err := loadTokenCacheFromFile(cfg.Salesforce.TokenFilePath)
+	store, err := TokenStore(cfg)
 	if err != nil {
+		return nil, err
+	}
+	cache, err := loadTokenCache(store)
+	if errors.Is(err, fs.ErrNotExist) {
 		return nil, fmt.Errorf("no token file found at '%s'. Please run the 'login' command first", cfg.Salesforce.TokenFilePath)
 	}
-
-	tokenSource := cfg.Salesforce.OAuth2Config.TokenSource(ctx, cache.Token)
-	refreshedToken, err := tokenSource.Token()
 	if err != nil {
-		return nil, fmt.Errorf("failed to refresh token: %w", err)
+		return nil, fmt.Errorf("failed to load token: %w", err)
 	}
 
-	if refreshedToken.AccessToken != cache.Token.AccessToken {
-		log.Println("Access token was refreshed. Saving new token.")
-		cache.Token = refreshedToken
-		// The instance_url does not change on refresh, so keep the old one.
-		if err := saveTokenCacheToFile(cache, cfg.Salesforce.TokenFilePath); err != nil {
-			return nil, fmt.Errorf("failed to save refreshed token: %w", err)
-		}
+	// Every refreshed token is saved. The instance_url does not change on refresh, so
+	// the saved one is kept.
+	instanceURL := cache.InstanceURL
+	session := newSessionTokenSource(ctx, cfg.Salesforce.OAuth2Config, cache.Token)
+	tokenSource := tokenstore.NewPersistingTokenSource(
+		session,
+		cache.Token,
+		func(t *oauth2.Token) error {
+			return saveTokenCache(store, &tokenCache{Token: t, InstanceURL: instanceURL})
+		},
+	)
+	if _, err := tokenSource.Token(); err != nil {
+		return nil, fmt.Errorf("failed to refresh token: %w", err)
 	}
 
-	oauthClient := oauth2.NewClient(ctx, tokenSource)
+	// oauth2.NewClient is not used as it caches the token, which would prevent the
+	// session source from replacing a rejected token.
+	oauthClient := &http.Client{Transport: &oauth2.Transport{Source: tokenSource, Base: contextTransport(ctx)}}
 	return &Client{
 		httpClient:  oauthClient,
 		instanceURL: cache.InstanceURL,
 		apiVersion:  SalesforceAPIVersionNumber,
 		config:      *cfg,
+		refresh:     session.refresh,
+		retry:       defaultRetryPolicy,
+		sleep:       sleep,
 	}, nil
 }
 
+// contextTransport returns the transport of the http client set in the context with
+// the oauth2.HTTPClient key, as used by oauth2.NewClient, or nil for the default.
+func contextTransport(ctx context.Context) http.RoundTripper {
+	if c, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok {
+		return c.Transport
+	}
+	return nil
+}
+
+// sessionTokenSource is an oauth2.TokenSource which can be made to refresh its access
+// token before the token's expiry. Salesforce access tokens are issued without an
+// expiry time, so are otherwise only refreshed when the client is created, yet the
+// session can be ended at any time, such as by a session timeout or an administrator.
+type sessionTokenSource struct {
+	ctx context.Context
+	cfg *oauth2.Config
+
+	mu  sync.Mutex
+	src oauth2.TokenSource
+}
+
+// newSessionTokenSource returns a sessionTokenSource starting with the token.
+func newSessionTokenSource(ctx context.Context, cfg *oauth2.Config, tok *oauth2.Token) *sessionTokenSource {
+	return &sessionTokenSource{ctx: ctx, cfg: cfg, src: cfg.TokenSource(ctx, tok)}
+}
+
+// Token returns the current token, refreshing it if it has expired.
+func (s *sessionTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Token()
+}
+
+// refresh discards the current access token and obtains a new one with the refresh
+// token.
+func (s *sessionTokenSource) refresh() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, err := s.src.Token()
+	if err != nil {
+		return err
+	}
+	if current.RefreshToken == "" {
+		return errors.New("no refresh token is available")
+	}
+	src := s.cfg.TokenSource(s.ctx, &oauth2.Token{RefreshToken: current.RefreshToken})
+	if _, err := src.Token(); err != nil {
+		return err
+	}
+	s.src = src
+	return nil
+}
+
 // InitiateLogin starts the interactive OAuth2 flow to get a new token
 // from the web. It saves the new token and instance URL to the
 // specified configuration path upon success.
@@ -65,35 +150,102 @@ func InitiateLogin(ctx context.Context, cfg *config.Config) error {
 		return fmt.Errorf("failed to get new token: %w", err)
 	}
 
+	if err := saveNewToken(cfg, tok); err != nil {
+		return err
+	}
+	log.Println("Login successful. Token saved.")
+	return nil
+}
+
+// AuthCodeURL returns the Salesforce url at which the user authorizes this
+// application. The state is returned to the callback url with the authorization code.
+// The PKCE verifier should be generated with oauth2.GenerateVerifier and provided
+// again to Exchange.
+func AuthCodeURL(cfg *config.Config, state, verifier string) string {
+	return cfg.Salesforce.OAuth2Config.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier))
+}
+
+// Exchange exchanges an authorization code received at the callback url for a token,
+// and saves the token and instance url.
+func Exchange(ctx context.Context, cfg *config.Config, code, verifier string) error {
+	tok, err := cfg.Salesforce.OAuth2Config.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return fmt.Errorf("failed to exchange authorization code for token: %w", err)
+	}
+	return saveNewToken(cfg, tok)
+}
+
+// Status reports the status of the saved Salesforce connection. A missing token is
+// reported as not connected rather than as an error.
+func Status(cfg *config.Config) (ConnectionStatus, error) {
+	store, err := TokenStore(cfg)
+	if err != nil {
+		return ConnectionStatus{}, err
+	}
+	cache, err := loadTokenCache(store)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ConnectionStatus{}, nil
+	}
+	if err != nil {
+		return ConnectionStatus{}, fmt.Errorf("failed to load token: %w", err)
+	}
+	status := ConnectionStatus{
+		Connected:   true,
+		InstanceURL: cache.InstanceURL,
+	}
+	if cache.Token != nil {
+		status.Expiry = cache.Token.Expiry
+	}
+	return status, nil
+}
+
+// saveNewToken saves a newly issued token together with its instance url.
+func saveNewToken(cfg *config.Config, tok *oauth2.Token) error {
 	instanceURL, ok := tok.Extra("instance_url").(string)
 	if !ok || instanceURL == "" {
 		return fmt.Errorf("oauth token did not contain the required 'instance_url'")
 	}
 
+	store, err := TokenStore(cfg)
+	if err != nil {
+		return err
+	}
 	cache := &tokenCache{Token: tok, InstanceURL: instanceURL}
-	if err := saveTokenCacheToFile(cache, cfg.Salesforce.TokenFilePath); err != nil {
+	if err := saveTokenCache(store, cache); err != nil {
 		return fmt.Errorf("failed to save new token: %w", err)
 	}
-	log.Println("Login successful. Token saved.")
 	return nil
 }
 
 // getNewTokenFromWeb starts a temporary web server to handle the OAuth2 callback.
-// It uses the PKCE extension for enhanced security.
+// It uses a random state, checked in the callback, and the PKCE extension for enhanced
+// security.
 func getNewTokenFromWeb(ctx context.Context, cfg *config.Config) (*oauth2.Token, error) {
-	codeChan := make(chan string)
-	errChan := make(chan error)
-	server := &http.Server{Addr: cfg.Web.ListenAddress}
+	state, err := internal.NewOAuthState()
+	if err != nil {
+		return nil, err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	codeChan := make(chan string, 1)
+	errChan := make(chan error, 1)
 
-	http.HandleFunc(cfg.Web.SalesforceCallBack, func(w http.ResponseWriter, r *http.Request) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(cfg.Web.SalesforceCallBack, func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("state"); got != state {
+			http.Error(w, "Invalid authorization state.", http.StatusBadRequest)
+			return
+		}
 		code := r.URL.Query().Get("code")
 		if code == "" {
+			http.Error(w, "No authorization code received.", http.StatusBadRequest)
 			errChan <- fmt.Errorf("did not receive authorization code in callback")
 			return
 		}
 		fmt.Fprintln(w, "Authorization successful! You can close this window.")
 		codeChan <- code
 	})
+	server := &http.Server{Addr: cfg.Web.ListenAddress, Handler: mux}
 
 	go func() {
 		if err := server.ListenAndServe(); err != http.ErrServerClosed {
@@ -101,8 +253,7 @@ func getNewTokenFromWeb(ctx context.Context, cfg *config.Config) (*oauth2.Token,
 		}
 	}()
 
-	verifier := oauth2.GenerateVerifier()
-	authURL := cfg.Salesforce.OAuth2Config.AuthCodeURL("state-string", oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier))
+	authURL := AuthCodeURL(cfg, state, verifier)
 
 	fmt.Printf("\nPlease open this URL in your browser to authorize the application:\n%s\n\n", authURL)
 
@@ -128,27 +279,24 @@ func getNewTokenFromWeb(ctx context.Context, cfg *config.Config) (*oauth2.Token,
 	return tok, nil
 }
 
-// loadTokenCacheFromFile reads a token cache from a JSON file.
-func loadTokenCacheFromFile(path string) (*tokenCache, error) {
-	f, err := os.Open(path)
-	if err != nil {
+// TokenStore returns the configured store for the Salesforce token.
+func TokenStore(cfg *config.Config) (tokenstore.Store, error) {
+	return tokenstore.New(cfg.TokenStore, cfg.Salesforce.TokenFilePath, cfg.TokenPassphrase)
+}
+
+// loadTokenCache reads a token cache from the store.
+func loadTokenCache(store tokenstore.Store) (*tokenCache, error) {
+	cache := &tokenCache{}
+	if err := store.Load(cache); err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	cache := &tokenCache{}
-	err = json.NewDecoder(f).Decode(cache)
-	return cache, err
+	return cache, nil
 }
 
-// saveTokenCacheToFile writes a token cache to a JSON file with secure permissions.
-func saveTokenCacheToFile(cache *tokenCache, path string) error {
-	log.Printf("Saving token to %s", path)
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		return fmt.Errorf("unable to cache oauth token: %w", err)
-	}
-	defer f.Close()
-	return json.NewEncoder(f).Encode(cache)
+// saveTokenCache writes a token cache to the store.
+func saveTokenCache(store tokenstore.Store, cache *tokenCache) error {
+	log.Println("Saving Salesforce token")
+	return store.Save(cache)
 }
 
 // DeleteToken removes the token file from disk.
@@ -158,3 +306,65 @@ func DeleteToken(path string) error {
 	}
 	return nil
 }
+
+// RevokeAndDeleteToken revokes the saved refresh token with Salesforce, which also
+// revokes the access tokens issued from it, and then removes the token file. The token
+// file is removed even if revocation fails, in which case the revocation error is
+// returned.
+func RevokeAndDeleteToken(ctx context.Context, cfg *config.Config) error {
+	store, err := TokenStore(cfg)
+	if err != nil {
+		return err
+	}
+	cache, err := loadTokenCache(store)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	var revokeErr error
+	switch {
+	case err != nil:
+		revokeErr = fmt.Errorf("could not read token for revocation: %w", err)
+	case cache.Token == nil:
+		revokeErr = errors.New("token file holds no token to revoke")
+	default:
+		revokeErr = revokeToken(ctx, cfg, cache.Token)
+	}
+	if err := store.Delete(); err != nil {
+		return err
+	}
+	return revokeErr
+}
+
+// revocationURL returns the Salesforce token revocation endpoint, which sits alongside
+// the token endpoint, for example
+// https://login.salesforce.com/services/oauth2/revoke.
+func revocationURL(cfg *config.Config) string {
+	return strings.TrimSuffix(cfg.Salesforce.OAuth2Config.Endpoint.TokenURL, "/token") + "/revoke"
+}
+
+// revokeToken revokes the refresh token, or the access token if there is no refresh
+// token.
+func revokeToken(ctx context.Context, cfg *config.Config, tok *oauth2.Token) error {
+	token := tok.RefreshToken
+	if token == "" {
+		token = tok.AccessToken
+	}
+	form := url.Values{"token": {token}}
+	req, err := http.NewRequestWithContext(ctx, "POST", revocationURL(cfg), strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create revocation request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := &http.Client{Timeout: revocationTimeout, Transport: contextTransport(ctx)}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("token revocation failed (status %d): %s", resp.StatusCode, body)
+	}
+	return nil
+}
@@ -3,14 +3,17 @@ package salesforce
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"reconciler/apiclients/tokenstore"
 	"reconciler/config"
 
 	"golang.org/x/oauth2"
@@ -227,3 +230,182 @@ func TestTokenCache_RefreshExpiredToken(t *testing.T) {
 	}
 
 }
+
+// TestExchangeAndStatus tests exchanging an authorization code for a token using PKCE,
+// and the reported connection status before and after.
+func TestExchangeAndStatus(t *testing.T) {
+	const instanceURL = "https://instance-url-example"
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	verifier := oauth2.GenerateVerifier()
+	mux.HandleFunc("/oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.FormValue("code"), "auth-code-1"; got != want {
+			t.Errorf("got code %q want %q", got, want)
+		}
+		if got, want := r.FormValue("code_verifier"), verifier; got != want {
+			t.Errorf("got code verifier %q want %q", got, want)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token": "new-token", "token_type": "Bearer", "instance_url": "%s"}`, instanceURL)
+	})
+
+	tokenPath := filepath.Join(t.TempDir(), "token.json")
+	cfg := &config.Config{
+		Salesforce: createSFConfig(t, "/callback/sf", server.URL, tokenPath),
+	}
+
+	status, err := Status(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Connected {
+		t.Error("expected not to be connected without a token")
+	}
+
+	authURL := AuthCodeURL(cfg, "state-123", verifier)
+	if !strings.Contains(authURL, "state=state-123") || !strings.Contains(authURL, "code_challenge=") {
+		t.Errorf("auth url missing state or code challenge: %s", authURL)
+	}
+
+	if err := Exchange(context.Background(), cfg, "auth-code-1", verifier); err != nil {
+		t.Fatalf("exchange error: %v", err)
+	}
+
+	status, err = Status(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Connected {
+		t.Error("expected to be connected after exchange")
+	}
+	if got, want := status.InstanceURL, instanceURL; got != want {
+		t.Errorf("got instance url %q want %q", got, want)
+	}
+}
+
+// TestRevokeAndDeleteToken tests that the refresh token is revoked at the endpoint
+// alongside the token endpoint and the token file removed.
+func TestRevokeAndDeleteToken(t *testing.T) {
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	var revoked string
+	mux.HandleFunc("/oauth2/revoke", func(w http.ResponseWriter, r *http.Request) {
+		revoked = r.FormValue("token")
+	})
+
+	tokenPath := filepath.Join(t.TempDir(), "token.json")
+	cfg := &config.Config{
+		Salesforce: createSFConfig(t, "/callback/sf", server.URL, tokenPath),
+	}
+	cache := &tokenCache{
+		InstanceURL: "https://instance-url-example",
+		Token:       &oauth2.Token{AccessToken: "access-token", RefreshToken: "refresh-token"},
+	}
+	if err := saveTokenCacheToFile(cache, tokenPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RevokeAndDeleteToken(context.Background(), cfg); err != nil {
+		t.Fatalf("revoke error: %v", err)
+	}
+	if got, want := revoked, "refresh-token"; got != want {
+		t.Errorf("got revoked token %q want %q", got, want)
+	}
+	if _, err := os.Stat(tokenPath); !os.IsNotExist(err) {
+		t.Error("token file still exists after revocation")
+	}
+}
+
+// loadTokenCacheFromFile reads a token cache from a plain JSON file.
+func loadTokenCacheFromFile(path string) (*tokenCache, error) {
+	return loadTokenCache(&tokenstore.FileStore{Path: path})
+}
+
+// saveTokenCacheToFile writes a token cache to a plain JSON file with secure
+// permissions.
+func saveTokenCacheToFile(cache *tokenCache, path string) error {
+	return saveTokenCache(&tokenstore.FileStore{Path: path}, cache)
+}
+
+// TestSessionRefresh tests that a request refused because the session has ended is
+// retried once after refreshing the access token, which is saved.
+func TestSessionRefresh(t *testing.T) {
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	okBody, err := os.ReadFile(filepath.Join("testdata", "salesforce_response.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var refreshes, queries int
+	var rejectAll bool
+	mux.HandleFunc("/oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		refreshes++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token": "access-%d", "token_type": "Bearer"}`, refreshes+1)
+	})
+	mux.HandleFunc(fmt.Sprintf("/services/data/%s/query", SalesforceAPIVersionNumber), func(w http.ResponseWriter, r *http.Request) {
+		queries++
+		w.Header().Set("Content-Type", "application/json")
+		// Only the current access token is accepted.
+		if rejectAll || r.Header.Get("Authorization") != fmt.Sprintf("Bearer access-%d", refreshes+1) {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`[{"message": "Session expired or invalid", "errorCode": "INVALID_SESSION_ID"}]`))
+			return
+		}
+		w.Write(okBody)
+	})
+
+	// Salesforce access tokens have no expiry, so the stale token is used until the
+	// session is rejected.
+	tokenPath := filepath.Join(t.TempDir(), "token.json")
+	if err := saveTokenCacheToFile(&tokenCache{
+		InstanceURL: server.URL,
+		Token:       &oauth2.Token{AccessToken: "stale", RefreshToken: "my-refresh-token", TokenType: "Bearer"},
+	}, tokenPath); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{Salesforce: createSFConfig(t, "/callback/sf", server.URL, tokenPath)}
+
+	client, err := NewClient(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetOpportunities(context.Background(), time.Now(), time.Now().AddDate(1, 0, 0), time.Time{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := refreshes, 1; got != want {
+		t.Errorf("got %d refreshes want %d", got, want)
+	}
+	if got, want := queries, 2; got != want {
+		t.Errorf("got %d queries want %d", got, want)
+	}
+	saved, err := loadTokenCacheFromFile(tokenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := saved.Token.AccessToken, "access-2"; got != want {
+		t.Errorf("got saved access token %q want %q", got, want)
+	}
+
+	// A session which is still rejected after a refresh is reported, without
+	// refreshing again.
+	rejectAll = true
+	refreshes, queries = 0, 0
+	_, err = client.GetOpportunities(context.Background(), time.Now(), time.Now().AddDate(1, 0, 0), time.Time{})
+	if !errors.Is(err, ErrSessionExpired) {
+		t.Errorf("expected a session expired error, got %v", err)
+	}
+	if refreshes != 1 || queries != 2 {
+		t.Errorf("got %d refreshes and %d queries want 1 and 2", refreshes, queries)
+	}
+}
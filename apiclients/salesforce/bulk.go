@@ -0,0 +1,168 @@
+package salesforce
+
+// bulk.go runs SOQL queries as Bulk API 2.0 query jobs.
+//
+// The REST query API returns at most 2000 records a request, so a query matching
+// hundreds of thousands of opportunities takes hundreds of requests against the daily
+// API limit. A bulk query job is instead processed asynchronously by Salesforce, with
+// the results retrieved as CSV in pages of up to bulkResultsPageSize records. See
+// https://developer.salesforce.com/docs/atlas.en-us.api_asynch.meta/api_asynch/queries.htm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// bulkResultsPageSize is the most records retrieved in each request for the results
+// of a bulk query job.
+const bulkResultsPageSize = 50000
+
+// Bulk query jobs are polled from bulkPollDelay, doubling up to bulkPollMaxDelay
+// between requests.
+const (
+	bulkPollDelay    = 2 * time.Second
+	bulkPollMaxDelay = 30 * time.Second
+)
+
+// The states of a bulk query job.
+const (
+	bulkJobComplete = "JobComplete"
+	bulkJobFailed   = "Failed"
+	bulkJobAborted  = "Aborted"
+)
+
+// bulkQuery runs the SOQL query as a Bulk API 2.0 query job, waits for it to complete
+// and returns the donations in the results. The queried fields are described first,
+// so that numeric and boolean values in the CSV results are converted as in a REST
+// query.
+func (c *Client) bulkQuery(ctx context.Context, soql string) ([]Donation, error) {
+	unmarshaller := c.unmarshaller()
+	fieldTypes, err := c.queryFieldTypes(ctx, soql)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe the query fields: %w", err)
+	}
+	unmarshaller.FieldTypes = fieldTypes
+
+	job, err := c.createBulkQueryJob(ctx, soql)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bulk query job: %w", err)
+	}
+	log.Printf("Created Salesforce bulk query job %s.", job.ID)
+
+	job, err = c.waitBulkQueryJob(ctx, job.ID)
+	if err != nil {
+		if job.State == bulkJobFailed || job.State == bulkJobAborted {
+			return nil, err
+		}
+		// Stop Salesforce processing a job for which the results won't be collected.
+		if abortErr := c.abortBulkQueryJob(context.WithoutCancel(ctx), job.ID); abortErr != nil {
+			log.Printf("Failed to abort Salesforce bulk query job %s: %v", job.ID, abortErr)
+		}
+		return nil, err
+	}
+
+	records := make([]Donation, 0, job.NumberRecordsProcessed)
+	var locator string
+	for pageNo := 1; ; pageNo++ {
+		params := url.Values{}
+		params.Set("maxRecords", strconv.Itoa(bulkResultsPageSize))
+		if locator != "" {
+			params.Set("locator", locator)
+		}
+		requestURL := fmt.Sprintf("%s/services/data/%s/jobs/query/%s/results?%s", c.instanceURL, c.apiVersion, job.ID, params.Encode())
+		req, err := c.newRequest(ctx, "GET", requestURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("newRequest error results page %d: %w", pageNo, err)
+		}
+		req.Header.Set("Accept", "text/csv")
+		// Each page is decoded as it is read, rather than being held in memory.
+		resp, err := c.open(req)
+		if err != nil {
+			return nil, fmt.Errorf("bulk query results error page %d: %w", pageNo, err)
+		}
+		donations, err := unmarshaller.UnmarshalCSVRecords(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode bulk query results page %d: %w", pageNo, err)
+		}
+		records = append(records, donations...)
+
+		// The locator of the last page is the string "null".
+		locator = resp.Header.Get("Sforce-Locator")
+		if locator == "" || locator == "null" {
+			break
+		}
+	}
+	return records, nil
+}
+
+// createBulkQueryJob creates a Bulk API 2.0 job for the SOQL query.
+func (c *Client) createBulkQueryJob(ctx context.Context, soql string) (BulkQueryJob, error) {
+	body, err := json.Marshal(map[string]string{
+		"operation":       "query",
+		"query":           soql,
+		"contentType":     "CSV",
+		"columnDelimiter": "COMMA",
+		"lineEnding":      "LF",
+	})
+	if err != nil {
+		return BulkQueryJob{}, fmt.Errorf("failed to marshal job request: %w", err)
+	}
+	requestURL := fmt.Sprintf("%s/services/data/%s/jobs/query", c.instanceURL, c.apiVersion)
+	req, err := c.newRequest(ctx, "POST", requestURL, body)
+	if err != nil {
+		return BulkQueryJob{}, err
+	}
+	var job BulkQueryJob
+	if _, err := c.do(req, &job); err != nil {
+		return BulkQueryJob{}, err
+	}
+	return job, nil
+}
+
+// waitBulkQueryJob polls the bulk query job until it completes, returning an error if
+// it fails or is aborted.
+func (c *Client) waitBulkQueryJob(ctx context.Context, id string) (BulkQueryJob, error) {
+	requestURL := fmt.Sprintf("%s/services/data/%s/jobs/query/%s", c.instanceURL, c.apiVersion, id)
+	delay := bulkPollDelay
+	for {
+		req, err := c.newRequest(ctx, "GET", requestURL, nil)
+		if err != nil {
+			return BulkQueryJob{ID: id}, err
+		}
+		var job BulkQueryJob
+		if _, err := c.do(req, &job); err != nil {
+			return BulkQueryJob{ID: id}, fmt.Errorf("bulk query job %s status error: %w", id, err)
+		}
+		switch job.State {
+		case bulkJobComplete:
+			return job, nil
+		case bulkJobFailed, bulkJobAborted:
+			return job, fmt.Errorf("bulk query job %s %s: %s", id, job.State, job.ErrorMessage)
+		}
+		if err := c.sleep(ctx, delay); err != nil {
+			return job, err
+		}
+		delay = min(delay*2, bulkPollMaxDelay)
+	}
+}
+
+// abortBulkQueryJob aborts the bulk query job.
+func (c *Client) abortBulkQueryJob(ctx context.Context, id string) error {
+	body, err := json.Marshal(map[string]string{"state": bulkJobAborted})
+	if err != nil {
+		return err
+	}
+	requestURL := fmt.Sprintf("%s/services/data/%s/jobs/query/%s", c.instanceURL, c.apiVersion, id)
+	req, err := c.newRequest(ctx, "PATCH", requestURL, body)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(req, nil)
+	return err
+}
@@ -0,0 +1,272 @@
+package salesforce
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reconciler/config"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// bulkResults are the pages of CSV results of a bulk query job.
+var bulkResults = []string{
+	`Id,Name,Amount,CloseDate,LastModifiedDate,Payout_Reference__c,StageName,Probability,IsPrivate,RecordType.Name,Account.Name,Account.Owner.Name,CreatedBy.Name,CreatedDate,LastModifiedBy.Name
+006-01,Dickenson Mobile Generators,15000.0,2025-10-04,2025-12-20T20:21:32.000Z,ENTH-20251112,Qualification,10,false,,Dickenson plc,,OrgFarm EPIC,2025-11-27T10:21:45.000Z,Test User
+006-02,"United Oil Office Portable Generators, Phase 2",125000.0,2025-09-22,2025-12-20T20:21:32.000Z,,Closed Won,100,true,Donation,United Oil,Ada Owner,OrgFarm EPIC,2025-11-27T10:21:45.000Z,Test User
+`,
+	`Id,Name,Amount,CloseDate,LastModifiedDate,Payout_Reference__c,StageName,Probability,IsPrivate,RecordType.Name,Account.Name,Account.Owner.Name,CreatedBy.Name,CreatedDate,LastModifiedBy.Name
+006-03,Grand Hotels Emergency Generators,210000.0,2025-08-14,2025-12-20T20:21:32.000Z,,Closed Won,100,false,,Grand Hotels,Ada Owner,OrgFarm EPIC,2025-11-27T10:21:45.000Z,Test User
+`,
+}
+
+// bulkQuery is the query of the bulk results.
+const bulkQuery = `SELECT Id, Name, Amount, CloseDate, LastModifiedDate, Payout_Reference__c, StageName,
+	Probability, IsPrivate, RecordType.Name, Account.Name, Account.Owner.Name, CreatedBy.Name,
+	CreatedDate, LastModifiedBy.Name FROM Opportunity WHERE {{.WhereClause}}`
+
+// fakeBulkQuery serves a Bulk API 2.0 query job which completes after being polled
+// once, or fails if failed is set, and the describe metadata of the queried objects.
+type fakeBulkQuery struct {
+	t        *testing.T
+	failed   bool
+	query    string
+	requests []string
+}
+
+func (f *fakeBulkQuery) register(mux *http.ServeMux, apiVersion string) {
+	mux.HandleFunc(fmt.Sprintf("GET /services/data/%s/sobjects/{name}/describe", apiVersion), func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(describes[r.PathValue("name")])
+	})
+	path := fmt.Sprintf("/services/data/%s/jobs/query", apiVersion)
+	mux.HandleFunc("POST "+path, func(w http.ResponseWriter, r *http.Request) {
+		var job map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+			f.t.Fatal(err)
+		}
+		f.query = job["query"]
+		f.requests = append(f.requests, "create "+job["operation"])
+		json.NewEncoder(w).Encode(BulkQueryJob{ID: "750-01", Operation: "query", State: "UploadComplete"})
+	})
+	mux.HandleFunc("PATCH "+path+"/750-01", func(w http.ResponseWriter, r *http.Request) {
+		f.requests = append(f.requests, "abort")
+		json.NewEncoder(w).Encode(BulkQueryJob{ID: "750-01", State: "Aborted"})
+	})
+	mux.HandleFunc("GET "+path+"/750-01", func(w http.ResponseWriter, r *http.Request) {
+		f.requests = append(f.requests, "poll")
+		job := BulkQueryJob{ID: "750-01", State: "InProgress"}
+		switch {
+		case len(f.requests) < 3:
+		case f.failed:
+			job.State, job.ErrorMessage = "Failed", "INVALID_FIELD: No such column 'Payout_Reference__c'"
+		default:
+			job.State, job.NumberRecordsProcessed = "JobComplete", 3
+		}
+		json.NewEncoder(w).Encode(job)
+	})
+	mux.HandleFunc("GET "+path+"/750-01/results", func(w http.ResponseWriter, r *http.Request) {
+		locator := r.URL.Query().Get("locator")
+		f.requests = append(f.requests, "results "+locator)
+		if got, want := r.URL.Query().Get("maxRecords"), "50000"; got != want {
+			f.t.Errorf("got maxRecords %s want %s", got, want)
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		if locator == "" {
+			w.Header().Set("Sforce-Locator", "MjAwMA")
+			w.Write([]byte(bulkResults[0]))
+			return
+		}
+		w.Header().Set("Sforce-Locator", "null")
+		w.Write([]byte(bulkResults[1]))
+	})
+}
+
+// TestGetOpportunities_Bulk tests running the opportunities query as a bulk query job,
+// with the results retrieved in two pages and converted by the types of the fields.
+func TestGetOpportunities_Bulk(t *testing.T) {
+
+	mux, client, teardown := setup(t)
+	defer teardown()
+	client.config.Salesforce.Query = bulkQuery
+	client.config.Salesforce.QueryAPI = config.SalesforceQueryBulk
+	client.config.Salesforce.FieldMappings = map[string]string{"Account.Name": "Account"}
+	var delays []time.Duration
+	client.sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+	f := &fakeBulkQuery{t: t}
+	f.register(mux, client.apiVersion)
+
+	from := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+	donations, err := client.GetOpportunities(context.Background(), from, from.AddDate(1, 0, -1), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := f.query, strings.Replace(bulkQuery, "{{.WhereClause}}", "CloseDate >= 2025-04-01 AND CloseDate <= 2026-03-31", 1); got != want {
+		t.Errorf("got query %q want %q", got, want)
+	}
+	if diff := cmp.Diff([]string{"create query", "poll", "poll", "results ", "results MjAwMA"}, f.requests); diff != "" {
+		t.Errorf("requests diff:\n%s", diff)
+	}
+	if diff := cmp.Diff([]time.Duration{bulkPollDelay}, delays); diff != "" {
+		t.Errorf("poll delays diff:\n%s", diff)
+	}
+	if got, want := len(donations), 3; got != want {
+		t.Fatalf("got %d donations want %d", got, want)
+	}
+
+	d := donations[1]
+	want := CoreFields{
+		ID:               "006-02",
+		Name:             "United Oil Office Portable Generators, Phase 2",
+		Amount:           125000,
+		CloseDate:        SalesforceDate{time.Date(2025, 9, 22, 0, 0, 0, 0, time.UTC)},
+		CreatedDate:      SalesforceTime{time.Date(2025, 11, 27, 10, 21, 45, 0, time.UTC)},
+		LastModifiedDate: SalesforceTime{time.Date(2025, 12, 20, 20, 21, 32, 0, time.UTC)},
+		CreatedBy:        "OrgFarm EPIC",
+		LastModifiedBy:   "Test User",
+		StageName:        "Closed Won",
+	}
+	if diff := cmp.Diff(want, d.CoreFields); diff != "" {
+		t.Errorf("core fields diff:\n%s", diff)
+	}
+	wantFields := map[string]any{
+		"Account":            "United Oil",
+		"Account.Owner.Name": "Ada Owner",
+		"StageName":          "Closed Won",
+		"Probability":        100.0,
+		"IsPrivate":          true,
+		"RecordType.Name":    "Donation",
+	}
+	if diff := cmp.Diff(wantFields, d.AdditionalFields); diff != "" {
+		t.Errorf("additional fields diff:\n%s", diff)
+	}
+	if ref := donations[0].PayoutReference; ref == nil || *ref != "ENTH-20251112" {
+		t.Errorf("got payout reference %v want ENTH-20251112", ref)
+	}
+	// A null relationship is omitted, as for a SOQL response.
+	for _, field := range []string{"RecordType.Name", "Account.Owner.Name"} {
+		if _, ok := donations[0].AdditionalFields[field]; ok {
+			t.Errorf("expected the null %s to be omitted", field)
+		}
+	}
+}
+
+// TestGetOpportunities_BulkFailed tests that a failed bulk query job is reported, and
+// that a job which is no longer waited for is aborted.
+func TestGetOpportunities_BulkFailed(t *testing.T) {
+
+	tests := []struct {
+		name         string
+		failed       bool
+		sleepErr     error
+		wantErr      string
+		wantRequests []string
+	}{
+		{"failed", true, nil, "No such column", []string{"create query", "poll", "poll"}},
+		{"cancelled", false, context.Canceled, "context canceled", []string{"create query", "poll", "abort"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux, client, teardown := setup(t)
+			defer teardown()
+			client.config.Salesforce.Query = "SELECT Id FROM Opportunity WHERE {{.WhereClause}}"
+			client.config.Salesforce.QueryAPI = config.SalesforceQueryBulk
+			client.sleep = func(ctx context.Context, d time.Duration) error { return tt.sleepErr }
+			f := &fakeBulkQuery{t: t, failed: tt.failed}
+			f.register(mux, client.apiVersion)
+
+			_, err := client.GetOpportunities(context.Background(), time.Now(), time.Now().AddDate(1, 0, 0), time.Time{})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+			if diff := cmp.Diff(tt.wantRequests, f.requests); diff != "" {
+				t.Errorf("requests diff:\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestGetOpportunities_Auto tests that a REST query reporting more records than the
+// bulk query threshold is switched to a bulk query job.
+func TestGetOpportunities_Auto(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		threshold int
+		want      int
+	}{
+		{"below threshold", 2, 3},
+		{"above threshold", 1, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux, client, teardown := setup(t)
+			defer teardown()
+			client.config.Salesforce.Query = "SELECT Id FROM Opportunity WHERE {{.WhereClause}}"
+			client.config.Salesforce.QueryAPI = config.SalesforceQueryAuto
+			client.config.Salesforce.BulkQueryThreshold = tt.threshold
+			client.sleep = func(ctx context.Context, d time.Duration) error { return nil }
+			f := &fakeBulkQuery{t: t}
+			f.register(mux, client.apiVersion)
+
+			// The REST query serves two pages with a total of 2 records.
+			queryPath := fmt.Sprintf("/services/data/%s/query", client.apiVersion)
+			var pages int
+			mux.HandleFunc(queryPath, func(w http.ResponseWriter, r *http.Request) {
+				pages++
+				b, err := os.ReadFile(filepath.Join("testdata", fmt.Sprintf("salesforce_batch%d.json", pages)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				w.Write(bytes.ReplaceAll(b, []byte("REPLACE-ME"), []byte(queryPath)))
+			})
+
+			donations, err := client.GetOpportunities(context.Background(), time.Now(), time.Now().AddDate(1, 0, 0), time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := len(donations), tt.want; got != want {
+				t.Errorf("got %d donations want %d", got, want)
+			}
+			bulk := tt.threshold < 2
+			if got, want := len(f.requests) > 0, bulk; got != want {
+				t.Errorf("got bulk query %t want %t", got, want)
+			}
+			if got, want := pages, map[bool]int{true: 1, false: 2}[bulk]; got != want {
+				t.Errorf("got %d rest query pages want %d", got, want)
+			}
+		})
+	}
+}
+
+// TestGetOpportunities_CloseDateField tests that the date range is applied to the
+// configured close date field.
+func TestGetOpportunities_CloseDateField(t *testing.T) {
+
+	mux, client, teardown := setup(t)
+	defer teardown()
+	client.config.Salesforce.Query = "SELECT Id FROM Opportunity WHERE {{.WhereClause}}"
+	client.config.Salesforce.QueryAPI = config.SalesforceQueryBulk
+	client.config.Salesforce.CoreFields = map[string]string{"CloseDate": "Gift_Date__c"}
+	client.sleep = func(ctx context.Context, d time.Duration) error { return nil }
+	f := &fakeBulkQuery{t: t}
+	f.register(mux, client.apiVersion)
+
+	from := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := client.GetOpportunities(context.Background(), from, from.AddDate(1, 0, -1), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.query, "SELECT Id FROM Opportunity WHERE Gift_Date__c >= 2025-04-01 AND Gift_Date__c <= 2026-03-31"; got != want {
+		t.Errorf("got query %q want %q", got, want)
+	}
+}
@@ -4,10 +4,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,19 +22,75 @@ import (
 const maxBatchUpdateCount = 200
 
 // Client is a wrapper for making authenticated calls to the Salesforce API.
+//
+// A request refused with a 401 status is retried once after refreshing the access
+// token with refresh, if set. Requests refused for exceeding the request limits, or
+// failing with a 503 status, are retried according to retry.
 type Client struct {
 	httpClient  *http.Client
 	instanceURL string
 	apiVersion  string
 	config      config.Config
+	refresh     func() error
+	retry       retryPolicy
+	sleep       func(ctx context.Context, d time.Duration) error
+}
+
+// retryPolicy sets out how requests refused for exceeding the request limits are
+// retried. A zero policy makes no retries.
+type retryPolicy struct {
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+}
+
+// defaultRetryPolicy backs off for a little over a minute in total, which covers the
+// concurrent request limit but not the daily limit.
+var defaultRetryPolicy = retryPolicy{
+	maxRetries: 3,
+	baseDelay:  5 * time.Second,
+	maxDelay:   time.Minute,
+}
+
+// wait returns the time to wait before retrying a request which failed with the API
+// error on the provided (zero-based) retry, or false if it should not be retried.
+func (p retryPolicy) wait(apiErr *APIError, retry int, retryAfter string) (time.Duration, bool) {
+	if retry >= p.maxRetries {
+		return 0, false
+	}
+	if !errors.Is(apiErr, ErrRequestLimit) && apiErr.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(retryAfter); err == nil && secs > 0 {
+		return min(time.Duration(secs)*time.Second, p.maxDelay), true
+	}
+	return min(p.baseDelay<<retry, p.maxDelay), true
+}
+
+// sleep waits for the duration, returning early with an error if the context is
+// cancelled.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
 
 // GetOpportunities fetches records from Salesforce using a configurable SOQL query.
-func (c *Client) GetOpportunities(ctx context.Context, fromDate, ifModifiedSince time.Time) ([]Donation, error) {
+// Records with a close date from fromDate up to and including toDate are returned.
+//
+// The query is run with the REST query API or as a bulk query job as set by the
+// query_api setting. In "auto" mode the REST query is switched to a bulk query job if
+// the first page reports more than the bulk query threshold of matching records.
+func (c *Client) GetOpportunities(ctx context.Context, fromDate, toDate, ifModifiedSince time.Time) ([]Donation, error) {
+	closeDate := coreFieldName(c.config.Salesforce.CoreFields, "CloseDate")
 	var conditions []string
-	toDate := fromDate.AddDate(1, 0, 0) // One year from the start date
-	conditions = append(conditions, fmt.Sprintf("CloseDate >= %s", fromDate.Format("2006-01-02")))
-	conditions = append(conditions, fmt.Sprintf("CloseDate < %s", toDate.Format("2006-01-02")))
+	conditions = append(conditions, fmt.Sprintf("%s >= %s", closeDate, fromDate.Format("2006-01-02")))
+	conditions = append(conditions, fmt.Sprintf("%s <= %s", closeDate, toDate.Format("2006-01-02")))
 
 	if !ifModifiedSince.IsZero() {
 		conditions = append(conditions, fmt.Sprintf("LastModifiedDate > %s", ifModifiedSince.UTC().Format(time.RFC3339)))
@@ -44,6 +103,10 @@ func (c *Client) GetOpportunities(ctx context.Context, fromDate, ifModifiedSince
 	// Dump the final query for debugging purposes.
 	// _ = os.WriteFile("salesforce_query.log", []byte(finalSOQL), 0644)
 
+	if c.config.Salesforce.QueryAPI == config.SalesforceQueryBulk {
+		return c.bulkQuery(ctx, finalSOQL)
+	}
+
 	// Salesforce sobject queries provide at most 2000 records in a batch. Subsequent
 	// query paths are represented by response.NextRecordsURL. If there are no more
 	// records to retrieve this URL will be empty and response.Done will be true.
@@ -65,10 +128,15 @@ func (c *Client) GetOpportunities(ctx context.Context, fromDate, ifModifiedSince
 		if _, err := c.do(req, &response); err != nil {
 			return nil, fmt.Errorf("soql do error pageNo %d: %w", pageNo, err)
 		}
-		records = append(records, response.Donations...)
 		if response.Done || response.NextRecordsURL == "" {
+			records = append(records, response.Donations...)
 			break
 		}
+		if pageNo == 1 && c.useBulkQuery(response.TotalSize) {
+			log.Printf("Salesforce query matches %d records; switching to a bulk query job.", response.TotalSize)
+			return c.bulkQuery(ctx, finalSOQL)
+		}
+		records = append(records, response.Donations...)
 		requestURL, err = url.JoinPath(c.instanceURL, response.NextRecordsURL)
 		if err != nil {
 			return nil, fmt.Errorf("url construction error for page %d: (%s) %w", pageNo+1, response.NextRecordsURL, err)
@@ -78,12 +146,81 @@ func (c *Client) GetOpportunities(ctx context.Context, fromDate, ifModifiedSince
 	return records, nil
 }
 
+// useBulkQuery reports if a query matching the number of records should be run as a
+// bulk query job in "auto" mode.
+func (c *Client) useBulkQuery(totalSize int) bool {
+	sc := c.config.Salesforce
+	return sc.QueryAPI == config.SalesforceQueryAuto && totalSize > sc.BulkQueryThreshold
+}
+
+// getDeletedDays is the number of days of deletions reported by the sObject getDeleted
+// resource, less a day's margin.
+const getDeletedDays = 29
+
+// GetDeletedOpportunityIDs returns the ids of the opportunities deleted, including
+// those merged into another opportunity, since the provided time. Deletions within the
+// last 29 days are found with the getDeleted resource, which also reports records
+// since removed from the recycle bin. Earlier deletions, or all deletions if since is
+// zero, are found by querying the recycle bin with queryAll. See
+// https://developer.salesforce.com/docs/atlas.en-us.api_rest.meta/api_rest/resources_getdeleted.htm
+func (c *Client) GetDeletedOpportunityIDs(ctx context.Context, since time.Time) ([]string, error) {
+	now := time.Now().UTC()
+	if !since.IsZero() && now.Sub(since) < getDeletedDays*24*time.Hour {
+		params := url.Values{}
+		params.Set("start", since.UTC().Format(time.RFC3339))
+		params.Set("end", now.Format(time.RFC3339))
+		requestURL := fmt.Sprintf("%s/services/data/%s/sobjects/Opportunity/deleted/?%s", c.instanceURL, c.apiVersion, params.Encode())
+		req, err := c.newRequest(ctx, "GET", requestURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		var response DeletedRecordsResponse
+		if _, err := c.do(req, &response); err != nil {
+			return nil, fmt.Errorf("get deleted opportunities error: %w", err)
+		}
+		ids := make([]string, len(response.DeletedRecords))
+		for i, r := range response.DeletedRecords {
+			ids[i] = r.ID
+		}
+		return ids, nil
+	}
+
+	soql := "SELECT Id FROM Opportunity WHERE IsDeleted = true"
+	if !since.IsZero() {
+		soql += fmt.Sprintf(" AND SystemModstamp > %s", since.UTC().Format(time.RFC3339))
+	}
+	requestURL := fmt.Sprintf("%s/services/data/%s/queryAll?q=%s", c.instanceURL, c.apiVersion, url.QueryEscape(soql))
+	var ids []string
+	for pageNo := 1; ; pageNo++ {
+		req, err := c.newRequest(ctx, "GET", requestURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		var response IDQueryResponse
+		if _, err := c.do(req, &response); err != nil {
+			return nil, fmt.Errorf("query deleted opportunities error page %d: %w", pageNo, err)
+		}
+		for _, r := range response.Records {
+			ids = append(ids, r.ID)
+		}
+		if response.Done || response.NextRecordsURL == "" {
+			break
+		}
+		requestURL, err = url.JoinPath(c.instanceURL, response.NextRecordsURL)
+		if err != nil {
+			return nil, fmt.Errorf("url construction error for page %d: (%s) %w", pageNo+1, response.NextRecordsURL, err)
+		}
+	}
+	return ids, nil
+}
+
 // BatchUpdateOpportunityRefs performs a update using the Salesforce sObject Collections
 // API (which is a synchronous API) for up to 200 records at a time. See
 // https://developer.salesforce.com/docs/atlas.en-us.api_rest.meta/api_rest/resources_sobject_describe.htm.
 //
 // The method replaces the data in the stated salesforce LinkingFieldName for salesforce
-// opportunity records with the provided IDs with `reference`.
+// opportunity records with the provided IDs with `reference`. UpdateOpportunityRefs
+// updates any number of records, reporting the outcome of each.
 //
 // Note that setting `allOrNone` to true makes the SOQL update atomic and the
 // transaction will fail in it's entirety if any single opportunity record cannot be
@@ -97,43 +234,12 @@ func (c *Client) BatchUpdateOpportunityRefs(
 	ids []string,
 	allOrNone bool) (CollectionsUpdateResponse, error) {
 
-	urlTpl := "%s/services/data/%s/composite/sobjects"
-
-	if len(ids) > maxBatchUpdateCount {
-		return nil, fmt.Errorf("cannot update more than 200 records in a single batch")
-	}
-
-	// Build a slice of records.
-	donationsForUpdate := make([]map[string]any, len(ids))
+	updates := make([]RefUpdateResult, len(ids))
 	for i, id := range ids {
-		donationsForUpdate[i] = map[string]any{
-			"id":                                 id,
-			c.config.Salesforce.LinkingFieldName: reference,
-			"attributes": map[string]string{
-				"type": c.config.Salesforce.LinkingObject,
-			},
-		}
+		updates[i] = RefUpdateResult{RefUpdate: RefUpdate{ID: id, Reference: reference}}
 	}
-
-	// Wrap records in the required request body structure.
-	payload := CollectionsUpdateRequest{
-		AllOrNone: allOrNone,
-		Records:   donationsForUpdate,
-	}
-
-	body, err := json.Marshal(payload)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal batch request: %w", err)
-	}
-
-	requestURL := fmt.Sprintf(urlTpl, c.instanceURL, c.apiVersion)
-	req, err := c.newRequest(ctx, "PATCH", requestURL, body)
+	response, err := c.patchOpportunityRefs(ctx, updates, allOrNone)
 	if err != nil {
-		return nil, fmt.Errorf("new patch request error: %w", err)
-	}
-
-	var response CollectionsUpdateResponse
-	if _, err := c.do(req, &response); err != nil {
 		return nil, err
 	}
 
@@ -159,6 +265,17 @@ func (c *Client) BatchUpdateOpportunityRefs(
 	return response, nil
 }
 
+// unmarshaller returns a SOQLUnmarshaller for the configured field mappings, linking
+// field and core fields.
+func (c *Client) unmarshaller() SOQLUnmarshaller {
+	sc := c.config.Salesforce
+	return SOQLUnmarshaller{
+		Mapper:           sc.FieldMappings,
+		LinkingFieldName: sc.LinkingFieldName,
+		CoreFieldNames:   sc.CoreFields,
+	}
+}
+
 // newRequest is a helper to create a new HTTP request with common headers.
 func (c *Client) newRequest(ctx context.Context, method, url string, body []byte) (*http.Request, error) {
 	var bodyReader *bytes.Reader
@@ -176,26 +293,78 @@ func (c *Client) newRequest(ctx context.Context, method, url string, body []byte
 	return req, nil
 }
 
-// do is a helper to execute an HTTP request and decode the JSON response.
-func (c *Client) do(req *http.Request, v any) (*http.Response, error) {
-	resp, err := c.httpClient.Do(req)
+// send executes the request, returning the response with its body read. Expired
+// sessions and limit errors are retried as set out in Client. Non-2xx responses are
+// returned as an *APIError.
+func (c *Client) send(req *http.Request) (*http.Response, []byte, error) {
+	resp, err := c.open(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute request: %w", err)
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
-
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
+		return nil, nil, fmt.Errorf("failed to read response body: %w", err)
 	}
+	return resp, body, nil
+}
 
-	// Uncomment to save the raw response to disk for debugging.
-	// _ = os.WriteFile("salesforce_response.json", body, 0644)
+// open executes the request as send does, but returns a successful response with its
+// body unread, for large responses to be decoded as they are read. The caller must
+// close the body.
+func (c *Client) open(req *http.Request) (*http.Response, error) {
+	refreshed := false
+	retries := 0
+	for {
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute request: %w", err)
+		}
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp, nil
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response body: %w", err)
+		}
+
+		apiErr := parseAPIError(resp.StatusCode, body)
+		switch wait, retry := c.retry.wait(apiErr, retries, resp.Header.Get("Retry-After")); {
+		case resp.StatusCode == http.StatusUnauthorized && !refreshed && c.refresh != nil:
+			refreshed = true
+			log.Printf("Salesforce session rejected (%s); refreshing the access token.", apiErr.Code)
+			if err := c.refresh(); err != nil {
+				return nil, fmt.Errorf("%w; token refresh failed: %w", apiErr, err)
+			}
+		case retry:
+			retries++
+			log.Printf("Salesforce API returned status %d (%s); retrying in %s.", apiErr.StatusCode, apiErr.Code, wait)
+			if err := c.sleep(req.Context(), wait); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, apiErr
+		}
+
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, fmt.Errorf("failed to reset request body: %w", err)
+			}
+		}
+	}
+}
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return nil, fmt.Errorf("API error (status %d): %s", resp.StatusCode, string(body))
+// do is a helper to execute an HTTP request and decode the JSON response.
+func (c *Client) do(req *http.Request, v any) (*http.Response, error) {
+	resp, body, err := c.send(req)
+	if err != nil {
+		return nil, err
 	}
 
+	// Uncomment to save the raw response to disk for debugging.
+	// _ = os.WriteFile("salesforce_response.json", body, 0644)
+
 	if v != nil {
 		// check if v is of the SOQLResponse type
 		soqlResponsePtr, ok := v.(*SOQLResponse)
@@ -204,7 +373,7 @@ func (c *Client) do(req *http.Request, v any) (*http.Response, error) {
 			return resp, json.Unmarshal(body, v)
 		}
 		// unmarshal
-		unmarshaller := SOQLUnmarshaller{Mapper: c.config.Salesforce.FieldMappings}
+		unmarshaller := c.unmarshaller()
 		data, err := unmarshaller.UnmarshalSOQLResponse(body)
 		if err != nil {
 			return nil, fmt.Errorf("failed to decode response: %w", err)
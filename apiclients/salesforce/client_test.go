@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -158,7 +159,7 @@ func testPatch(
 func TestGetOpportunities_OneBatch(t *testing.T) {
 
 	getOpportunitiesFunc := func(client *Client) ([]Donation, error) {
-		return client.GetOpportunities(context.Background(), time.Now(), time.Time{})
+		return client.GetOpportunities(context.Background(), time.Now(), time.Now().AddDate(1, 0, 0), time.Time{})
 	}
 
 	donations, err := testBatching(
@@ -181,7 +182,7 @@ func TestGetOpportunities_OneBatch(t *testing.T) {
 func TestGetOpportunities_TwoBatch(t *testing.T) {
 
 	getOpportunitiesFunc := func(client *Client) ([]Donation, error) {
-		return client.GetOpportunities(context.Background(), time.Now(), time.Time{})
+		return client.GetOpportunities(context.Background(), time.Now(), time.Now().AddDate(1, 0, 0), time.Time{})
 	}
 
 	donations, err := testBatching(
@@ -265,3 +266,162 @@ func TestBatchUpdateOpportunityRefs_Fail(t *testing.T) {
 	}
 
 }
+
+// TestLimitBackoff tests that requests refused for exceeding the request limits are
+// retried with a backoff, and that other errors are not retried.
+func TestLimitBackoff(t *testing.T) {
+
+	limitBody := `[{"message": "ConcurrentPerOrgLongTxn Limit exceeded.", "errorCode": "REQUEST_LIMIT_EXCEEDED"}]`
+	queryBody := `[{"message": "unexpected token: FROM", "errorCode": "MALFORMED_QUERY"}]`
+
+	tests := []struct {
+		name      string
+		statuses  []int
+		bodies    []string
+		wantWaits []time.Duration
+		wantKind  error // the kind of error returned, or nil for success
+	}{
+		{
+			name:      "limit then ok",
+			statuses:  []int{http.StatusForbidden, http.StatusForbidden, http.StatusOK},
+			bodies:    []string{limitBody, limitBody, ""},
+			wantWaits: []time.Duration{5 * time.Second, 10 * time.Second},
+		},
+		{
+			name:      "limit persists",
+			statuses:  []int{http.StatusForbidden, http.StatusForbidden, http.StatusForbidden, http.StatusForbidden},
+			bodies:    []string{limitBody, limitBody, limitBody, limitBody},
+			wantWaits: []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second},
+			wantKind:  ErrRequestLimit,
+		},
+		{
+			name:     "malformed query",
+			statuses: []int{http.StatusBadRequest},
+			bodies:   []string{queryBody},
+			wantKind: ErrInvalidQuery,
+		},
+	}
+
+	okBody, err := os.ReadFile(filepath.Join("testdata", "salesforce_response.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux, client, teardown := setup(t)
+			defer teardown()
+
+			client.retry = defaultRetryPolicy
+			var waits []time.Duration
+			client.sleep = func(ctx context.Context, d time.Duration) error {
+				waits = append(waits, d)
+				return nil
+			}
+
+			var calls int
+			mux.HandleFunc(fmt.Sprintf("/services/data/%s/query", client.apiVersion), func(w http.ResponseWriter, r *http.Request) {
+				if calls >= len(tt.statuses) {
+					t.Fatalf("unexpected request %d", calls+1)
+				}
+				status, body := tt.statuses[calls], tt.bodies[calls]
+				calls++
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(status)
+				if status == http.StatusOK {
+					w.Write(okBody)
+					return
+				}
+				w.Write([]byte(body))
+			})
+
+			_, err := client.GetOpportunities(context.Background(), time.Now(), time.Now().AddDate(1, 0, 0), time.Time{})
+			switch {
+			case tt.wantKind == nil && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantKind != nil && !errors.Is(err, tt.wantKind):
+				t.Fatalf("expected a %v error, got %v", tt.wantKind, err)
+			}
+			if got, want := calls, len(tt.statuses); got != want {
+				t.Errorf("got %d requests want %d", got, want)
+			}
+			if got, want := fmt.Sprint(waits), fmt.Sprint(tt.wantWaits); got != want {
+				t.Errorf("got waits %s want %s", got, want)
+			}
+		})
+	}
+}
+
+// TestGetDeletedOpportunityIDs tests that recent deletions are found with the
+// getDeleted resource and earlier deletions by querying the recycle bin.
+func TestGetDeletedOpportunityIDs(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		since     time.Time
+		wantPaths []string
+		wantIDs   []string
+	}{
+		{
+			name:      "recent",
+			since:     time.Now().Add(-48 * time.Hour),
+			wantPaths: []string{"deleted"},
+			wantIDs:   []string{"006-deleted-01", "006-merged-01"},
+		},
+		{
+			name:      "earlier",
+			since:     time.Now().AddDate(0, -2, 0),
+			wantPaths: []string{"queryAll", "queryAll"},
+			wantIDs:   []string{"006-binned-01", "006-binned-02"},
+		},
+		{
+			name:      "all",
+			wantPaths: []string{"queryAll", "queryAll"},
+			wantIDs:   []string{"006-binned-01", "006-binned-02"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux, client, teardown := setup(t)
+			defer teardown()
+
+			var paths []string
+			mux.HandleFunc(fmt.Sprintf("/services/data/%s/sobjects/Opportunity/deleted/", client.apiVersion), func(w http.ResponseWriter, r *http.Request) {
+				paths = append(paths, "deleted")
+				if r.URL.Query().Get("start") == "" || r.URL.Query().Get("end") == "" {
+					t.Errorf("expected a start and end, got %q", r.URL.RawQuery)
+				}
+				w.Write([]byte(`{"deletedRecords": [
+					{"id": "006-deleted-01", "deletedDate": "2025-06-01T10:00:00.000+0000"},
+					{"id": "006-merged-01", "deletedDate": "2025-06-02T10:00:00.000+0000"}
+				], "earliestDateAvailable": "2025-05-01T00:00:00.000+0000", "latestDateCovered": "2025-06-03T00:00:00.000+0000"}`))
+			})
+			mux.HandleFunc(fmt.Sprintf("/services/data/%s/queryAll", client.apiVersion), func(w http.ResponseWriter, r *http.Request) {
+				paths = append(paths, "queryAll")
+				q := r.URL.Query().Get("q")
+				if !strings.Contains(q, "IsDeleted = true") {
+					t.Errorf("expected a query for deleted records, got %q", q)
+				}
+				if got, want := strings.Contains(q, "SystemModstamp"), !tt.since.IsZero(); got != want {
+					t.Errorf("got modification condition %t want %t in %q", got, want, q)
+				}
+				w.Write([]byte(`{"done": false, "nextRecordsUrl": "/services/data/v65.0/queryAll/01g-2000", "records": [{"Id": "006-binned-01"}]}`))
+			})
+			mux.HandleFunc(fmt.Sprintf("/services/data/%s/queryAll/01g-2000", client.apiVersion), func(w http.ResponseWriter, r *http.Request) {
+				paths = append(paths, "queryAll")
+				w.Write([]byte(`{"done": true, "records": [{"Id": "006-binned-02"}]}`))
+			})
+
+			ids, err := client.GetDeletedOpportunityIDs(context.Background(), tt.since)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := strings.Join(paths, ","), strings.Join(tt.wantPaths, ","); got != want {
+				t.Errorf("got requests %s want %s", got, want)
+			}
+			if got, want := strings.Join(ids, ","), strings.Join(tt.wantIDs, ","); got != want {
+				t.Errorf("got ids %s want %s", got, want)
+			}
+		})
+	}
+}
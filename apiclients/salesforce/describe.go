@@ -0,0 +1,274 @@
+package salesforce
+
+// describe.go checks the Salesforce configuration against the describe metadata of
+// the configured objects, so that a misspelt field is reported before a sync or
+// update fails. See
+// https://developer.salesforce.com/docs/atlas.en-us.api_rest.meta/api_rest/resources_sobject_describe.htm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reconciler/config"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ConfigError lists the problems found checking the Salesforce configuration against
+// the Salesforce metadata.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid salesforce configuration:\n- " + strings.Join(e.Problems, "\n- ")
+}
+
+// DescribeSObject returns the describe metadata of the sObject with the name.
+func (c *Client) DescribeSObject(ctx context.Context, name string) (SObjectDescribe, error) {
+	requestURL := fmt.Sprintf("%s/services/data/%s/sobjects/%s/describe", c.instanceURL, c.apiVersion, url.PathEscape(name))
+	req, err := c.newRequest(ctx, "GET", requestURL, nil)
+	if err != nil {
+		return SObjectDescribe{}, err
+	}
+	var describe SObjectDescribe
+	if _, err := c.do(req, &describe); err != nil {
+		return SObjectDescribe{}, fmt.Errorf("describe %s error: %w", name, err)
+	}
+	return describe, nil
+}
+
+// field returns the field with the name, ignoring case as Salesforce does.
+func (d SObjectDescribe) field(name string) (FieldDescribe, bool) {
+	for _, f := range d.Fields {
+		if strings.EqualFold(f.Name, name) {
+			return f, true
+		}
+	}
+	return FieldDescribe{}, false
+}
+
+// ValidateConfig checks that the configured linking field exists on the linking object
+// and is updateable, that the fields selected by the query exist, and that the linking
+// field, the configured core fields and the fields in the field mappings are selected
+// by the query, with the mappings spelt as in the query results. The problems found
+// are returned as a *ConfigError; other errors are from the API.
+func (c *Client) ValidateConfig(ctx context.Context) error {
+	sc := c.config.Salesforce
+	d := &describer{client: c, cache: map[string]SObjectDescribe{}}
+	var problems []string
+
+	var linkingFound bool
+	linking, err := d.describe(ctx, sc.LinkingObject)
+	switch {
+	case isNotFound(err):
+		problems = append(problems, fmt.Sprintf("salesforce.linking_object %q is not a Salesforce object", sc.LinkingObject))
+	case err != nil:
+		return err
+	default:
+		f, ok := linking.field(sc.LinkingFieldName)
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("salesforce.linking_field_name %q is not a field of %s", sc.LinkingFieldName, linking.Name))
+		case !f.Updateable:
+			problems = append(problems, fmt.Sprintf("salesforce.linking_field_name %s.%s is not updateable", linking.Name, f.Name))
+		}
+		linkingFound = ok
+	}
+
+	object, fields, err := parseSelect(sc.Query)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("salesforce.query: %v", err))
+		return configError(problems)
+	}
+	queried, err := d.describe(ctx, object)
+	if isNotFound(err) {
+		problems = append(problems, fmt.Sprintf("salesforce.query object %q is not a Salesforce object", object))
+		return configError(problems)
+	}
+	if err != nil {
+		return err
+	}
+
+	// selected maps the lower-cased fields of the query to their name in the results.
+	selected := map[string]string{}
+	for _, field := range fields {
+		// Functions, such as toLabel(StageName), and subqueries are not checked.
+		if strings.ContainsAny(field, "( ") {
+			continue
+		}
+		f, ok, err := d.resolve(ctx, queried, field)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			problems = append(problems, fmt.Sprintf("salesforce.query field %q is not a field of %s", field, queried.Name))
+			f.Name = field
+		}
+		selected[strings.ToLower(field)] = f.Name
+	}
+
+	_, ok := selected[strings.ToLower(sc.LinkingFieldName)]
+	if linkingFound && strings.EqualFold(linking.Name, queried.Name) && !ok {
+		problems = append(problems, fmt.Sprintf("salesforce.linking_field_name %s is not selected by the query, so links cannot be read", sc.LinkingFieldName))
+	}
+	for _, core := range config.SalesforceCoreFields {
+		field, ok := sc.CoreFields[core]
+		if _, selectedOK := selected[strings.ToLower(field)]; ok && !selectedOK {
+			problems = append(problems, fmt.Sprintf("salesforce.core_fields.%s field %q is not selected by the query", core, field))
+		}
+	}
+
+	keys := make([]string, 0, len(sc.FieldMappings))
+	for k := range sc.FieldMappings {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		name, ok := selected[strings.ToLower(key)]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("salesforce.field_mappings field %q is not selected by the query", key))
+		case mapperKey(name) != key:
+			problems = append(problems, fmt.Sprintf("salesforce.field_mappings field %q should be written %q", key, mapperKey(name)))
+		}
+	}
+	return configError(problems)
+}
+
+// configError returns a *ConfigError for the problems, or nil if there are none.
+func configError(problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	return &ConfigError{Problems: problems}
+}
+
+// isNotFound reports if the error is for a resource, such as an sObject, not found.
+func isNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// mapperKey returns the key of a field in the field mappings, being the field name in
+// the query results with each part title cased, such as Account.Name.
+func mapperKey(field string) string {
+	parts := strings.Split(field, ".")
+	for i, p := range parts {
+		parts[i] = enTitle(p)
+	}
+	return strings.Join(parts, ".")
+}
+
+// describer describes sObjects, caching the results.
+type describer struct {
+	client *Client
+	cache  map[string]SObjectDescribe
+}
+
+func (d *describer) describe(ctx context.Context, name string) (SObjectDescribe, error) {
+	if describe, ok := d.cache[strings.ToLower(name)]; ok {
+		return describe, nil
+	}
+	describe, err := d.client.DescribeSObject(ctx, name)
+	if err != nil {
+		return SObjectDescribe{}, err
+	}
+	d.cache[strings.ToLower(name)] = describe
+	return describe, nil
+}
+
+// queryFieldTypes returns the Salesforce types of the fields selected by the SOQL
+// query by their lower-cased name, such as "account.name". Functions, subqueries and
+// fields which are not found are omitted.
+func (c *Client) queryFieldTypes(ctx context.Context, soql string) (map[string]string, error) {
+	object, fields, err := parseSelect(soql)
+	if err != nil {
+		return nil, err
+	}
+	d := &describer{client: c, cache: map[string]SObjectDescribe{}}
+	queried, err := d.describe(ctx, object)
+	if err != nil {
+		return nil, err
+	}
+	types := map[string]string{}
+	for _, field := range fields {
+		if strings.ContainsAny(field, "( ") {
+			continue
+		}
+		f, ok, err := d.resolve(ctx, queried, field)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			types[strings.ToLower(field)] = f.Type
+		}
+	}
+	return types, nil
+}
+
+// resolve returns the field of the object with the path, such as "Account.Name",
+// following relationships to the related objects. The name of the field returned is
+// the path as spelt in the query results. It returns false if the field is not found.
+func (d *describer) resolve(ctx context.Context, object SObjectDescribe, path string) (FieldDescribe, bool, error) {
+	name, rest, related := strings.Cut(path, ".")
+	if !related {
+		f, ok := object.field(name)
+		return f, ok, nil
+	}
+	for _, f := range object.Fields {
+		if f.RelationshipName == "" || !strings.EqualFold(f.RelationshipName, name) {
+			continue
+		}
+		// A polymorphic relationship, such as Owner, refers to several objects.
+		for _, ref := range f.ReferenceTo {
+			relatedObject, err := d.describe(ctx, ref)
+			if err != nil {
+				return FieldDescribe{}, false, err
+			}
+			sub, ok, err := d.resolve(ctx, relatedObject, rest)
+			if err != nil || ok {
+				sub.Name = f.RelationshipName + "." + sub.Name
+				return sub, ok, err
+			}
+		}
+	}
+	return FieldDescribe{}, false, nil
+}
+
+// soqlFrom matches the FROM clause at the start of the remainder of a SOQL query.
+var soqlFrom = regexp.MustCompile(`(?i)^\s+FROM\s+(\w+)`)
+
+// parseSelect returns the object and the fields selected by a SOQL query. Functions
+// and subqueries are returned as written.
+func parseSelect(soql string) (string, []string, error) {
+	soql = strings.TrimSpace(soql)
+	if len(soql) < 6 || !strings.EqualFold(soql[:6], "SELECT") {
+		return "", nil, errors.New("query does not start with SELECT")
+	}
+	list := soql[6:]
+	var fields []string
+	var depth, start int
+	for i := 0; i < len(list); i++ {
+		switch list[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				fields = append(fields, strings.TrimSpace(list[start:i]))
+				start = i + 1
+			}
+		case ' ', '\t', '\n', '\r':
+			if m := soqlFrom.FindStringSubmatch(list[i:]); depth == 0 && m != nil {
+				fields = append(fields, strings.TrimSpace(list[start:i]))
+				return m[1], fields, nil
+			}
+		}
+	}
+	return "", nil, errors.New("query has no FROM clause")
+}
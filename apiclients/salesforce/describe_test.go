@@ -0,0 +1,179 @@
+package salesforce
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// describes is the describe metadata of the sObjects served by the test server.
+var describes = map[string]SObjectDescribe{
+	"Opportunity": {Name: "Opportunity", Fields: []FieldDescribe{
+		{Name: "Id", Type: "id"},
+		{Name: "Name", Type: "string", Updateable: true},
+		{Name: "Amount", Type: "currency", Updateable: true},
+		{Name: "CloseDate", Type: "date", Updateable: true},
+		{Name: "StageName", Type: "picklist", Updateable: true},
+		{Name: "LastModifiedDate", Type: "datetime"},
+		{Name: "Payout_Reference__c", Type: "string", Updateable: true},
+		{Name: "Legacy_Reference__c", Type: "string"},
+		{Name: "Gift_Date__c", Type: "date", Updateable: true},
+		{Name: "Probability", Type: "percent", Updateable: true},
+		{Name: "IsPrivate", Type: "boolean", Updateable: true},
+		{Name: "AccountId", Type: "reference", Updateable: true, RelationshipName: "Account", ReferenceTo: []string{"Account"}},
+		{Name: "CreatedById", Type: "reference", RelationshipName: "CreatedBy", ReferenceTo: []string{"User"}},
+	}},
+	"Account": {Name: "Account", Fields: []FieldDescribe{
+		{Name: "Id", Type: "id"},
+		{Name: "Name", Type: "string", Updateable: true},
+		{Name: "OwnerId", Type: "reference", Updateable: true, RelationshipName: "Owner", ReferenceTo: []string{"User"}},
+	}},
+	"User": {Name: "User", Fields: []FieldDescribe{
+		{Name: "Id", Type: "id"},
+		{Name: "Name", Type: "string"},
+	}},
+}
+
+// TestValidateConfig tests checking the Salesforce configuration against the describe
+// metadata.
+func TestValidateConfig(t *testing.T) {
+
+	const query = `SELECT Id, Name, Amount, CloseDate, LastModifiedDate, Payout_Reference__c,
+		StageName, toLabel(StageName) StageLabel, Account.Name, CreatedBy.Name
+	FROM Opportunity
+	WHERE {{.WhereClause}}`
+
+	tests := []struct {
+		name          string
+		linkingObject string
+		linkingField  string
+		query         string
+		mappings      map[string]string
+		coreFields    map[string]string
+		wantProblems  []string
+	}{
+		{
+			name:          "valid",
+			linkingObject: "Opportunity",
+			linkingField:  "Payout_Reference__c",
+			query:         query,
+			mappings:      map[string]string{"StageName": "Stage", "Account.Name": "Account", "CreatedBy.Name": "CreatedBy"},
+		},
+		{
+			name:          "linking field misspelt",
+			linkingObject: "Opportunity",
+			linkingField:  "Payout_Ref__c",
+			query:         query,
+			wantProblems:  []string{`salesforce.linking_field_name "Payout_Ref__c" is not a field of Opportunity`},
+		},
+		{
+			name:          "linking field not updateable",
+			linkingObject: "Opportunity",
+			linkingField:  "legacy_reference__c",
+			query:         query,
+			wantProblems: []string{
+				"salesforce.linking_field_name Opportunity.Legacy_Reference__c is not updateable",
+				"salesforce.linking_field_name legacy_reference__c is not selected by the query, so links cannot be read",
+			},
+		},
+		{
+			name:          "unknown linking object",
+			linkingObject: "Donation__c",
+			linkingField:  "Payout_Reference__c",
+			query:         query,
+			wantProblems:  []string{`salesforce.linking_object "Donation__c" is not a Salesforce object`},
+		},
+		{
+			name:          "query and mappings",
+			linkingObject: "Opportunity",
+			linkingField:  "Payout_Reference__c",
+			query:         "SELECT Id, Name, Stage, account.name, Account.Owner, CloseDate FROM Opportunity WHERE {{.WhereClause}}",
+			mappings:      map[string]string{"Account.Name": "Account", "StageName": "Stage", "account.name": "Account"},
+			coreFields:    map[string]string{"CloseDate": "Gift_Date__c"},
+			wantProblems: []string{
+				`salesforce.query field "Stage" is not a field of Opportunity`,
+				`salesforce.query field "Account.Owner" is not a field of Opportunity`,
+				"salesforce.linking_field_name Payout_Reference__c is not selected by the query, so links cannot be read",
+				`salesforce.core_fields.CloseDate field "Gift_Date__c" is not selected by the query`,
+				`salesforce.field_mappings field "StageName" is not selected by the query`,
+				`salesforce.field_mappings field "account.name" should be written "Account.Name"`,
+			},
+		},
+		{
+			name:          "invalid query",
+			linkingObject: "Opportunity",
+			linkingField:  "Payout_Reference__c",
+			query:         "SELECT Id, Name",
+			wantProblems:  []string{"salesforce.query: query has no FROM clause"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux, client, teardown := setup(t)
+			defer teardown()
+			client.config.Salesforce.LinkingObject = tt.linkingObject
+			client.config.Salesforce.LinkingFieldName = tt.linkingField
+			client.config.Salesforce.Query = tt.query
+			client.config.Salesforce.FieldMappings = tt.mappings
+			client.config.Salesforce.CoreFields = tt.coreFields
+
+			described := map[string]int{}
+			mux.HandleFunc(fmt.Sprintf("GET /services/data/%s/sobjects/{name}/describe", client.apiVersion), func(w http.ResponseWriter, r *http.Request) {
+				name := r.PathValue("name")
+				described[name]++
+				d, ok := describes[name]
+				if !ok {
+					w.WriteHeader(http.StatusNotFound)
+					w.Write([]byte(`[{"errorCode":"NOT_FOUND","message":"The requested resource does not exist"}]`))
+					return
+				}
+				json.NewEncoder(w).Encode(d)
+			})
+
+			err := client.ValidateConfig(context.Background())
+			var configErr *ConfigError
+			if err != nil && !errors.As(err, &configErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var problems []string
+			if configErr != nil {
+				problems = configErr.Problems
+			}
+			if diff := cmp.Diff(tt.wantProblems, problems); diff != "" {
+				t.Errorf("problems diff:\n%s", diff)
+			}
+			for name, n := range described {
+				if n > 1 {
+					t.Errorf("%s described %d times", name, n)
+				}
+			}
+		})
+	}
+}
+
+func TestParseSelect(t *testing.T) {
+
+	object, fields, err := parseSelect(`select Id, FORMAT(Amount), (SELECT Id FROM OpportunityLineItems),
+		Account.Name
+	from Opportunity WHERE {{.WhereClause}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := object, "Opportunity"; got != want {
+		t.Errorf("got object %s want %s", got, want)
+	}
+	want := []string{"Id", "FORMAT(Amount)", "(SELECT Id FROM OpportunityLineItems)", "Account.Name"}
+	if diff := cmp.Diff(want, fields); diff != "" {
+		t.Errorf("fields diff:\n%s", diff)
+	}
+
+	if _, _, err := parseSelect("DELETE FROM Opportunity"); err == nil || !strings.Contains(err.Error(), "SELECT") {
+		t.Errorf("expected a SELECT error, got %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package salesforce
+
+// errors.go sets out the errors returned by the Salesforce REST API.
+//
+// Salesforce reports a failed request as a json list of errors, each with a message
+// and an error code such as INVALID_SESSION_ID. See
+// https://developer.salesforce.com/docs/atlas.en-us.api_rest.meta/api_rest/errorcodes.htm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Kinds of Salesforce API error, for use with errors.Is.
+var (
+	ErrSessionExpired = errors.New("salesforce session expired or invalid")
+	ErrRequestLimit   = errors.New("salesforce request limit exceeded")
+	ErrInvalidQuery   = errors.New("salesforce query invalid")
+)
+
+// errorCodeKinds maps Salesforce error codes to the error kinds.
+var errorCodeKinds = map[string]error{
+	"INVALID_SESSION_ID":            ErrSessionExpired,
+	"INVALID_AUTH_HEADER":           ErrSessionExpired,
+	"REQUEST_LIMIT_EXCEEDED":        ErrRequestLimit,
+	"TOO_MANY_REQUESTS":             ErrRequestLimit,
+	"MALFORMED_QUERY":               ErrInvalidQuery,
+	"INVALID_FIELD":                 ErrInvalidQuery,
+	"INVALID_TYPE":                  ErrInvalidQuery,
+	"INVALID_QUERY_FILTER_OPERATOR": ErrInvalidQuery,
+	"INVALID_QUERY_LOCATOR":         ErrInvalidQuery,
+}
+
+// APIError is a non-2xx response from the Salesforce API. Code and Message are from
+// the first error reported in the response body; Body is the raw response body.
+type APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Fields     []string
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("API error (status %d): %s", e.StatusCode, e.Body)
+	}
+	return fmt.Sprintf("API error (status %d): %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Is reports whether the error is of the target kind, such as ErrSessionExpired.
+func (e *APIError) Is(target error) bool {
+	if kind, ok := errorCodeKinds[e.Code]; ok && kind == target {
+		return true
+	}
+	return target == ErrSessionExpired && e.StatusCode == http.StatusUnauthorized
+}
+
+// parseAPIError returns an APIError for a response with the provided status and body.
+func parseAPIError(statusCode int, body []byte) *APIError {
+	apiErr := &APIError{StatusCode: statusCode, Body: string(body)}
+	var details []ErrorDetail
+	if err := json.Unmarshal(body, &details); err == nil && len(details) > 0 {
+		apiErr.Code = details[0].ErrorCode
+		apiErr.Message = details[0].Message
+		apiErr.Fields = details[0].Fields
+	}
+	return apiErr
+}
+
+// UserMessage returns an explanation of a Salesforce error suggesting how it might be
+// resolved, suitable for showing to a user instead of the raw API response. It returns
+// false if the error is not a recognised Salesforce error.
+func UserMessage(err error) (string, bool) {
+	var apiErr *APIError
+	switch {
+	case errors.Is(err, ErrSessionExpired):
+		return "The Salesforce session has expired or been revoked. Reconnect to Salesforce on the Connect page, or run 'login salesforce'.", true
+	case errors.Is(err, ErrRequestLimit):
+		return "The Salesforce API request limit for your organisation has been reached. Please try again later.", true
+	case errors.As(err, &apiErr) && errors.Is(err, ErrInvalidQuery):
+		msg := "Salesforce rejected the donations query: " + apiErr.Message
+		if len(apiErr.Fields) > 0 {
+			msg += " (fields: " + strings.Join(apiErr.Fields, ", ") + ")"
+		}
+		return msg + ". Check the Salesforce query and field mappings in the configuration.", true
+	case errors.As(err, &apiErr) && apiErr.Code != "":
+		return fmt.Sprintf("Salesforce reported an error: %s (%s).", apiErr.Message, apiErr.Code), true
+	}
+	return "", false
+}
@@ -0,0 +1,125 @@
+package salesforce
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseAPIError(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		wantCode string
+		wantKind error
+	}{
+		{
+			name:     "session",
+			status:   http.StatusUnauthorized,
+			body:     `[{"message": "Session expired or invalid", "errorCode": "INVALID_SESSION_ID"}]`,
+			wantCode: "INVALID_SESSION_ID",
+			wantKind: ErrSessionExpired,
+		},
+		{
+			name:     "limit",
+			status:   http.StatusForbidden,
+			body:     `[{"message": "TotalRequests Limit exceeded.", "errorCode": "REQUEST_LIMIT_EXCEEDED"}]`,
+			wantCode: "REQUEST_LIMIT_EXCEEDED",
+			wantKind: ErrRequestLimit,
+		},
+		{
+			name:     "query",
+			status:   http.StatusBadRequest,
+			body:     `[{"message": "No such column 'Foo__c' on entity 'Opportunity'.", "errorCode": "INVALID_FIELD"}]`,
+			wantCode: "INVALID_FIELD",
+			wantKind: ErrInvalidQuery,
+		},
+		{
+			name:     "unauthorized without a body",
+			status:   http.StatusUnauthorized,
+			body:     `Unauthorized`,
+			wantKind: ErrSessionExpired,
+		},
+		{
+			name:   "other",
+			status: http.StatusInternalServerError,
+			body:   `<html>oops</html>`,
+		},
+	}
+
+	kinds := []error{ErrSessionExpired, ErrRequestLimit, ErrInvalidQuery}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apiErr := parseAPIError(tt.status, []byte(tt.body))
+			if got, want := apiErr.Code, tt.wantCode; got != want {
+				t.Errorf("got code %q want %q", got, want)
+			}
+			// The error kind is found through wrapping.
+			err := fmt.Errorf("wrapped: %w", apiErr)
+			for _, kind := range kinds {
+				if got, want := errors.Is(err, kind), kind == tt.wantKind; got != want {
+					t.Errorf("errors.Is(%v) got %t want %t", kind, got, want)
+				}
+			}
+			var target *APIError
+			if !errors.As(err, &target) || target.StatusCode != tt.status {
+				t.Errorf("expected an APIError with status %d", tt.status)
+			}
+		})
+	}
+}
+
+func TestUserMessage(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		err      error
+		contains string
+		ok       bool
+	}{
+		{
+			name:     "session",
+			err:      parseAPIError(http.StatusUnauthorized, []byte(`[{"message": "Session expired or invalid", "errorCode": "INVALID_SESSION_ID"}]`)),
+			contains: "Reconnect to Salesforce",
+			ok:       true,
+		},
+		{
+			name:     "limit",
+			err:      parseAPIError(http.StatusForbidden, []byte(`[{"message": "TotalRequests Limit exceeded.", "errorCode": "REQUEST_LIMIT_EXCEEDED"}]`)),
+			contains: "try again later",
+			ok:       true,
+		},
+		{
+			name:     "query",
+			err:      parseAPIError(http.StatusBadRequest, []byte(`[{"message": "No such column 'Foo__c'", "errorCode": "INVALID_FIELD", "fields": ["Foo__c"]}]`)),
+			contains: "No such column 'Foo__c' (fields: Foo__c). Check the Salesforce query",
+			ok:       true,
+		},
+		{
+			name:     "other salesforce error",
+			err:      parseAPIError(http.StatusBadRequest, []byte(`[{"message": "bad id", "errorCode": "MALFORMED_ID"}]`)),
+			contains: "bad id (MALFORMED_ID)",
+			ok:       true,
+		},
+		{
+			name: "not salesforce",
+			err:  errors.New("disk full"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, ok := UserMessage(tt.err)
+			if ok != tt.ok {
+				t.Fatalf("got ok %t want %t", ok, tt.ok)
+			}
+			if !strings.Contains(msg, tt.contains) {
+				t.Errorf("message %q does not contain %q", msg, tt.contains)
+			}
+		})
+	}
+}
@@ -1,9 +1,14 @@
 package salesforce
 
 import (
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"reconciler/config"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -41,10 +46,13 @@ func (st *SalesforceTime) UnmarshalJSON(b []byte) error {
 	if s == "null" || s == "" {
 		return nil
 	}
-	// Handles Salesforce's custom format: "2025-07-14T02:25:51.000+0000"
+	// Handles Salesforce's custom format: "2025-07-14T02:25:51.000+0000", or the
+	// RFC3339 format used in Bulk API results: "2025-07-14T02:25:51.000Z".
 	t, err := time.Parse("2006-01-02T15:04:05.000-0700", s)
 	if err != nil {
-		return err
+		if t, err = time.Parse(time.RFC3339, s); err != nil {
+			return err
+		}
 	}
 	st.Time = t
 	return nil
@@ -70,6 +78,56 @@ func (fn *FlattenedName) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// DeletedRecordsResponse is the response of the sObject getDeleted resource, listing
+// the records deleted within a date range.
+type DeletedRecordsResponse struct {
+	DeletedRecords []struct {
+		ID          string `json:"id"`
+		DeletedDate string `json:"deletedDate"`
+	} `json:"deletedRecords"`
+	EarliestDateAvailable string `json:"earliestDateAvailable"`
+	LatestDateCovered     string `json:"latestDateCovered"`
+}
+
+// IDQueryResponse is a page of the response of a SOQL query selecting only record ids.
+type IDQueryResponse struct {
+	Done           bool   `json:"done"`
+	NextRecordsURL string `json:"nextRecordsUrl"`
+	Records        []struct {
+		ID string `json:"Id"`
+	} `json:"records"`
+}
+
+// BulkQueryJob is a Bulk API 2.0 query job. State progresses from UploadComplete
+// through InProgress to one of JobComplete, Failed or Aborted.
+type BulkQueryJob struct {
+	ID                     string `json:"id"`
+	Operation              string `json:"operation"`
+	Object                 string `json:"object"`
+	State                  string `json:"state"`
+	ErrorMessage           string `json:"errorMessage"`
+	NumberRecordsProcessed int    `json:"numberRecordsProcessed"`
+}
+
+// SObjectDescribe is the describe metadata of an sObject, listing its fields.
+type SObjectDescribe struct {
+	Name   string          `json:"name"`
+	Label  string          `json:"label"`
+	Fields []FieldDescribe `json:"fields"`
+}
+
+// FieldDescribe is the describe metadata of an sObject field. Reference fields, such
+// as AccountId, have the RelationshipName used in queries, such as Account, and the
+// objects they refer to in ReferenceTo.
+type FieldDescribe struct {
+	Name             string   `json:"name"`
+	Label            string   `json:"label"`
+	Type             string   `json:"type"`
+	Updateable       bool     `json:"updateable"`
+	RelationshipName string   `json:"relationshipName"`
+	ReferenceTo      []string `json:"referenceTo"`
+}
+
 // SOQLResponse is the top-level envelope for a SOQL query response.
 type SOQLResponse struct {
 	TotalSize      int        `json:"totalSize"`
@@ -79,6 +137,8 @@ type SOQLResponse struct {
 }
 
 // CoreFields defines the essential, non-negotiable fields the application requires.
+// The json names are those of a standard Opportunity; SOQLUnmarshaller reads them from
+// the configured fields of the org where these differ.
 type CoreFields struct {
 	ID               string         `json:"Id"`
 	Name             string         `json:"Name"`
@@ -88,7 +148,8 @@ type CoreFields struct {
 	LastModifiedDate SalesforceTime `json:"LastModifiedDate"`
 	CreatedBy        FlattenedName  `json:"CreatedBy"`
 	LastModifiedBy   FlattenedName  `json:"LastModifiedBy"`
-	PayoutReference  *string        `json:"Payout_Reference__c"` // Pointer to handle null values
+	PayoutReference  *string        `json:"PayoutReference"` // The linking field; a pointer to handle null values
+	StageName        string         `json:"StageName"`       // Also kept in AdditionalFields for display
 }
 
 // Donation represents the data for a single Salesforce donation, combining
@@ -101,9 +162,42 @@ type Donation struct {
 // SOQLUnmarshaller is a configurable struct for managing the custom
 // unmarshalling of a SOQL response. The Mapper provides a map of
 // fields (other than CoreFields) to store in each Donation's
-// AdditionalFields.
+// AdditionalFields. LinkingFieldName is the field holding the payout
+// reference, DefaultLinkingFieldName if empty, and CoreFieldNames maps
+// core fields such as Amount to the fields of the org holding them,
+// where these differ. FieldTypes holds the Salesforce types of the
+// queried fields by their lower-cased name, such as "account.name", for
+// converting the text of bulk query results.
 type SOQLUnmarshaller struct {
-	Mapper map[string]string
+	Mapper           map[string]string
+	LinkingFieldName string
+	CoreFieldNames   map[string]string
+	FieldTypes       map[string]string
+}
+
+// DefaultLinkingFieldName is the field holding the payout reference if none is set.
+const DefaultLinkingFieldName = "Payout_Reference__c"
+
+// fixedCoreFields are the core fields, other than the payout reference, read from
+// the fields of the same name. The remainder, config.SalesforceCoreFields, may be
+// configured.
+var fixedCoreFields = []string{"Id", "CreatedDate", "LastModifiedDate", "CreatedBy", "LastModifiedBy"}
+
+// coreFieldName returns the name of the field holding the core field, such as Amount,
+// from the configured names.
+func coreFieldName(names map[string]string, core string) string {
+	if name := names[core]; name != "" {
+		return name
+	}
+	return core
+}
+
+// linkingFieldName returns the name of the field holding the payout reference.
+func (su *SOQLUnmarshaller) linkingFieldName() string {
+	if su.LinkingFieldName == "" {
+		return DefaultLinkingFieldName
+	}
+	return su.LinkingFieldName
 }
 
 // ErrUnmarshallFieldNotFoundError reports an error from trying to
@@ -150,60 +244,150 @@ func (su *SOQLUnmarshaller) UnmarshalSOQLResponse(data []byte) (*SOQLResponse, e
 	return finalResponse, nil
 }
 
+// UnmarshalCSVRecords unmarshals the CSV results of a Bulk API 2.0 query job into
+// donations, mapping the fields as for a SOQL response. Bulk results are text, with
+// relationship fields in dotted columns such as "Account.Owner.Name" and nulls as
+// empty values, so each row is converted to the equivalent SOQL record before
+// mapping. Numeric and boolean values are converted by their FieldTypes; the values
+// of fields without a type, such as functions, are kept as strings, other than the
+// Amount.
+func (su *SOQLUnmarshaller) UnmarshalCSVRecords(r io.Reader) ([]Donation, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read csv header: %w", err)
+	}
+
+	var donations []Donation
+	for line := 2; ; line++ {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read csv record: %w", err)
+		}
+		record, err := su.csvRecord(header, row)
+		if err != nil {
+			return nil, fmt.Errorf("csv line %d: %w", line, err)
+		}
+		donation, err := su.unmarshalAndMapRecord(record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to process donation on csv line %d: %w", line, err)
+		}
+		donations = append(donations, donation)
+	}
+	return donations, nil
+}
+
+// csvRecord converts a row of Bulk API CSV results to a SOQL JSON record. Relationship
+// columns are nested in objects which, like those of a SOQL record, are null if all
+// their values are null.
+func (su *SOQLUnmarshaller) csvRecord(header, row []string) ([]byte, error) {
+	amount := strings.ToLower(coreFieldName(su.CoreFieldNames, "Amount"))
+	record := make(map[string]any, len(header))
+	for i, column := range header {
+		fieldType, ok := su.FieldTypes[strings.ToLower(column)]
+		if !ok && strings.ToLower(column) == amount {
+			fieldType = "currency"
+		}
+		value, err := csvValue(fieldType, row[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", column, row[i], err)
+		}
+		parts := strings.Split(column, ".")
+		object := record
+		for _, part := range parts[:len(parts)-1] {
+			related, ok := object[part].(map[string]any)
+			if !ok {
+				related = map[string]any{}
+				object[part] = related
+			}
+			object = related
+		}
+		object[parts[len(parts)-1]] = value
+	}
+	nullRelationships(record)
+	return json.Marshal(record)
+}
+
+// csvValue converts the text of a bulk query result of the Salesforce field type to
+// its SOQL JSON value. An empty value is null.
+func csvValue(fieldType, s string) (any, error) {
+	if s == "" {
+		return nil, nil
+	}
+	switch fieldType {
+	case "currency", "double", "percent", "int", "long":
+		return strconv.ParseFloat(s, 64)
+	case "boolean":
+		return strconv.ParseBool(s)
+	}
+	return s, nil
+}
+
+// nullRelationships sets the related objects of the record in which all the values
+// are null to null, and reports if all the values of the record are null.
+func nullRelationships(record map[string]any) bool {
+	allNull := true
+	for k, v := range record {
+		if related, ok := v.(map[string]any); ok && nullRelationships(related) {
+			record[k], v = nil, nil
+		}
+		allNull = allNull && v == nil
+	}
+	return allNull
+}
+
 // unmarshalAndMapRecord marshals raw data into Donation.CoreFields and
 // Donation.AdditionalFields.
 func (su *SOQLUnmarshaller) unmarshalAndMapRecord(data []byte) (Donation, error) {
 	var donation Donation
 
-	if err := json.Unmarshal(data, &donation.CoreFields); err != nil {
-		return donation, fmt.Errorf("failed to unmarshal core fields: %v", err)
-	}
-
 	var allFields map[string]json.RawMessage
 	if err := json.Unmarshal(data, &allFields); err != nil {
 		return donation, fmt.Errorf("failed to unmarshal into generic map: %v", err)
 	}
 
-	// Delete core fields and unneeded fields from allFields. Retain the top-level
-	// "attributes" for reference if needed.
-	delete(allFields, "Id")
-	delete(allFields, "Name")
-	delete(allFields, "Amount")
-	delete(allFields, "CloseDate")
-	delete(allFields, "LastModifiedDate")
-	delete(allFields, "Payout_Reference__c")
-	delete(allFields, "CreatedDate")
-	delete(allFields, "CreatedBy")
+	// Read the core fields from the fields holding them, deleting them, other than the
+	// StageName, and unneeded fields from allFields. Retain the top-level "attributes"
+	// for reference if needed.
+	core := make(map[string]json.RawMessage)
+	for _, name := range fixedCoreFields {
+		if v, ok := allFields[name]; ok {
+			core[name] = v
+		}
+		delete(allFields, name)
+	}
+	for _, name := range config.SalesforceCoreFields {
+		field := coreFieldName(su.CoreFieldNames, name)
+		if v, ok := allFields[field]; ok {
+			core[name] = v
+		}
+		if name != "StageName" {
+			delete(allFields, field)
+		}
+	}
+	if v, ok := allFields[su.linkingFieldName()]; ok {
+		core["PayoutReference"] = v
+	}
+	delete(allFields, su.linkingFieldName())
 	delete(allFields, "ModifiedBy")
-	delete(allFields, "LastModifiedBy")
+
+	coreData, err := json.Marshal(core)
+	if err != nil {
+		return donation, fmt.Errorf("failed to marshal core fields: %v", err)
+	}
+	if err := json.Unmarshal(coreData, &donation.CoreFields); err != nil {
+		return donation, fmt.Errorf("failed to unmarshal core fields: %v", err)
+	}
 
 	donation.AdditionalFields = make(map[string]any)
 	for key, rawValue := range allFields {
-		var subMap map[string]json.RawMessage
-		// Determine if v is a map, if so recurse one level and make a compound key
-		// such as "LastModifiedBy.Name".
-		if err := json.Unmarshal(rawValue, &subMap); err == nil {
-			for subKey, subValue := range subMap {
-				if subKey == "attributes" {
-					continue
-				}
-				newKey := strings.Join([]string{enTitle(key), enTitle(subKey)}, ".")
-				if replacementKey, ok := su.Mapper[newKey]; ok {
-					newKey = replacementKey
-				}
-				var v any
-				_ = json.Unmarshal(subValue, &v)
-				donation.AdditionalFields[newKey] = v
-			}
-		} else {
-			newKey := enTitle(key)
-			if replacementKey, ok := su.Mapper[newKey]; ok {
-				newKey = replacementKey
-			}
-			var v any
-			_ = json.Unmarshal(rawValue, &v)
-			donation.AdditionalFields[newKey] = v
-		}
+		su.addField(donation.AdditionalFields, enTitle(key), rawValue)
 	}
 
 	// Check all anticipated mapper values exist in donation.
@@ -219,6 +403,28 @@ func (su *SOQLUnmarshaller) unmarshalAndMapRecord(data []byte) (Donation, error)
 	return donation, nil
 }
 
+// addField adds the field with the key to the additional fields, replacing the key by
+// its field mapping, if any. The fields of a related object are added recursively
+// with compound keys such as "Account.Owner.Name", without the object's attributes.
+func (su *SOQLUnmarshaller) addField(fields map[string]any, key string, rawValue json.RawMessage) {
+	var subMap map[string]json.RawMessage
+	if err := json.Unmarshal(rawValue, &subMap); err == nil {
+		for subKey, subValue := range subMap {
+			if subKey == "attributes" {
+				continue
+			}
+			su.addField(fields, key+"."+enTitle(subKey), subValue)
+		}
+		return
+	}
+	if replacementKey, ok := su.Mapper[key]; ok {
+		key = replacementKey
+	}
+	var v any
+	_ = json.Unmarshal(rawValue, &v)
+	fields[key] = v
+}
+
 // CollectionsUpdateRequest is the structure for the sObject Collections
 // API request body.
 type CollectionsUpdateRequest struct {
@@ -3,6 +3,7 @@ package salesforce
 import (
 	"errors"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -71,6 +72,7 @@ func TestTypesExtended(t *testing.T) {
 			CreatedBy:        FlattenedName("OrgFarm EPIC"),
 			LastModifiedBy:   FlattenedName("Test User"),
 			PayoutReference:  ptrStr("ENTH-20251112"),
+			StageName:        "Closed Won",
 		},
 		AdditionalFields: map[string]any{
 			"Account":         "Express Logistics and Transport",
@@ -114,3 +116,121 @@ func TestTypesFail(t *testing.T) {
 		t.Fatalf("expected fieldMapping error not triggered")
 	}
 }
+
+// TestTypesConfiguredFields tests reading the payout reference and core fields from
+// configured fields, for both SOQL and bulk query CSV records.
+func TestTypesConfiguredFields(t *testing.T) {
+
+	unmarshaller := SOQLUnmarshaller{
+		Mapper:           map[string]string{"Status__c": "Stage"},
+		LinkingFieldName: "DFK__c",
+		CoreFieldNames:   map[string]string{"Amount": "Gift_Amount__c", "CloseDate": "Gift_Date__c", "StageName": "Status__c"},
+	}
+
+	soql := []byte(`{"totalSize": 1, "done": true, "records": [{
+		"Id": "006-01",
+		"Name": "Gift",
+		"Gift_Amount__c": 12.5,
+		"Gift_Date__c": "2025-05-06",
+		"Status__c": "Received",
+		"DFK__c": "JG-PAYOUT-2025-05-06",
+		"Payout_Reference__c": "OLD-REF"
+	}]}`)
+	sr, err := unmarshaller.UnmarshalSOQLResponse(soql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csv := "Id,Name,Gift_Amount__c,Gift_Date__c,Status__c,DFK__c,Payout_Reference__c\n" +
+		"006-01,Gift,12.5,2025-05-06,Received,JG-PAYOUT-2025-05-06,OLD-REF\n"
+	donations, err := unmarshaller.UnmarshalCSVRecords(strings.NewReader(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref := "JG-PAYOUT-2025-05-06"
+	want := CoreFields{
+		ID:              "006-01",
+		Name:            "Gift",
+		Amount:          12.5,
+		CloseDate:       SalesforceDate{time.Date(2025, 5, 6, 0, 0, 0, 0, time.UTC)},
+		PayoutReference: &ref,
+		StageName:       "Received",
+	}
+	wantFields := map[string]any{"Stage": "Received", "Payout_Reference__c": "OLD-REF"}
+	for name, got := range map[string][]Donation{"soql": sr.Donations, "csv": donations} {
+		if len(got) != 1 {
+			t.Fatalf("%s: got %d donations want 1", name, len(got))
+		}
+		if diff := cmp.Diff(want, got[0].CoreFields); diff != "" {
+			t.Errorf("%s: core fields diff:\n%s", name, diff)
+		}
+		if diff := cmp.Diff(wantFields, got[0].AdditionalFields); diff != "" {
+			t.Errorf("%s: additional fields diff:\n%s", name, diff)
+		}
+	}
+}
+
+// TestTypesCSVRecords tests that bulk query CSV records are read as the equivalent SOQL
+// records, with numeric and boolean values converted by the field types and nested
+// relationships flattened.
+func TestTypesCSVRecords(t *testing.T) {
+
+	unmarshaller := SOQLUnmarshaller{
+		FieldTypes: map[string]string{
+			"amount":             "currency",
+			"probability":        "percent",
+			"isprivate":          "boolean",
+			"account.name":       "string",
+			"account.owner.name": "string",
+		},
+	}
+
+	soql := []byte(`{"totalSize": 2, "done": true, "records": [{
+		"Id": "006-01",
+		"Name": "Gift",
+		"Amount": 12.5,
+		"Probability": 100,
+		"IsPrivate": true,
+		"Account": {"attributes": {"type": "Account"}, "Name": "United Oil",
+			"Owner": {"attributes": {"type": "User"}, "Name": "Ada Owner"}}
+	}, {
+		"Id": "006-02",
+		"Name": "Anonymous gift",
+		"Amount": 10,
+		"Probability": null,
+		"IsPrivate": false,
+		"Account": null
+	}]}`)
+	sr, err := unmarshaller.UnmarshalSOQLResponse(soql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csv := "Id,Name,Amount,Probability,IsPrivate,Account.Name,Account.Owner.Name\n" +
+		"006-01,Gift,12.5,100,true,United Oil,Ada Owner\n" +
+		"006-02,Anonymous gift,10,,false,,\n"
+	donations, err := unmarshaller.UnmarshalCSVRecords(strings.NewReader(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []map[string]any{
+		{"Probability": 100.0, "IsPrivate": true, "Account.Name": "United Oil", "Account.Owner.Name": "Ada Owner"},
+		{"IsPrivate": false},
+	}
+	for name, got := range map[string][]Donation{"soql": sr.Donations, "csv": donations} {
+		if len(got) != len(want) {
+			t.Fatalf("%s: got %d donations want %d", name, len(got), len(want))
+		}
+		for i, d := range got {
+			if diff := cmp.Diff(want[i], d.AdditionalFields); diff != "" {
+				t.Errorf("%s: donation %d additional fields diff:\n%s", name, i, diff)
+			}
+		}
+	}
+
+	// A value which is not of the field type is an error.
+	csv = "Id,Name,Amount,IsPrivate\n006-01,Gift,12.5,maybe\n"
+	if _, err := unmarshaller.UnmarshalCSVRecords(strings.NewReader(csv)); err == nil || !strings.Contains(err.Error(), "IsPrivate") {
+		t.Errorf("expected an invalid IsPrivate error, got %v", err)
+	}
+}
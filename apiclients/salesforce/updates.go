@@ -0,0 +1,281 @@
+package salesforce
+
+// updates.go updates the linking field of any number of opportunities.
+//
+// The sObject Collections API updates at most 200 records a request, so larger sets of
+// updates, such as the several hundred donations in a platform payout, are split into
+// chunks, with the outcome of each record collected into a report. A collections
+// request can only be made atomic on its own, so an update across several chunks is
+// made all or none by restoring the previous values of the records already updated
+// when a later chunk fails. See
+// https://developer.salesforce.com/docs/atlas.en-us.api_rest.meta/api_rest/resources_composite_sobjects_collections_update.htm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// RefUpdate sets the linking field of the opportunity with the ID to Reference. An
+// empty Reference clears the field.
+type RefUpdate struct {
+	ID        string
+	Reference string
+}
+
+// RefUpdateStatus is the outcome of a RefUpdate.
+type RefUpdateStatus string
+
+const (
+	RefUpdated        RefUpdateStatus = "updated"
+	RefFailed         RefUpdateStatus = "failed"
+	RefNotAttempted   RefUpdateStatus = "not attempted"   // a chunk failed in all or none mode
+	RefRolledBack     RefUpdateStatus = "rolled back"     // restored after a chunk failed
+	RefRollbackFailed RefUpdateStatus = "rollback failed" // updated, but could not be restored
+)
+
+// RefUpdateResult reports the outcome of a RefUpdate. Previous is the value of the
+// linking field before the update, and is only retrieved in all or none mode. Errors
+// holds the reasons for a failed update or rollback.
+type RefUpdateResult struct {
+	RefUpdate
+	Previous string
+	Status   RefUpdateStatus
+	Errors   []string
+}
+
+// RefUpdateReport reports the outcome of each update, in the order provided.
+type RefUpdateReport []RefUpdateResult
+
+// Count returns the number of results with the status.
+func (r RefUpdateReport) Count(status RefUpdateStatus) int {
+	var n int
+	for _, result := range r {
+		if result.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// chunks splits the indexes of n items into consecutive ranges of at most size.
+func chunks(n, size int) [][2]int {
+	var ranges [][2]int
+	for start := 0; start < n; start += size {
+		ranges = append(ranges, [2]int{start, min(start+size, n)})
+	}
+	return ranges
+}
+
+// UpdateOpportunityRefs sets the linking field of any number of opportunities, in
+// requests of up to 200 records, returning the outcome of each update. An error is
+// returned if any update failed, together with the report.
+//
+// If allOrNone is set each request is atomic, and once a request fails the records
+// updated by earlier requests are restored to their previous values, with the
+// remaining requests not made. Otherwise each record is updated independently and all
+// the requests are made.
+func (c *Client) UpdateOpportunityRefs(ctx context.Context, updates []RefUpdate, allOrNone bool) (RefUpdateReport, error) {
+	report := make(RefUpdateReport, len(updates))
+	seen := map[string]bool{}
+	for i, u := range updates {
+		if seen[u.ID] {
+			return nil, fmt.Errorf("opportunity %s is updated more than once", u.ID)
+		}
+		seen[u.ID] = true
+		report[i] = RefUpdateResult{RefUpdate: u, Status: RefNotAttempted}
+	}
+
+	// The previous values are needed to restore the records updated before a failure.
+	if allOrNone {
+		ids := make([]string, len(updates))
+		for i, u := range updates {
+			ids[i] = u.ID
+		}
+		previous, err := c.getOpportunityRefs(ctx, ids)
+		if err != nil {
+			return report, fmt.Errorf("failed to get the current references: %w", err)
+		}
+		for i := range report {
+			report[i].Previous = previous[report[i].ID]
+		}
+	}
+
+	for _, r := range chunks(len(updates), maxBatchUpdateCount) {
+		chunk := report[r[0]:r[1]]
+		response, err := c.patchOpportunityRefs(ctx, chunk, allOrNone)
+		if err != nil {
+			for i := range chunk {
+				chunk[i].Status = RefFailed
+				chunk[i].Errors = []string{err.Error()}
+			}
+		} else {
+			applySaveResults(chunk, response)
+		}
+		if allOrNone && (err != nil || report.Count(RefFailed) > 0) {
+			c.rollbackOpportunityRefs(ctx, report[:r[0]])
+			return report, refUpdateError(report)
+		}
+		if err != nil {
+			// A failed request, such as for an expired session, fails the remainder.
+			return report, refUpdateError(report)
+		}
+	}
+	return report, refUpdateError(report)
+}
+
+// applySaveResults sets the status of each result from the save result for the same
+// record.
+func applySaveResults(results []RefUpdateResult, response CollectionsUpdateResponse) {
+	saved := make(map[string]SaveResult, len(response))
+	for i, s := range response {
+		// Salesforce omits the id of records which failed validation, so fall back
+		// to the order of the request.
+		if s.ID == "" && i < len(results) {
+			s.ID = results[i].ID
+		}
+		saved[s.ID] = s
+	}
+	for i := range results {
+		s, ok := saved[results[i].ID]
+		switch {
+		case !ok:
+			results[i].Status = RefFailed
+			results[i].Errors = []string{"no result returned"}
+		case s.Success:
+			results[i].Status = RefUpdated
+		default:
+			results[i].Status = RefFailed
+			for _, e := range s.Errors {
+				results[i].Errors = append(results[i].Errors, fmt.Sprintf("%s (%s)", e.Message, e.ErrorCode))
+			}
+		}
+	}
+}
+
+// rollbackOpportunityRefs restores the previous values of the updated results, marking
+// them as rolled back or, if they could not be restored, as failing to roll back.
+// Each record is restored independently so that as many as possible are restored.
+func (c *Client) rollbackOpportunityRefs(ctx context.Context, results []RefUpdateResult) {
+	var restore []RefUpdateResult
+	var index []int
+	for i, r := range results {
+		if r.Status == RefUpdated {
+			restore = append(restore, RefUpdateResult{RefUpdate: RefUpdate{ID: r.ID, Reference: r.Previous}})
+			index = append(index, i)
+		}
+	}
+	for _, r := range chunks(len(restore), maxBatchUpdateCount) {
+		chunk := restore[r[0]:r[1]]
+		response, err := c.patchOpportunityRefs(ctx, chunk, false)
+		if err != nil {
+			for i := range chunk {
+				chunk[i].Status = RefFailed
+				chunk[i].Errors = []string{err.Error()}
+			}
+		} else {
+			applySaveResults(chunk, response)
+		}
+	}
+	for j, i := range index {
+		if restore[j].Status == RefUpdated {
+			results[i].Status = RefRolledBack
+			continue
+		}
+		results[i].Status = RefRollbackFailed
+		results[i].Errors = append(results[i].Errors, restore[j].Errors...)
+	}
+}
+
+// refUpdateError summarises the failures in the report, returning nil if every
+// update succeeded.
+func refUpdateError(report RefUpdateReport) error {
+	if report.Count(RefUpdated) == len(report) {
+		return nil
+	}
+	var failures []string
+	for _, r := range report {
+		if r.Status == RefFailed || r.Status == RefRollbackFailed {
+			failures = append(failures, fmt.Sprintf("%s %s: %s", r.Status, r.ID, strings.Join(r.Errors, ", ")))
+		}
+	}
+	msg := fmt.Sprintf("%d of %d opportunities updated", report.Count(RefUpdated), len(report))
+	if n := report.Count(RefRolledBack); n > 0 {
+		msg += fmt.Sprintf(", %d rolled back", n)
+	}
+	if len(failures) > 0 {
+		msg += ":\n- " + strings.Join(failures, "\n- ")
+	}
+	return fmt.Errorf("%s", msg)
+}
+
+// patchOpportunityRefs sets the linking field of up to 200 opportunities with a single
+// sObject Collections request.
+func (c *Client) patchOpportunityRefs(ctx context.Context, updates []RefUpdateResult, allOrNone bool) (CollectionsUpdateResponse, error) {
+	if len(updates) > maxBatchUpdateCount {
+		return nil, fmt.Errorf("cannot update more than %d records in a single batch", maxBatchUpdateCount)
+	}
+	records := make([]map[string]any, len(updates))
+	for i, u := range updates {
+		var reference any = u.Reference
+		if u.Reference == "" {
+			reference = nil // clear the field
+		}
+		records[i] = map[string]any{
+			"id":                                 u.ID,
+			c.config.Salesforce.LinkingFieldName: reference,
+			"attributes": map[string]string{
+				"type": c.config.Salesforce.LinkingObject,
+			},
+		}
+	}
+	body, err := json.Marshal(CollectionsUpdateRequest{AllOrNone: allOrNone, Records: records})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal batch request: %w", err)
+	}
+
+	requestURL := fmt.Sprintf("%s/services/data/%s/composite/sobjects", c.instanceURL, c.apiVersion)
+	req, err := c.newRequest(ctx, "PATCH", requestURL, body)
+	if err != nil {
+		return nil, fmt.Errorf("new patch request error: %w", err)
+	}
+	var response CollectionsUpdateResponse
+	if _, err := c.do(req, &response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// getOpportunityRefs returns the values of the linking field of the opportunities with
+// the ids, keyed by id, using sObject Collections requests of up to 200 records. Ids
+// of records which are not found are omitted.
+func (c *Client) getOpportunityRefs(ctx context.Context, ids []string) (map[string]string, error) {
+	field := c.config.Salesforce.LinkingFieldName
+	refs := make(map[string]string, len(ids))
+	for _, r := range chunks(len(ids), maxBatchUpdateCount) {
+		params := url.Values{}
+		params.Set("ids", strings.Join(ids[r[0]:r[1]], ","))
+		params.Set("fields", "Id,"+field)
+		requestURL := fmt.Sprintf("%s/services/data/%s/composite/sobjects/%s?%s", c.instanceURL, c.apiVersion, c.config.Salesforce.LinkingObject, params.Encode())
+		req, err := c.newRequest(ctx, "GET", requestURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		// Records which are not found are returned as null.
+		var records []map[string]any
+		if _, err := c.do(req, &records); err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			id, _ := record["Id"].(string)
+			if id == "" {
+				continue
+			}
+			ref, _ := record[field].(string)
+			refs[id] = ref
+		}
+	}
+	return refs, nil
+}
@@ -0,0 +1,159 @@
+package salesforce
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeOpportunities is an in-memory set of opportunity linking field values served
+// with the sObject Collections API.
+type fakeOpportunities struct {
+	t        *testing.T
+	refs     map[string]string
+	fail     map[string]bool // ids of records which fail to update
+	requests []string        // the method and number of records of each request
+}
+
+func (f *fakeOpportunities) handleGet(w http.ResponseWriter, r *http.Request) {
+	ids := strings.Split(r.URL.Query().Get("ids"), ",")
+	if got, want := r.URL.Query().Get("fields"), "Id,Payout_Reference__c"; got != want {
+		f.t.Errorf("got fields %q want %q", got, want)
+	}
+	f.requests = append(f.requests, fmt.Sprintf("GET %d", len(ids)))
+	records := make([]any, len(ids))
+	for i, id := range ids {
+		if ref, ok := f.refs[id]; ok {
+			records[i] = map[string]any{"Id": id, "Payout_Reference__c": ref}
+		}
+	}
+	json.NewEncoder(w).Encode(records)
+}
+
+func (f *fakeOpportunities) handlePatch(w http.ResponseWriter, r *http.Request) {
+	var payload CollectionsUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		f.t.Fatal(err)
+	}
+	f.requests = append(f.requests, fmt.Sprintf("PATCH %d", len(payload.Records)))
+	var failed bool
+	for _, record := range payload.Records {
+		failed = failed || f.fail[record["id"].(string)]
+	}
+	response := make(CollectionsUpdateResponse, len(payload.Records))
+	for i, record := range payload.Records {
+		id := record["id"].(string)
+		response[i].ID = id
+		switch {
+		case f.fail[id]:
+			response[i].Errors = []ErrorDetail{{Message: "entity is locked", ErrorCode: "ENTITY_IS_LOCKED"}}
+		case failed && payload.AllOrNone:
+			response[i].Errors = []ErrorDetail{{Message: "rolled back", ErrorCode: "ALL_OR_NONE_OPERATION_ROLLED_BACK"}}
+		default:
+			response[i].Success = true
+			ref, _ := record["Payout_Reference__c"].(string)
+			f.refs[id] = ref
+		}
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// TestUpdateOpportunityRefs tests updating more opportunities than fit in a single
+// request, with and without all or none compensation.
+func TestUpdateOpportunityRefs(t *testing.T) {
+
+	const n = 450
+	newUpdates := func() []RefUpdate {
+		updates := make([]RefUpdate, n)
+		for i := range updates {
+			updates[i] = RefUpdate{ID: fmt.Sprintf("006-%03d", i), Reference: "JG-PAYOUT-2025-06-01"}
+		}
+		return updates
+	}
+
+	tests := []struct {
+		name         string
+		allOrNone    bool
+		fail         string
+		wantRequests []string
+		wantCounts   map[RefUpdateStatus]int
+		wantRef      string // the final reference of the first record
+	}{
+		{
+			name:         "chunked",
+			wantRequests: []string{"PATCH 200", "PATCH 200", "PATCH 50"},
+			wantCounts:   map[RefUpdateStatus]int{RefUpdated: n},
+			wantRef:      "JG-PAYOUT-2025-06-01",
+		},
+		{
+			name:         "partial",
+			fail:         "006-250",
+			wantRequests: []string{"PATCH 200", "PATCH 200", "PATCH 50"},
+			wantCounts:   map[RefUpdateStatus]int{RefUpdated: n - 1, RefFailed: 1},
+			wantRef:      "JG-PAYOUT-2025-06-01",
+		},
+		{
+			name:         "all or none",
+			allOrNone:    true,
+			wantRequests: []string{"GET 200", "GET 200", "GET 50", "PATCH 200", "PATCH 200", "PATCH 50"},
+			wantCounts:   map[RefUpdateStatus]int{RefUpdated: n},
+			wantRef:      "JG-PAYOUT-2025-06-01",
+		},
+		{
+			name:         "all or none rolled back",
+			allOrNone:    true,
+			fail:         "006-250",
+			wantRequests: []string{"GET 200", "GET 200", "GET 50", "PATCH 200", "PATCH 200", "PATCH 200"},
+			wantCounts:   map[RefUpdateStatus]int{RefRolledBack: 200, RefFailed: 200, RefNotAttempted: 50},
+			wantRef:      "OLD-REF",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux, client, teardown := setup(t)
+			defer teardown()
+			client.config.Salesforce.LinkingFieldName = "Payout_Reference__c"
+			client.config.Salesforce.LinkingObject = "Opportunity"
+
+			f := &fakeOpportunities{t: t, refs: map[string]string{}, fail: map[string]bool{tt.fail: true}}
+			for _, u := range newUpdates() {
+				f.refs[u.ID] = "OLD-REF"
+			}
+			mux.HandleFunc(fmt.Sprintf("GET /services/data/%s/composite/sobjects/Opportunity", client.apiVersion), f.handleGet)
+			mux.HandleFunc(fmt.Sprintf("PATCH /services/data/%s/composite/sobjects", client.apiVersion), f.handlePatch)
+
+			report, err := client.UpdateOpportunityRefs(context.Background(), newUpdates(), tt.allOrNone)
+			if got, want := err != nil, tt.fail != ""; got != want {
+				t.Errorf("got error %v, want an error %t", err, want)
+			}
+			if diff := cmp.Diff(tt.wantRequests, f.requests); diff != "" {
+				t.Errorf("requests diff:\n%s", diff)
+			}
+			counts := map[RefUpdateStatus]int{}
+			for _, r := range report {
+				counts[r.Status]++
+			}
+			if diff := cmp.Diff(tt.wantCounts, counts); diff != "" {
+				t.Errorf("status counts diff:\n%s", diff)
+			}
+			if got, want := f.refs["006-000"], tt.wantRef; got != want {
+				t.Errorf("got reference %q want %q", got, want)
+			}
+			if tt.fail != "" && !strings.Contains(err.Error(), "006-250: entity is locked (ENTITY_IS_LOCKED)") {
+				t.Errorf("expected the failed record in the error, got %v", err)
+			}
+		})
+	}
+
+	// Each opportunity may only be updated once.
+	_, client, teardown := setup(t)
+	defer teardown()
+	if _, err := client.UpdateOpportunityRefs(context.Background(), []RefUpdate{{ID: "006-1"}, {ID: "006-1"}}, false); err == nil {
+		t.Error("expected an error for a repeated opportunity")
+	}
+}
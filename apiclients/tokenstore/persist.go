@@ -0,0 +1,109 @@
+package tokenstore
+
+// persist.go provides an oauth2.TokenSource which saves each refreshed token, so that
+// a token rotated during the life of a long running client, such as the web server,
+// is not lost when the process exits.
+//
+// Where the refresh token is rotated on each refresh, as by Xero, every client using
+// the saved token must refresh with the latest refresh token, as the previous one
+// soon stops working. A reloading source reloads the saved token before refreshing,
+// so that a token refreshed by another client, in this or another process, is used
+// rather than refreshed again.
+
+import (
+	"log"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// SaveFunc saves a refreshed token.
+type SaveFunc func(*oauth2.Token) error
+
+// LoadFunc loads the saved token.
+type LoadFunc func() (*oauth2.Token, error)
+
+// SourceFunc returns a token source which refreshes the token when it expires, such
+// as that of oauth2.Config.TokenSource.
+type SourceFunc func(*oauth2.Token) oauth2.TokenSource
+
+// refreshMu serialises the reloading and refreshing of saved tokens in the process, so
+// that two sources do not both refresh with the same refresh token.
+var refreshMu sync.Mutex
+
+// PersistingTokenSource wraps a token source, calling save whenever the source
+// returns a token different from the last one seen.
+type PersistingTokenSource struct {
+	newSource SourceFunc
+	load      LoadFunc
+	save      SaveFunc
+
+	mu   sync.Mutex
+	src  oauth2.TokenSource
+	last *oauth2.Token
+}
+
+// NewPersistingTokenSource returns a PersistingTokenSource for src. The current token,
+// as loaded from the store, is used to determine when the token has been refreshed.
+func NewPersistingTokenSource(src oauth2.TokenSource, current *oauth2.Token, save SaveFunc) *PersistingTokenSource {
+	return &PersistingTokenSource{src: src, save: save, last: current}
+}
+
+// NewReloadingTokenSource returns a PersistingTokenSource for the current token, as
+// loaded from the store, which reloads the saved token before refreshing an expired
+// token. If the saved token has changed it replaces the current token, with a new
+// source from newSource, so that a refresh token rotated by another source is not
+// reused.
+func NewReloadingTokenSource(newSource SourceFunc, current *oauth2.Token, load LoadFunc, save SaveFunc) *PersistingTokenSource {
+	return &PersistingTokenSource{newSource: newSource, load: load, save: save, src: newSource(current), last: current}
+}
+
+// Token returns a token from the underlying source, saving it if it has been
+// refreshed. A failure to save is logged rather than returned, as the token is still
+// valid for the current request; the save is retried on the next call.
+func (p *PersistingTokenSource) Token() (*oauth2.Token, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.load != nil && !p.last.Valid() {
+		refreshMu.Lock()
+		defer refreshMu.Unlock()
+		p.reload()
+	}
+	tok, err := p.src.Token()
+	if err != nil {
+		return nil, err
+	}
+	if !tokenChanged(p.last, tok) {
+		return tok, nil
+	}
+	log.Println("Access token was refreshed. Saving new token.")
+	if err := p.save(tok); err != nil {
+		log.Printf("Warning: failed to save refreshed token: %v", err)
+		return tok, nil
+	}
+	p.last = tok
+	return tok, nil
+}
+
+// reload replaces the last token with the saved token if it has changed. A failure to
+// load is logged, and the last token refreshed as before.
+func (p *PersistingTokenSource) reload() {
+	saved, err := p.load()
+	if err != nil {
+		log.Printf("Warning: failed to reload saved token: %v", err)
+		return
+	}
+	if tokenChanged(p.last, saved) {
+		log.Println("Using the token saved since it was loaded.")
+		p.last, p.src = saved, p.newSource(saved)
+	}
+}
+
+// tokenChanged reports if the token differs from the last token.
+func tokenChanged(last, tok *oauth2.Token) bool {
+	if last == nil {
+		return true
+	}
+	return last.AccessToken != tok.AccessToken || last.RefreshToken != tok.RefreshToken
+}
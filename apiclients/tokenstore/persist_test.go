@@ -0,0 +1,183 @@
+package tokenstore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// sequenceSource returns its tokens in turn, repeating the last one.
+type sequenceSource struct {
+	tokens []*oauth2.Token
+	i      int
+}
+
+func (s *sequenceSource) Token() (*oauth2.Token, error) {
+	tok := s.tokens[s.i]
+	if s.i < len(s.tokens)-1 {
+		s.i++
+	}
+	return tok, nil
+}
+
+func TestPersistingTokenSource(t *testing.T) {
+
+	initial := &oauth2.Token{AccessToken: "a1", RefreshToken: "r1"}
+	src := &sequenceSource{tokens: []*oauth2.Token{
+		initial,
+		{AccessToken: "a2", RefreshToken: "r1"},
+		{AccessToken: "a2", RefreshToken: "r1"},
+		{AccessToken: "a3", RefreshToken: "r2"},
+	}}
+
+	var saved []string
+	var saveErr error
+	p := NewPersistingTokenSource(src, initial, func(tok *oauth2.Token) error {
+		if saveErr != nil {
+			return saveErr
+		}
+		saved = append(saved, tok.AccessToken)
+		return nil
+	})
+
+	for range 4 {
+		if _, err := p.Token(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := len(saved), 2; got != want {
+		t.Fatalf("got %d saves want %d: %v", got, want, saved)
+	}
+	if saved[0] != "a2" || saved[1] != "a3" {
+		t.Errorf("unexpected saved tokens %v", saved)
+	}
+
+	// A failed save is retried on the next call.
+	saveErr = errors.New("disk full")
+	src.tokens = append(src.tokens, &oauth2.Token{AccessToken: "a4", RefreshToken: "r3"})
+	src.i = len(src.tokens) - 1
+	if tok, err := p.Token(); err != nil || tok.AccessToken != "a4" {
+		t.Fatalf("got %v %v, expected the token despite the save failure", tok, err)
+	}
+	saveErr = nil
+	if _, err := p.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := saved[len(saved)-1], "a4"; got != want {
+		t.Errorf("got last saved %q want %q", got, want)
+	}
+}
+
+// rotatingServer issues tokens as Xero does, rotating the refresh token on each refresh
+// so that the previous refresh token can no longer be used.
+type rotatingServer struct {
+	refreshToken string
+	refreshes    int
+	lifetime     time.Duration // of the issued access tokens
+}
+
+// refresher refreshes tokens from the server, as the refresher of an oauth2.Config
+// token source does.
+type refresher struct {
+	server       *rotatingServer
+	refreshToken string
+}
+
+func (r *refresher) Token() (*oauth2.Token, error) {
+	s := r.server
+	if r.refreshToken != s.refreshToken {
+		return nil, &oauth2.RetrieveError{ErrorCode: "invalid_grant"}
+	}
+	s.refreshes++
+	s.refreshToken = fmt.Sprintf("r%d", s.refreshes+1)
+	r.refreshToken = s.refreshToken
+	return &oauth2.Token{
+		AccessToken:  fmt.Sprintf("a%d", s.refreshes+1),
+		RefreshToken: s.refreshToken,
+		Expiry:       time.Now().Add(s.lifetime),
+	}, nil
+}
+
+func (s *rotatingServer) source(tok *oauth2.Token) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(tok, &refresher{server: s, refreshToken: tok.RefreshToken})
+}
+
+// TestReloadingTokenSource tests two sources sharing a saved token, where the second
+// refreshes after the first has rotated the refresh token.
+func TestReloadingTokenSource(t *testing.T) {
+
+	server := &rotatingServer{refreshToken: "r1"}
+	saved := &oauth2.Token{AccessToken: "a1", RefreshToken: "r1", Expiry: time.Now().Add(-time.Hour)}
+	load := func() (*oauth2.Token, error) { return saved, nil }
+	save := func(tok *oauth2.Token) error {
+		saved = tok
+		return nil
+	}
+
+	first := NewReloadingTokenSource(server.source, saved, load, save)
+	second := NewReloadingTokenSource(server.source, saved, load, save)
+
+	// The first source refreshes the expired token, issued already expired, so that
+	// the second must refresh again with the rotated refresh token.
+	server.lifetime = -time.Minute
+	if _, err := first.Token(); err != nil {
+		t.Fatal(err)
+	}
+	tok, err := second.Token()
+	if err != nil {
+		t.Fatalf("second source refresh: %v", err)
+	}
+	if got, want := tok.AccessToken, "a3"; got != want {
+		t.Errorf("got access token %q want %q", got, want)
+	}
+
+	// Once refreshed, the saved token is used by the other source without refreshing.
+	server.lifetime = time.Hour
+	if _, err := second.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if tok, err = first.Token(); err != nil {
+		t.Fatalf("first source refresh: %v", err)
+	}
+	if got, want := tok.AccessToken, "a4"; got != want {
+		t.Errorf("got access token %q want %q", got, want)
+	}
+	if got, want := server.refreshes, 3; got != want {
+		t.Errorf("got %d refreshes want %d", got, want)
+	}
+	if got, want := saved.RefreshToken, "r4"; got != want {
+		t.Errorf("got saved refresh token %q want %q", got, want)
+	}
+}
+
+func TestAtomicSave(t *testing.T) {
+
+	dir := t.TempDir()
+	store := &FileStore{Path: filepath.Join(dir, "token.json")}
+	for _, access := range []string{"a1", "a2"} {
+		if err := store.Save(oauth2.Token{AccessToken: access}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the token file remains, with no temporary files.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(entries), 1; got != want {
+		t.Errorf("got %d files want %d", got, want)
+	}
+	var tok oauth2.Token
+	if err := store.Load(&tok); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tok.AccessToken, "a2"; got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
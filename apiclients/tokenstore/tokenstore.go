@@ -0,0 +1,256 @@
+// Package tokenstore persists the OAuth2 tokens used by the Xero and Salesforce API
+// clients.
+//
+// Two stores are provided: a plain JSON file store, and a file store which encrypts
+// the token at rest with AES-GCM using a key derived from a passphrase. Both write
+// files readable only by the current user.
+package tokenstore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Store kinds, as set in the configuration.
+const (
+	KindFile      = "file"
+	KindEncrypted = "encrypted"
+)
+
+// PassphraseEnv is the environment variable holding the passphrase for the encrypted
+// store. The passphrase is deliberately not read from the configuration file.
+const PassphraseEnv = "RECONCILER_TOKEN_PASSPHRASE"
+
+// ErrNotEncrypted is returned when an encrypted store reads a plain token file.
+var ErrNotEncrypted = errors.New("token file is not encrypted")
+
+// Store loads and saves a token record, such as an *oauth2.Token, encoded as JSON.
+// Load returns an error wrapping fs.ErrNotExist if no token has been saved.
+type Store interface {
+	Load(v any) error
+	Save(v any) error
+	Delete() error
+}
+
+// New returns the store of the provided kind for the token file at path. The
+// passphrase is only used by the encrypted store. An empty kind is a plain file store.
+func New(kind, path, passphrase string) (Store, error) {
+	switch kind {
+	case "", KindFile:
+		return &FileStore{Path: path}, nil
+	case KindEncrypted:
+		if passphrase == "" {
+			return nil, fmt.Errorf("the encrypted token store requires a passphrase in the %s environment variable", PassphraseEnv)
+		}
+		return &EncryptedFileStore{Path: path, Passphrase: passphrase}, nil
+	}
+	return nil, fmt.Errorf("unknown token store %q, expected %s or %s", kind, KindFile, KindEncrypted)
+}
+
+// writeFile writes data to path with permissions restricted to the current user. The
+// data is written to a temporary file in the same directory which then replaces path,
+// so that a crash or concurrent reader never sees a partially written token.
+func writeFile(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("unable to save oauth token: %w", err)
+	}
+	tmpPath := f.Name()
+	defer os.Remove(tmpPath) // fails harmlessly once renamed
+
+	if err := f.Chmod(0600); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("unable to save oauth token: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("unable to save oauth token: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("unable to save oauth token: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("unable to save oauth token: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("unable to save oauth token: %w", err)
+	}
+	return nil
+}
+
+// deleteFile removes the file at path, if it exists.
+func deleteFile(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// FileStore stores a token as plain JSON.
+type FileStore struct {
+	Path string
+}
+
+// Load reads the token from the file.
+func (f *FileStore) Load(v any) error {
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return err
+	}
+	if isEncrypted(data) {
+		return fmt.Errorf("token file %s is encrypted; set the token store to %q", f.Path, KindEncrypted)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Save writes the token to the file.
+func (f *FileStore) Save(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("unable to encode oauth token: %w", err)
+	}
+	return writeFile(f.Path, append(data, '\n'))
+}
+
+// Delete removes the file.
+func (f *FileStore) Delete() error {
+	return deleteFile(f.Path)
+}
+
+// Key derivation and encryption settings for the encrypted store.
+const (
+	encryptedFormat  = "reconciler-token-aes-gcm-v1"
+	pbkdf2Iterations = 600_000
+	saltLength       = 16
+	keyLength        = 32 // AES-256
+)
+
+// envelope is the on-disk format of an encrypted token.
+type envelope struct {
+	Format     string `json:"format"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// isEncrypted reports whether the file data is an encrypted token envelope.
+func isEncrypted(data []byte) bool {
+	return bytes.Contains(data, []byte(encryptedFormat))
+}
+
+// EncryptedFileStore stores a token encrypted with AES-256-GCM, using a key derived
+// from the passphrase with PBKDF2-SHA256 and a random salt.
+type EncryptedFileStore struct {
+	Path       string
+	Passphrase string
+}
+
+// gcm returns the AES-GCM cipher for the salt and iterations.
+func (e *EncryptedFileStore) gcm(salt []byte, iterations int) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, e.Passphrase, salt, iterations, keyLength)
+	if err != nil {
+		return nil, fmt.Errorf("key derivation error: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Load reads and decrypts the token from the file.
+func (e *EncryptedFileStore) Load(v any) error {
+	data, err := os.ReadFile(e.Path)
+	if err != nil {
+		return err
+	}
+	if !isEncrypted(data) {
+		return fmt.Errorf("%w: %s; migrate it with the migrate-tokens command", ErrNotEncrypted, e.Path)
+	}
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return fmt.Errorf("invalid encrypted token file %s: %w", e.Path, err)
+	}
+	if env.Format != encryptedFormat {
+		return fmt.Errorf("unsupported encrypted token format %q", env.Format)
+	}
+	aead, err := e.gcm(env.Salt, env.Iterations)
+	if err != nil {
+		return err
+	}
+	if len(env.Nonce) != aead.NonceSize() {
+		return fmt.Errorf("invalid encrypted token file %s: bad nonce", e.Path)
+	}
+	plaintext, err := aead.Open(nil, env.Nonce, env.Ciphertext, []byte(encryptedFormat))
+	if err != nil {
+		return fmt.Errorf("could not decrypt token file %s: wrong passphrase or corrupted file", e.Path)
+	}
+	return json.Unmarshal(plaintext, v)
+}
+
+// Save encrypts and writes the token to the file. A new salt and nonce are used for
+// each save.
+func (e *EncryptedFileStore) Save(v any) error {
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("unable to encode oauth token: %w", err)
+	}
+	env := envelope{
+		Format:     encryptedFormat,
+		Iterations: pbkdf2Iterations,
+		Salt:       make([]byte, saltLength),
+	}
+	if _, err := rand.Read(env.Salt); err != nil {
+		return err
+	}
+	aead, err := e.gcm(env.Salt, env.Iterations)
+	if err != nil {
+		return err
+	}
+	env.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(env.Nonce); err != nil {
+		return err
+	}
+	env.Ciphertext = aead.Seal(nil, env.Nonce, plaintext, []byte(encryptedFormat))
+
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return writeFile(e.Path, append(data, '\n'))
+}
+
+// Delete removes the file.
+func (e *EncryptedFileStore) Delete() error {
+	return deleteFile(e.Path)
+}
+
+// Migrate moves a token from one store to another. If the stores share a path the
+// token is rewritten in place. Migrating a store with no saved token does nothing and
+// returns false.
+func Migrate(from, to Store) (bool, error) {
+	var record json.RawMessage
+	err := from.Load(&record)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not load token: %w", err)
+	}
+	if err := to.Save(record); err != nil {
+		return false, fmt.Errorf("could not save token: %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,155 @@
+package tokenstore
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type testToken struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func TestNew(t *testing.T) {
+
+	tests := []struct {
+		kind       string
+		passphrase string
+		want       Store
+		isErr      bool
+	}{
+		{kind: "", want: &FileStore{Path: "t.json"}},
+		{kind: "file", want: &FileStore{Path: "t.json"}},
+		{kind: "encrypted", passphrase: "pw", want: &EncryptedFileStore{Path: "t.json", Passphrase: "pw"}},
+		{kind: "encrypted", isErr: true}, // no passphrase
+		{kind: "keychain", isErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			got, err := New(tt.kind, "t.json", tt.passphrase)
+			if (err != nil) != tt.isErr {
+				t.Fatalf("got error %v, wanted error %t", err, tt.isErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("store mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestStores(t *testing.T) {
+
+	dir := t.TempDir()
+	stores := []Store{
+		&FileStore{Path: filepath.Join(dir, "plain.json")},
+		&EncryptedFileStore{Path: filepath.Join(dir, "encrypted.json"), Passphrase: "correct horse"},
+	}
+	tok := testToken{AccessToken: "access", RefreshToken: "refresh-secret"}
+
+	for _, store := range stores {
+		var got testToken
+		if err := store.Load(&got); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%T: expected fs.ErrNotExist before saving, got %v", store, err)
+		}
+		if err := store.Save(tok); err != nil {
+			t.Fatalf("%T: save error: %v", store, err)
+		}
+		if err := store.Load(&got); err != nil {
+			t.Fatalf("%T: load error: %v", store, err)
+		}
+		if diff := cmp.Diff(tok, got); diff != "" {
+			t.Errorf("%T: token mismatch (-want +got):\n%s", store, diff)
+		}
+		if err := store.Delete(); err != nil {
+			t.Fatalf("%T: delete error: %v", store, err)
+		}
+		if err := store.Delete(); err != nil {
+			t.Errorf("%T: deleting a missing token should succeed, got %v", store, err)
+		}
+	}
+}
+
+func TestEncryptedFileStore(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "token.json")
+	store := &EncryptedFileStore{Path: path, Passphrase: "correct horse"}
+	if err := store.Save(testToken{RefreshToken: "refresh-secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "refresh-secret") {
+		t.Error("token saved in plain text")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.Mode().Perm(), os.FileMode(0600); got != want {
+		t.Errorf("got permissions %v want %v", got, want)
+	}
+
+	// A wrong passphrase is refused.
+	var tok testToken
+	wrong := &EncryptedFileStore{Path: path, Passphrase: "battery staple"}
+	if err := wrong.Load(&tok); err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Errorf("expected a wrong passphrase error, got %v", err)
+	}
+
+	// The plain store refuses to read an encrypted file, and the encrypted store a
+	// plain one.
+	if err := (&FileStore{Path: path}).Load(&tok); err == nil {
+		t.Error("expected an error reading an encrypted file with the plain store")
+	}
+	plainPath := filepath.Join(t.TempDir(), "plain.json")
+	if err := (&FileStore{Path: plainPath}).Save(testToken{}); err != nil {
+		t.Fatal(err)
+	}
+	plain := &EncryptedFileStore{Path: plainPath, Passphrase: "correct horse"}
+	if err := plain.Load(&tok); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("expected ErrNotEncrypted, got %v", err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "token.json")
+	plain := &FileStore{Path: path}
+	encrypted := &EncryptedFileStore{Path: path, Passphrase: "correct horse"}
+
+	// Nothing to migrate.
+	if ok, err := Migrate(plain, encrypted); ok || err != nil {
+		t.Fatalf("got %t %v migrating a missing token", ok, err)
+	}
+
+	tok := testToken{AccessToken: "access", RefreshToken: "refresh"}
+	if err := plain.Save(tok); err != nil {
+		t.Fatal(err)
+	}
+
+	// Migrate to the encrypted store, and back, in place.
+	for _, stores := range [][2]Store{{plain, encrypted}, {encrypted, plain}} {
+		from, to := stores[0], stores[1]
+		ok, err := Migrate(from, to)
+		if !ok || err != nil {
+			t.Fatalf("%T to %T: got %t %v", from, to, ok, err)
+		}
+		var got testToken
+		if err := to.Load(&got); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(tok, got); diff != "" {
+			t.Errorf("token mismatch (-want +got):\n%s", diff)
+		}
+	}
+}
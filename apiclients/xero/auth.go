@@ -3,51 +3,211 @@ package xero
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
+	"reconciler/apiclients/tokenstore"
 	"reconciler/config"
+	"reconciler/internal"
 
 	"golang.org/x/oauth2"
 )
 
 var connectionsURL = "https://api.xero.com/connections"
 
-// NewClient handles the OAuth2 flow to return an authenticated http.Client.
+// revocationURL is the Xero endpoint for revoking refresh tokens.
+var revocationURL = "https://identity.xero.com/connect/revocation"
+
+// revocationTimeout is the longest a token revocation request may take, so that
+// disconnecting is not held up by an unresponsive endpoint.
+const revocationTimeout = 30 * time.Second
+
+// ConnectionStatus describes the saved Xero connection. TenantName is the name of the
+// default organisation, and is empty if more than one organisation is connected and
+// none is configured.
+type ConnectionStatus struct {
+	Connected   bool
+	TenantName  string
+	Connections []Connection // the connected organisations
+	Expiry      time.Time    // the expiry of the current access token
+}
+
+// NewClient handles the OAuth2 flow to return an authenticated http.Client for the
+// default Xero organisation, as selected by SelectTenant.
 // It attempts to use a saved token first and will refresh it if necessary.
 // If no token exists, it will fail, requiring the user to run the `login` command.
 func NewClient(ctx context.Context, cfg *config.Config) (*APIClient, error) {
-	tok, err := loadTokenFromFile(cfg.Xero.TokenFilePath)
+	return NewClientForTenant(ctx, cfg, "")
+}
+
+// NewClientForTenant returns an authenticated client for the Xero organisation with
+// the provided tenant id or name. An empty tenant selects the default organisation.
+func NewClientForTenant(ctx context.Context, cfg *config.Config, tenant string) (*APIClient, error) {
+	oauthClient, _, err := newTokenClient(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	connections, err := getConnections(ctx, oauthClient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine tenant ID: %w", err)
+	}
+	connection, err := SelectTenant(connections, cfg, tenant)
 	if err != nil {
-		return nil, fmt.Errorf("no token file found at '%s'. Please run 'reconciler login xero' first", cfg.Xero.TokenFilePath)
+		return nil, err
 	}
 
-	tokenSource := cfg.Xero.OAuth2Config.TokenSource(ctx, tok)
+	client := NewAPIClient(connection.TenantID, oauthClient)
+	client.SetFilters(cfg.Xero)
+	return client, nil
+}
 
-	// Check if the token was refreshed saving the new one if it was.
-	refreshedToken, err := tokenSource.Token()
+// Connections returns the Xero organisations (tenants) connected to the saved token.
+func Connections(ctx context.Context, cfg *config.Config) ([]Connection, error) {
+	oauthClient, _, err := newTokenClient(ctx, cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to refresh token: %w", err)
+		return nil, err
 	}
+	return getConnections(ctx, oauthClient)
+}
 
-	if refreshedToken.AccessToken != tok.AccessToken {
-		log.Println("Access token was refreshed. Saving new token.")
-		if err := saveTokenToFile(refreshedToken, cfg.Xero.TokenFilePath); err != nil {
-			return nil, fmt.Errorf("failed to save refreshed token: %w", err)
+// SelectTenant returns the connection for the tenant, which may be a tenant id or
+// name. An empty tenant selects the organisation set by xero.tenant_id or
+// xero.tenant_name in the configuration or, if neither is set, the only connected
+// organisation. An error is returned rather than guessing between several
+// organisations.
+func SelectTenant(connections []Connection, cfg *config.Config, tenant string) (Connection, error) {
+	if len(connections) == 0 {
+		return Connection{}, fmt.Errorf("no tenants found for this connection")
+	}
+
+	var want string
+	switch {
+	case tenant != "":
+		want = tenant
+	case cfg.Xero.TenantID != "":
+		want = cfg.Xero.TenantID
+	case cfg.Xero.TenantName != "":
+		want = cfg.Xero.TenantName
+	case len(connections) == 1:
+		return connections[0], nil
+	default:
+		return Connection{}, fmt.Errorf(
+			"%d Xero organisations are connected (%s); set xero.tenant_id or xero.tenant_name to choose one",
+			len(connections), tenantNames(connections),
+		)
+	}
+
+	for _, c := range connections {
+		if c.TenantID == want || strings.EqualFold(c.TenantName, want) {
+			return c, nil
 		}
 	}
+	return Connection{}, fmt.Errorf("organisation %q is not connected to Xero; connected organisations are %s", want, tenantNames(connections))
+}
+
+// tenantNames returns the quoted names of the connected organisations.
+func tenantNames(connections []Connection) string {
+	names := make([]string, len(connections))
+	for i, c := range connections {
+		names[i] = fmt.Sprintf("%q", c.TenantName)
+	}
+	return strings.Join(names, ", ")
+}
+
+// newTokenClient returns an http.Client authenticated with the saved token. The token
+// is refreshed if it has expired, and saved each time it is refreshed during the life
+// of the client. The current token is also returned.
+//
+// Clients are held for the life of the syncer and made for each web request, so the
+// saved token is reloaded before each refresh, in case another client has refreshed
+// it since it was loaded.
+func newTokenClient(ctx context.Context, cfg *config.Config) (*http.Client, *oauth2.Token, error) {
+	store, err := TokenStore(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	tok, err := loadToken(store)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, fmt.Errorf("no token file found at '%s'. Please run 'reconciler login xero' first", cfg.Xero.TokenFilePath)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load token: %w", err)
+	}
 
-	oauthClient := oauth2.NewClient(ctx, tokenSource)
+	// Every refreshed token is saved, as Xero rotates the refresh token on each
+	// refresh and the previous one soon stops working.
+	tokenSource := tokenstore.NewReloadingTokenSource(
+		func(t *oauth2.Token) oauth2.TokenSource { return cfg.Xero.OAuth2Config.TokenSource(ctx, t) },
+		tok,
+		func() (*oauth2.Token, error) { return loadToken(store) },
+		func(t *oauth2.Token) error { return saveToken(store, t) },
+	)
 
-	tenantID, err := getTenantID(ctx, oauthClient)
+	refreshedToken, err := tokenSource.Token()
 	if err != nil {
-		return nil, fmt.Errorf("failed to determine tenant ID: %w", err)
+		return nil, nil, fmt.Errorf("failed to refresh token: %w", err)
+	}
+
+	return oauth2.NewClient(ctx, tokenSource), refreshedToken, nil
+}
+
+// Status reports the status of the saved Xero connection, including the connected
+// organisations. A missing token is reported as not connected rather than as an
+// error.
+func Status(ctx context.Context, cfg *config.Config) (ConnectionStatus, error) {
+	if _, err := os.Stat(cfg.Xero.TokenFilePath); errors.Is(err, fs.ErrNotExist) {
+		return ConnectionStatus{}, nil
 	}
 
-	return NewAPIClient(tenantID, oauthClient), nil
+	oauthClient, tok, err := newTokenClient(ctx, cfg)
+	if err != nil {
+		return ConnectionStatus{}, err
+	}
+	connections, err := getConnections(ctx, oauthClient)
+	if err != nil {
+		return ConnectionStatus{}, err
+	}
+	if len(connections) == 0 {
+		return ConnectionStatus{}, fmt.Errorf("no tenants found for this connection")
+	}
+	status := ConnectionStatus{
+		Connected:   true,
+		Connections: connections,
+		Expiry:      tok.Expiry,
+	}
+	if c, err := SelectTenant(connections, cfg, ""); err == nil {
+		status.TenantName = c.TenantName
+	}
+	return status, nil
+}
+
+// AuthCodeURL returns the Xero url at which the user authorizes this application. The
+// state is returned to the callback url with the authorization code. The PKCE verifier
+// should be generated with oauth2.GenerateVerifier and provided again to Exchange.
+func AuthCodeURL(cfg *config.Config, state, verifier string) string {
+	return cfg.Xero.OAuth2Config.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier))
+}
+
+// Exchange exchanges an authorization code received at the callback url for a token,
+// and saves the token.
+func Exchange(ctx context.Context, cfg *config.Config, code, verifier string) error {
+	tok, err := cfg.Xero.OAuth2Config.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return fmt.Errorf("failed to exchange authorization code for token: %w", err)
+	}
+	if err := saveNewToken(cfg, tok); err != nil {
+		return fmt.Errorf("failed to save new token: %w", err)
+	}
+	return nil
 }
 
 // InitiateLogin starts the interactive OAuth2 flow to get a new token from the web.
@@ -57,7 +217,7 @@ func InitiateLogin(ctx context.Context, cfg *config.Config) error {
 	if err != nil {
 		return fmt.Errorf("failed to get new token: %w", err)
 	}
-	if err := saveTokenToFile(tok, cfg.Xero.TokenFilePath); err != nil {
+	if err := saveNewToken(cfg, tok); err != nil {
 		return fmt.Errorf("failed to save new token: %w", err)
 	}
 	log.Println("Login successful. Token saved.")
@@ -65,20 +225,33 @@ func InitiateLogin(ctx context.Context, cfg *config.Config) error {
 }
 
 // getNewTokenFromWeb starts a temporary web server to handle the OAuth2 callback.
+// It uses a random state, checked in the callback, and the PKCE extension.
 func getNewTokenFromWeb(ctx context.Context, cfg *config.Config) (*oauth2.Token, error) {
-	codeChan := make(chan string)
-	errChan := make(chan error)
-	server := &http.Server{Addr: cfg.Web.ListenAddress}
+	state, err := internal.NewOAuthState()
+	if err != nil {
+		return nil, err
+	}
+	verifier := oauth2.GenerateVerifier()
 
-	http.HandleFunc(cfg.Web.XeroCallBack, func(w http.ResponseWriter, r *http.Request) {
+	codeChan := make(chan string, 1)
+	errChan := make(chan error, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(cfg.Web.XeroCallBack, func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("state"); got != state {
+			http.Error(w, "Invalid authorization state.", http.StatusBadRequest)
+			return
+		}
 		code := r.URL.Query().Get("code")
 		if code == "" {
+			http.Error(w, "No authorization code received.", http.StatusBadRequest)
 			errChan <- fmt.Errorf("did not receive authorization code in callback")
 			return
 		}
 		fmt.Fprintln(w, "Authorization successful! You can close this window.")
 		codeChan <- code
 	})
+	server := &http.Server{Addr: cfg.Web.ListenAddress, Handler: mux}
 
 	go func() {
 		if err := server.ListenAndServe(); err != http.ErrServerClosed {
@@ -86,7 +259,7 @@ func getNewTokenFromWeb(ctx context.Context, cfg *config.Config) (*oauth2.Token,
 		}
 	}()
 
-	authURL := cfg.Xero.OAuth2Config.AuthCodeURL("state-string", oauth2.AccessTypeOffline)
+	authURL := AuthCodeURL(cfg, state, verifier)
 	fmt.Printf("\nPlease open this URL in your browser to authorize the application:\n%s\n\n", authURL)
 
 	var authCode string
@@ -103,7 +276,7 @@ func getNewTokenFromWeb(ctx context.Context, cfg *config.Config) (*oauth2.Token,
 		log.Printf("Failed to shut down server gracefully: %v", err)
 	}
 
-	tok, err := cfg.Xero.OAuth2Config.Exchange(ctx, authCode)
+	tok, err := cfg.Xero.OAuth2Config.Exchange(ctx, authCode, oauth2.VerifierOption(verifier))
 	if err != nil {
 		return nil, fmt.Errorf("failed to exchange authorization code for token: %w", err)
 	}
@@ -111,27 +284,33 @@ func getNewTokenFromWeb(ctx context.Context, cfg *config.Config) (*oauth2.Token,
 	return tok, nil
 }
 
-// loadTokenFromFile reads an OAuth2 token from a JSON file.
-func loadTokenFromFile(path string) (*oauth2.Token, error) {
-	f, err := os.Open(path)
+// TokenStore returns the configured store for the Xero token.
+func TokenStore(cfg *config.Config) (tokenstore.Store, error) {
+	return tokenstore.New(cfg.TokenStore, cfg.Xero.TokenFilePath, cfg.TokenPassphrase)
+}
+
+// saveNewToken saves a newly issued token to the configured store.
+func saveNewToken(cfg *config.Config, tok *oauth2.Token) error {
+	store, err := TokenStore(cfg)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer f.Close()
-	tok := &oauth2.Token{}
-	err = json.NewDecoder(f).Decode(tok)
-	return tok, err
+	return saveToken(store, tok)
 }
 
-// saveTokenToFile writes an OAuth2 token to a JSON file with secure permissions.
-func saveTokenToFile(token *oauth2.Token, path string) error {
-	log.Printf("Saving token to %s", path)
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		return fmt.Errorf("unable to cache oauth token: %w", err)
+// loadToken reads an OAuth2 token from the store.
+func loadToken(store tokenstore.Store) (*oauth2.Token, error) {
+	tok := &oauth2.Token{}
+	if err := store.Load(tok); err != nil {
+		return nil, err
 	}
-	defer f.Close()
-	return json.NewEncoder(f).Encode(token)
+	return tok, nil
+}
+
+// saveToken writes an OAuth2 token to the store.
+func saveToken(store tokenstore.Store, tok *oauth2.Token) error {
+	log.Println("Saving Xero token")
+	return store.Save(tok)
 }
 
 // DeleteToken removes the token file from disk.
@@ -142,31 +321,89 @@ func DeleteToken(path string) error {
 	return nil
 }
 
-// getTenantID fetches the list of connections and returns the first TenantID found.
-func getTenantID(ctx context.Context, client *http.Client) (string, error) {
+// RevokeAndDeleteToken revokes the saved refresh token with Xero, which also removes
+// the application's connection to the Xero organisation, and then removes the token
+// file. The token file is removed even if revocation fails, in which case the
+// revocation error is returned.
+func RevokeAndDeleteToken(ctx context.Context, cfg *config.Config) error {
+	store, err := TokenStore(cfg)
+	if err != nil {
+		return err
+	}
+	tok, err := loadToken(store)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	var revokeErr error
+	if err != nil {
+		revokeErr = fmt.Errorf("could not read token for revocation: %w", err)
+	} else {
+		revokeErr = revokeToken(ctx, cfg, tok)
+	}
+	if err := store.Delete(); err != nil {
+		return err
+	}
+	return revokeErr
+}
+
+// revokeToken revokes the refresh token, or the access token if there is no refresh
+// token.
+func revokeToken(ctx context.Context, cfg *config.Config, tok *oauth2.Token) error {
+	token := tok.RefreshToken
+	if token == "" {
+		token = tok.AccessToken
+	}
+	form := url.Values{"token": {token}}
+	req, err := http.NewRequestWithContext(ctx, "POST", revocationURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create revocation request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(cfg.Xero.OAuth2Config.ClientID, cfg.Xero.OAuth2Config.ClientSecret)
+
+	client := &http.Client{Timeout: revocationTimeout, Transport: contextTransport(ctx)}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("token revocation failed (status %d): %s", resp.StatusCode, body)
+	}
+	return nil
+}
+
+// contextTransport returns the transport of the http client set in the context with
+// the oauth2.HTTPClient key, as used by oauth2.NewClient, or nil for the default.
+func contextTransport(ctx context.Context) http.RoundTripper {
+	if c, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok {
+		return c.Transport
+	}
+	return nil
+}
+
+// getConnections fetches the list of Xero organisations (tenants) connected to the
+// token.
+func getConnections(ctx context.Context, client *http.Client) ([]Connection, error) {
 	req, err := http.NewRequestWithContext(ctx, "GET", connectionsURL, nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to create connections request: %w", err)
+		return nil, fmt.Errorf("failed to create connections request: %w", err)
 	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to get connections: %w", err)
+		return nil, fmt.Errorf("failed to get connections: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("error getting connections (status %d)", resp.StatusCode)
+		return nil, fmt.Errorf("error getting connections (status %d)", resp.StatusCode)
 	}
 
 	var connections []Connection
 	if err := json.NewDecoder(resp.Body).Decode(&connections); err != nil {
-		return "", fmt.Errorf("failed to decode connections response: %w", err)
-	}
-
-	if len(connections) == 0 {
-		return "", fmt.Errorf("no tenants found for this connection")
+		return nil, fmt.Errorf("failed to decode connections response: %w", err)
 	}
-
-	return connections[0].TenantID, nil
+	return connections, nil
 }
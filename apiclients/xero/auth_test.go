@@ -8,9 +8,11 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"reconciler/apiclients/tokenstore"
 	"reconciler/config"
 
 	"golang.org/x/oauth2"
@@ -221,3 +223,274 @@ func TestToken_RefreshExpiredToken(t *testing.T) {
 	}
 
 }
+
+// TestExchangeAndStatus tests exchanging an authorization code for a token, and the
+// reported connection status before and after.
+func TestExchangeAndStatus(t *testing.T) {
+	const tenantName = "Test Charity"
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	origURL := connectionsURL
+	connectionsURL = server.URL + "/connections"
+	t.Cleanup(func() {
+		connectionsURL = origURL
+	})
+
+	mux.HandleFunc("/connections", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `[{"tenantId": "tenant-abc-123", "tenantName": "%s"}]`, tenantName)
+	})
+	verifier := oauth2.GenerateVerifier()
+	mux.HandleFunc("/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.FormValue("code"), "auth-code-1"; got != want {
+			t.Errorf("got code %q want %q", got, want)
+		}
+		if got, want := r.FormValue("code_verifier"), verifier; got != want {
+			t.Errorf("got code verifier %q want %q", got, want)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token": "new-token", "token_type": "Bearer", "refresh_token": "refresh", "expires_in": 1800}`)
+	})
+
+	tokenPath := filepath.Join(t.TempDir(), "token.json")
+	cfg := &config.Config{
+		Xero: config.XeroConfig{
+			TokenFilePath: tokenPath,
+			OAuth2Config: &oauth2.Config{
+				Endpoint: oauth2.Endpoint{
+					AuthURL:  server.URL + "/oauth/authorize",
+					TokenURL: server.URL + "/oauth/token",
+				},
+			},
+		},
+	}
+	ctx := context.Background()
+
+	status, err := Status(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Connected {
+		t.Error("expected not to be connected without a token")
+	}
+
+	authURL := AuthCodeURL(cfg, "state-123", verifier)
+	if !strings.Contains(authURL, "state=state-123") || !strings.Contains(authURL, "code_challenge=") {
+		t.Errorf("auth url missing state or code challenge: %s", authURL)
+	}
+
+	if err := Exchange(ctx, cfg, "auth-code-1", verifier); err != nil {
+		t.Fatalf("exchange error: %v", err)
+	}
+
+	status, err = Status(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Connected {
+		t.Error("expected to be connected after exchange")
+	}
+	if got, want := status.TenantName, tenantName; got != want {
+		t.Errorf("got tenant name %q want %q", got, want)
+	}
+	if status.Expiry.Before(time.Now()) {
+		t.Errorf("expected a future token expiry, got %s", status.Expiry)
+	}
+}
+
+// countingTransport is an http.RoundTripper counting the requests it makes.
+type countingTransport struct {
+	requests int
+}
+
+func (c *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	c.requests++
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// TestRevokeAndDeleteToken tests that the refresh token is revoked and the token file
+// removed, even when revocation fails, using the http client in the context.
+func TestRevokeAndDeleteToken(t *testing.T) {
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	origURL := revocationURL
+	revocationURL = server.URL + "/connect/revocation"
+	t.Cleanup(func() {
+		revocationURL = origURL
+	})
+
+	var revoked string
+	mux.HandleFunc("/connect/revocation", func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "client-id" || pass != "client-secret" {
+			t.Errorf("got basic auth %q %q", user, pass)
+		}
+		revoked = r.FormValue("token")
+		if revoked == "bad-refresh-token" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		}
+	})
+
+	tokenPath := filepath.Join(t.TempDir(), "token.json")
+	cfg := &config.Config{
+		Xero: config.XeroConfig{
+			TokenFilePath: tokenPath,
+			OAuth2Config: &oauth2.Config{
+				ClientID:     "client-id",
+				ClientSecret: "client-secret",
+			},
+		},
+	}
+	transport := &countingTransport{}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: transport})
+
+	// A missing token is not an error.
+	if err := RevokeAndDeleteToken(ctx, cfg); err != nil {
+		t.Fatalf("unexpected error for a missing token: %v", err)
+	}
+
+	for _, refreshToken := range []string{"refresh-token", "bad-refresh-token"} {
+		tok := &oauth2.Token{AccessToken: "access-token", RefreshToken: refreshToken}
+		if err := saveTokenToFile(tok, tokenPath); err != nil {
+			t.Fatal(err)
+		}
+		err := RevokeAndDeleteToken(ctx, cfg)
+		if got, want := err != nil, refreshToken == "bad-refresh-token"; got != want {
+			t.Errorf("%s: got error %v", refreshToken, err)
+		}
+		if got, want := revoked, refreshToken; got != want {
+			t.Errorf("got revoked token %q want %q", got, want)
+		}
+		if _, err := os.Stat(tokenPath); !os.IsNotExist(err) {
+			t.Errorf("%s: token file still exists after revocation", refreshToken)
+		}
+	}
+	if got, want := transport.requests, 2; got != want {
+		t.Errorf("got %d requests through the context client want %d", got, want)
+	}
+}
+
+// loadTokenFromFile reads an OAuth2 token from a plain JSON file.
+func loadTokenFromFile(path string) (*oauth2.Token, error) {
+	return loadToken(&tokenstore.FileStore{Path: path})
+}
+
+// saveTokenToFile writes an OAuth2 token to a plain JSON file with secure permissions.
+func saveTokenToFile(token *oauth2.Token, path string) error {
+	return saveToken(&tokenstore.FileStore{Path: path}, token)
+}
+
+// TestRefreshedTokenPersisted tests that a token refreshed after the client has been
+// created, including its rotated refresh token, is saved.
+func TestRefreshedTokenPersisted(t *testing.T) {
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.Header.Get("Authorization"), "Bearer access-2"; got != want {
+			t.Errorf("got Authorization %q want %q", got, want)
+		}
+	})
+	mux.HandleFunc("/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.FormValue("refresh_token"), "refresh-1"; got != want {
+			t.Errorf("got refresh_token %q want %q", got, want)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(oauth2.Token{
+			AccessToken:  "access-2",
+			RefreshToken: "refresh-2", // Xero rotates refresh tokens
+			Expiry:       time.Now().Add(time.Hour),
+		})
+	})
+
+	// The token is valid when the client is created, but expires shortly afterwards.
+	// The oauth2 package treats tokens as expired 10 seconds before their expiry.
+	tokenPath := filepath.Join(t.TempDir(), "token.json")
+	tok := &oauth2.Token{
+		AccessToken:  "access-1",
+		RefreshToken: "refresh-1",
+		Expiry:       time.Now().Add(10*time.Second + 500*time.Millisecond),
+	}
+	if err := saveTokenToFile(tok, tokenPath); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		Xero: config.XeroConfig{
+			TokenFilePath: tokenPath,
+			OAuth2Config: &oauth2.Config{
+				Endpoint: oauth2.Endpoint{TokenURL: server.URL + "/oauth/token"},
+			},
+		},
+	}
+
+	client, current, err := newTokenClient(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := current.AccessToken, "access-1"; got != want {
+		t.Fatalf("got access token %q want %q", got, want)
+	}
+
+	time.Sleep(600 * time.Millisecond)
+	resp, err := client.Get(server.URL + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	saved, err := loadTokenFromFile(tokenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := saved.RefreshToken, "refresh-2"; got != want {
+		t.Errorf("got saved refresh token %q want %q", got, want)
+	}
+	if got, want := saved.AccessToken, "access-2"; got != want {
+		t.Errorf("got saved access token %q want %q", got, want)
+	}
+}
+
+func TestSelectTenant(t *testing.T) {
+
+	connections := []Connection{
+		{TenantID: "tenant-a", TenantName: "Charity A"},
+		{TenantID: "tenant-b", TenantName: "Charity B"},
+	}
+
+	tests := []struct {
+		name        string
+		connections []Connection
+		xeroConfig  config.XeroConfig
+		tenant      string
+		want        string
+		isErr       bool
+	}{
+		{name: "only connection", connections: connections[:1], want: "tenant-a"},
+		{name: "ambiguous", connections: connections, isErr: true},
+		{name: "no connections", isErr: true},
+		{name: "configured id", connections: connections, xeroConfig: config.XeroConfig{TenantID: "tenant-b"}, want: "tenant-b"},
+		{name: "configured name", connections: connections, xeroConfig: config.XeroConfig{TenantName: "charity b"}, want: "tenant-b"},
+		{name: "configured but not connected", connections: connections[:1], xeroConfig: config.XeroConfig{TenantID: "tenant-b"}, isErr: true},
+		{name: "override by name", connections: connections, xeroConfig: config.XeroConfig{TenantID: "tenant-b"}, tenant: "Charity A", want: "tenant-a"},
+		{name: "override unknown", connections: connections, tenant: "Charity C", isErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{Xero: tt.xeroConfig}
+			got, err := SelectTenant(tt.connections, cfg, tt.tenant)
+			if (err != nil) != tt.isErr {
+				t.Fatalf("got error %v, wanted error %t", err, tt.isErr)
+			}
+			if got, want := got.TenantID, tt.want; got != want {
+				t.Errorf("got tenant %q want %q", got, want)
+			}
+		})
+	}
+}
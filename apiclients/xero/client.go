@@ -7,52 +7,103 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
-	"strings"
+	"slices"
+	"sync"
 	"time"
+
+	"reconciler/config"
 )
 
 const baseURL = "https://api.xero.com/api.xro/2.0"
 
-// APIClient is a wrapper for making authenticated calls to the Xero API.
+// APIClient is a wrapper for making authenticated calls to the Xero API. Rate limited
+// and failed requests are retried as set out in ratelimit.go.
 type APIClient struct {
 	httpClient *http.Client
 	tenantID   string
 	baseURL    string
+	retry      retryPolicy
+	sleep      func(ctx context.Context, d time.Duration) error
+
+	// the types and statuses of the records to fetch
+	invoices         config.XeroFilterConfig
+	bankTransactions config.XeroFilterConfig
+
+	mu    sync.Mutex
+	stats Stats
+}
+
+// TenantID returns the id of the Xero organisation (tenant) used by the client.
+func (c *APIClient) TenantID() string {
+	return c.tenantID
 }
 
-// NewAPIClient creates a new Xero API client. If not httpClient is
-// provided http.DefaultClient is used.
+// NewAPIClient creates a new Xero API client fetching the default types and statuses
+// of records. If not httpClient is provided http.DefaultClient is used.
 func NewAPIClient(tenantID string, httpClient *http.Client) *APIClient {
 	if httpClient == nil {
 		httpClient = http.DefaultClient
 	}
 	return &APIClient{
-		httpClient: httpClient,
-		tenantID:   tenantID,
-		baseURL:    baseURL,
+		httpClient:       httpClient,
+		tenantID:         tenantID,
+		baseURL:          baseURL,
+		retry:            defaultRetryPolicy,
+		sleep:            sleep,
+		invoices:         config.DefaultXeroInvoices,
+		bankTransactions: config.DefaultXeroBankTransactions,
+		stats:            Stats{MinuteRemaining: -1, DayRemaining: -1},
+	}
+}
+
+// SetFilters sets the types and statuses of the invoices and bank transactions
+// fetched by the client, as set out in the configuration. Those not set keep the
+// defaults.
+func (c *APIClient) SetFilters(cfg config.XeroConfig) {
+	set := func(dst *config.XeroFilterConfig, src config.XeroFilterConfig) {
+		if len(src.Types) > 0 {
+			dst.Types = src.Types
+		}
+		if len(src.Statuses) > 0 {
+			dst.Statuses = src.Statuses
+		}
 	}
+	set(&c.invoices, cfg.Invoices)
+	set(&c.bankTransactions, cfg.BankTransactions)
 }
 
-// GetBankTransactions fetches bank transactions from Xero, applying appropriate filters.
-func (c *APIClient) GetBankTransactions(ctx context.Context, fromDate, ifModifiedSince time.Time) ([]BankTransaction, error) {
+// withRemoved returns the statuses together with the removed statuses if
+// ifModifiedSince is set. Incremental fetches include the records deleted or voided
+// since the last sync, whatever the configured statuses, so that they can be removed
+// or updated locally.
+func withRemoved(statuses []string, ifModifiedSince time.Time, removed ...string) []string {
+	if ifModifiedSince.IsZero() {
+		return statuses
+	}
+	all := slices.Clone(statuses)
+	for _, s := range removed {
+		if !slices.Contains(all, s) {
+			all = append(all, s)
+		}
+	}
+	return all
+}
+
+// GetBankTransactions fetches bank transactions from Xero of the client's types and
+// statuses. Transactions dated from fromDate up to and including toDate are returned,
+// together with those deleted since ifModifiedSince, if set.
+func (c *APIClient) GetBankTransactions(ctx context.Context, fromDate, toDate, ifModifiedSince time.Time) ([]BankTransaction, error) {
 	var allTransactions []BankTransaction
 	page := 1
 
+	filter := Filter{}.
+		In("Type", c.bankTransactions.Types...).
+		In("Status", withRemoved(c.bankTransactions.Statuses, ifModifiedSince, "DELETED")...).
+		DateRange("Date", fromDate, toDate).
+		OrderBy("Date", false)
+
 	for {
-		// Build the 'where' clause for the query.
-		var conditions []string
-		conditions = append(conditions, `Type=="RECEIVE"`, `(Status=="AUTHORISED" OR Status=="PAID")`)
-		toDate := fromDate.AddDate(1, 0, 0) // One year from the start date
-		conditions = append(conditions, fmt.Sprintf(`Date >= DateTime(%d, %d, %d)`, fromDate.Year(), fromDate.Month(), fromDate.Day()))
-		conditions = append(conditions, fmt.Sprintf(`Date < DateTime(%d, %d, %d)`, toDate.Year(), toDate.Month(), toDate.Day()))
-		whereClause := strings.Join(conditions, " AND ")
-
-		// Prepare the request URL with query parameters.
-		params := url.Values{}
-		params.Add("where", whereClause)
-		params.Add("page", fmt.Sprintf("%d", page))
-		requestURL := fmt.Sprintf("%s/BankTransactions?%s", c.baseURL, params.Encode())
+		requestURL := fmt.Sprintf("%s/BankTransactions?%s", c.baseURL, filter.Values(page).Encode())
 
 		req, err := c.newRequest(ctx, "GET", requestURL, ifModifiedSince, nil)
 		if err != nil {
@@ -81,23 +132,21 @@ func (c *APIClient) GetBankTransactions(ctx context.Context, fromDate, ifModifie
 	return allTransactions, nil
 }
 
-// GetInvoices fetches invoices from Xero, applying appropriate filters.
-func (c *APIClient) GetInvoices(ctx context.Context, fromDate, ifModifiedSince time.Time) ([]Invoice, error) {
+// GetInvoices fetches invoices from Xero of the client's types and statuses. Invoices
+// dated from fromDate up to and including toDate are returned, together with those
+// deleted or voided since ifModifiedSince, if set.
+func (c *APIClient) GetInvoices(ctx context.Context, fromDate, toDate, ifModifiedSince time.Time) ([]Invoice, error) {
 	var allInvoices []Invoice
 	page := 1
 
+	filter := Filter{}.
+		In("Type", c.invoices.Types...).
+		In("Status", withRemoved(c.invoices.Statuses, ifModifiedSince, "DELETED", "VOIDED")...).
+		DateRange("Date", fromDate, toDate).
+		OrderBy("Date", false)
+
 	for {
-		var conditions []string
-		conditions = append(conditions, `Type=="ACCREC"`, `(Status=="AUTHORISED" OR Status=="PAID" OR Status=="VOIDED")`)
-		toDate := fromDate.AddDate(1, 0, 0)
-		conditions = append(conditions, fmt.Sprintf(`Date >= DateTime(%d, %d, %d)`, fromDate.Year(), fromDate.Month(), fromDate.Day()))
-		conditions = append(conditions, fmt.Sprintf(`Date < DateTime(%d, %d, %d)`, toDate.Year(), toDate.Month(), toDate.Day()))
-		whereClause := strings.Join(conditions, " AND ")
-
-		params := url.Values{}
-		params.Add("where", whereClause)
-		params.Add("page", fmt.Sprintf("%d", page))
-		requestURL := fmt.Sprintf("%s/Invoices?%s", c.baseURL, params.Encode())
+		requestURL := fmt.Sprintf("%s/Invoices?%s", c.baseURL, filter.Values(page).Encode())
 
 		req, err := c.newRequest(ctx, "GET", requestURL, ifModifiedSince, nil)
 		if err != nil {
@@ -124,6 +173,88 @@ func (c *APIClient) GetInvoices(ctx context.Context, fromDate, ifModifiedSince t
 	return allInvoices, nil
 }
 
+// GetCreditNotes fetches the credit notes raised against sales invoices, such as
+// donation refunds, from Xero. Credit notes dated from fromDate up to and including
+// toDate are returned, including voided credit notes so that their removal is
+// recorded.
+func (c *APIClient) GetCreditNotes(ctx context.Context, fromDate, toDate, ifModifiedSince time.Time) ([]CreditNote, error) {
+	var allCreditNotes []CreditNote
+	page := 1
+
+	filter := Filter{}.
+		Equal("Type", "ACCRECCREDIT").
+		In("Status", "AUTHORISED", "PAID", "VOIDED").
+		DateRange("Date", fromDate, toDate).
+		OrderBy("Date", false)
+
+	for {
+		requestURL := fmt.Sprintf("%s/CreditNotes?%s", c.baseURL, filter.Values(page).Encode())
+
+		req, err := c.newRequest(ctx, "GET", requestURL, ifModifiedSince, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var response CreditNotesResponse
+		resp, err := do(c, req, &response)
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute request for page %d: %w", page, err)
+		}
+
+		if resp.StatusCode == http.StatusNotModified {
+			break
+		}
+		if len(response.CreditNotes) == 0 {
+			break
+		}
+
+		allCreditNotes = append(allCreditNotes, response.CreditNotes...)
+		page++
+	}
+
+	return allCreditNotes, nil
+}
+
+// GetPayments fetches the payments made against sales invoices from Xero. Payments
+// dated from fromDate up to and including toDate are returned, including deleted
+// payments so that their removal is recorded.
+func (c *APIClient) GetPayments(ctx context.Context, fromDate, toDate, ifModifiedSince time.Time) ([]Payment, error) {
+	var allPayments []Payment
+	page := 1
+
+	filter := Filter{}.
+		Equal("PaymentType", "ACCRECPAYMENT").
+		DateRange("Date", fromDate, toDate).
+		OrderBy("Date", false)
+
+	for {
+		requestURL := fmt.Sprintf("%s/Payments?%s", c.baseURL, filter.Values(page).Encode())
+
+		req, err := c.newRequest(ctx, "GET", requestURL, ifModifiedSince, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var response PaymentsResponse
+		resp, err := do(c, req, &response)
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute request for page %d: %w", page, err)
+		}
+
+		if resp.StatusCode == http.StatusNotModified {
+			break
+		}
+		if len(response.Payments) == 0 {
+			break
+		}
+
+		allPayments = append(allPayments, response.Payments...)
+		page++
+	}
+
+	return allPayments, nil
+}
+
 // GetAccounts fetches accounts from Xero, applying appropriate filters.
 // There is no pagination.
 func (c *APIClient) GetAccounts(ctx context.Context, ifModifiedSince time.Time) ([]Account, error) {
@@ -148,6 +279,69 @@ func (c *APIClient) GetAccounts(ctx context.Context, ifModifiedSince time.Time)
 	return response.Accounts, nil
 }
 
+// GetTrackingCategories fetches the tracking categories and their options from Xero,
+// including archived categories and options so that older line items tagged with them
+// can be reported. There is no pagination.
+func (c *APIClient) GetTrackingCategories(ctx context.Context, ifModifiedSince time.Time) ([]TrackingCategory, error) {
+
+	requestURL := fmt.Sprintf("%s/TrackingCategories?includeArchived=true", c.baseURL)
+
+	req, err := c.newRequest(ctx, "GET", requestURL, ifModifiedSince, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var response TrackingCategoriesResponse
+	resp, err := do(c, req, &response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request for tracking categories: %w", err)
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+
+	return response.TrackingCategories, nil
+}
+
+// GetContacts fetches contacts from Xero, including archived contacts so that the
+// names of contacts of older transactions are kept up to date.
+func (c *APIClient) GetContacts(ctx context.Context, ifModifiedSince time.Time) ([]Contact, error) {
+	var allContacts []Contact
+	page := 1
+
+	filter := Filter{}.OrderBy("Name", false)
+
+	for {
+		params := filter.Values(page)
+		params.Set("includeArchived", "true")
+		requestURL := fmt.Sprintf("%s/Contacts?%s", c.baseURL, params.Encode())
+
+		req, err := c.newRequest(ctx, "GET", requestURL, ifModifiedSince, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var response ContactsResponse
+		resp, err := do(c, req, &response)
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute request for page %d: %w", page, err)
+		}
+
+		if resp.StatusCode == http.StatusNotModified {
+			break
+		}
+		if len(response.Contacts) == 0 {
+			break
+		}
+
+		allContacts = append(allContacts, response.Contacts...)
+		page++
+	}
+
+	return allContacts, nil
+}
+
 // GetBankTransactionByID fetches a single bank transaction by its UUID.
 func (c *APIClient) GetBankTransactionByID(ctx context.Context, uuid string) (BankTransaction, error) {
 	requestURL := fmt.Sprintf("%s/BankTransactions/%s", c.baseURL, uuid)
@@ -169,29 +363,118 @@ func (c *APIClient) GetBankTransactionByID(ctx context.Context, uuid string) (Ba
 
 // UpdateBankTransactionReference performs a POST request to update a transaction's reference.
 // It returns the full, updated transaction object from the Xero API response.
-func (c *APIClient) UpdateBankTransactionReference(ctx context.Context, tx BankTransaction, reference string) (BankTransaction, error) {
-	tx.Reference = reference
-	payload := map[string][]BankTransaction{"BankTransactions": {tx}}
-	body, err := json.Marshal(payload)
+func (c *APIClient) UpdateBankTransactionReference(ctx context.Context, id, reference string) (BankTransaction, error) {
+	updated, err := c.UpdateBankTransactionReferences(ctx, []ReferenceUpdate{{ID: id, Reference: reference}})
 	if err != nil {
-		return BankTransaction{}, fmt.Errorf("failed to marshal update payload: %w", err)
+		return BankTransaction{}, err
 	}
+	return updated[0], nil
+}
+
+// UpdateBankTransactionReferences updates the references of several bank transactions
+// in a single POST request. Only the id and reference of each transaction are posted,
+// so that Xero leaves its other fields, such as the line items, unchanged; Xero
+// rejects changes to the line items of a reconciled transaction.
+//
+// The updated transactions are returned in the order provided. Xero updates the valid
+// transactions even if others are rejected; the transactions Xero rejected are
+// reported in a *ValidationError, returned with the updated transactions.
+func (c *APIClient) UpdateBankTransactionReferences(ctx context.Context, updates []ReferenceUpdate) ([]BankTransaction, error) {
+	return updateReferences(ctx, c, "BankTransactions", "BankTransactionID", updates, func(tx BankTransaction) UpdateStatus {
+		return tx.UpdateStatus
+	})
+}
 
-	requestURL := fmt.Sprintf("%s/BankTransactions", c.baseURL)
+// GetInvoiceByID fetches a single invoice by its UUID.
+func (c *APIClient) GetInvoiceByID(ctx context.Context, uuid string) (Invoice, error) {
+	requestURL := fmt.Sprintf("%s/Invoices/%s", c.baseURL, uuid)
+	req, err := c.newRequest(ctx, "GET", requestURL, time.Time{}, nil)
+	if err != nil {
+		return Invoice{}, err
+	}
+
+	var response InvoiceResponse
+	if _, err := do(c, req, &response); err != nil {
+		return Invoice{}, err
+	}
+
+	if len(response.Invoices) == 0 {
+		return Invoice{}, fmt.Errorf("invoice with UUID %s not found", uuid)
+	}
+	return response.Invoices[0], nil
+}
+
+// UpdateInvoiceReference performs a POST request to update an invoice's reference.
+// It returns the full, updated invoice object from the Xero API response.
+func (c *APIClient) UpdateInvoiceReference(ctx context.Context, id, reference string) (Invoice, error) {
+	updated, err := c.UpdateInvoiceReferences(ctx, []ReferenceUpdate{{ID: id, Reference: reference}})
+	if err != nil {
+		return Invoice{}, err
+	}
+	return updated[0], nil
+}
+
+// UpdateInvoiceReferences updates the references of several invoices in a single POST
+// request. As with UpdateBankTransactionReferences, only the id and reference of each
+// invoice are posted, and those rejected by Xero are reported in a *ValidationError.
+func (c *APIClient) UpdateInvoiceReferences(ctx context.Context, updates []ReferenceUpdate) ([]Invoice, error) {
+	return updateReferences(ctx, c, "Invoices", "InvoiceID", updates, func(invoice Invoice) UpdateStatus {
+		return invoice.UpdateStatus
+	})
+}
+
+// updateReferences posts the reference updates to the Xero collection, such as
+// "Invoices", in a single request, returning the records updated. Each record is
+// posted with only its id, under the idField, and its reference. The status func
+// returns the status of the update of a returned record. Records rejected by Xero are
+// reported in a *ValidationError, returned with the updated records.
+func updateReferences[T any](ctx context.Context, c *APIClient, collection, idField string, updates []ReferenceUpdate, status func(T) UpdateStatus) ([]T, error) {
+	if len(updates) == 0 {
+		return nil, nil
+	}
+	records := make([]map[string]string, len(updates))
+	for i, u := range updates {
+		records[i] = map[string]string{idField: u.ID, "Reference": u.Reference}
+	}
+	body, err := json.Marshal(map[string][]map[string]string{collection: records})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal update payload: %w", err)
+	}
+
+	// Report the outcome for each record rather than failing the whole request.
+	requestURL := fmt.Sprintf("%s/%s?summarizeErrors=false", c.baseURL, collection)
 	req, err := c.newRequest(ctx, "POST", requestURL, time.Time{}, body)
 	if err != nil {
-		return BankTransaction{}, err
+		return nil, err
 	}
 
-	var response BankTransactionsResponse
+	// The response has other fields, such as the request status, alongside the
+	// records.
+	var response map[string]json.RawMessage
 	if _, err := do(c, req, &response); err != nil {
-		return BankTransaction{}, err
+		return nil, err
+	}
+	var results []T
+	if err := json.Unmarshal(response[collection], &results); err != nil {
+		return nil, fmt.Errorf("failed to decode %s update response: %w", collection, err)
 	}
 
-	if len(response.BankTransactions) == 0 {
-		return BankTransaction{}, fmt.Errorf("update response did not contain a bank transaction")
+	if got, want := len(results), len(updates); got != want {
+		return nil, fmt.Errorf("update response contained %d %s, expected %d", got, collection, want)
 	}
-	return response.BankTransactions[0], nil
+	var updated []T
+	validationErr := &ValidationError{}
+	for i, result := range results {
+		if s := status(result); s.StatusAttributeString == "ERROR" {
+			validationErr.add(updates[i].ID, s.ValidationErrors)
+			continue
+		}
+		updated = append(updated, result)
+	}
+	if len(validationErr.Records) > 0 {
+		return updated, validationErr
+	}
+	return updated, nil
 }
 
 // newRequest is a helper to create a new HTTP request with common headers.
@@ -221,27 +504,20 @@ func (c *APIClient) newRequest(ctx context.Context, method, url string, ifModifi
 
 // do is a helper to execute an HTTP request and decode the JSON
 // response. A nil `v` is supported for API calls not providing a
-// response, such as DELETE calls.
+// response, such as DELETE calls. Non-2xx responses, other than 304 Not
+// Modified, are returned as an *APIError.
 func do[T any](c *APIClient, req *http.Request, v *T) (*http.Response, error) {
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.send(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute request: %w", err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
+	// Don't treat 304 Not Modified as an error, it's an expected response
 	if resp.StatusCode == http.StatusNotModified {
 		return resp, nil
 	}
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		// Don't treat 304 Not Modified as an error, it's an expected response
-		if resp.StatusCode == http.StatusNotModified {
-			return resp, nil
-		}
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API error (status %d): %s", resp.StatusCode, string(body))
-	}
-
 	if v != nil { // v might be nil for a DELETE request, for example.
 		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
 			return nil, fmt.Errorf("failed to decode response: %w", err)
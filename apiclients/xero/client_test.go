@@ -2,6 +2,8 @@ package xero
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -9,6 +11,10 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"reconciler/config"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 // setup creates a test environment for running API client tests.
@@ -20,6 +26,7 @@ func setup(t *testing.T) (mux *http.ServeMux, client *APIClient, teardown func()
 	server := httptest.NewServer(mux)
 	client = NewAPIClient("fake-tenant-id", server.Client())
 	client.baseURL = server.URL // Override the default base URL.
+	client.sleep = func(ctx context.Context, d time.Duration) error { return nil }
 	teardown = func() {
 		server.Close()
 	}
@@ -121,7 +128,7 @@ func testNoPagination[T any](
 func TestGetInvoices_PaginationAndTermination(t *testing.T) {
 
 	getInvoicesFunc := func(client *APIClient) ([]Invoice, error) {
-		return client.GetInvoices(context.Background(), time.Now(), time.Time{})
+		return client.GetInvoices(context.Background(), time.Now(), time.Now().AddDate(1, 0, 0), time.Time{})
 	}
 
 	invoices, err := testPagination(
@@ -145,7 +152,7 @@ func TestGetInvoices_PaginationAndTermination(t *testing.T) {
 func TestGetBankTransactions_PaginationAndTermination(t *testing.T) {
 
 	getBankTransactionsFunc := func(client *APIClient) ([]BankTransaction, error) {
-		return client.GetBankTransactions(context.Background(), time.Now(), time.Time{})
+		return client.GetBankTransactions(context.Background(), time.Now(), time.Now().AddDate(1, 0, 0), time.Time{})
 	}
 
 	bankTransactions, err := testPagination(
@@ -165,6 +172,101 @@ func TestGetBankTransactions_PaginationAndTermination(t *testing.T) {
 	}
 }
 
+// TestGetPayments_PaginationAndTermination verifies Payments API pagination and
+// termination.
+func TestGetPayments_PaginationAndTermination(t *testing.T) {
+
+	getPaymentsFunc := func(client *APIClient) ([]Payment, error) {
+		return client.GetPayments(context.Background(), time.Now(), time.Now().AddDate(1, 0, 0), time.Time{})
+	}
+
+	payments, err := testPagination(
+		t,
+		"/Payments",        // endpoint
+		"payments.json",    // json file to serve
+		`{"Payments": []}`, // empty response
+		getPaymentsFunc,    // the api function to call
+	)
+	if err != nil {
+		t.Fatalf("testPagination returned an unexpected error: %v", err)
+	}
+
+	if got, want := len(payments), 2; got != want {
+		t.Errorf("expected %d payments, got %d", want, got)
+	}
+}
+
+// TestGetCreditNotes_PaginationAndTermination verifies CreditNotes API pagination and
+// termination.
+func TestGetCreditNotes_PaginationAndTermination(t *testing.T) {
+
+	getCreditNotesFunc := func(client *APIClient) ([]CreditNote, error) {
+		return client.GetCreditNotes(context.Background(), time.Now(), time.Now().AddDate(1, 0, 0), time.Time{})
+	}
+
+	creditNotes, err := testPagination(
+		t,
+		"/CreditNotes",        // endpoint
+		"credit_notes.json",   // json file to serve
+		`{"CreditNotes": []}`, // empty response
+		getCreditNotesFunc,    // the api function to call
+	)
+	if err != nil {
+		t.Fatalf("testPagination returned an unexpected error: %v", err)
+	}
+
+	if got, want := len(creditNotes), 1; got != want {
+		t.Errorf("expected %d credit notes, got %d", want, got)
+	}
+}
+
+// TestGetContacts_PaginationAndTermination verifies Contacts API pagination and
+// termination.
+func TestGetContacts_PaginationAndTermination(t *testing.T) {
+
+	getContactsFunc := func(client *APIClient) ([]Contact, error) {
+		return client.GetContacts(context.Background(), time.Time{})
+	}
+
+	contacts, err := testPagination(
+		t,
+		"/Contacts",        // endpoint
+		"contacts.json",    // json file to serve
+		`{"Contacts": []}`, // empty response
+		getContactsFunc,    // the api function to call
+	)
+	if err != nil {
+		t.Fatalf("testPagination returned an unexpected error: %v", err)
+	}
+
+	if got, want := len(contacts), 2; got != want {
+		t.Errorf("expected %d contacts, got %d", want, got)
+	}
+}
+
+// TestGetTrackingCategories verifies that the TrackingCategories API is not paginated
+// and that archived categories are requested.
+func TestGetTrackingCategories(t *testing.T) {
+
+	getTrackingCategoriesFunc := func(client *APIClient) ([]TrackingCategory, error) {
+		return client.GetTrackingCategories(context.Background(), time.Time{})
+	}
+
+	categories, err := testNoPagination(
+		t,
+		"/TrackingCategories",      // endpoint
+		"tracking_categories.json", // json file to serve
+		getTrackingCategoriesFunc,  // the api function to call
+	)
+	if err != nil {
+		t.Fatalf("testNoPagination returned an unexpected error: %v", err)
+	}
+
+	if got, want := len(categories), 2; got != want {
+		t.Errorf("expected %d tracking categories, got %d", want, got)
+	}
+}
+
 // TestGetAccounts_PaginationAndTermination verifies Accounts  API
 // pagination and termination.
 func TestGetAccounts_PaginationAndTermination(t *testing.T) {
@@ -206,7 +308,7 @@ func TestGetInvoices_NotModified(t *testing.T) {
 
 	// The actual time used here doesn't matter, as long as it's not the zero value.
 	ifModifiedSince := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
-	invoices, err := client.GetInvoices(context.Background(), time.Now(), ifModifiedSince)
+	invoices, err := client.GetInvoices(context.Background(), time.Now(), time.Now().AddDate(1, 0, 0), ifModifiedSince)
 
 	if err != nil {
 		t.Fatalf("GetInvoices returned an unexpected error: %v", err)
@@ -233,7 +335,7 @@ func TestGetInvoices_APIError(t *testing.T) {
 		w.Write([]byte(apiErrorBody))
 	})
 
-	_, err := client.GetInvoices(context.Background(), time.Now(), time.Time{})
+	_, err := client.GetInvoices(context.Background(), time.Now(), time.Now().AddDate(1, 0, 0), time.Time{})
 
 	if err == nil {
 		t.Fatal("expected an error, but got nil")
@@ -246,3 +348,137 @@ func TestGetInvoices_APIError(t *testing.T) {
 		t.Errorf("error message should contain API response body, but was: %q", err.Error())
 	}
 }
+
+// TestGetInvoicesFilter tests that the configured invoice types and statuses are
+// requested.
+func TestGetInvoicesFilter(t *testing.T) {
+
+	mux, client, teardown := setup(t)
+	defer teardown()
+
+	client.SetFilters(config.XeroConfig{
+		Invoices: config.XeroFilterConfig{Statuses: []string{"DRAFT", "AUTHORISED"}},
+	})
+
+	var where string
+	mux.HandleFunc("/Invoices", func(w http.ResponseWriter, r *http.Request) {
+		where = r.URL.Query().Get("where")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"Invoices": []}`))
+	})
+
+	date := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := client.GetInvoices(context.Background(), date, date, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	want := `Type=="ACCREC" AND (Status=="DRAFT" OR Status=="AUTHORISED") AND Date >= DateTime(2025, 4, 1) AND Date < DateTime(2025, 4, 2)`
+	if where != want {
+		t.Errorf("got where %q want %q", where, want)
+	}
+
+	// Incremental fetches include the invoices removed since the last sync.
+	if _, err := client.GetInvoices(context.Background(), date, date, date); err != nil {
+		t.Fatal(err)
+	}
+	want = `Type=="ACCREC" AND (Status=="DRAFT" OR Status=="AUTHORISED" OR Status=="DELETED" OR Status=="VOIDED") AND Date >= DateTime(2025, 4, 1) AND Date < DateTime(2025, 4, 2)`
+	if where != want {
+		t.Errorf("got incremental where %q want %q", where, want)
+	}
+}
+
+// TestUpdateBankTransactionReferences tests that the references of several bank
+// transactions are updated in one request posting only the id and reference of each,
+// with the transactions rejected by Xero reported in a ValidationError.
+func TestUpdateBankTransactionReferences(t *testing.T) {
+
+	mux, client, teardown := setup(t)
+	defer teardown()
+
+	var calls int
+	var posted []map[string]string
+	mux.HandleFunc("/BankTransactions", func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Method != http.MethodPost {
+			t.Errorf("expected method POST, got %s", r.Method)
+		}
+		if got := r.URL.Query().Get("summarizeErrors"); got != "false" {
+			t.Errorf("got summarizeErrors %q want false", got)
+		}
+		var payload struct{ BankTransactions []map[string]string }
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+		posted = payload.BankTransactions
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"BankTransactions": [
+			{"BankTransactionID": "bt-1", "Reference": "payout-1", "StatusAttributeString": "OK"},
+			{"BankTransactionID": "bt-2", "Reference": "payout-2", "StatusAttributeString": "ERROR",
+			 "ValidationErrors": [{"Message": "The transaction has been reconciled"}]}
+		]}`))
+	})
+
+	updated, err := client.UpdateBankTransactionReferences(context.Background(), []ReferenceUpdate{
+		{ID: "bt-1", Reference: "payout-1"},
+		{ID: "bt-2", Reference: "payout-2"},
+	})
+	if got, want := calls, 1; got != want {
+		t.Errorf("got %d requests want %d", got, want)
+	}
+	wantPosted := []map[string]string{
+		{"BankTransactionID": "bt-1", "Reference": "payout-1"},
+		{"BankTransactionID": "bt-2", "Reference": "payout-2"},
+	}
+	if diff := cmp.Diff(wantPosted, posted); diff != "" {
+		t.Errorf("posted transactions diff:\n%s", diff)
+	}
+	if got, want := len(updated), 1; got != want {
+		t.Fatalf("got %d updated transactions want %d", got, want)
+	}
+	if got, want := updated[0].Reference, "payout-1"; got != want {
+		t.Errorf("got reference %q want %q", got, want)
+	}
+
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("expected a ValidationError, got %v", err)
+	}
+	if diff := cmp.Diff(map[string][]string{"bt-2": {"The transaction has been reconciled"}}, validationErr.Records); diff != "" {
+		t.Errorf("rejected records diff:\n%s", diff)
+	}
+}
+
+// TestUpdateInvoiceReference tests updating the reference of an invoice, posting only
+// its id and reference.
+func TestUpdateInvoiceReference(t *testing.T) {
+
+	mux, client, teardown := setup(t)
+	defer teardown()
+
+	var posted []map[string]string
+	mux.HandleFunc("/Invoices", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("expected method POST, got %s", r.Method)
+		}
+		var payload struct{ Invoices []map[string]string }
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+		posted = payload.Invoices
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"Status": "OK", "Invoices": [{"InvoiceID": "inv-1", "InvoiceNumber": "INV-001", "Reference": "payout-1", "StatusAttributeString": "OK"}]}`))
+	})
+
+	updated, err := client.UpdateInvoiceReference(context.Background(), "inv-1", "payout-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]map[string]string{{"InvoiceID": "inv-1", "Reference": "payout-1"}}, posted); diff != "" {
+		t.Errorf("posted invoices diff:\n%s", diff)
+	}
+	if got, want := updated.InvoiceNumber, "INV-001"; got != want {
+		t.Errorf("got invoice number %q want %q", got, want)
+	}
+	if got, want := updated.Reference, "payout-1"; got != want {
+		t.Errorf("got reference %q want %q", got, want)
+	}
+}
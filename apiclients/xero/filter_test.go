@@ -0,0 +1,85 @@
+package xero
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilter(t *testing.T) {
+
+	from := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2025, 6, 30, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		filter Filter
+		page   int
+		want   string
+	}{
+		{
+			name:   "empty",
+			filter: Filter{},
+			want:   "",
+		},
+		{
+			name:   "equal",
+			filter: Filter{}.Equal("Type", "ACCREC"),
+			want:   `where=Type=="ACCREC"`,
+		},
+		{
+			name:   "quoted",
+			filter: Filter{}.Equal("Reference", `say "hi" \o/`),
+			want:   `where=Reference=="say \"hi\" \\o/"`,
+		},
+		{
+			name:   "in",
+			filter: Filter{}.In("Status", "AUTHORISED", "PAID"),
+			want:   `where=(Status=="AUTHORISED" OR Status=="PAID")`,
+		},
+		{
+			name:   "in one",
+			filter: Filter{}.In("Status", "PAID"),
+			want:   `where=Status=="PAID"`,
+		},
+		{
+			name:   "in none",
+			filter: Filter{}.In("Status"),
+			want:   "",
+		},
+		{
+			name:   "date range includes the end date",
+			filter: Filter{}.DateRange("Date", from, to),
+			want:   `where=Date >= DateTime(2025, 4, 1) AND Date < DateTime(2025, 7, 1)`,
+		},
+		{
+			name:   "order and page size",
+			filter: Filter{}.Equal("Type", "SPEND").OrderBy("Date", true).PageSize(500),
+			page:   2,
+			want:   `order=Date DESC&page=2&pageSize=500&where=Type=="SPEND"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.filter.Values(tt.page)
+			// Compare the unescaped parameters for readability.
+			var params []string
+			for _, k := range []string{"order", "page", "pageSize", "where"} {
+				if v := got.Get(k); v != "" {
+					params = append(params, k+"="+v)
+				}
+			}
+			if joined := strings.Join(params, "&"); joined != tt.want {
+				t.Errorf("got %s want %s", joined, tt.want)
+			}
+		})
+	}
+
+	// Filters are values, so deriving one filter from another leaves it unchanged.
+	base := Filter{}.Equal("Type", "ACCREC")
+	_ = base.Equal("Status", "PAID")
+	if got, want := base.Where(), `Type=="ACCREC"`; got != want {
+		t.Errorf("got base filter %q want %q", got, want)
+	}
+}
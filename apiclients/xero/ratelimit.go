@@ -0,0 +1,208 @@
+package xero
+
+// ratelimit.go handles the Xero API rate limits and transient server errors.
+//
+// Xero allows 60 calls a minute and 5000 calls a day for each organisation, reporting
+// the calls remaining in the X-MinLimit-Remaining and X-DayLimit-Remaining response
+// headers. A request over a limit receives a 429 response with a Retry-After header
+// giving the number of seconds to wait, and an X-Rate-Limit-Problem header naming the
+// limit reached.
+//
+// See https://developer.xero.com/documentation/guides/oauth2/limits/
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIError is a non-2xx response from the Xero API.
+type APIError struct {
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration // from the Retry-After header, if any
+	Problem    string        // the limit reached by a 429 response, such as "minute" or "day"
+}
+
+func (e *APIError) Error() string {
+	if e.StatusCode == http.StatusTooManyRequests {
+		return fmt.Sprintf("API error (status %d): Xero %s rate limit reached, retry after %s", e.StatusCode, e.Problem, e.RetryAfter)
+	}
+	return fmt.Sprintf("API error (status %d): %s", e.StatusCode, e.Body)
+}
+
+// newAPIError returns an APIError for the response with the provided body.
+func newAPIError(resp *http.Response, body []byte) *APIError {
+	return &APIError{
+		StatusCode: resp.StatusCode,
+		Body:       string(body),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		Problem:    strings.ToLower(resp.Header.Get("X-Rate-Limit-Problem")),
+	}
+}
+
+// parseRetryAfter parses a Retry-After header value, which is either a number of
+// seconds or an http date. Zero is returned for an empty or invalid value.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// Stats reports the API usage of a client. The remaining call counts are from the
+// most recent response and are -1 until a response reporting them is received.
+type Stats struct {
+	Requests        int           // requests made, including retries
+	Retries         int           // requests retried after a 429 or 5xx response
+	RateLimited     int           // 429 responses received
+	Waited          time.Duration // time spent waiting to retry
+	MinuteRemaining int           // calls remaining this minute
+	DayRemaining    int           // calls remaining today
+}
+
+// String summarises the stats for logging.
+func (s Stats) String() string {
+	remaining := func(n int) string {
+		if n < 0 {
+			return "unknown"
+		}
+		return strconv.Itoa(n)
+	}
+	return fmt.Sprintf("%d requests, %d retries (%d rate limited, waited %s); calls remaining: %s this minute, %s today",
+		s.Requests, s.Retries, s.RateLimited, s.Waited.Round(time.Second),
+		remaining(s.MinuteRemaining), remaining(s.DayRemaining))
+}
+
+// record updates the stats from the response headers.
+func (s *Stats) record(h http.Header) {
+	s.Requests++
+	if n, err := strconv.Atoi(h.Get("X-MinLimit-Remaining")); err == nil {
+		s.MinuteRemaining = n
+	}
+	if n, err := strconv.Atoi(h.Get("X-DayLimit-Remaining")); err == nil {
+		s.DayRemaining = n
+	}
+}
+
+// retryPolicy sets out how failed requests are retried.
+type retryPolicy struct {
+	maxRetries int           // the maximum retries of a request
+	baseDelay  time.Duration // the first backoff delay after a server error
+	maxDelay   time.Duration // the maximum backoff delay after a server error
+	maxWait    time.Duration // the longest Retry-After wait honoured
+}
+
+// defaultRetryPolicy waits out the minute limit, which resets within 60 seconds, but
+// not the daily limit.
+var defaultRetryPolicy = retryPolicy{
+	maxRetries: 5,
+	baseDelay:  time.Second,
+	maxDelay:   30 * time.Second,
+	maxWait:    2 * time.Minute,
+}
+
+// wait returns the time to wait before retrying a request which failed with the API
+// error on the provided (zero-based) attempt, or false if it should not be retried.
+func (p retryPolicy) wait(apiErr *APIError, attempt int) (time.Duration, bool) {
+	if attempt >= p.maxRetries {
+		return 0, false
+	}
+	switch apiErr.StatusCode {
+	case http.StatusTooManyRequests:
+		if apiErr.Problem == "day" {
+			return 0, false
+		}
+		wait := apiErr.RetryAfter
+		if wait == 0 {
+			wait = time.Minute
+		}
+		return wait, wait <= p.maxWait
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		if apiErr.RetryAfter > 0 && apiErr.RetryAfter <= p.maxWait {
+			return apiErr.RetryAfter, true
+		}
+		return min(p.baseDelay<<attempt, p.maxDelay), true
+	}
+	return 0, false
+}
+
+// sleep waits for the duration, returning early with an error if the context is
+// cancelled.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Stats returns the API usage of the client.
+func (c *APIClient) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// send executes the request, retrying it according to the client's retry policy if
+// it is rate limited or fails with a server error. Successful and 304 Not Modified
+// responses are returned with an unread body; other responses are returned as an
+// *APIError.
+func (c *APIClient) send(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("failed to reset request body: %w", err)
+			}
+			req.Body = body
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute request: %w", err)
+		}
+		c.mu.Lock()
+		c.stats.record(resp.Header)
+		c.mu.Unlock()
+
+		if resp.StatusCode == http.StatusNotModified || (resp.StatusCode >= 200 && resp.StatusCode < 300) {
+			return resp, nil
+		}
+
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		apiErr := newAPIError(resp, body)
+
+		wait, ok := c.retry.wait(apiErr, attempt)
+		if !ok {
+			return nil, apiErr
+		}
+		log.Printf("Xero API returned status %d for %s %s; retrying in %s.", apiErr.StatusCode, req.Method, req.URL.Path, wait)
+		c.mu.Lock()
+		c.stats.Retries++
+		if apiErr.StatusCode == http.StatusTooManyRequests {
+			c.stats.RateLimited++
+		}
+		c.stats.Waited += wait
+		c.mu.Unlock()
+
+		if err := c.sleep(req.Context(), wait); err != nil {
+			return nil, err
+		}
+	}
+}
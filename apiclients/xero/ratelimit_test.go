@@ -0,0 +1,178 @@
+package xero
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"30", 30 * time.Second},
+		{"-1", 0},
+		{"soon", 0},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) got %s want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+// response is a canned response from the test server.
+type response struct {
+	status  int
+	headers map[string]string
+}
+
+// TestRetry tests the retrying of rate limited and failed requests.
+func TestRetry(t *testing.T) {
+
+	ok := response{http.StatusOK, map[string]string{"X-MinLimit-Remaining": "58", "X-DayLimit-Remaining": "4990"}}
+
+	tests := []struct {
+		name       string
+		responses  []response
+		wantWaits  []time.Duration
+		wantStatus int // the status of the returned APIError, or 0 for success
+		wantStats  Stats
+	}{
+		{
+			name:      "ok",
+			responses: []response{ok},
+			wantStats: Stats{Requests: 1, MinuteRemaining: 58, DayRemaining: 4990},
+		},
+		{
+			name: "minute limit",
+			responses: []response{
+				{http.StatusTooManyRequests, map[string]string{"Retry-After": "12", "X-Rate-Limit-Problem": "minute", "X-MinLimit-Remaining": "0"}},
+				ok,
+			},
+			wantWaits: []time.Duration{12 * time.Second},
+			wantStats: Stats{Requests: 2, Retries: 1, RateLimited: 1, Waited: 12 * time.Second, MinuteRemaining: 58, DayRemaining: 4990},
+		},
+		{
+			name: "daily limit",
+			responses: []response{
+				{http.StatusTooManyRequests, map[string]string{"Retry-After": "3600", "X-Rate-Limit-Problem": "day", "X-DayLimit-Remaining": "0"}},
+			},
+			wantStatus: http.StatusTooManyRequests,
+			wantStats:  Stats{Requests: 1, MinuteRemaining: -1, DayRemaining: 0},
+		},
+		{
+			name: "server errors",
+			responses: []response{
+				{http.StatusServiceUnavailable, nil},
+				{http.StatusBadGateway, nil},
+				ok,
+			},
+			wantWaits: []time.Duration{time.Second, 2 * time.Second},
+			wantStats: Stats{Requests: 3, Retries: 2, Waited: 3 * time.Second, MinuteRemaining: 58, DayRemaining: 4990},
+		},
+		{
+			name: "persistent server error",
+			responses: []response{
+				{http.StatusInternalServerError, nil},
+				{http.StatusInternalServerError, nil},
+				{http.StatusInternalServerError, nil},
+				{http.StatusInternalServerError, nil},
+				{http.StatusInternalServerError, nil},
+				{http.StatusInternalServerError, nil},
+			},
+			wantWaits:  []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second},
+			wantStatus: http.StatusInternalServerError,
+			wantStats:  Stats{Requests: 6, Retries: 5, Waited: 31 * time.Second, MinuteRemaining: -1, DayRemaining: -1},
+		},
+		{
+			name:       "client error",
+			responses:  []response{{http.StatusBadRequest, nil}},
+			wantStatus: http.StatusBadRequest,
+			wantStats:  Stats{Requests: 1, MinuteRemaining: -1, DayRemaining: -1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux, client, teardown := setup(t)
+			defer teardown()
+
+			var waits []time.Duration
+			client.sleep = func(ctx context.Context, d time.Duration) error {
+				waits = append(waits, d)
+				return nil
+			}
+
+			var calls int
+			mux.HandleFunc("/BankTransactions", func(w http.ResponseWriter, r *http.Request) {
+				if calls >= len(tt.responses) {
+					t.Fatalf("unexpected request %d", calls+1)
+				}
+				// The body of a retried request is sent again in full.
+				if body, _ := io.ReadAll(r.Body); len(body) == 0 {
+					t.Error("expected a request body")
+				}
+				resp := tt.responses[calls]
+				calls++
+				for k, v := range resp.headers {
+					w.Header().Set(k, v)
+				}
+				w.WriteHeader(resp.status)
+				w.Write([]byte(`{"BankTransactions": [{"BankTransactionID": "bt-1"}]}`))
+			})
+
+			_, err := client.UpdateBankTransactionReference(context.Background(), "bt-1", "ref")
+			if tt.wantStatus == 0 && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantStatus != 0 {
+				var apiErr *APIError
+				if !errors.As(err, &apiErr) {
+					t.Fatalf("expected an APIError, got %v", err)
+				}
+				if got, want := apiErr.StatusCode, tt.wantStatus; got != want {
+					t.Errorf("got status %d want %d", got, want)
+				}
+			}
+			if got, want := calls, len(tt.responses); got != want {
+				t.Errorf("got %d requests want %d", got, want)
+			}
+			if diff := cmp.Diff(tt.wantWaits, waits); diff != "" {
+				t.Errorf("waits diff:\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.wantStats, client.Stats()); diff != "" {
+				t.Errorf("stats diff:\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestRetryCancelled tests that waiting to retry stops when the context is cancelled.
+func TestRetryCancelled(t *testing.T) {
+	mux, client, teardown := setup(t)
+	defer teardown()
+	client.sleep = sleep
+
+	mux.HandleFunc("/Accounts", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := client.GetAccounts(ctx, time.Time{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the context deadline error, got %v", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -28,29 +29,6 @@ func parseXeroDate(xeroDate string) (time.Time, error) {
 	return time.Unix(timestamp/1000, 0).UTC(), nil
 }
 
-// FlattenedName flattens an obj.Name string to a string.
-type FlattenedName string
-
-// UnmarshalJSON implements the json.Unmarshaler interface for a FlattenedName,
-// extracting the "Name" field of the object pointed to by the struct tag into the
-// string field.
-func (fn *FlattenedName) UnmarshalJSON(data []byte) error {
-	// Handle the case of a JSON null value.
-	if string(data) == "null" {
-		*fn = ""
-		return nil
-	}
-	// Use a helper struct to extract the 'Name' field from the object.
-	var helper struct {
-		Name string `json:"Name"`
-	}
-	if err := json.Unmarshal(data, &helper); err != nil {
-		return err
-	}
-	*fn = FlattenedName(helper.Name)
-	return nil
-}
-
 // XeroDateTime is a custom date type.
 type XeroDateTime struct {
 	time.Time
@@ -80,6 +58,7 @@ type Connection struct {
 	ID         string `json:"id"`
 	TenantID   string `json:"tenantId"`
 	TenantName string `json:"tenantName"`
+	TenantType string `json:"tenantType"`
 }
 
 // BankTransactionsResponse is the top-level structure of the API response.
@@ -89,33 +68,144 @@ type BankTransactionsResponse struct {
 
 // BankTransaction represents a single bank transaction record.
 type BankTransaction struct {
-	BankTransactionID string        `json:"BankTransactionID"`
-	Type              string        `json:"Type"`
-	Reference         string        `json:"Reference"`
-	Contact           FlattenedName `json:"Contact"`
-	BankAccount       FlattenedName `json:"BankAccount"`
-	Date              XeroDateTime  `json:"DateString"`
-	Updated           XeroDateTime  `json:"UpdatedDateUTC"`
-	Status            string        `json:"Status"`
-	Total             float64       `json:"Total"`
-	IsReconciled      bool          `json:"IsReconciled"`
-	LineItems         []LineItem    `json:"LineItems"`
+	BankTransactionID string       `json:"BankTransactionID"`
+	Type              string       `json:"Type"`
+	Reference         string       `json:"Reference"`
+	Contact           Contact      `json:"Contact"`
+	BankAccount       BankAccount  `json:"BankAccount"`
+	Date              XeroDateTime `json:"DateString"`
+	Updated           XeroDateTime `json:"UpdatedDateUTC"`
+	Status            string       `json:"Status"`
+	Total             float64      `json:"Total"`
+	IsReconciled      bool         `json:"IsReconciled"`
+	LineItems         []LineItem   `json:"LineItems"`
+	UpdateStatus
+}
+
+// Removed reports whether the bank transaction has been deleted in Xero.
+func (b BankTransaction) Removed() bool {
+	return b.Status == "DELETED"
+}
+
+// ReferenceUpdate is a change to the reference of the Xero record with the ID.
+type ReferenceUpdate struct {
+	ID        string
+	Reference string
+}
+
+// UpdateStatus reports the outcome of the update of a record: a StatusAttributeString
+// of "ERROR" shows the record was rejected, for the reasons in ValidationErrors.
+type UpdateStatus struct {
+	StatusAttributeString string            `json:"StatusAttributeString,omitempty"`
+	ValidationErrors      []ValidationIssue `json:"ValidationErrors,omitempty"`
+}
+
+// ValidationIssue is a reason given by Xero for rejecting a record.
+type ValidationIssue struct {
+	Message string `json:"Message"`
+}
+
+// ValidationError reports the records rejected by Xero in an update of several
+// records, keyed by the record id.
+type ValidationError struct {
+	Records map[string][]string
+}
+
+// add records the messages for a rejected record.
+func (e *ValidationError) add(id string, issues []ValidationIssue) {
+	if e.Records == nil {
+		e.Records = map[string][]string{}
+	}
+	e.Records[id] = []string{}
+	for _, issue := range issues {
+		e.Records[id] = append(e.Records[id], issue.Message)
+	}
+}
+
+func (e *ValidationError) Error() string {
+	ids := make([]string, 0, len(e.Records))
+	for id := range e.Records {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = fmt.Sprintf("%s (%s)", id, strings.Join(e.Records[id], "; "))
+	}
+	return fmt.Sprintf("xero rejected %d record(s): %s", len(ids), strings.Join(parts, ", "))
 }
 
 // LineItem represents a single line in a transaction or invoice, crucial for splits.
 type LineItem struct {
-	Description string  `json:"Description"`
-	UnitAmount  float64 `json:"UnitAmount"`
-	AccountCode string  `json:"AccountCode"`
-	LineItemID  string  `json:"LineItemID"`
-	Quantity    float64 `json:"Quantity"`
-	TaxAmount   float64 `json:"TaxAmount"`
-	LineAmount  float64 `json:"LineAmount"`
+	Description string             `json:"Description"`
+	UnitAmount  float64            `json:"UnitAmount"`
+	AccountCode string             `json:"AccountCode"`
+	LineItemID  string             `json:"LineItemID"`
+	Quantity    float64            `json:"Quantity"`
+	TaxAmount   float64            `json:"TaxAmount"`
+	LineAmount  float64            `json:"LineAmount"`
+	Tracking    []LineItemTracking `json:"Tracking,omitempty"`
 }
 
-// BankAccount represents the bank account for the transaction.
+// LineItemTracking is the tracking category option, such as a fundraising campaign,
+// with which a line item is tagged. A line item may be tagged with one option from
+// each of up to two tracking categories.
+type LineItemTracking struct {
+	TrackingCategoryID string `json:"TrackingCategoryID"`
+	TrackingOptionID   string `json:"TrackingOptionID"`
+	Name               string `json:"Name"`   // the category name
+	Option             string `json:"Option"` // the option name
+}
+
+// TrackingCategoriesResponse is the top-level structure of the /TrackingCategories
+// API response.
+type TrackingCategoriesResponse struct {
+	TrackingCategories []TrackingCategory `json:"TrackingCategories"`
+}
+
+// TrackingCategory represents a tracking category, such as "Campaign", with its
+// options.
+type TrackingCategory struct {
+	TrackingCategoryID string           `json:"TrackingCategoryID"`
+	Name               string           `json:"Name"`
+	Status             string           `json:"Status"`
+	Options            []TrackingOption `json:"Options"`
+}
+
+// TrackingOption represents an option of a tracking category.
+type TrackingOption struct {
+	TrackingOptionID string `json:"TrackingOptionID"`
+	Name             string `json:"Name"`
+	Status           string `json:"Status"`
+}
+
+// BankAccount represents the bank account for the transaction, which is one of the
+// organisation's accounts of type BANK.
 type BankAccount struct {
-	Name string `json:"Name"`
+	AccountID string `json:"AccountID"`
+	Code      string `json:"Code,omitempty"`
+	Name      string `json:"Name,omitempty"`
+}
+
+// ContactsResponse is the top-level structure of the /Contacts API response.
+type ContactsResponse struct {
+	Contacts []Contact `json:"Contacts"`
+}
+
+// Contact represents a Xero contact, such as a donor or a fundraising platform. The
+// contact of an invoice, credit note or bank transaction has only some of its fields
+// set, including the ContactID and the name at the time the record was fetched.
+type Contact struct {
+	ContactID     string       `json:"ContactID"`
+	Name          string       `json:"Name,omitempty"`
+	FirstName     string       `json:"FirstName,omitempty"`
+	LastName      string       `json:"LastName,omitempty"`
+	EmailAddress  string       `json:"EmailAddress,omitempty"`
+	AccountNumber string       `json:"AccountNumber,omitempty"`
+	ContactStatus string       `json:"ContactStatus,omitempty"`
+	IsCustomer    bool         `json:"IsCustomer,omitempty"`
+	IsSupplier    bool         `json:"IsSupplier,omitempty"`
+	Updated       XeroDateTime `json:"UpdatedDateUTC,omitzero"`
 }
 
 // InvoiceResponse is the top-level structure of the /Invoices API response.
@@ -125,17 +215,88 @@ type InvoiceResponse struct {
 
 // Invoice represents a single invoice record.
 type Invoice struct {
-	InvoiceID     string        `json:"InvoiceID"`
-	Type          string        `json:"Type"`
-	InvoiceNumber string        `json:"InvoiceNumber"`
-	Contact       FlattenedName `json:"Contact"`
-	Date          XeroDateTime  `json:"DateString"`
-	Updated       XeroDateTime  `json:"UpdatedDateUTC"`
-	Status        string        `json:"Status"`
-	Reference     string        `json:"Reference,omitempty"`
-	Total         float64       `json:"Total"`
-	AmountPaid    float64       `json:"AmountPaid"`
-	LineItems     []LineItem    `json:"LineItems"`
+	InvoiceID     string       `json:"InvoiceID"`
+	Type          string       `json:"Type"`
+	InvoiceNumber string       `json:"InvoiceNumber"`
+	Contact       Contact      `json:"Contact"`
+	Date          XeroDateTime `json:"DateString"`
+	Updated       XeroDateTime `json:"UpdatedDateUTC"`
+	Status        string       `json:"Status"`
+	Reference     string       `json:"Reference,omitempty"`
+	Total         float64      `json:"Total"`
+	AmountPaid    float64      `json:"AmountPaid"`
+	LineItems     []LineItem   `json:"LineItems"`
+	UpdateStatus
+}
+
+// Removed reports whether the invoice has been deleted in Xero. A voided invoice is
+// not removed: it is kept, with its status, as a record of the void, and is excluded
+// from the listings by its status.
+func (i Invoice) Removed() bool {
+	return i.Status == "DELETED"
+}
+
+// CreditNotesResponse is the top-level structure of the /CreditNotes API response.
+type CreditNotesResponse struct {
+	CreditNotes []CreditNote `json:"CreditNotes"`
+}
+
+// CreditNote represents a single credit note record, such as a refund of a donation.
+// Allocations record the invoices against which the credit has been applied.
+type CreditNote struct {
+	CreditNoteID     string       `json:"CreditNoteID"`
+	CreditNoteNumber string       `json:"CreditNoteNumber"`
+	Type             string       `json:"Type"`
+	Contact          Contact      `json:"Contact"`
+	Date             XeroDateTime `json:"DateString"`
+	Updated          XeroDateTime `json:"UpdatedDateUTC"`
+	Status           string       `json:"Status"`
+	Reference        string       `json:"Reference"`
+	Total            float64      `json:"Total"`
+	RemainingCredit  float64      `json:"RemainingCredit"`
+	LineItems        []LineItem   `json:"LineItems"`
+	Allocations      []Allocation `json:"Allocations"`
+}
+
+// Allocation is the application of part or all of a credit note to an invoice.
+type Allocation struct {
+	AllocationID string         `json:"AllocationID"`
+	Amount       float64        `json:"Amount"`
+	Date         XeroDateTime   `json:"Date"`
+	Invoice      PaymentInvoice `json:"Invoice"`
+}
+
+// PaymentsResponse is the top-level structure of the /Payments API response.
+type PaymentsResponse struct {
+	Payments []Payment `json:"Payments"`
+}
+
+// Payment represents a single payment against an invoice, made into or out of the
+// bank account in Account.
+type Payment struct {
+	PaymentID    string         `json:"PaymentID"`
+	Date         XeroDateTime   `json:"Date"`
+	Updated      XeroDateTime   `json:"UpdatedDateUTC"`
+	Amount       float64        `json:"Amount"`
+	BankAmount   float64        `json:"BankAmount"`
+	Reference    string         `json:"Reference"`
+	Status       string         `json:"Status"`
+	PaymentType  string         `json:"PaymentType"`
+	IsReconciled bool           `json:"IsReconciled"`
+	Invoice      PaymentInvoice `json:"Invoice"`
+	Account      PaymentAccount `json:"Account"`
+}
+
+// PaymentInvoice is the invoice paid by a payment or credited by an allocation.
+type PaymentInvoice struct {
+	InvoiceID     string `json:"InvoiceID"`
+	InvoiceNumber string `json:"InvoiceNumber"`
+}
+
+// PaymentAccount is the bank account of a payment.
+type PaymentAccount struct {
+	AccountID string `json:"AccountID"`
+	Code      string `json:"Code"`
 }
 
 // AccountResponse is the top-level structure of the /Accounts API response.
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"os"
 	"testing"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 func TestAccountsType(t *testing.T) {
@@ -47,3 +49,123 @@ func TestInvoicesType(t *testing.T) {
 		t.Errorf("got %d invoices, want %d", got, want)
 	}
 }
+
+func TestContactsType(t *testing.T) {
+	b, err := os.ReadFile("testdata/contacts.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cr ContactsResponse
+	if err := json.Unmarshal(b, &cr); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(cr.Contacts), 2; got != want {
+		t.Fatalf("got %d contacts, want %d", got, want)
+	}
+	c := cr.Contacts[1]
+	if got, want := c.ContactStatus, "ARCHIVED"; got != want {
+		t.Errorf("got status %s, want %s", got, want)
+	}
+	if got, want := c.Updated.Format("2006-01-02"), "2011-04-04"; got != want {
+		t.Errorf("got updated %s, want %s", got, want)
+	}
+}
+
+// TestTransactionReferences tests that the contact and bank account of a bank
+// transaction are kept as references.
+func TestTransactionReferences(t *testing.T) {
+	b, err := os.ReadFile("testdata/bank_transactions.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var br BankTransactionsResponse
+	if err := json.Unmarshal(b, &br); err != nil {
+		t.Fatal(err)
+	}
+	bt := br.BankTransactions[0]
+	if got, want := bt.Contact, (Contact{ContactID: "bc446de5-971e-48b5-8efd-1745149844ef", Name: "Wilson Periodicals"}); got != want {
+		t.Errorf("got contact %+v, want %+v", got, want)
+	}
+	want := BankAccount{AccountID: "bd9e85e0-0478-433d-ae9f-0b3c4f04bfe4", Code: "090", Name: "Business Bank Account"}
+	if got := bt.BankAccount; got != want {
+		t.Errorf("got bank account %+v, want %+v", got, want)
+	}
+}
+
+func TestPaymentsType(t *testing.T) {
+	b, err := os.ReadFile("testdata/payments.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pr PaymentsResponse
+	if err := json.Unmarshal(b, &pr); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(pr.Payments), 2; got != want {
+		t.Fatalf("got %d payments, want %d", got, want)
+	}
+	p := pr.Payments[0]
+	if got, want := p.Invoice.InvoiceNumber, "INV-0041"; got != want {
+		t.Errorf("got invoice number %s, want %s", got, want)
+	}
+	if got, want := p.Account.Code, "090"; got != want {
+		t.Errorf("got account code %s, want %s", got, want)
+	}
+	if got, want := p.Date.Format("2006-01-02"), "2025-04-19"; got != want {
+		t.Errorf("got date %s, want %s", got, want)
+	}
+}
+
+func TestCreditNotesType(t *testing.T) {
+	b, err := os.ReadFile("testdata/credit_notes.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cr CreditNotesResponse
+	if err := json.Unmarshal(b, &cr); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(cr.CreditNotes), 1; got != want {
+		t.Fatalf("got %d credit notes, want %d", got, want)
+	}
+	cn := cr.CreditNotes[0]
+	if got, want := len(cn.LineItems), 1; got != want {
+		t.Errorf("got %d line items, want %d", got, want)
+	}
+	if got, want := len(cn.Allocations), 1; got != want {
+		t.Fatalf("got %d allocations, want %d", got, want)
+	}
+	if got, want := cn.Allocations[0].Invoice.InvoiceNumber, "INV-0041"; got != want {
+		t.Errorf("got allocated invoice %s, want %s", got, want)
+	}
+	wantTracking := []LineItemTracking{{
+		TrackingCategoryID: "351953c4-8127-4009-88c3-f9cd8c9cbe9f",
+		TrackingOptionID:   "ae777a87-5ef3-4fa0-a4f0-d10e1f13073a",
+		Name:               "Campaign",
+		Option:             "Spring Appeal 2025",
+	}}
+	if diff := cmp.Diff(wantTracking, cn.LineItems[0].Tracking); diff != "" {
+		t.Errorf("tracking diff:\n%s", diff)
+	}
+}
+
+func TestTrackingCategoriesType(t *testing.T) {
+	b, err := os.ReadFile("testdata/tracking_categories.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tr TrackingCategoriesResponse
+	if err := json.Unmarshal(b, &tr); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(tr.TrackingCategories), 2; got != want {
+		t.Fatalf("got %d tracking categories, want %d", got, want)
+	}
+	campaign := tr.TrackingCategories[0]
+	if got, want := len(campaign.Options), 2; got != want {
+		t.Fatalf("got %d options, want %d", got, want)
+	}
+	if got, want := campaign.Options[1].Status, "ARCHIVED"; got != want {
+		t.Errorf("got option status %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,543 @@
+// Package app provides the business logic for the reconciler command, wiring together
+// the configuration, database, API clients and web server.
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"reconciler/apiclients/salesforce"
+	"reconciler/apiclients/tokenstore"
+	"reconciler/apiclients/xero"
+	"reconciler/config"
+	"reconciler/db"
+	"reconciler/syncer"
+	"reconciler/web"
+)
+
+// shutdownTimeout is the time allowed for the web server to shut down gracefully.
+const shutdownTimeout = 10 * time.Second
+
+// configCheckTimeout is the time allowed for checking the Salesforce configuration,
+// and for resolving the configured Xero organisation, when the web server starts.
+const configCheckTimeout = 30 * time.Second
+
+// App is the central orchestrator for the application's business logic.
+type App struct{}
+
+// New creates and returns a new App instance.
+func New() *App {
+	return &App{}
+}
+
+// openDB loads the configuration and opens the database, applying any pending schema
+// migrations.
+func openDB(cfgPath string) (*config.Config, *db.DB, error) {
+	cfg, err := config.Load(cfgPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	dbConn, err := db.NewConnection(
+		cfg.DatabasePath,
+		"",
+		cfg.DonationAccountCodesRegex(),
+		cfg.Salesforce.ExcludedStage,
+		cfg.Xero.Invoices.TypesRegex(),
+		cfg.Xero.Invoices.StatusesRegex(),
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	return cfg, dbConn, nil
+}
+
+// Serve runs the web server until the context is cancelled.
+func (a *App) Serve(ctx context.Context, cfgPath string) error {
+	cfg, dbConn, err := openDB(cfgPath)
+	if err != nil {
+		return err
+	}
+	defer dbConn.Close()
+
+	if err := checkSalesforceConfig(ctx, cfg); err != nil {
+		return fmt.Errorf("%w\nCorrect the configuration, or run the doctor command for details", err)
+	}
+	if err := resolveXeroTenant(ctx, cfg); err != nil {
+		return err
+	}
+
+	staticFS, templatesFS, err := web.FileMounts(cfg)
+	if err != nil {
+		return err
+	}
+
+	// The web listings default to the year of data from the configured start date.
+	start := cfg.DataStartDate
+	end := start.AddDate(1, 0, -1)
+
+	webApp, err := web.New(log.Default(), cfg, dbConn, staticFS, templatesFS, start, end)
+	if err != nil {
+		return fmt.Errorf("failed to initialise web server: %w", err)
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- webApp.StartServer()
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+		log.Println("Shutting down web server.")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := webApp.Shutdown(shutdownCtx); err != nil {
+			return fmt.Errorf("web server shutdown error: %w", err)
+		}
+		if err := <-errChan; err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSalesforceConfig checks the Salesforce configuration against the Salesforce
+// metadata, returning an error for any problems found. The check is skipped, with a
+// warning, if Salesforce is not connected or cannot be reached, so that the web
+// server can be used to connect.
+func checkSalesforceConfig(ctx context.Context, cfg *config.Config) error {
+	ctx, cancel := context.WithTimeout(ctx, configCheckTimeout)
+	defer cancel()
+	client, err := salesforce.NewClient(ctx, cfg)
+	if err != nil {
+		log.Printf("Skipping the Salesforce configuration check: %v", err)
+		return nil
+	}
+	err = client.ValidateConfig(ctx)
+	var configErr *salesforce.ConfigError
+	switch {
+	case errors.As(err, &configErr):
+		return err
+	case err != nil:
+		log.Printf("Skipping the Salesforce configuration check: %v", err)
+	}
+	return nil
+}
+
+// resolveXeroTenant sets xero.tenant_id from a configured xero.tenant_name, as the web
+// listings select the Xero organisation by its id. If Xero is not connected, the name
+// is resolved once Xero is connected from the web interface.
+func resolveXeroTenant(ctx context.Context, cfg *config.Config) error {
+	if cfg.Xero.TenantID != "" || cfg.Xero.TenantName == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, configCheckTimeout)
+	defer cancel()
+	connections, err := xero.Connections(ctx, cfg)
+	if err != nil {
+		log.Printf("Xero organisation %q will be selected once Xero is connected: %v", cfg.Xero.TenantName, err)
+		return nil
+	}
+	connection, err := xero.SelectTenant(connections, cfg, "")
+	if err != nil {
+		return err
+	}
+	cfg.Xero.TenantID = connection.TenantID
+	return nil
+}
+
+// Doctor checks the configuration, including the Salesforce linking field, query and
+// field mappings against the Salesforce metadata, reporting any problems found.
+func (a *App) Doctor(ctx context.Context, cfgPath string) error {
+	cfg, err := config.Load(cfgPath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Configuration file %s loaded.\n", cfgPath)
+
+	client, err := salesforce.NewClient(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to connect to Salesforce: %w", err)
+	}
+	if err := client.ValidateConfig(ctx); err != nil {
+		return err
+	}
+	fmt.Printf("Salesforce %s.%s, query and field mappings checked.\n", cfg.Salesforce.LinkingObject, cfg.Salesforce.LinkingFieldName)
+	return nil
+}
+
+// Login runs the interactive OAuth2 login flow for the provided service, which should
+// be one of "xero" or "salesforce".
+func (a *App) Login(ctx context.Context, cfgPath, service string) error {
+	cfg, err := config.Load(cfgPath)
+	if err != nil {
+		return err
+	}
+	switch service {
+	case "xero":
+		return xero.InitiateLogin(ctx, cfg)
+	case "salesforce":
+		return salesforce.InitiateLogin(ctx, cfg)
+	default:
+		return fmt.Errorf("unknown service %q, expected xero or salesforce", service)
+	}
+}
+
+// Sync fetches the provided entities from Xero and Salesforce and persists them to the
+// database. If no entities are provided all are synchronised. The date range, the
+// modification time and the Xero organisation are set out by opts, as described in
+// syncer.Options.
+func (a *App) Sync(ctx context.Context, cfgPath string, entities []syncer.Entity, opts syncer.Options) error {
+	cfg, dbConn, err := openDB(cfgPath)
+	if err != nil {
+		return err
+	}
+	defer dbConn.Close()
+
+	if len(entities) == 0 {
+		entities = syncer.Entities
+	}
+	if opts.FromDate.IsZero() {
+		log.Printf("No --fromDate specified, using default from config: %s", cfg.DataStartDate.Format("2006-01-02"))
+	}
+	if opts.Full {
+		log.Println("Full sync: retrieving all records.")
+	}
+
+	s := syncer.New(cfg, dbConn)
+	for _, entity := range entities {
+		log.Printf("Fetching %s...", entity)
+		result, err := s.Sync(ctx, entity, opts)
+		if !result.IfModifiedSince.IsZero() {
+			log.Printf("Only retrieved %s modified since: %s", entity, result.IfModifiedSince.Format(time.RFC1123))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	log.Println("Sync complete.")
+	return nil
+}
+
+// History prints the most recent sync runs, up to limit, for the provided entity or for
+// all entities if entity is empty.
+func (a *App) History(ctx context.Context, cfgPath string, entity syncer.Entity, limit int) error {
+	_, dbConn, err := openDB(cfgPath)
+	if err != nil {
+		return err
+	}
+	defer dbConn.Close()
+
+	runs, err := dbConn.SyncRunsGet(ctx, string(entity), limit)
+	if errors.Is(err, sql.ErrNoRows) {
+		fmt.Println("No syncs have been run.")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return "-"
+		}
+		return t.Local().Format("2006-01-02 15:04:05")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tENTITY\tTENANT\tSTARTED\tFINISHED\tDATES\tFULL\tSINCE\tFETCHED\tREMOVED\tHIGH WATER MARK\tSTATUS")
+	for _, r := range runs {
+		status := "ok"
+		switch {
+		case r.Error != nil:
+			status = "error: " + *r.Error
+		case r.FinishedAt == nil:
+			status = "incomplete"
+		}
+		tenant := r.TenantID
+		if tenant == "" {
+			tenant = "-"
+		}
+		dates := "-"
+		if r.FromDate != nil && r.ToDate != nil {
+			dates = r.FromDate.Format("2006-01-02") + " to " + r.ToDate.Format("2006-01-02")
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%t\t%s\t%d\t%d\t%s\t%s\n",
+			r.ID,
+			r.Entity,
+			tenant,
+			formatTime(&r.StartedAt),
+			formatTime(r.FinishedAt),
+			dates,
+			r.FullSync,
+			formatTime(r.IfModifiedSince),
+			r.RecordsFetched,
+			r.RecordsDeleted,
+			formatTime(r.HighWaterMark),
+			status,
+		)
+	}
+	return w.Flush()
+}
+
+// Connections prints the Xero organisations (tenants) the application is authorised
+// to access, marking the one synced by default.
+func (a *App) Connections(ctx context.Context, cfgPath string) error {
+	cfg, err := config.Load(cfgPath)
+	if err != nil {
+		return err
+	}
+	connections, err := xero.Connections(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	if len(connections) == 0 {
+		fmt.Println("No Xero organisations are connected. Run 'login xero' to connect one.")
+		return nil
+	}
+
+	// There is no default if several organisations are connected and none is
+	// configured.
+	var defaultID string
+	if c, err := xero.SelectTenant(connections, cfg, ""); err == nil {
+		defaultID = c.TenantID
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\tTENANT ID\tNAME\tTYPE")
+	for _, c := range connections {
+		mark := ""
+		if c.TenantID == defaultID {
+			mark = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", mark, c.TenantID, c.TenantName, c.TenantType)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if defaultID == "" {
+		fmt.Println("\nSeveral organisations are connected: set tenant_id or tenant_name in the configuration or use sync --tenant.")
+	}
+	return nil
+}
+
+// UpdateReference sets the reference of the Xero record of recordType, which should be
+// one of "invoice" or "bank-transaction", and refreshes the local record from the
+// record Xero returns. The record is updated in the Xero organisation with the tenant
+// id or name, or in the organisation of the synced record if tenant is empty.
+func (a *App) UpdateReference(ctx context.Context, cfgPath, recordType, id, reference, tenant string) error {
+	if recordType != "invoice" && recordType != "bank-transaction" {
+		return fmt.Errorf("unknown record type %q, expected invoice or bank-transaction", recordType)
+	}
+	cfg, dbConn, err := openDB(cfgPath)
+	if err != nil {
+		return err
+	}
+	defer dbConn.Close()
+
+	// Records which have not been synced are updated in the default organisation.
+	if tenant == "" {
+		var lookupErr error
+		if recordType == "invoice" {
+			var invoice db.WRInvoice
+			invoice, _, lookupErr = dbConn.InvoiceWRGet(ctx, id)
+			tenant = invoice.TenantID
+		} else {
+			var transaction db.WRTransaction
+			transaction, _, lookupErr = dbConn.BankTransactionWRGet(ctx, id)
+			tenant = transaction.TenantID
+		}
+		if lookupErr != nil && !errors.Is(lookupErr, sql.ErrNoRows) {
+			return lookupErr
+		}
+	}
+
+	client, err := xero.NewClientForTenant(ctx, cfg, tenant)
+	if err != nil {
+		return err
+	}
+	if recordType == "invoice" {
+		updated, err := client.UpdateInvoiceReference(ctx, id, reference)
+		if err != nil {
+			return fmt.Errorf("failed to update invoice %s: %w", id, err)
+		}
+		err = dbConn.InvoicesUpsert(ctx, client.TenantID(), []xero.Invoice{updated})
+	} else {
+		updated, err := client.UpdateBankTransactionReference(ctx, id, reference)
+		if err != nil {
+			return fmt.Errorf("failed to update bank transaction %s: %w", id, err)
+		}
+		err = dbConn.BankTransactionsUpsert(ctx, client.TenantID(), []xero.BankTransaction{updated})
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Updated the reference of %s %s to %q.", recordType, id, reference)
+	return nil
+}
+
+// UpdateDonationRefs sets the linking field of any number of Salesforce donations, with
+// the outcome of each update printed, and then updates the local donations updated in
+// Salesforce. If allOrNone is set, the donations already updated are restored if any
+// update fails. No donations are updated if any reference is used by more than one
+// Xero organisation, as donations are linked by the reference alone.
+func (a *App) UpdateDonationRefs(ctx context.Context, cfgPath string, updates []salesforce.RefUpdate, allOrNone bool) error {
+	cfg, dbConn, err := openDB(cfgPath)
+	if err != nil {
+		return err
+	}
+	defer dbConn.Close()
+
+	checked := map[string]bool{}
+	for _, u := range updates {
+		if u.Reference == "" || checked[u.Reference] {
+			continue
+		}
+		checked[u.Reference] = true
+		tenants, err := dbConn.PayoutReferenceTenants(ctx, u.Reference)
+		if err != nil {
+			return err
+		}
+		if tenants > 1 {
+			return fmt.Errorf("reference %q is used by %d Xero organisations, so donations cannot be linked to it", u.Reference, tenants)
+		}
+	}
+
+	client, err := salesforce.NewClient(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create Salesforce client: %w", err)
+	}
+	log.Printf("Updating %d donations...", len(updates))
+	report, updateErr := client.UpdateOpportunityRefs(ctx, updates, allOrNone)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tREFERENCE\tSTATUS\tERRORS")
+	updated := map[string][]string{} // the ids of the updated donations by reference
+	for _, r := range report {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.ID, r.Reference, r.Status, strings.Join(r.Errors, "; "))
+		if r.Status == salesforce.RefUpdated {
+			updated[r.Reference] = append(updated[r.Reference], r.ID)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	for reference, ids := range updated {
+		if err := dbConn.DonationsPayoutReferenceUpdate(ctx, reference, "", ids); err != nil {
+			return err
+		}
+	}
+	if updateErr != nil {
+		return fmt.Errorf("update failed: %d of %d donations updated", report.Count(salesforce.RefUpdated), len(updates))
+	}
+	log.Printf("Updated %d donations.", len(updates))
+	return nil
+}
+
+// Wipe removes local data for security and confidentiality. It revokes the OAuth2
+// tokens and deletes the token files and the database files.
+func (a *App) Wipe(ctx context.Context, cfgPath string) error {
+	cfg, err := config.Load(cfgPath)
+	if err != nil {
+		return err
+	}
+
+	// Tokens are revoked with each service so that no live refresh token remains.
+	// Revocation failures, such as when offline, are reported but do not prevent the
+	// local files being removed.
+	log.Printf("Revoking Xero token and deleting token file at: %s", cfg.Xero.TokenFilePath)
+	if err := xero.RevokeAndDeleteToken(ctx, cfg); err != nil {
+		log.Printf("Warning: %v", err)
+		if _, statErr := os.Stat(cfg.Xero.TokenFilePath); statErr == nil {
+			return fmt.Errorf("failed to delete xero token file: %w", err)
+		}
+	}
+
+	log.Printf("Revoking Salesforce token and deleting token file at: %s", cfg.Salesforce.TokenFilePath)
+	if err := salesforce.RevokeAndDeleteToken(ctx, cfg); err != nil {
+		log.Printf("Warning: %v", err)
+		if _, statErr := os.Stat(cfg.Salesforce.TokenFilePath); statErr == nil {
+			return fmt.Errorf("failed to delete salesforce token file: %w", err)
+		}
+	}
+
+	// The database runs in WAL mode, so the write-ahead log and shared memory files
+	// are removed too.
+	log.Printf("Deleting database file at: %s", cfg.DatabasePath)
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Remove(cfg.DatabasePath + suffix); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete database file: %w", err)
+		}
+	}
+
+	log.Println("Wipe complete.")
+	return nil
+}
+
+// MigrateTokens moves the saved Xero and Salesforce tokens from the configured token
+// store to the store of kind to, rewriting each token file in place. Services with no
+// saved token are skipped.
+func (a *App) MigrateTokens(ctx context.Context, cfgPath, to string) error {
+	cfg, err := config.Load(cfgPath)
+	if err != nil {
+		return err
+	}
+	if to == cfg.TokenStore {
+		return fmt.Errorf("tokens are already in the %q token store", to)
+	}
+
+	services := []struct {
+		name  string
+		path  string
+		store func(*config.Config) (tokenstore.Store, error)
+	}{
+		{"Xero", cfg.Xero.TokenFilePath, xero.TokenStore},
+		{"Salesforce", cfg.Salesforce.TokenFilePath, salesforce.TokenStore},
+	}
+	for _, s := range services {
+		from, err := s.store(cfg)
+		if err != nil {
+			return err
+		}
+		toStore, err := tokenstore.New(to, s.path, cfg.TokenPassphrase)
+		if err != nil {
+			return err
+		}
+		ok, err := tokenstore.Migrate(from, toStore)
+		if err != nil {
+			return fmt.Errorf("failed to migrate %s token: %w", s.name, err)
+		}
+		if !ok {
+			log.Printf("No %s token found at %s, skipping.", s.name, s.path)
+			continue
+		}
+		log.Printf("Migrated %s token at %s to the %s store.", s.name, s.path, to)
+	}
+
+	log.Printf("Set token_store to %q in %s to use the migrated tokens.", to, cfgPath)
+	return nil
+}
+
+// InitDB creates the database and applies any pending schema migrations.
+func (a *App) InitDB(ctx context.Context, cfgPath string) error {
+	cfg, dbConn, err := openDB(cfgPath)
+	if err != nil {
+		return err
+	}
+	defer dbConn.Close()
+	version, err := dbConn.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("Database at %s is at schema version %d.", cfg.DatabasePath, version)
+	return nil
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"reconciler/apiclients/salesforce"
+	"reconciler/syncer"
+
+	"github.com/urfave/cli/v3"
+)
+
+// Applicator defines the interface for the core application logic.
+// This allows the CLI to be tested independently of the main app implementation.
+type Applicator interface {
+	Serve(ctx context.Context, cfgPath string) error
+	Login(ctx context.Context, cfgPath, service string) error
+	Sync(ctx context.Context, cfgPath string, entities []syncer.Entity, opts syncer.Options) error
+	Connections(ctx context.Context, cfgPath string) error
+	History(ctx context.Context, cfgPath string, entity syncer.Entity, limit int) error
+	UpdateReference(ctx context.Context, cfgPath, recordType, id, reference, tenant string) error
+	UpdateDonationRefs(ctx context.Context, cfgPath string, updates []salesforce.RefUpdate, allOrNone bool) error
+	Wipe(ctx context.Context, cfgPath string) error
+	MigrateTokens(ctx context.Context, cfgPath, to string) error
+	InitDB(ctx context.Context, cfgPath string) error
+	Doctor(ctx context.Context, cfgPath string) error
+}
+
+// BuildCLI creates the full CLI command structure for the application.
+// It injects the core application logic (the Applicator) into the command actions.
+func BuildCLI(app Applicator) *cli.Command {
+	// Define flags that are common across multiple commands.
+	configFlag := &cli.StringFlag{
+		Name:    "config",
+		Aliases: []string{"c"},
+		Value:   "config.yaml",
+		Usage:   "path to the configuration file",
+	}
+
+	agoFlag := &cli.StringFlag{
+		Name:    "ago",
+		Usage:   "only refresh records updated within this duration (e.g., '2h', '15m')",
+		Aliases: []string{"a"},
+	}
+
+	sinceFlag := &cli.StringFlag{
+		Name:    "since",
+		Usage:   "only refresh records updated since this timestamp (format: '2006-01-02T15:04:05Z')",
+		Aliases: []string{"s"},
+	}
+
+	fromDateFlag := &cli.StringFlag{
+		Name:    "fromDate",
+		Usage:   "start date for the date range to sync (format: '2006-01-02')",
+		Aliases: []string{"f"},
+	}
+
+	toDateFlag := &cli.StringFlag{
+		Name:  "toDate",
+		Usage: "inclusive end date for the date range to sync (format: '2006-01-02'), defaulting to a year after --fromDate",
+	}
+
+	fullFlag := &cli.BoolFlag{
+		Name:  "full",
+		Usage: "refresh all records, ignoring the last successful sync time",
+	}
+
+	tenantFlag := &cli.StringFlag{
+		Name:    "tenant",
+		Usage:   "the id or name of the Xero organisation to sync, overriding the configuration",
+		Aliases: []string{"t"},
+	}
+
+	// Define all application commands.
+	serveCmd := &cli.Command{
+		Name:  "serve",
+		Usage: "Run the reconciler web application",
+		Flags: []cli.Flag{configFlag},
+		Action: func(ctx context.Context, c *cli.Command) error {
+			return app.Serve(ctx, c.String("config"))
+		},
+	}
+
+	loginCmd := &cli.Command{
+		Name:  "login",
+		Usage: "Authorize the application with your Xero or Salesforce account",
+		Commands: []*cli.Command{
+			{
+				Name:  "xero",
+				Usage: "Authorize the application with your Xero account",
+				Flags: []cli.Flag{configFlag},
+				Action: func(ctx context.Context, c *cli.Command) error {
+					return app.Login(ctx, c.String("config"), "xero")
+				},
+			},
+			{
+				Name:  "salesforce",
+				Usage: "Authorize the application with your Salesforce account",
+				Flags: []cli.Flag{configFlag},
+				Action: func(ctx context.Context, c *cli.Command) error {
+					return app.Login(ctx, c.String("config"), "salesforce")
+				},
+			},
+		},
+	}
+
+	syncCmd := &cli.Command{
+		Name:      "sync",
+		Usage:     "Fetch and save records from Xero and Salesforce",
+		ArgsUsage: "[accounts|contacts|tracking-categories|invoices|payments|credit-notes|bank-transactions|donations ...]",
+		Description: "By default only records modified since the last successful sync of each\n" +
+			"entity are fetched. Use --since or --ago to set the modification time\n" +
+			"explicitly, or --full to fetch all records.\n\n" +
+			"Records dated within a year of the configured data start date are fetched\n" +
+			"unless --fromDate and --toDate are set. Ranges longer than a year are\n" +
+			"fetched a year at a time.",
+		Flags: []cli.Flag{configFlag, agoFlag, sinceFlag, fromDateFlag, toDateFlag, fullFlag, tenantFlag},
+		Action: func(ctx context.Context, c *cli.Command) error {
+			entities, err := parseEntities(c.Args().Slice())
+			if err != nil {
+				return err
+			}
+			opts, err := parseDateFlags(c.String("fromDate"), c.String("toDate"), c.String("since"), c.String("ago"))
+			if err != nil {
+				return err
+			}
+			opts.Full = c.Bool("full")
+			opts.Tenant = c.String("tenant")
+			if opts.Full && !opts.IfModifiedSince.IsZero() {
+				return fmt.Errorf("--full cannot be used with --since or --ago")
+			}
+			return app.Sync(ctx, c.String("config"), entities, opts)
+		},
+	}
+
+	connectionsCmd := &cli.Command{
+		Name:  "connections",
+		Usage: "List the Xero organisations the application is connected to",
+		Description: "Shows the id, name and type of each connected organisation. The\n" +
+			"organisation synced by default is marked with an asterisk; set tenant_id\n" +
+			"or tenant_name in the configuration, or use sync --tenant, to choose another.",
+		Flags: []cli.Flag{configFlag},
+		Action: func(ctx context.Context, c *cli.Command) error {
+			return app.Connections(ctx, c.String("config"))
+		},
+	}
+
+	historyCmd := &cli.Command{
+		Name:      "history",
+		Usage:     "Show the history of past syncs",
+		ArgsUsage: "[accounts|contacts|tracking-categories|invoices|payments|credit-notes|bank-transactions|donations]",
+		Flags: []cli.Flag{
+			configFlag,
+			&cli.IntFlag{
+				Name:    "limit",
+				Aliases: []string{"n"},
+				Value:   20,
+				Usage:   "the maximum number of runs to show",
+			},
+		},
+		Action: func(ctx context.Context, c *cli.Command) error {
+			if c.Args().Len() > 1 {
+				return fmt.Errorf("history takes at most one entity, got %d", c.Args().Len())
+			}
+			var entity syncer.Entity
+			if c.Args().Present() {
+				var err error
+				entity, err = syncer.ParseEntity(c.Args().First())
+				if err != nil {
+					return err
+				}
+			}
+			if c.Int("limit") < 1 {
+				return fmt.Errorf("--limit must be at least 1")
+			}
+			return app.History(ctx, c.String("config"), entity, c.Int("limit"))
+		},
+	}
+
+	// referenceCmd sets the reference of an invoice or bank transaction in Xero.
+	referenceCmd := &cli.Command{
+		Name:  "reference",
+		Usage: "Update the reference of a Xero invoice or bank transaction",
+		Description: "Writes the reference to Xero and refreshes the local record from the\n" +
+			"updated Xero record. The record is updated in the Xero organisation it was\n" +
+			"synced from unless --tenant is set.",
+	}
+	for _, recordType := range []string{"invoice", "bank-transaction"} {
+		referenceCmd.Commands = append(referenceCmd.Commands, &cli.Command{
+			Name:      recordType,
+			Usage:     fmt.Sprintf("Update the reference of a Xero %s", strings.ReplaceAll(recordType, "-", " ")),
+			ArgsUsage: "<id> <reference>",
+			Flags: []cli.Flag{
+				configFlag,
+				&cli.StringFlag{
+					Name:    "tenant",
+					Usage:   "the id or name of the Xero organisation holding the record",
+					Aliases: []string{"t"},
+				},
+			},
+			Action: func(ctx context.Context, c *cli.Command) error {
+				if c.Args().Len() != 2 {
+					return fmt.Errorf("%s reference requires an id and a reference, got %d arguments", recordType, c.Args().Len())
+				}
+				id, reference := c.Args().Get(0), strings.TrimSpace(c.Args().Get(1))
+				return app.UpdateReference(ctx, c.String("config"), recordType, id, reference, c.String("tenant"))
+			},
+		})
+	}
+
+	// donationRefsCmd sets the linking field of Salesforce donations from a CSV file.
+	donationRefsCmd := &cli.Command{
+		Name:      "donation-refs",
+		Usage:     "Update the linking field of Salesforce donations from a CSV file",
+		ArgsUsage: "<csv file>",
+		Description: "Reads a CSV file of id,reference rows, with an optional header row, and\n" +
+			"sets the configured linking field of each donation in Salesforce, in requests\n" +
+			"of up to 200 records, before updating the local donations. An empty\n" +
+			"reference clears the field. The outcome of each update is printed.",
+		Flags: []cli.Flag{
+			configFlag,
+			&cli.BoolFlag{
+				Name:  "all-or-none",
+				Usage: "restore the donations already updated if any update fails",
+			},
+		},
+		Action: func(ctx context.Context, c *cli.Command) error {
+			if c.Args().Len() != 1 {
+				return fmt.Errorf("donation-refs requires a csv file, got %d arguments", c.Args().Len())
+			}
+			updates, err := readRefUpdates(c.Args().First())
+			if err != nil {
+				return err
+			}
+			return app.UpdateDonationRefs(ctx, c.String("config"), updates, c.Bool("all-or-none"))
+		},
+	}
+
+	wipeCmd := &cli.Command{
+		Name:  "wipe",
+		Usage: "Delete the local token and database files for security",
+		Flags: []cli.Flag{configFlag},
+		Action: func(ctx context.Context, c *cli.Command) error {
+			return app.Wipe(ctx, c.String("config"))
+		},
+	}
+
+	migrateTokensCmd := &cli.Command{
+		Name:  "migrate-tokens",
+		Usage: "Move the saved Xero and Salesforce tokens to another token store",
+		Description: "Rewrites the token files from the configured token_store to the store\n" +
+			"given by --to, after which token_store should be updated to match. The\n" +
+			"encrypted store reads its passphrase from RECONCILER_TOKEN_PASSPHRASE.",
+		Flags: []cli.Flag{
+			configFlag,
+			&cli.StringFlag{
+				Name:     "to",
+				Usage:    "the token store to migrate to: file or encrypted",
+				Required: true,
+			},
+		},
+		Action: func(ctx context.Context, c *cli.Command) error {
+			switch to := c.String("to"); to {
+			case "file", "encrypted":
+				return app.MigrateTokens(ctx, c.String("config"), to)
+			default:
+				return fmt.Errorf("invalid --to %q, expected file or encrypted", to)
+			}
+		},
+	}
+
+	initDBCmd := &cli.Command{
+		Name:  "init-db",
+		Usage: "Create the database and apply any pending schema migrations",
+		Flags: []cli.Flag{configFlag},
+		Action: func(ctx context.Context, c *cli.Command) error {
+			return app.InitDB(ctx, c.String("config"))
+		},
+	}
+
+	doctorCmd := &cli.Command{
+		Name:  "doctor",
+		Usage: "Check the configuration against the Salesforce metadata",
+		Description: "Loads the configuration and checks that the Salesforce linking field\n" +
+			"exists and is updateable, that the fields selected by the query exist, and\n" +
+			"that the field mappings refer to fields selected by the query. The same\n" +
+			"check is made when the web server starts.",
+		Flags: []cli.Flag{configFlag},
+		Action: func(ctx context.Context, c *cli.Command) error {
+			return app.Doctor(ctx, c.String("config"))
+		},
+	}
+
+	// Assemble the root command.
+	rootCmd := &cli.Command{
+		Name:     "reconciler",
+		Usage:    "Reconcile Xero invoices and bank transactions with Salesforce donations",
+		Commands: []*cli.Command{serveCmd, loginCmd, syncCmd, connectionsCmd, historyCmd, referenceCmd, donationRefsCmd, wipeCmd, migrateTokensCmd, initDBCmd, doctorCmd},
+	}
+
+	return rootCmd
+}
+
+// parseEntities converts the provided sync entity names to syncer entities.
+func parseEntities(names []string) ([]syncer.Entity, error) {
+	entities := make([]syncer.Entity, 0, len(names))
+	for _, name := range names {
+		entity, err := syncer.ParseEntity(name)
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, entity)
+	}
+	return entities, nil
+}
+
+// readRefUpdates reads the id,reference rows of a CSV file. A first row with the
+// column name "id" is treated as a header.
+func readRefUpdates(path string) ([]salesforce.RefUpdate, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open csv file: %w", err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 2
+	r.TrimLeadingSpace = true
+	var updates []salesforce.RefUpdate
+	for line := 1; ; line++ {
+		row, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read csv file: %w", err)
+		}
+		if line == 1 && strings.EqualFold(strings.TrimSpace(row[0]), "id") {
+			continue
+		}
+		id := strings.TrimSpace(row[0])
+		if id == "" {
+			return nil, fmt.Errorf("csv line %d: missing donation id", line)
+		}
+		updates = append(updates, salesforce.RefUpdate{ID: id, Reference: strings.TrimSpace(row[1])})
+	}
+	if len(updates) == 0 {
+		return nil, fmt.Errorf("no updates found in %s", path)
+	}
+	return updates, nil
+}
+
+// parseDateFlags processes the date-related flags and returns the sync options they
+// set. It enforces mutual exclusivity between --since and --ago, and that --toDate is
+// not before --fromDate.
+func parseDateFlags(fromDateStr, toDateStr, sinceStr, agoStr string) (syncer.Options, error) {
+	var opts syncer.Options
+	var err error
+
+	if fromDateStr != "" {
+		opts.FromDate, err = time.Parse("2006-01-02", fromDateStr)
+		if err != nil {
+			return opts, fmt.Errorf("invalid --fromDate format: %w", err)
+		}
+	}
+
+	if toDateStr != "" {
+		opts.ToDate, err = time.Parse("2006-01-02", toDateStr)
+		if err != nil {
+			return opts, fmt.Errorf("invalid --toDate format: %w", err)
+		}
+		if !opts.FromDate.IsZero() && opts.ToDate.Before(opts.FromDate) {
+			return opts, fmt.Errorf("--toDate cannot be before --fromDate")
+		}
+	}
+
+	if sinceStr != "" && agoStr != "" {
+		return opts, fmt.Errorf("--since and --ago flags are mutually exclusive")
+	}
+
+	if sinceStr != "" {
+		opts.IfModifiedSince, err = time.Parse("2006-01-02T15:04:05Z", sinceStr)
+		if err != nil {
+			return opts, fmt.Errorf("invalid --since format: %w", err)
+		}
+	}
+
+	if agoStr != "" {
+		duration, err := time.ParseDuration(agoStr)
+		if err != nil {
+			return opts, fmt.Errorf("invalid --ago duration format: %w", err)
+		}
+		opts.IfModifiedSince = time.Now().Add(-duration)
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"reconciler/apiclients/salesforce"
+	"reconciler/syncer"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeApp is a fake Applicator recording the calls made by the CLI.
+type fakeApp struct {
+	calls    []string
+	entities []syncer.Entity
+	opts     syncer.Options
+	limit    int
+	updates  []salesforce.RefUpdate
+}
+
+func (f *fakeApp) Serve(ctx context.Context, cfgPath string) error {
+	f.calls = append(f.calls, "serve "+cfgPath)
+	return nil
+}
+
+func (f *fakeApp) Login(ctx context.Context, cfgPath, service string) error {
+	f.calls = append(f.calls, "login "+service+" "+cfgPath)
+	return nil
+}
+
+func (f *fakeApp) Sync(ctx context.Context, cfgPath string, entities []syncer.Entity, opts syncer.Options) error {
+	f.calls = append(f.calls, "sync "+cfgPath)
+	f.entities = entities
+	f.opts = opts
+	return nil
+}
+
+func (f *fakeApp) Connections(ctx context.Context, cfgPath string) error {
+	f.calls = append(f.calls, "connections "+cfgPath)
+	return nil
+}
+
+func (f *fakeApp) History(ctx context.Context, cfgPath string, entity syncer.Entity, limit int) error {
+	f.calls = append(f.calls, "history "+string(entity)+" "+cfgPath)
+	f.limit = limit
+	return nil
+}
+
+func (f *fakeApp) UpdateReference(ctx context.Context, cfgPath, recordType, id, reference, tenant string) error {
+	f.calls = append(f.calls, strings.Join([]string{"reference", recordType, id, reference, tenant, cfgPath}, " "))
+	return nil
+}
+
+func (f *fakeApp) UpdateDonationRefs(ctx context.Context, cfgPath string, updates []salesforce.RefUpdate, allOrNone bool) error {
+	f.calls = append(f.calls, fmt.Sprintf("donation-refs %t %s", allOrNone, cfgPath))
+	f.updates = updates
+	return nil
+}
+
+func (f *fakeApp) Wipe(ctx context.Context, cfgPath string) error {
+	f.calls = append(f.calls, "wipe "+cfgPath)
+	return nil
+}
+
+func (f *fakeApp) MigrateTokens(ctx context.Context, cfgPath, to string) error {
+	f.calls = append(f.calls, "migrate-tokens "+to+" "+cfgPath)
+	return nil
+}
+
+func (f *fakeApp) InitDB(ctx context.Context, cfgPath string) error {
+	f.calls = append(f.calls, "init-db "+cfgPath)
+	return nil
+}
+
+func (f *fakeApp) Doctor(ctx context.Context, cfgPath string) error {
+	f.calls = append(f.calls, "doctor "+cfgPath)
+	return nil
+}
+
+func TestCLI(t *testing.T) {
+
+	date := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name     string
+		args     []string
+		calls    []string
+		entities []syncer.Entity
+		opts     syncer.Options
+		limit    int
+		isErr    bool
+	}{
+		{
+			name:  "serve",
+			args:  []string{"serve"},
+			calls: []string{"serve config.yaml"},
+		},
+		{
+			name:  "login xero",
+			args:  []string{"login", "xero", "-c", "other.yaml"},
+			calls: []string{"login xero other.yaml"},
+		},
+		{
+			name:  "login salesforce",
+			args:  []string{"login", "salesforce"},
+			calls: []string{"login salesforce config.yaml"},
+		},
+		{
+			name:     "sync some",
+			args:     []string{"sync", "--fromDate", "2024-04-01", "invoices", "donations"},
+			calls:    []string{"sync config.yaml"},
+			entities: []syncer.Entity{syncer.Invoices, syncer.Donations},
+			opts:     syncer.Options{FromDate: date(2024, 4, 1)},
+		},
+		{
+			name:     "sync date range",
+			args:     []string{"sync", "--fromDate", "2022-04-01", "--toDate", "2025-03-31", "invoices"},
+			calls:    []string{"sync config.yaml"},
+			entities: []syncer.Entity{syncer.Invoices},
+			opts:     syncer.Options{FromDate: date(2022, 4, 1), ToDate: date(2025, 3, 31)},
+		},
+		{
+			name:  "sync reversed date range",
+			args:  []string{"sync", "--fromDate", "2025-04-01", "--toDate", "2025-03-31"},
+			isErr: true,
+		},
+		{
+			name:  "sync invalid to date",
+			args:  []string{"sync", "--toDate", "31/03/2025"},
+			isErr: true,
+		},
+		{
+			name:  "sync unknown entity",
+			args:  []string{"sync", "journals"},
+			isErr: true,
+		},
+		{
+			name:  "sync since and ago",
+			args:  []string{"sync", "--since", "2025-01-01T00:00:00Z", "--ago", "2h"},
+			isErr: true,
+		},
+		{
+			name:     "sync full",
+			args:     []string{"sync", "--full"},
+			calls:    []string{"sync config.yaml"},
+			entities: []syncer.Entity{},
+			opts:     syncer.Options{Full: true},
+		},
+		{
+			name:     "sync tenant",
+			args:     []string{"sync", "--tenant", "Charity B", "invoices"},
+			calls:    []string{"sync config.yaml"},
+			entities: []syncer.Entity{syncer.Invoices},
+			opts:     syncer.Options{Tenant: "Charity B"},
+		},
+		{
+			name:  "connections",
+			args:  []string{"connections"},
+			calls: []string{"connections config.yaml"},
+		},
+		{
+			name:  "sync full and since",
+			args:  []string{"sync", "--full", "--ago", "2h"},
+			isErr: true,
+		},
+		{
+			name:  "history",
+			args:  []string{"history"},
+			calls: []string{"history  config.yaml"},
+			limit: 20,
+		},
+		{
+			name:  "history entity with limit",
+			args:  []string{"history", "-n", "5", "invoices"},
+			calls: []string{"history invoices config.yaml"},
+			limit: 5,
+		},
+		{
+			name:  "history unknown entity",
+			args:  []string{"history", "journals"},
+			isErr: true,
+		},
+		{
+			name:  "doctor",
+			args:  []string{"doctor", "-c", "other.yaml"},
+			calls: []string{"doctor other.yaml"},
+		},
+		{
+			name:  "migrate tokens",
+			args:  []string{"migrate-tokens", "--to", "encrypted"},
+			calls: []string{"migrate-tokens encrypted config.yaml"},
+		},
+		{
+			name:  "migrate tokens unknown store",
+			args:  []string{"migrate-tokens", "--to", "keychain"},
+			isErr: true,
+		},
+		{
+			name:  "migrate tokens without store",
+			args:  []string{"migrate-tokens"},
+			isErr: true,
+		},
+		{
+			name:  "reference invoice",
+			args:  []string{"reference", "invoice", "inv-001", "JG-PAYOUT-2025-04-15"},
+			calls: []string{"reference invoice inv-001 JG-PAYOUT-2025-04-15  config.yaml"},
+		},
+		{
+			name:  "reference bank transaction with tenant",
+			args:  []string{"reference", "bank-transaction", "--tenant", "Charity B", "bt-001", "JG-PAYOUT-2025-04-15"},
+			calls: []string{"reference bank-transaction bt-001 JG-PAYOUT-2025-04-15 Charity B config.yaml"},
+		},
+		{
+			name:  "reference without reference",
+			args:  []string{"reference", "invoice", "inv-001"},
+			isErr: true,
+		},
+		{
+			name:  "wipe",
+			args:  []string{"wipe"},
+			calls: []string{"wipe config.yaml"},
+		},
+		{
+			name:  "init-db",
+			args:  []string{"init-db"},
+			calls: []string{"init-db config.yaml"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fa := &fakeApp{}
+			cmd := BuildCLI(fa)
+			err := cmd.Run(context.Background(), append([]string{"reconciler"}, tt.args...))
+			if tt.isErr {
+				if err == nil {
+					t.Fatal("expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tt.calls, fa.calls); diff != "" {
+				t.Errorf("calls diff:\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.entities, fa.entities); diff != "" {
+				t.Errorf("entities diff:\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.opts, fa.opts); diff != "" {
+				t.Errorf("options diff:\n%s", diff)
+			}
+			if got, want := fa.limit, tt.limit; got != want {
+				t.Errorf("got limit %d want %d", got, want)
+			}
+		})
+	}
+}
+
+// TestDonationRefs tests reading the donation reference updates from a CSV file.
+func TestDonationRefs(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		csv     string
+		args    []string
+		want    []salesforce.RefUpdate
+		wantErr string
+	}{
+		{
+			name: "with header",
+			csv:  "id,reference\n006-01, JG-PAYOUT-2025-06-01\n006-02,\n",
+			args: []string{"--all-or-none"},
+			want: []salesforce.RefUpdate{{ID: "006-01", Reference: "JG-PAYOUT-2025-06-01"}, {ID: "006-02"}},
+		},
+		{
+			name: "without header",
+			csv:  "006-01,JG-PAYOUT-2025-06-01\n",
+			want: []salesforce.RefUpdate{{ID: "006-01", Reference: "JG-PAYOUT-2025-06-01"}},
+		},
+		{name: "missing id", csv: "id,reference\n,JG-PAYOUT-2025-06-01\n", wantErr: "line 2"},
+		{name: "extra column", csv: "006-01,JG-PAYOUT-2025-06-01,x\n", wantErr: "wrong number of fields"},
+		{name: "empty", csv: "id,reference\n", wantErr: "no updates"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "refs.csv")
+			if err := os.WriteFile(path, []byte(tt.csv), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			fa := &fakeApp{}
+			args := append([]string{"reconciler", "donation-refs"}, tt.args...)
+			err := BuildCLI(fa).Run(context.Background(), append(args, path))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantCalls := []string{fmt.Sprintf("donation-refs %t config.yaml", len(tt.args) > 0)}
+			if diff := cmp.Diff(wantCalls, fa.calls); diff != "" {
+				t.Errorf("calls diff:\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.want, fa.updates); diff != "" {
+				t.Errorf("updates diff:\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"reconciler/app"
+	"reconciler/internal/usermsg"
+)
+
+// main is the entry point for the application.
+// It initializes the core application logic, builds the CLI interface,
+// and executes the command provided by the user.
+func main() {
+	// Cancel the context on an interrupt so that long-running commands, such as
+	// `serve`, can shut down gracefully.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Create the core application object which contains the business logic.
+	application := app.New()
+
+	// Build the CLI command structure, injecting the application logic.
+	cmd := BuildCLI(application)
+
+	// Run the CLI, passing command-line arguments.
+	if err := cmd.Run(ctx, os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", usermsg.ErrorMessage("", err))
+		os.Exit(1)
+	}
+}
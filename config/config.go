@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
+	"reconciler/apiclients/tokenstore"
+
 	"golang.org/x/oauth2"
 	"gopkg.in/yaml.v2"
 )
@@ -18,9 +21,11 @@ type Config struct {
 	Web                     WebConfig        `yaml:"web"`
 	DataStartDateStr        string           `yaml:"data_date_start"`
 	DonationAccountPrefixes []string         `yaml:"donation_account_prefixes"`
+	TokenStore              string           `yaml:"token_store"`
 	Xero                    XeroConfig       `yaml:"xero"`
 	Salesforce              SalesforceConfig `yaml:"salesforce"`
 	DataStartDate           time.Time        // Parsed from DataStartDateStr
+	TokenPassphrase         string           `yaml:"-"` // From the environment
 }
 
 // WebConfig holds settings specific to the web server.
@@ -33,27 +38,128 @@ type WebConfig struct {
 	DevMode            bool   `yaml:"dev_mode"`
 }
 
-// XeroConfig holds Xero-specific settings.
+// XeroConfig holds Xero-specific settings. TenantID or TenantName select the Xero
+// organisation to use when more than one is connected. Invoices and BankTransactions
+// select the types and statuses of each entity to sync.
 type XeroConfig struct {
-	ClientID      string `yaml:"client_id"`
-	ClientSecret  string `yaml:"client_secret"`
-	TokenFilePath string `yaml:"token_file_path"`
-	OAuth2Config  *oauth2.Config
+	ClientID         string           `yaml:"client_id"`
+	ClientSecret     string           `yaml:"client_secret"`
+	TokenFilePath    string           `yaml:"token_file_path"`
+	TenantID         string           `yaml:"tenant_id"`
+	TenantName       string           `yaml:"tenant_name"`
+	Invoices         XeroFilterConfig `yaml:"invoices"`
+	BankTransactions XeroFilterConfig `yaml:"bank_transactions"`
+	OAuth2Config     *oauth2.Config
+}
+
+// XeroFilterConfig holds the types and statuses of a Xero entity to sync.
+type XeroFilterConfig struct {
+	Types    []string `yaml:"types"`
+	Statuses []string `yaml:"statuses"`
+}
+
+// Default Xero filters, used for any types or statuses not set in the configuration.
+var (
+	DefaultXeroInvoices = XeroFilterConfig{
+		Types:    []string{"ACCREC"},
+		Statuses: []string{"AUTHORISED", "PAID", "VOIDED"},
+	}
+	DefaultXeroBankTransactions = XeroFilterConfig{
+		Types:    []string{"RECEIVE"},
+		Statuses: []string{"AUTHORISED", "PAID"},
+	}
+)
+
+// The Xero types and statuses of each entity. See
+// https://developer.xero.com/documentation/api/accounting/types
+var (
+	xeroInvoiceTypes            = []string{"ACCREC", "ACCPAY"}
+	xeroInvoiceStatuses         = []string{"DRAFT", "SUBMITTED", "AUTHORISED", "PAID", "VOIDED", "DELETED"}
+	xeroBankTransactionTypes    = []string{"RECEIVE", "RECEIVE-OVERPAYMENT", "RECEIVE-PREPAYMENT", "SPEND", "SPEND-OVERPAYMENT", "SPEND-PREPAYMENT"}
+	xeroBankTransactionStatuses = []string{"AUTHORISED", "PAID", "DELETED"}
+)
+
+// prepare sets any missing types or statuses from the defaults and checks the
+// remainder are known to Xero, upper-casing them. Name is the configuration key used
+// in errors.
+func (f *XeroFilterConfig) prepare(name string, defaults XeroFilterConfig, types, statuses []string) error {
+	check := func(key string, values, valid, fallback []string) ([]string, error) {
+		if len(values) == 0 {
+			return fallback, nil
+		}
+		checked := make([]string, len(values))
+		for i, v := range values {
+			v = strings.ToUpper(strings.TrimSpace(v))
+			if !slices.Contains(valid, v) {
+				return nil, fmt.Errorf("invalid %s.%s %q, expected one of %s", name, key, values[i], strings.Join(valid, ", "))
+			}
+			checked[i] = v
+		}
+		return checked, nil
+	}
+	var err error
+	if f.Types, err = check("types", f.Types, types, defaults.Types); err != nil {
+		return err
+	}
+	f.Statuses, err = check("statuses", f.Statuses, statuses, defaults.Statuses)
+	return err
+}
+
+// TypesRegex returns the types as a regex string suitable for SQLite, matching any
+// of the types in full.
+func (f XeroFilterConfig) TypesRegex() string {
+	return fmt.Sprintf("^(%s)$", strings.Join(f.Types, "|"))
+}
+
+// StatusesRegex returns the statuses as a regex string suitable for SQLite, matching
+// any of the statuses in full.
+func (f XeroFilterConfig) StatusesRegex() string {
+	return fmt.Sprintf("^(%s)$", strings.Join(f.Statuses, "|"))
 }
 
-// SalesforceConfig holds Salesforce-specific settings.
+// SalesforceConfig holds Salesforce-specific settings. QueryAPI selects how the
+// query is run: with the REST query API, with a Bulk API 2.0 query job, or
+// automatically with a bulk job when more than BulkQueryThreshold records match.
+// CoreFields maps the Name, Amount, CloseDate and StageName of a donation to the
+// fields holding them, where these differ from the standard Opportunity fields.
+// Donations in the ExcludedStage, such as refunds, are not counted towards the
+// totals of the invoices and bank transactions they are linked to.
 type SalesforceConfig struct {
-	LoginDomain      string            `yaml:"login_domain"`
-	ClientID         string            `yaml:"client_id"`
-	ClientSecret     string            `yaml:"client_secret"`
-	TokenFilePath    string            `yaml:"token_file_path"`
-	Query            string            `yaml:"query"`
-	FieldMappings    map[string]string `yaml:"field_mappings"`
-	LinkingObject    string            `yaml:"linking_object"`
-	LinkingFieldName string            `yaml:"linking_field_name"`
-	OAuth2Config     *oauth2.Config
+	LoginDomain        string            `yaml:"login_domain"`
+	ClientID           string            `yaml:"client_id"`
+	ClientSecret       string            `yaml:"client_secret"`
+	TokenFilePath      string            `yaml:"token_file_path"`
+	Query              string            `yaml:"query"`
+	QueryAPI           string            `yaml:"query_api"`
+	BulkQueryThreshold int               `yaml:"bulk_query_threshold"`
+	FieldMappings      map[string]string `yaml:"field_mappings"`
+	CoreFields         map[string]string `yaml:"core_fields"`
+	LinkingObject      string            `yaml:"linking_object"`
+	LinkingFieldName   string            `yaml:"linking_field_name"`
+	ExcludedStage      string            `yaml:"excluded_stage"`
+	OAuth2Config       *oauth2.Config
 }
 
+// The Salesforce query APIs.
+const (
+	SalesforceQueryREST = "rest"
+	SalesforceQueryBulk = "bulk"
+	SalesforceQueryAuto = "auto"
+)
+
+// SalesforceCoreFields are the donation fields which may be set in
+// salesforce.core_fields, as they are held in differently named fields in some
+// NPSP orgs.
+var SalesforceCoreFields = []string{"Name", "Amount", "CloseDate", "StageName"}
+
+// DefaultBulkQueryThreshold is the number of records above which a query is run as a
+// bulk job when salesforce.query_api is "auto".
+const DefaultBulkQueryThreshold = 10000
+
+// DefaultExcludedStage is the stage of donations not counted towards the totals of
+// invoices and bank transactions when salesforce.excluded_stage is not set.
+const DefaultExcludedStage = "Closed Lost"
+
 // Load loads and validates the configuration from the given file path.
 func Load(filePath string) (*Config, error) {
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
@@ -95,6 +201,15 @@ func validateAndPrepare(c *Config) error {
 	if len(c.DonationAccountPrefixes) < 1 {
 		return errors.New("at least one donation_account_prefix should be supplied")
 	}
+	switch c.TokenStore {
+	case "":
+		c.TokenStore = tokenstore.KindFile
+	case tokenstore.KindFile, tokenstore.KindEncrypted:
+	default:
+		return fmt.Errorf("invalid token_store %q, expected %q or %q", c.TokenStore, tokenstore.KindFile, tokenstore.KindEncrypted)
+	}
+	// The passphrase is only required when the encrypted token store is used.
+	c.TokenPassphrase = os.Getenv(tokenstore.PassphraseEnv)
 
 	// Web
 	if c.Web.TemplatesPath == "" {
@@ -124,6 +239,15 @@ func validateAndPrepare(c *Config) error {
 	if xc.TokenFilePath == "" {
 		return errors.New("xero.token_file_path is missing")
 	}
+	if xc.TenantID != "" && xc.TenantName != "" {
+		return errors.New("only one of xero.tenant_id and xero.tenant_name should be set")
+	}
+	if err := xc.Invoices.prepare("xero.invoices", DefaultXeroInvoices, xeroInvoiceTypes, xeroInvoiceStatuses); err != nil {
+		return err
+	}
+	if err := xc.BankTransactions.prepare("xero.bank_transactions", DefaultXeroBankTransactions, xeroBankTransactionTypes, xeroBankTransactionStatuses); err != nil {
+		return err
+	}
 	xc.OAuth2Config = &oauth2.Config{
 		ClientID:     xc.ClientID,
 		ClientSecret: xc.ClientSecret,
@@ -131,7 +255,7 @@ func validateAndPrepare(c *Config) error {
 			AuthURL:  "https://login.xero.com/identity/connect/authorize",
 			TokenURL: "https://identity.xero.com/connect/token",
 		},
-		RedirectURL: "http://localhost:8080/callback/xero",
+		RedirectURL: c.Web.callbackURL(c.Web.XeroCallBack),
 		Scopes:      []string{"accounting.transactions", "accounting.settings.read", "offline_access"},
 	}
 
@@ -155,16 +279,40 @@ func validateAndPrepare(c *Config) error {
 	if !strings.Contains(sc.Query, "{{.WhereClause}}") {
 		return errors.New("salesforce.query must contain '{{.WhereClause}}'")
 	}
+	switch sc.QueryAPI {
+	case "":
+		sc.QueryAPI = SalesforceQueryAuto
+	case SalesforceQueryREST, SalesforceQueryBulk, SalesforceQueryAuto:
+	default:
+		return fmt.Errorf("invalid salesforce.query_api %q, expected %q, %q or %q", sc.QueryAPI, SalesforceQueryREST, SalesforceQueryBulk, SalesforceQueryAuto)
+	}
+	switch {
+	case sc.BulkQueryThreshold < 0:
+		return errors.New("salesforce.bulk_query_threshold cannot be negative")
+	case sc.BulkQueryThreshold == 0:
+		sc.BulkQueryThreshold = DefaultBulkQueryThreshold
+	}
 	if sc.LinkingObject == "" {
 		return errors.New("salesforce.linking_object is missing")
 	}
 	if sc.LinkingFieldName == "" {
 		return errors.New("salesforce.linking_field_name is missing")
 	}
+	if sc.ExcludedStage == "" {
+		sc.ExcludedStage = DefaultExcludedStage
+	}
+	for core, field := range sc.CoreFields {
+		if !slices.Contains(SalesforceCoreFields, core) {
+			return fmt.Errorf("invalid salesforce.core_fields field %q, expected one of %s", core, strings.Join(SalesforceCoreFields, ", "))
+		}
+		if strings.TrimSpace(field) == "" {
+			return fmt.Errorf("salesforce.core_fields.%s is empty", core)
+		}
+	}
 	sc.OAuth2Config = &oauth2.Config{
 		ClientID:     sc.ClientID,
 		ClientSecret: sc.ClientSecret,
-		RedirectURL:  "http://localhost:8080/callback/sf",
+		RedirectURL:  c.Web.callbackURL(c.Web.SalesforceCallBack),
 		Endpoint: oauth2.Endpoint{
 			AuthURL:  fmt.Sprintf("https://%s/services/oauth2/authorize", sc.LoginDomain),
 			TokenURL: fmt.Sprintf("https://%s/services/oauth2/token", sc.LoginDomain),
@@ -175,6 +323,12 @@ func validateAndPrepare(c *Config) error {
 	return nil
 }
 
+// callbackURL returns the full OAuth2 redirect url for the provided callback path,
+// served from the web listen address.
+func (w WebConfig) callbackURL(path string) string {
+	return fmt.Sprintf("http://%s%s", w.ListenAddress, path)
+}
+
 // DonationAccountCodesRegex returns the donation account prefixes as a
 // compiled regex string suitable for SQLite.
 func (c *Config) DonationAccountCodesRegex() string {
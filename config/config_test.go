@@ -1,6 +1,10 @@
 package config
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
 
 func TestConfig(t *testing.T) {
 
@@ -14,3 +18,196 @@ func TestConfig(t *testing.T) {
 	}
 
 }
+
+func TestConfigCallbacks(t *testing.T) {
+
+	config, err := Load("config.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := config.Xero.OAuth2Config.RedirectURL, "http://127.0.0.1:8080/callback/xero"; got != want {
+		t.Errorf("got %s want %s", got, want)
+	}
+	if got, want := config.Salesforce.OAuth2Config.RedirectURL, "http://127.0.0.1:8080/callback/salesforce"; got != want {
+		t.Errorf("got %s want %s", got, want)
+	}
+}
+
+func TestConfigTokenStore(t *testing.T) {
+
+	t.Setenv("RECONCILER_TOKEN_PASSPHRASE", "secret")
+	config, err := Load("config.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := config.TokenStore, "file"; got != want {
+		t.Errorf("got %s want %s", got, want)
+	}
+	if got, want := config.TokenPassphrase, "secret"; got != want {
+		t.Errorf("got %s want %s", got, want)
+	}
+
+	config.TokenStore = "keychain"
+	if err := validateAndPrepare(config); err == nil {
+		t.Error("expected an error for an unknown token store")
+	}
+}
+
+func TestConfigXeroFilters(t *testing.T) {
+
+	config, err := Load("config.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(DefaultXeroBankTransactions, config.Xero.BankTransactions); diff != "" {
+		t.Errorf("bank transactions diff:\n%s", diff)
+	}
+	if got, want := config.Xero.Invoices.TypesRegex(), "^(ACCREC)$"; got != want {
+		t.Errorf("got invoice types regex %q want %q", got, want)
+	}
+	if got, want := config.Xero.Invoices.StatusesRegex(), "^(AUTHORISED|PAID|VOIDED)$"; got != want {
+		t.Errorf("got invoice statuses regex %q want %q", got, want)
+	}
+
+	tests := []struct {
+		name   string
+		filter XeroFilterConfig
+		want   XeroFilterConfig
+		isErr  bool
+	}{
+		{
+			name:   "defaults",
+			filter: XeroFilterConfig{},
+			want:   DefaultXeroBankTransactions,
+		},
+		{
+			name:   "refunds and overpayments",
+			filter: XeroFilterConfig{Types: []string{"receive", "SPEND", "RECEIVE-OVERPAYMENT"}},
+			want: XeroFilterConfig{
+				Types:    []string{"RECEIVE", "SPEND", "RECEIVE-OVERPAYMENT"},
+				Statuses: DefaultXeroBankTransactions.Statuses,
+			},
+		},
+		{
+			name:   "unknown type",
+			filter: XeroFilterConfig{Types: []string{"ACCREC"}},
+			isErr:  true,
+		},
+		{
+			name:   "unknown status",
+			filter: XeroFilterConfig{Statuses: []string{"DRAFT"}},
+			isErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Xero.BankTransactions = tt.filter
+			err := validateAndPrepare(config)
+			if tt.isErr {
+				if err == nil {
+					t.Fatal("expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, config.Xero.BankTransactions); diff != "" {
+				t.Errorf("bank transactions diff:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestConfigSalesforceQueryAPI(t *testing.T) {
+
+	config, err := Load("config.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		api           string
+		threshold     int
+		wantAPI       string
+		wantThreshold int
+		isErr         bool
+	}{
+		{"defaults", "", 0, SalesforceQueryAuto, DefaultBulkQueryThreshold, false},
+		{"bulk", "bulk", 0, SalesforceQueryBulk, DefaultBulkQueryThreshold, false},
+		{"threshold", "auto", 50000, SalesforceQueryAuto, 50000, false},
+		{"unknown api", "soap", 0, "", 0, true},
+		{"negative threshold", "auto", -1, "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Salesforce.QueryAPI = tt.api
+			config.Salesforce.BulkQueryThreshold = tt.threshold
+			err := validateAndPrepare(config)
+			if tt.isErr {
+				if err == nil {
+					t.Fatal("expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := config.Salesforce.QueryAPI, tt.wantAPI; got != want {
+				t.Errorf("got query api %s want %s", got, want)
+			}
+			if got, want := config.Salesforce.BulkQueryThreshold, tt.wantThreshold; got != want {
+				t.Errorf("got threshold %d want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestConfigSalesforceCoreFields(t *testing.T) {
+
+	config, err := Load("config.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		fields map[string]string
+		isErr  bool
+	}{
+		{"none", nil, false},
+		{"amount and close date", map[string]string{"Amount": "Gift_Amount__c", "CloseDate": "Gift_Date__c"}, false},
+		{"unknown core field", map[string]string{"Id": "Gift_Id__c"}, true},
+		{"empty field", map[string]string{"Amount": " "}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Salesforce.CoreFields = tt.fields
+			err := validateAndPrepare(config)
+			if got, want := err != nil, tt.isErr; got != want {
+				t.Errorf("got error %v, want an error %t", err, want)
+			}
+		})
+	}
+}
+
+func TestConfigSalesforceExcludedStage(t *testing.T) {
+
+	config, err := Load("config.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := config.Salesforce.ExcludedStage, "Closed Lost"; got != want {
+		t.Errorf("got %s want %s", got, want)
+	}
+
+	config.Salesforce.ExcludedStage = ""
+	if err := validateAndPrepare(config); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := config.Salesforce.ExcludedStage, DefaultExcludedStage; got != want {
+		t.Errorf("got default %s want %s", got, want)
+	}
+}
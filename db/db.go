@@ -20,6 +20,7 @@ import (
 	"os"
 	"reconciler/internal"
 	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx" // helper library
 	_ "modernc.org/sqlite"    // pure go sqlite driver
@@ -53,27 +54,59 @@ func (p *parameterizedStmt) verifyArgs(args map[string]any) error {
 // DB provides a wrapper around the sql.DB connection for application-specific db operations.
 type DB struct {
 	*sqlx.DB
-	accountCodes string
-	sqlFS        fs.FS
-	logger       *slog.Logger
+	accountCodes    string
+	excludedStage   string
+	invoiceTypes    string
+	invoiceStatuses string
+	sqlFS           fs.FS
+	logger          *slog.Logger
 
 	// Prepared statements.
 	accountUpsertStmt *parameterizedStmt
+	contactUpsertStmt *parameterizedStmt
 
 	invoicesGetStmt     *parameterizedStmt
 	invoiceGetStmt      *parameterizedStmt
 	invoiceUpsertStmt   *parameterizedStmt
 	invoiceLIDeleteStmt *parameterizedStmt
 	invoiceLIInsertStmt *parameterizedStmt
+	invoiceDeleteStmt   *parameterizedStmt
+
+	paymentUpsertStmt      *parameterizedStmt
+	invoicePaymentsGetStmt *parameterizedStmt
+
+	creditNoteUpsertStmt            *parameterizedStmt
+	creditNoteLIDeleteStmt          *parameterizedStmt
+	creditNoteLIInsertStmt          *parameterizedStmt
+	creditNoteAllocationsDeleteStmt *parameterizedStmt
+	creditNoteAllocationInsertStmt  *parameterizedStmt
 
 	bankTransactionsGetStmt     *parameterizedStmt
 	bankTransactionGetStmt      *parameterizedStmt
 	bankTransactionUpsertStmt   *parameterizedStmt
 	bankTransactionLIDeleteStmt *parameterizedStmt
 	bankTransactionLIInsertStmt *parameterizedStmt
-
-	donationsGetStmt   *parameterizedStmt
-	donationUpsertStmt *parameterizedStmt
+	bankTransactionDeleteStmt   *parameterizedStmt
+
+	donationsGetStmt          *parameterizedStmt
+	donationUpsertStmt        *parameterizedStmt
+	donationDeleteStmt        *parameterizedStmt
+	donationRefStmt           *parameterizedStmt
+	donationLinkedStmt        *parameterizedStmt
+	payoutReferenceExistsStmt *parameterizedStmt
+	payoutRefTenantsStmt      *parameterizedStmt
+
+	syncRunInsertStmt     *parameterizedStmt
+	syncRunFinishStmt     *parameterizedStmt
+	syncRunsGetStmt       *parameterizedStmt
+	syncHighWaterMarkStmt *parameterizedStmt
+
+	trackingCategoryUpsertStmt *parameterizedStmt
+	trackingOptionsDeleteStmt  *parameterizedStmt
+	trackingOptionInsertStmt   *parameterizedStmt
+	trackingOptionsGetStmt     *parameterizedStmt
+	lineItemTrackingDeleteStmt *parameterizedStmt
+	lineItemTrackingInsertStmt *parameterizedStmt
 }
 
 // prepareNamedStatementsOnStartup sets whether to register the prepared SQL statements
@@ -81,7 +114,11 @@ type DB struct {
 var prepareNamedStatementsOnStartup bool = true
 
 // NewConnection creates a new connection to an SQLite database at the given path.
-func NewConnection(dbPath string, sqlDir string, accountCodes string) (*DB, error) {
+// Donations in the excludedStage, such as refunded donations, are not counted
+// towards the totals of the invoices and bank transactions they are linked to. Only
+// invoices with types and statuses matching the invoiceTypes and invoiceStatuses
+// regular expressions are listed, other than deleted and voided invoices.
+func NewConnection(dbPath string, sqlDir string, accountCodes string, excludedStage string, invoiceTypes string, invoiceStatuses string) (*DB, error) {
 
 	// mount the sql fs either using the embedded fs or via the provided path.
 	// The path is likely to need to be relative to "here" as ".." type paths are not
@@ -91,8 +128,9 @@ func NewConnection(dbPath string, sqlDir string, accountCodes string) (*DB, erro
 		return nil, fmt.Errorf("mount error: %v", err)
 	}
 
-	// dataSource is the default setting for file-based databases.
-	dataSource := fmt.Sprintf("%s?_dataSource=foreign_keys(1)&_dataSource=journal_mode(WAL)", dbPath)
+	// dataSource is the default setting for file-based databases. The busy timeout
+	// allows concurrent background syncs to wait for each other's writes.
+	dataSource := fmt.Sprintf("%s?_dataSource=foreign_keys(1)&_dataSource=journal_mode(WAL)&_pragma=busy_timeout(5000)", dbPath)
 
 	// for in-memory test databases, check the necessary cached setting is used.
 	if strings.Contains(dbPath, ":memory:") {
@@ -122,15 +160,27 @@ func NewConnection(dbPath string, sqlDir string, accountCodes string) (*DB, erro
 
 	// Wrap the standard library *sql.DB with sqlx.
 	db := &DB{
-		DB:           sqlx.NewDb(dbDB, "sqlite"),
-		accountCodes: accountCodes,
-		sqlFS:        sqlFS,
-		logger:       logger,
+		DB:              sqlx.NewDb(dbDB, "sqlite"),
+		accountCodes:    accountCodes,
+		excludedStage:   excludedStage,
+		invoiceTypes:    invoiceTypes,
+		invoiceStatuses: invoiceStatuses,
+		sqlFS:           sqlFS,
+		logger:          logger,
 	}
 
 	// Normally prepared statements are run on startup, but need to be deferred for
-	// loading of schema and test data for testing.
+	// loading of schema and test data for testing. Pending schema migrations are
+	// applied first, as the statements cannot be prepared without the schema.
 	if prepareNamedStatementsOnStartup {
+		applied, err := db.Migrate(context.Background())
+		if err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("could not migrate database: %w", err)
+		}
+		if applied > 0 {
+			db.logger.Info("applied database migrations", "path", dbPath, "count", applied)
+		}
 		err = db.prepareNamedStatements()
 		if err != nil {
 			return nil, fmt.Errorf("could not prepare named statements: %w", err)
@@ -141,7 +191,7 @@ func NewConnection(dbPath string, sqlDir string, accountCodes string) (*DB, erro
 }
 
 // NewConnectionInTestMode runs a new connection in test mode, loading the test data.
-func NewConnectionInTestMode(dbPath string, sqlDir string, accountCodes string) (*DB, error) {
+func NewConnectionInTestMode(dbPath string, sqlDir string, accountCodes string, excludedStage string, invoiceTypes string, invoiceStatuses string) (*DB, error) {
 	if !strings.Contains(dbPath, ":memory:") {
 		return nil, fmt.Errorf("db path %q invalid for test mode", dbPath)
 	}
@@ -150,13 +200,13 @@ func NewConnectionInTestMode(dbPath string, sqlDir string, accountCodes string)
 		prepareNamedStatementsOnStartup = true
 	}()
 
-	testDB, err := NewConnection(dbPath, sqlDir, accountCodes)
+	testDB, err := NewConnection(dbPath, sqlDir, accountCodes, excludedStage, invoiceTypes, invoiceStatuses)
 	if err != nil {
 		return nil, fmt.Errorf("could not initialise test database: %w", err)
 	}
 
 	// Load the schema definitions.
-	if err := testDB.InitSchema(testDB.sqlFS, "schema.sql"); err != nil {
+	if _, err := testDB.Migrate(context.Background()); err != nil {
 		_ = testDB.Close()
 		return nil, fmt.Errorf("Failed to initialize schema for test database: %v", err)
 	}
@@ -198,6 +248,10 @@ func (db *DB) prepareNamedStatements() error {
 	if err != nil {
 		return fmt.Errorf("account upsert statement error: %w", err)
 	}
+	db.contactUpsertStmt, err = db.prepNamedStatement(db.sqlFS, "contact_upsert.sql")
+	if err != nil {
+		return fmt.Errorf("contact upsert statement error: %w", err)
+	}
 
 	// Invoices.
 	db.invoicesGetStmt, err = db.prepNamedStatement(db.sqlFS, "invoices.sql")
@@ -220,6 +274,42 @@ func (db *DB) prepareNamedStatements() error {
 	if err != nil {
 		return fmt.Errorf("get invoice line item insert statement error: %w", err)
 	}
+	db.invoiceDeleteStmt, err = db.prepNamedStatement(db.sqlFS, "invoice_delete.sql")
+	if err != nil {
+		return fmt.Errorf("invoice delete statement error: %w", err)
+	}
+
+	// Payments.
+	db.paymentUpsertStmt, err = db.prepNamedStatement(db.sqlFS, "payment_upsert.sql")
+	if err != nil {
+		return fmt.Errorf("payment upsert statement error: %w", err)
+	}
+	db.invoicePaymentsGetStmt, err = db.prepNamedStatement(db.sqlFS, "invoice_payments.sql")
+	if err != nil {
+		return fmt.Errorf("get invoice payments statement error: %w", err)
+	}
+
+	// Credit notes.
+	db.creditNoteUpsertStmt, err = db.prepNamedStatement(db.sqlFS, "credit_note_upsert.sql")
+	if err != nil {
+		return fmt.Errorf("credit note upsert statement error: %w", err)
+	}
+	db.creditNoteLIDeleteStmt, err = db.prepNamedStatement(db.sqlFS, "credit_note_lis_delete.sql")
+	if err != nil {
+		return fmt.Errorf("credit note line item delete statement error: %w", err)
+	}
+	db.creditNoteLIInsertStmt, err = db.prepNamedStatement(db.sqlFS, "credit_note_lis_insert.sql")
+	if err != nil {
+		return fmt.Errorf("credit note line item insert statement error: %w", err)
+	}
+	db.creditNoteAllocationsDeleteStmt, err = db.prepNamedStatement(db.sqlFS, "credit_note_allocations_delete.sql")
+	if err != nil {
+		return fmt.Errorf("credit note allocations delete statement error: %w", err)
+	}
+	db.creditNoteAllocationInsertStmt, err = db.prepNamedStatement(db.sqlFS, "credit_note_allocation_insert.sql")
+	if err != nil {
+		return fmt.Errorf("credit note allocation insert statement error: %w", err)
+	}
 
 	// Bank Transactions.
 	db.bankTransactionsGetStmt, err = db.prepNamedStatement(db.sqlFS, "bank_transactions.sql")
@@ -242,6 +332,10 @@ func (db *DB) prepareNamedStatements() error {
 	if err != nil {
 		return fmt.Errorf("get bankTransaction line item insert statement error: %w", err)
 	}
+	db.bankTransactionDeleteStmt, err = db.prepNamedStatement(db.sqlFS, "bank_transaction_delete.sql")
+	if err != nil {
+		return fmt.Errorf("bank transaction delete statement error: %w", err)
+	}
 
 	// Donations.
 	db.donationsGetStmt, err = db.prepNamedStatement(db.sqlFS, "donations.sql")
@@ -252,6 +346,70 @@ func (db *DB) prepareNamedStatements() error {
 	if err != nil {
 		return fmt.Errorf("donation upsert statement error: %w", err)
 	}
+	db.donationDeleteStmt, err = db.prepNamedStatement(db.sqlFS, "donation_delete.sql")
+	if err != nil {
+		return fmt.Errorf("donation delete statement error: %w", err)
+	}
+	db.donationRefStmt, err = db.prepNamedStatement(db.sqlFS, "donation_reference_update.sql")
+	if err != nil {
+		return fmt.Errorf("donation reference update statement error: %w", err)
+	}
+	db.donationLinkedStmt, err = db.prepNamedStatement(db.sqlFS, "donation_linked.sql")
+	if err != nil {
+		return fmt.Errorf("donation linked statement error: %w", err)
+	}
+	db.payoutReferenceExistsStmt, err = db.prepNamedStatement(db.sqlFS, "payout_reference_exists.sql")
+	if err != nil {
+		return fmt.Errorf("payout reference exists statement error: %w", err)
+	}
+	db.payoutRefTenantsStmt, err = db.prepNamedStatement(db.sqlFS, "payout_reference_tenants.sql")
+	if err != nil {
+		return fmt.Errorf("payout reference tenants statement error: %w", err)
+	}
+
+	// Sync runs.
+	db.syncRunInsertStmt, err = db.prepNamedStatement(db.sqlFS, "sync_run_insert.sql")
+	if err != nil {
+		return fmt.Errorf("sync run insert statement error: %w", err)
+	}
+	db.syncRunFinishStmt, err = db.prepNamedStatement(db.sqlFS, "sync_run_finish.sql")
+	if err != nil {
+		return fmt.Errorf("sync run finish statement error: %w", err)
+	}
+	db.syncRunsGetStmt, err = db.prepNamedStatement(db.sqlFS, "sync_runs.sql")
+	if err != nil {
+		return fmt.Errorf("sync runs statement error: %w", err)
+	}
+	db.syncHighWaterMarkStmt, err = db.prepNamedStatement(db.sqlFS, "sync_high_water_mark.sql")
+	if err != nil {
+		return fmt.Errorf("sync high water mark statement error: %w", err)
+	}
+
+	// Tracking categories.
+	db.trackingCategoryUpsertStmt, err = db.prepNamedStatement(db.sqlFS, "tracking_category_upsert.sql")
+	if err != nil {
+		return fmt.Errorf("tracking category upsert statement error: %w", err)
+	}
+	db.trackingOptionsDeleteStmt, err = db.prepNamedStatement(db.sqlFS, "tracking_options_delete.sql")
+	if err != nil {
+		return fmt.Errorf("tracking options delete statement error: %w", err)
+	}
+	db.trackingOptionInsertStmt, err = db.prepNamedStatement(db.sqlFS, "tracking_option_insert.sql")
+	if err != nil {
+		return fmt.Errorf("tracking option insert statement error: %w", err)
+	}
+	db.trackingOptionsGetStmt, err = db.prepNamedStatement(db.sqlFS, "tracking_options.sql")
+	if err != nil {
+		return fmt.Errorf("tracking options statement error: %w", err)
+	}
+	db.lineItemTrackingDeleteStmt, err = db.prepNamedStatement(db.sqlFS, "line_item_tracking_delete.sql")
+	if err != nil {
+		return fmt.Errorf("line item tracking delete statement error: %w", err)
+	}
+	db.lineItemTrackingInsertStmt, err = db.prepNamedStatement(db.sqlFS, "line_item_tracking_insert.sql")
+	if err != nil {
+		return fmt.Errorf("line item tracking insert statement error: %w", err)
+	}
 
 	return nil
 }
@@ -274,22 +432,6 @@ func (db *DB) prepNamedStatement(fileFS fs.FS, filePath string) (*parameterizedS
 	}, nil
 }
 
-// InitSchema creates the necessary tables if they don't already exist. The schema file
-// can be run idempotently.
-func (db *DB) InitSchema(fileFS fs.FS, filePath string) error {
-
-	schema, err := fs.ReadFile(fileFS, filePath)
-	if err != nil {
-		return fmt.Errorf("could not read schema file at %q: %w", filePath, err)
-	}
-
-	_, err = db.ExecContext(context.Background(), string(schema))
-	if err != nil {
-		return fmt.Errorf("failed to execute schema initialization: %w", err)
-	}
-	return nil
-}
-
 // logQuery is for helping debug SQL issues.
 func (db *DB) logQuery(name string, stmt *parameterizedStmt, args map[string]any, err error) {
 	db.logger.Debug(
@@ -302,3 +444,38 @@ func (db *DB) logQuery(name string, stmt *parameterizedStmt, args map[string]any
 		),
 	)
 }
+
+// softDelete runs the soft delete statement once for each set of arguments in a
+// transaction, returning the number of records newly marked as deleted. Each set of
+// arguments is completed with the deletion time.
+func (db *DB) softDelete(ctx context.Context, name string, stmt *parameterizedStmt, argSets []map[string]any) (int, error) {
+	if len(argSets) == 0 {
+		return 0, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("could not begin %s transaction: %v", name, err)
+	}
+	defer tx.Rollback() // no-op after commit.
+
+	deletedAt := time.Now().UTC().Format(syncTimeFormat)
+	var deleted int
+	for _, namedArgs := range argSets {
+		namedArgs["DeletedAt"] = deletedAt
+		if err := stmt.verifyArgs(namedArgs); err != nil {
+			return 0, fmt.Errorf("%s verify arguments error: %v", name, err)
+		}
+		result, err := stmt.ExecContext(ctx, namedArgs)
+		if err != nil {
+			db.logQuery(name, stmt, namedArgs, err)
+			return 0, fmt.Errorf("%s error: %w", name, err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, fmt.Errorf("%s rows affected error: %w", name, err)
+		}
+		deleted += int(n)
+	}
+	return deleted, tx.Commit()
+}
@@ -19,10 +19,13 @@ func setupTestDB(t *testing.T) (*DB, func()) {
 	t.Helper()
 
 	accountCodes := "^(53|55|57)"
+	excludedStage := "Closed Lost"
+	invoiceTypes := "^(ACCREC)$"
+	invoiceStatuses := "^(AUTHORISED|PAID|VOIDED)$"
 	sqlDir := "sql"
 
 	var err error
-	testDB, err := NewConnectionInTestMode("file::memory:?cache=shared", sqlDir, accountCodes)
+	testDB, err := NewConnectionInTestMode("file::memory:?cache=shared", sqlDir, accountCodes, excludedStage, invoiceTypes, invoiceStatuses)
 	if err != nil {
 		t.Fatalf("in-memory test database opening error: %v", err)
 	}
@@ -0,0 +1,221 @@
+package db
+
+// migrate.go applies the numbered schema migrations held in the `sql/migrations`
+// directory.
+//
+// Each migration file is named with a four digit version number and a description,
+// such as `0001_initial_schema.sql`. Applied versions are recorded in the
+// schema_migrations table. Pending migrations are applied in version order in a single
+// transaction, so a failing migration leaves the database unchanged.
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// migrationsDir is the directory in the sql fs holding the migration files.
+const migrationsDir = "migrations"
+
+// regexpMigration matches migration file names such as `0001_initial_schema.sql`.
+var regexpMigration = regexp.MustCompile(`^(\d{4})_([a-z0-9_]+)\.sql$`)
+
+// migration is a single numbered schema migration.
+type migration struct {
+	version int
+	name    string
+	body    string
+}
+
+// ErrDatabaseAhead reports that the database has had migrations applied that are
+// unknown to this binary, which suggests that the binary is out of date.
+type ErrDatabaseAhead struct {
+	DatabaseVersion int
+	BinaryVersion   int
+}
+
+func (e *ErrDatabaseAhead) Error() string {
+	return fmt.Sprintf(
+		"database schema version %d is ahead of the version %d supported by this program; please upgrade",
+		e.DatabaseVersion,
+		e.BinaryVersion,
+	)
+}
+
+// loadMigrations reads and orders the migration files in dir.
+func loadMigrations(fileFS fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(fileFS, dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read migrations directory %q: %w", dir, err)
+	}
+
+	var migrations []migration
+	seen := map[int]string{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		matches := regexpMigration.FindStringSubmatch(e.Name())
+		if matches == nil {
+			return nil, fmt.Errorf("invalid migration file name %q", e.Name())
+		}
+		version, _ := strconv.Atoi(matches[1]) // guaranteed digits by the regexp
+		if version == 0 {
+			return nil, fmt.Errorf("migration %q: versions start at 1", e.Name())
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migrations %q and %q share version %d", other, e.Name(), version)
+		}
+		seen[version] = e.Name()
+
+		body, err := fs.ReadFile(fileFS, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("could not read migration %q: %w", e.Name(), err)
+		}
+		migrations = append(migrations, migration{
+			version: version,
+			name:    matches[2],
+			body:    string(body),
+		})
+	}
+	if len(migrations) == 0 {
+		return nil, fmt.Errorf("no migrations found in %q", dir)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	return migrations, nil
+}
+
+// SchemaVersion returns the highest migration version applied to the database, or 0
+// if no migrations have been applied.
+func (db *DB) SchemaVersion(ctx context.Context) (int, error) {
+	exists, err := tableExists(ctx, db, "schema_migrations")
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, nil
+	}
+	var version int
+	err = db.GetContext(ctx, &version, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations")
+	if err != nil {
+		return 0, fmt.Errorf("schema version error: %w", err)
+	}
+	return version, nil
+}
+
+// Migrate applies any pending migrations, returning the number applied. An
+// ErrDatabaseAhead error is returned if the database has a later version than the
+// latest migration known to this binary.
+//
+// Databases created before migrations were introduced have the initial schema tables
+// but no schema_migrations table. These are recorded as being at version 1 before
+// later migrations are applied.
+func (db *DB) Migrate(ctx context.Context) (int, error) {
+	migrations, err := loadMigrations(db.sqlFS, migrationsDir)
+	if err != nil {
+		return 0, err
+	}
+	latest := migrations[len(migrations)-1].version
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("could not begin migration transaction: %w", err)
+	}
+	defer tx.Rollback() // no-op after commit.
+
+	hasMigrationsTable, err := tableExists(ctx, tx, "schema_migrations")
+	if err != nil {
+		return 0, err
+	}
+	if !hasMigrationsTable {
+		hasLegacySchema, err := tableExists(ctx, tx, "invoices")
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.ExecContext(ctx, `
+			CREATE TABLE schema_migrations (
+				version    INTEGER PRIMARY KEY,
+				name       TEXT,
+				applied_at DATETIME
+			)`)
+		if err != nil {
+			return 0, fmt.Errorf("could not create schema_migrations table: %w", err)
+		}
+		if hasLegacySchema {
+			db.logger.Info("recording existing schema as migration version 1")
+			if err := recordMigration(ctx, tx, migrations[0]); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	var current int
+	err = tx.GetContext(ctx, &current, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations")
+	if err != nil {
+		return 0, fmt.Errorf("schema version error: %w", err)
+	}
+	if current > latest {
+		return 0, &ErrDatabaseAhead{DatabaseVersion: current, BinaryVersion: latest}
+	}
+
+	var applied int
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		db.logger.Info("applying migration", "version", m.version, "name", m.name)
+		if _, err := tx.ExecContext(ctx, m.body); err != nil {
+			return 0, fmt.Errorf("migration %04d_%s failed: %w", m.version, m.name, err)
+		}
+		if err := recordMigration(ctx, tx, m); err != nil {
+			return 0, err
+		}
+		applied++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("could not commit migrations: %w", err)
+	}
+	return applied, nil
+}
+
+// recordMigration records a migration as having been applied.
+func recordMigration(ctx context.Context, tx *sqlx.Tx, m migration) error {
+	_, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+		m.version,
+		m.name,
+		time.Now().UTC().Format("2006-01-02T15:04:05Z"),
+	)
+	if err != nil {
+		return fmt.Errorf("could not record migration %d: %w", m.version, err)
+	}
+	return nil
+}
+
+// tableExists reports whether the named table exists.
+func tableExists(ctx context.Context, q sqlx.QueryerContext, name string) (bool, error) {
+	var count int
+	err := sqlx.GetContext(
+		ctx,
+		q,
+		&count,
+		"SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?",
+		name,
+	)
+	if err != nil {
+		return false, fmt.Errorf("table %q check error: %w", name, err)
+	}
+	return count > 0, nil
+}
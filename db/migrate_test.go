@@ -0,0 +1,238 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// TestLoadMigrations tests reading and ordering migration files.
+func TestLoadMigrations(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		files    fstest.MapFS
+		versions []int
+		isErr    bool
+	}{
+		{
+			name: "ordered",
+			files: fstest.MapFS{
+				"migrations/0002_second.sql": {Data: []byte("SELECT 2;")},
+				"migrations/0001_first.sql":  {Data: []byte("SELECT 1;")},
+				"migrations/0010_tenth.sql":  {Data: []byte("SELECT 10;")},
+			},
+			versions: []int{1, 2, 10},
+		},
+		{
+			name: "duplicate version",
+			files: fstest.MapFS{
+				"migrations/0001_first.sql": {Data: []byte("SELECT 1;")},
+				"migrations/0001_again.sql": {Data: []byte("SELECT 1;")},
+			},
+			isErr: true,
+		},
+		{
+			name: "invalid name",
+			files: fstest.MapFS{
+				"migrations/1_first.sql": {Data: []byte("SELECT 1;")},
+			},
+			isErr: true,
+		},
+		{
+			name: "zero version",
+			files: fstest.MapFS{
+				"migrations/0000_first.sql": {Data: []byte("SELECT 1;")},
+			},
+			isErr: true,
+		},
+		{
+			name:  "no migrations",
+			files: fstest.MapFS{"migrations": {Mode: 0755 | 1<<31}},
+			isErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations, err := loadMigrations(tt.files, "migrations")
+			if tt.isErr {
+				if err == nil {
+					t.Fatal("expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got, want := len(migrations), len(tt.versions); got != want {
+				t.Fatalf("got %d migrations want %d", got, want)
+			}
+			for i, m := range migrations {
+				if got, want := m.version, tt.versions[i]; got != want {
+					t.Errorf("migration %d: got version %d want %d", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+// latestMigration returns the latest embedded migration version.
+func latestMigration(t *testing.T, db *DB) int {
+	t.Helper()
+	migrations, err := loadMigrations(db.sqlFS, migrationsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return migrations[len(migrations)-1].version
+}
+
+// TestMigrateFileDB tests that a new file database is migrated on first connection,
+// that reconnecting applies no further migrations, and that a database ahead of the
+// binary is refused.
+func TestMigrateFileDB(t *testing.T) {
+
+	ctx := context.Background()
+	dbPath := filepath.Join(t.TempDir(), "reconciliation.db")
+
+	for i := range 2 {
+		testDB, err := NewConnection(dbPath, "sql", "^(53|55|57)", "Closed Lost", "^(ACCREC)$", "^(AUTHORISED|PAID|VOIDED)$")
+		if err != nil {
+			t.Fatalf("connection %d error: %v", i, err)
+		}
+		version, err := testDB.SchemaVersion(ctx)
+		if err != nil {
+			t.Fatalf("schema version error: %v", err)
+		}
+		if got, want := version, latestMigration(t, testDB); got != want {
+			t.Errorf("connection %d: got schema version %d want %d", i, got, want)
+		}
+		applied, err := testDB.Migrate(ctx)
+		if err != nil {
+			t.Fatalf("migrate error: %v", err)
+		}
+		if got, want := applied, 0; got != want {
+			t.Errorf("got %d migrations applied want %d", got, want)
+		}
+		if err := testDB.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Simulate a migration from a later version of the program.
+	testDB, err := NewConnection(dbPath, "sql", "^(53|55|57)", "Closed Lost", "^(ACCREC)$", "^(AUTHORISED|PAID|VOIDED)$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = testDB.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES (9999, 'future')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = testDB.Close()
+
+	var ahead *ErrDatabaseAhead
+	_, err = NewConnection(dbPath, "sql", "^(53|55|57)", "Closed Lost", "^(ACCREC)$", "^(AUTHORISED|PAID|VOIDED)$")
+	if !errors.As(err, &ahead) {
+		t.Fatalf("expected ErrDatabaseAhead, got %v", err)
+	}
+	if got, want := ahead.DatabaseVersion, 9999; got != want {
+		t.Errorf("got database version %d want %d", got, want)
+	}
+}
+
+// TestMigrateLegacyDB tests that a database created from the initial schema before
+// migrations were introduced is recorded at version 1 and then migrated to the latest
+// version.
+func TestMigrateLegacyDB(t *testing.T) {
+
+	ctx := context.Background()
+	dbPath := filepath.Join(t.TempDir(), "legacy.db")
+
+	migrations, err := loadMigrations(os.DirFS("sql"), migrationsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create the legacy database with only the initial schema.
+	legacy, err := sqlx.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := legacy.ExecContext(ctx, migrations[0].body); err != nil {
+		t.Fatalf("legacy schema error: %v", err)
+	}
+	_ = legacy.Close()
+
+	testDB, err := NewConnection(dbPath, "sql", "^(53|55|57)", "Closed Lost", "^(ACCREC)$", "^(AUTHORISED|PAID|VOIDED)$")
+	if err != nil {
+		t.Fatalf("legacy migrate error: %v", err)
+	}
+	t.Cleanup(func() { _ = testDB.Close() })
+
+	var versions []int
+	if err := testDB.SelectContext(ctx, &versions, "SELECT version FROM schema_migrations ORDER BY version"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(versions), len(migrations); got != want {
+		t.Fatalf("got %d recorded migrations want %d", got, want)
+	}
+	if got, want := versions[0], 1; got != want {
+		t.Errorf("got first version %d want %d", got, want)
+	}
+}
+
+// TestMigrateSyncRunToDate tests that sync runs recorded before the to_date column was
+// added are given an end date one year after their from date.
+func TestMigrateSyncRunToDate(t *testing.T) {
+
+	ctx := context.Background()
+	dbPath := filepath.Join(t.TempDir(), "sync_runs.db")
+
+	migrations, err := loadMigrations(os.DirFS("sql"), migrationsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a database at version 3 with a recorded sync run.
+	older, err := sqlx.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := older.ExecContext(ctx, "CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY, name TEXT, applied_at DATETIME)"); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations[:3] {
+		if _, err := older.ExecContext(ctx, m.body); err != nil {
+			t.Fatalf("migration %d error: %v", m.version, err)
+		}
+		if _, err := older.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.version, m.name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = older.ExecContext(ctx, "INSERT INTO sync_runs (entity, started_at, from_date) VALUES ('invoices', '2025-06-01T10:00:00Z', '2025-04-01T00:00:00Z')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = older.Close()
+
+	testDB, err := NewConnection(dbPath, "sql", "^(53|55|57)", "Closed Lost", "^(ACCREC)$", "^(AUTHORISED|PAID|VOIDED)$")
+	if err != nil {
+		t.Fatalf("migrate error: %v", err)
+	}
+	t.Cleanup(func() { _ = testDB.Close() })
+
+	runs, err := testDB.SyncRunsGet(ctx, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2026, 3, 31, 0, 0, 0, 0, time.UTC)
+	if got := runs[0].ToDate; got == nil || !got.Equal(want) {
+		t.Errorf("got to date %v want %s", got, want)
+	}
+}
@@ -9,9 +9,11 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"reconciler/apiclients/salesforce"
+	"strings"
 	"time"
 )
 
@@ -113,6 +115,7 @@ func (db *DB) UpsertDonations(ctx context.Context, donations []salesforce.Donati
 			"LastModifiedDate":     dnt.LastModifiedDate.Time,
 			"LastModifiedBy":       dnt.LastModifiedBy,
 			"AdditionalFieldsJSON": string(additionalFieldsJSON),
+			"StageName":            dnt.StageName,
 		}
 
 		if err := stmt.verifyArgs(namedArgs); err != nil {
@@ -126,3 +129,134 @@ func (db *DB) UpsertDonations(ctx context.Context, donations []salesforce.Donati
 	}
 	return tx.Commit()
 }
+
+// ErrDonationsNotLinked reports that donations to be unlinked from a payout reference
+// are not linked to it.
+var ErrDonationsNotLinked = errors.New("donations are not linked to the payout reference")
+
+// DonationsPayoutReferenceUpdate sets the payout reference of the donations with the
+// ids, linking them to the invoice or bank transaction with the reference, once the
+// donations have been updated in Salesforce. An empty reference unlinks the donations.
+// If linkedReference is not empty only donations linked to it are updated, and
+// ErrDonationsNotLinked is returned if any of the donations are not.
+func (db *DB) DonationsPayoutReferenceUpdate(ctx context.Context, reference, linkedReference string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not begin donation reference update transaction: %v", err)
+	}
+	defer tx.Rollback() // no-op after commit.
+
+	stmt := db.donationRefStmt
+	var notLinked []string
+	for _, id := range ids {
+		namedArgs := map[string]any{
+			"ID":              id,
+			"PayoutReference": reference,
+			"LinkedReference": linkedReference,
+		}
+		if err := stmt.verifyArgs(namedArgs); err != nil {
+			return fmt.Errorf("donation reference update verify arguments err: %v", err)
+		}
+		result, err := stmt.ExecContext(ctx, namedArgs)
+		if err != nil {
+			db.logQuery("donation reference update", stmt, namedArgs, err)
+			return fmt.Errorf("failed to update reference of donation %s: %w", id, err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("donation reference update rows affected error: %w", err)
+		}
+		if n == 0 {
+			notLinked = append(notLinked, id)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if len(notLinked) > 0 {
+		return fmt.Errorf("%w %q: %s", ErrDonationsNotLinked, linkedReference, strings.Join(notLinked, ", "))
+	}
+	return nil
+}
+
+// DonationsNotLinked returns the ids of the donations which are not linked to the
+// payout reference, being those of the ids which cannot be unlinked from it.
+func (db *DB) DonationsNotLinked(ctx context.Context, reference string, ids []string) ([]string, error) {
+	stmt := db.donationLinkedStmt
+	var notLinked []string
+	for _, id := range ids {
+		namedArgs := map[string]any{
+			"ID":              id,
+			"PayoutReference": reference,
+		}
+		if err := stmt.verifyArgs(namedArgs); err != nil {
+			return nil, fmt.Errorf("donation linked verify arguments error: %v", err)
+		}
+		var linked bool
+		if err := stmt.GetContext(ctx, &linked, namedArgs); err != nil {
+			db.logQuery("donation linked", stmt, namedArgs, err)
+			return nil, fmt.Errorf("donation linked select error: %v", err)
+		}
+		if !linked {
+			notLinked = append(notLinked, id)
+		}
+	}
+	return notLinked, nil
+}
+
+// PayoutReferenceExists reports if donations can be linked to the reference, being
+// the invoice number of an invoice if recordType is "invoice", or the reference of a
+// bank transaction if it is "bank-transaction".
+func (db *DB) PayoutReferenceExists(ctx context.Context, recordType, reference string) (bool, error) {
+	stmt := db.payoutReferenceExistsStmt
+	namedArgs := map[string]any{
+		"RecordType": recordType,
+		"Reference":  reference,
+	}
+	if err := stmt.verifyArgs(namedArgs); err != nil {
+		return false, fmt.Errorf("payout reference exists verify arguments error: %v", err)
+	}
+	var found bool
+	err := stmt.GetContext(ctx, &found, namedArgs)
+	db.logQuery("payout reference exists", stmt, namedArgs, err)
+	if err != nil {
+		return false, fmt.Errorf("payout reference exists select error: %v", err)
+	}
+	return found, nil
+}
+
+// PayoutReferenceTenants returns the number of Xero organisations (tenants) with an
+// invoice or bank transaction with the reference. Donations are linked by the
+// reference alone, so they should only be linked to a reference of one organisation.
+func (db *DB) PayoutReferenceTenants(ctx context.Context, reference string) (int, error) {
+	stmt := db.payoutRefTenantsStmt
+	namedArgs := map[string]any{
+		"Reference": reference,
+	}
+	if err := stmt.verifyArgs(namedArgs); err != nil {
+		return 0, fmt.Errorf("payout reference tenants verify arguments error: %v", err)
+	}
+	var tenants int
+	err := stmt.GetContext(ctx, &tenants, namedArgs)
+	db.logQuery("payout reference tenants", stmt, namedArgs, err)
+	if err != nil {
+		return 0, fmt.Errorf("payout reference tenants select error: %v", err)
+	}
+	return tenants, nil
+}
+
+// DonationsDelete soft deletes the donations with the ids, which have been deleted in
+// Salesforce, and returns the number of donations removed. Deleted donations are
+// excluded from the donation and reconciliation totals queries. Ids of donations not
+// held in the database are ignored.
+func (db *DB) DonationsDelete(ctx context.Context, ids []string) (int, error) {
+	argSets := make([]map[string]any, len(ids))
+	for i, id := range ids {
+		argSets[i] = map[string]any{"ID": id}
+	}
+	return db.softDelete(ctx, "donations delete", db.donationDeleteStmt, argSets)
+}
@@ -5,8 +5,10 @@ package db
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"reconciler/apiclients/salesforce"
+	"reconciler/apiclients/xero"
 	"testing"
 	"time"
 
@@ -15,6 +17,9 @@ import (
 
 // Test06 DonationsGet(ctx context.Context, dateFrom, dateTo time.Time, linkageStatus, payoutReference, search string, limit, offset int) ([]Donation, error)
 // Test09 UpsertDonations(ctx context.Context, donations []salesforce.Donation) error
+// Test16 PayoutReferenceExists(ctx context.Context, recordType, reference string) (bool, error)
+// Test17 DonationsPayoutReferenceUpdate(ctx context.Context, reference, linkedReference string, ids []string) error
+// Test18 PayoutReferenceTenants(ctx context.Context, reference string) (int, error)
 
 // Test06_DonationsQuery tests searching the donation SQL records.
 func Test06_DonationsQuery(t *testing.T) {
@@ -233,9 +238,9 @@ func Test09_UpsertDonations(t *testing.T) {
 				ID:               "fb8b156f",
 				Name:             "A test donation",
 				Amount:           0.99,
-				CloseDate:        salesforce.SalesforceDate{time.Now().Add(48 * time.Hour)},
-				CreatedDate:      salesforce.SalesforceTime{time.Now()},
-				LastModifiedDate: salesforce.SalesforceTime{time.Now()},
+				CloseDate:        salesforce.SalesforceDate{Time: time.Now().Add(48 * time.Hour)},
+				CreatedDate:      salesforce.SalesforceTime{Time: time.Now()},
+				LastModifiedDate: salesforce.SalesforceTime{Time: time.Now()},
 				CreatedBy:        "An Admin User",
 				LastModifiedBy:   "Another Admin User",
 				PayoutReference:  ptrStr("TEST-123"),
@@ -250,9 +255,9 @@ func Test09_UpsertDonations(t *testing.T) {
 				ID:               "57144a9d",
 				Name:             "Another test donation",
 				Amount:           0.98,
-				CloseDate:        salesforce.SalesforceDate{time.Now().Add(12 * time.Hour)},
-				CreatedDate:      salesforce.SalesforceTime{time.Now()},
-				LastModifiedDate: salesforce.SalesforceTime{time.Now()},
+				CloseDate:        salesforce.SalesforceDate{Time: time.Now().Add(12 * time.Hour)},
+				CreatedDate:      salesforce.SalesforceTime{Time: time.Now()},
+				LastModifiedDate: salesforce.SalesforceTime{Time: time.Now()},
 				CreatedBy:        "Another Admin User",
 				LastModifiedBy:   "A Admin User",
 				PayoutReference:  ptrStr("TEST-345"),
@@ -291,3 +296,115 @@ func Test09_UpsertDonations(t *testing.T) {
 	}
 
 }
+
+// Test16_PayoutReferenceExists tests finding the invoice or bank transaction to which
+// donations are to be linked.
+func Test16_PayoutReferenceExists(t *testing.T) {
+
+	testDB, closeDB := setupTestDB(t)
+	t.Cleanup(closeDB)
+	ctx := context.Background()
+
+	tests := []struct {
+		recordType string
+		reference  string
+		want       bool
+	}{
+		{"invoice", "INV-2025-101", true},
+		{"invoice", "JG-PAYOUT-2025-04-15", false},
+		{"invoice", "INV-2025-999", false},
+		{"bank-transaction", "JG-PAYOUT-2025-04-15", true},
+		{"bank-transaction", "INV-2025-101", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.recordType+" "+tt.reference, func(t *testing.T) {
+			got, err := testDB.PayoutReferenceExists(ctx, tt.recordType, tt.reference)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %t want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+// Test17_DonationsUnlink tests that donations are only unlinked from the payout
+// reference they are linked to.
+func Test17_DonationsUnlink(t *testing.T) {
+
+	testDB, closeDB := setupTestDB(t)
+	t.Cleanup(closeDB)
+	ctx := context.Background()
+
+	// sf-opp-003 is linked to JG-PAYOUT-2025-04-15 and sf-opp-015 to STRIPE-PAYOUT-2025-04-20.
+	ids := []string{"sf-opp-003", "sf-opp-015"}
+	notLinked, err := testDB.DonationsNotLinked(ctx, "JG-PAYOUT-2025-04-15", ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"sf-opp-015"}, notLinked); diff != "" {
+		t.Errorf("not linked diff:\n%s", diff)
+	}
+
+	err = testDB.DonationsPayoutReferenceUpdate(ctx, "", "JG-PAYOUT-2025-04-15", ids)
+	if !errors.Is(err, ErrDonationsNotLinked) {
+		t.Fatalf("got error %v want %v", err, ErrDonationsNotLinked)
+	}
+	for id, want := range map[string]*string{"sf-opp-003": nil, "sf-opp-015": ptrStr("STRIPE-PAYOUT-2025-04-20")} {
+		var got *string
+		if err := testDB.GetContext(ctx, &got, "SELECT payout_reference_dfk FROM donations WHERE id = ?", id); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("%s reference diff:\n%s", id, diff)
+		}
+	}
+}
+
+// Test18_PayoutReferenceTenants tests counting the Xero organisations using a payout
+// reference, where two organisations have invoices with the same number.
+func Test18_PayoutReferenceTenants(t *testing.T) {
+
+	testDB, closeDB := setupTestDB(t)
+	t.Cleanup(closeDB)
+	ctx := context.Background()
+
+	date := xero.XeroDateTime{Time: time.Date(2025, 5, 4, 10, 0, 0, 0, time.UTC)}
+	for _, tenantID := range []string{"tenant-a", "tenant-b"} {
+		invoice := xero.Invoice{
+			InvoiceID:     tenantID + "-inv-0001",
+			InvoiceNumber: "INV-0001",
+			Type:          "ACCREC",
+			Status:        "PAID",
+			Total:         10,
+			Date:          date,
+			Updated:       date,
+			LineItems:     []xero.LineItem{{LineItemID: tenantID + "-inv-0001-a", AccountCode: "5501", LineAmount: 10}},
+		}
+		if err := testDB.InvoicesUpsert(ctx, tenantID, []xero.Invoice{invoice}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		reference string
+		want      int
+	}{
+		{"INV-0001", 2},
+		{"INV-2025-101", 1},
+		{"JG-PAYOUT-2025-04-15", 1},
+		{"INV-2025-999", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reference, func(t *testing.T) {
+			got, err := testDB.PayoutReferenceTenants(ctx, tt.reference)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %d tenants want %d", got, tt.want)
+			}
+		})
+	}
+}
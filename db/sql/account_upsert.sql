@@ -19,6 +19,7 @@ WITH variables AS (
          ,'false'                     AS SystemAccount /* @param */
          ,'GBP'                       AS CurrencyCode  /* @param */
          ,'2026-01-02'                AS Updated       /* @param */
+         ,'tenant-a'                  AS TenantID      /* @param */
 )
 
 INSERT INTO accounts (
@@ -32,6 +33,7 @@ INSERT INTO accounts (
     ,system_account
     ,currency_code
     ,updated_at
+    ,tenant_id
 )
 SELECT
     v.AccountID    
@@ -44,6 +46,7 @@ SELECT
     ,v.SystemAccount
     ,v.CurrencyCode 
     ,v.Updated      
+    ,v.TenantID
 FROM
     variables v
 -- sqlite.org/lang_upsert.html PARSING AMBIGUITY
@@ -59,4 +62,5 @@ ON CONFLICT (id) DO UPDATE SET
    ,system_account = excluded.system_account
    ,currency_code  = excluded.currency_code
    ,updated_at     = excluded.updated_at
+   ,tenant_id      = excluded.tenant_id
 ;
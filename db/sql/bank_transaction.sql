@@ -11,6 +11,8 @@ WITH variables AS (
     SELECT
          'bt-prev-fy-01' AS BankTransactionID /* @param */
         ,'^(53|55|57).*' AS AccountCodes      /* @param */
+        -- refunded donations may be moved to the excluded stage
+        ,'Closed Lost' AS ExcludedStage       /* @param */
 )
 
 SELECT
@@ -24,14 +26,17 @@ SELECT
 FROM (
     SELECT
         b.id
+        ,b.tenant_id
         ,b.reference
         ,b.date
         ,b.type
         ,b.status
-        ,b.contact
+        -- the current contact name, falling back to the name when synced
+        ,COALESCE(c.name, b.contact) AS contact
         ,b.total
+        -- money paid out, such as a refund, reduces the donation total
         ,COALESCE(
-                sum(li.line_amount) 
+                sum(CASE WHEN b.type LIKE 'SPEND%' THEN -li.line_amount ELSE li.line_amount END)
                 FILTER (WHERE li.account_code REGEXP variables.AccountCodes)
                 OVER (PARTITION BY b.id)
          , 0) AS donation_total
@@ -47,27 +52,37 @@ FROM (
         ,CASE WHEN
             li.account_code REGEXP variables.AccountCodes
         THEN
-            li.line_amount
+            CASE WHEN b.type LIKE 'SPEND%' THEN -li.line_amount ELSE li.line_amount END
          ELSE
             0
          END AS li_donation_amount
     FROM
         bank_transactions b
         JOIN bank_transaction_line_items li ON (li.transaction_id = b.id)
-        LEFT OUTER JOIN accounts a ON (li.account_code = a.code)
+        -- account codes are only unique within a Xero organisation
+        LEFT OUTER JOIN accounts a ON (li.account_code = a.code AND a.tenant_id = b.tenant_id)
+        LEFT OUTER JOIN contacts c ON (c.id = b.contact_id)
         ,variables
         -- reconciled_donations_summed rds is the total of
-        -- salesforce_opportunites for this transaction.
+        -- salesforce_opportunites for this transaction. Donations hold
+        -- only the payout reference, which is required to belong to one
+        -- Xero organisation when donations are linked.
         LEFT OUTER JOIN (
             SELECT
                 payout_reference_dfk
                 ,sum(amount) AS donation_sum
             FROM
                 donations
+            WHERE
+                deleted_at IS NULL
+                AND
+                COALESCE(stage_name, '') <> (SELECT ExcludedStage FROM variables)
             GROUP BY
                 payout_reference_dfk
         ) rds ON (rds.payout_reference_dfk = b.reference)
     WHERE
         b.id = variables.BankTransactionID
+        AND
+        b.deleted_at IS NULL
 ) x
 ;
@@ -17,7 +17,11 @@ WITH variables AS (
          ,date('2025-04-15T14:00:01Z') AS Date                 /* @param */
          ,date('2026-01-01')           AS Updated              /* @param */
          ,'Admin User'                 AS Contact              /* @param */
+         ,'con-001'                    AS ContactID            /* @param */
          ,'Current Account'            AS BankAccount          /* @param */
+         ,'acc-090'                    AS BankAccountID        /* @param */
+         ,'090'                        AS BankAccountCode      /* @param */
+         ,'tenant-a'                   AS TenantID             /* @param */
 )
 INSERT INTO bank_transactions (
     id
@@ -29,7 +33,11 @@ INSERT INTO bank_transactions (
     ,date
     ,updated_at
     ,contact
+    ,contact_id
     ,bank_account
+    ,bank_account_id
+    ,bank_account_code
+    ,tenant_id
 )
 SELECT
     v.BankTransactionID   
@@ -41,7 +49,11 @@ SELECT
     ,v.Date                
     ,v.Updated             
     ,v.Contact
-    ,v.BankAccount         
+    ,v.ContactID
+    ,v.BankAccount
+    ,v.BankAccountID
+    ,v.BankAccountCode
+    ,v.TenantID
 FROM
     variables v
 -- sqlite.org/lang_upsert.html PARSING AMBIGUITY
@@ -55,6 +67,12 @@ ON CONFLICT (id) DO UPDATE SET
     ,is_reconciled = excluded.is_reconciled
     ,date          = excluded.date
     ,updated_at    = excluded.updated_at
-    ,contact       = excluded.contact
-    ,bank_account  = excluded.bank_account
+    ,contact           = excluded.contact
+    ,contact_id        = excluded.contact_id
+    ,bank_account      = excluded.bank_account
+    ,bank_account_id   = excluded.bank_account_id
+    ,bank_account_code = excluded.bank_account_code
+    ,tenant_id     = excluded.tenant_id
+    -- a transaction returned by xero is no longer removed
+    ,deleted_at    = NULL
 ;
@@ -2,6 +2,8 @@
  Reconciler app SQL
  bank_transactions.sql
  List view of bank transactions with reconciliation status.
+ Transactions may be filtered by a tracking option, such as a campaign,
+ in which case the donations tagged with the option are totalled.
 
  Note @param comments declare a template value for middleware replacement.
  Note do _not_ use colons in sql or comments as it breaks the sqlx parser.
@@ -12,17 +14,24 @@ WITH variables AS (
         date('2025-04-01') AS DateFrom   /* @param */
         ,date('2026-03-31') AS DateTo    /* @param */
         ,'^(53|55|57).*' AS AccountCodes /* @param */
+        -- refunded donations may be moved to the excluded stage
+        ,'Closed Lost' AS ExcludedStage  /* @param */
         -- All | Reconciled | NotReconciled
         ,'NotReconciled' AS ReconciliationStatus   /* @param */
         ,'' AS TextSearch     /* @param */ 
         ,10 AS HereLimit                 /* @param */
         ,0 AS HereOffset                 /* @param */
+        -- an empty tenant lists records for all Xero organisations
+        ,'' AS TenantID                  /* @param */
+        -- an empty tracking option lists transactions with any tracking
+        ,'' AS TrackingOptionID          /* @param */
 )
 
 ,bank_transaction_donation_totals AS (
     SELECT
         li.transaction_id
-        ,SUM(li.line_amount) AS total_donation_amount
+        -- money paid out, such as a refund, reduces the donation total
+        ,SUM(CASE WHEN b.type LIKE 'SPEND%' THEN -li.line_amount ELSE li.line_amount END) AS total_donation_amount
     FROM bank_transaction_line_items li
     JOIN bank_transactions b ON (b.id = li.transaction_id)
     ,variables
@@ -31,11 +40,31 @@ WITH variables AS (
         AND
         b.status NOT IN ('DRAFT', 'DELETED', 'VOIDED')
         AND
+        b.deleted_at IS NULL
+        AND
         b.date BETWEEN variables.DateFrom AND variables.DateTo
     GROUP BY
         li.transaction_id
 ),
 
+bank_transaction_tracking_totals AS (
+    SELECT
+        li.transaction_id
+        ,SUM(CASE WHEN b.type LIKE 'SPEND%' THEN -li.line_amount ELSE li.line_amount END) AS total_tracking_amount
+    FROM bank_transaction_line_items li
+    JOIN bank_transactions b ON (b.id = li.transaction_id)
+    JOIN line_item_tracking t ON (t.line_item_id = li.id)
+    ,variables
+    WHERE
+        variables.TrackingOptionID <> ''
+        AND
+        t.tracking_option_id = variables.TrackingOptionID
+        AND
+        li.account_code REGEXP variables.AccountCodes
+    GROUP BY
+        li.transaction_id
+),
+
 crms_donation_totals AS (
     SELECT
         payout_reference_dfk
@@ -45,6 +74,10 @@ crms_donation_totals AS (
     WHERE
         payout_reference_dfk IS NOT NULL
         AND
+        deleted_at IS NULL
+        AND
+        COALESCE(stage_name, '') <> variables.ExcludedStage
+        AND
         close_date BETWEEN date(variables.DateFrom,'-60 day') AND date(variables.DateTo, '+60 day')
     GROUP BY
         payout_reference_dfk
@@ -55,20 +88,34 @@ crms_donation_totals AS (
         b.id
         ,b.reference
         ,date
-        ,b.contact
+        -- the current contact name, falling back to the name when synced
+        ,COALESCE(c.name, b.contact) AS contact
         ,b.status
         ,b.total
         ,COALESCE(bdt.total_donation_amount, 0) AS donation_total
         ,COALESCE(cdt.total_crms_amount, 0) AS crms_total
+        ,COALESCE(btt.total_tracking_amount, 0) AS tracking_total
+        ,SUM(COALESCE(btt.total_tracking_amount, 0)) OVER () AS tracking_sum
         ,COUNT(*) OVER () AS row_count
     FROM bank_transactions b
     JOIN variables v ON b.date BETWEEN v.DateFrom AND v.DateTo
+    LEFT JOIN contacts c ON b.contact_id = c.id
     LEFT JOIN bank_transaction_donation_totals bdt ON b.id = bdt.transaction_id
+    LEFT JOIN bank_transaction_tracking_totals btt ON b.id = btt.transaction_id
+    -- donations hold only the payout reference, which is required to
+    -- belong to one Xero organisation when donations are linked, so the
+    -- donations are not joined by tenant
     LEFT JOIN crms_donation_totals cdt ON b.reference = cdt.payout_reference_dfk
     WHERE
         b.status NOT IN ('DRAFT', 'DELETED', 'VOIDED')
         AND
+        b.deleted_at IS NULL
+        AND
         b.date BETWEEN v.DateFrom AND v.DateTo
+        AND
+        (v.TenantID = '' OR b.tenant_id = v.TenantID)
+        AND
+        (v.TrackingOptionID = '' OR btt.transaction_id IS NOT NULL)
         AND (
             (v.ReconciliationStatus = 'All')
             OR
@@ -88,7 +135,7 @@ crms_donation_totals AS (
         bdt.transaction_id IS NOT NULL 
         AND CASE
             WHEN v.TextSearch = '' THEN true
-            ELSE LOWER(CONCAT(b.reference, ' ', b.contact)) REGEXP LOWER(v.TextSearch)
+            ELSE LOWER(CONCAT(b.reference, ' ', COALESCE(c.name, b.contact))) REGEXP LOWER(v.TextSearch)
             END
     ORDER BY
         b.date ASC
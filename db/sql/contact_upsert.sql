@@ -0,0 +1,66 @@
+/*
+ Reconciler app SQL
+ contact_upsert.sql
+ Upsert a Xero Contact into the database.
+
+ Note @param comments declare a template value for middleware replacement.
+ Note do _not_ use colons in sql or comments as it breaks the sqlx parser.
+*/
+
+WITH variables AS (
+    SELECT
+         'con-001'                AS ContactID     /* @param */
+         ,'Example Corp Ltd'      AS Name          /* @param */
+         ,'Jane'                  AS FirstName     /* @param */
+         ,'Smith'                 AS LastName      /* @param */
+         ,'jane@example.com'      AS EmailAddress  /* @param */
+         ,'EC-001'                AS AccountNumber /* @param */
+         ,'ACTIVE'                AS Status        /* @param */
+         ,1                       AS IsCustomer    /* @param */
+         ,0                       AS IsSupplier    /* @param */
+         ,date('2026-01-01')      AS Updated       /* @param */
+         ,'tenant-a'              AS TenantID      /* @param */
+)
+
+INSERT INTO contacts (
+    id
+    ,name
+    ,first_name
+    ,last_name
+    ,email_address
+    ,account_number
+    ,status
+    ,is_customer
+    ,is_supplier
+    ,updated_at
+    ,tenant_id
+)
+SELECT
+    v.ContactID
+    ,v.Name
+    ,v.FirstName
+    ,v.LastName
+    ,v.EmailAddress
+    ,v.AccountNumber
+    ,v.Status
+    ,v.IsCustomer
+    ,v.IsSupplier
+    ,v.Updated
+    ,v.TenantID
+FROM
+    variables v
+-- sqlite.org/lang_upsert.html PARSING AMBIGUITY
+WHERE
+    true
+ON CONFLICT (id) DO UPDATE SET
+    name            = excluded.name
+    ,first_name     = excluded.first_name
+    ,last_name      = excluded.last_name
+    ,email_address  = excluded.email_address
+    ,account_number = excluded.account_number
+    ,status         = excluded.status
+    ,is_customer    = excluded.is_customer
+    ,is_supplier    = excluded.is_supplier
+    ,updated_at     = excluded.updated_at
+    ,tenant_id      = excluded.tenant_id
+;
@@ -0,0 +1,33 @@
+/*
+ Reconciler app SQL
+ credit_note_allocation_insert.sql
+ Insert the allocation of a credit note to an invoice.
+
+ Note @param comments declare a template value for middleware replacement.
+ Note do _not_ use colons in sql or comments as it breaks the sqlx parser.
+*/
+
+WITH variables AS (
+    SELECT
+     'cn-al-001a'            AS AllocationID   /* @param */
+     ,'cn-001'               AS CreditNoteID   /* @param */
+     ,'inv-001'              AS InvoiceID      /* @param */
+     ,50.0                   AS Amount         /* @param */
+     ,date('2025-05-01')     AS Date           /* @param */
+)
+INSERT INTO credit_note_allocations (
+    id
+    ,credit_note_id
+    ,invoice_id
+    ,amount
+    ,date
+)
+SELECT
+    v.AllocationID
+    ,v.CreditNoteID
+    ,v.InvoiceID
+    ,v.Amount
+    ,v.Date
+FROM
+    variables v
+;
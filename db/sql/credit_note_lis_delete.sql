@@ -0,0 +1,20 @@
+/*
+ Reconciler app SQL
+ credit_note_lis_delete.sql
+ Delete credit note line items by credit_note_id.
+
+ Note @param comments declare a template value for middleware replacement.
+ Note do _not_ use colons in sql or comments as it breaks the sqlx parser.
+*/
+
+WITH variables AS (
+    SELECT
+         'cn-001' AS CreditNoteID /* @param */
+)
+DELETE FROM
+    credit_note_line_items
+WHERE
+    credit_note_id = (
+        SELECT CreditNoteID from variables
+    )
+;
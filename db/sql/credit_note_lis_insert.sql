@@ -0,0 +1,42 @@
+/*
+ Reconciler app SQL
+ credit_note_lis_insert.sql
+ Insert a credit note line item.
+
+ Note @param comments declare a template value for middleware replacement.
+ Note do _not_ use colons in sql or comments as it breaks the sqlx parser.
+*/
+
+WITH variables AS (
+    SELECT
+     'cn-li-001a'            AS LineItemID     /* @param */
+     ,'cn-001'               AS CreditNoteID   /* @param */
+     ,'Refund of donation'   AS Description    /* @param */
+     ,1                      AS Quantity       /* @param */
+     ,50.0                   AS UnitAmount     /* @param */
+     ,50.0                   AS LineAmount     /* @param */
+     ,5501                   AS AccountCode    /* @param */
+     ,0                      AS TaxAmount      /* @param */
+)
+INSERT INTO credit_note_line_items (
+    id
+    ,credit_note_id
+    ,description
+    ,quantity
+    ,unit_amount
+    ,line_amount
+    ,account_code
+    ,tax_amount
+)
+SELECT
+    v.LineItemID
+    ,v.CreditNoteID
+    ,v.Description
+    ,v.Quantity
+    ,v.UnitAmount
+    ,v.LineAmount
+    ,v.AccountCode
+    ,v.TaxAmount
+FROM
+    variables v
+;
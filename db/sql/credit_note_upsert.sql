@@ -0,0 +1,69 @@
+/*
+ Reconciler app SQL
+ credit_note_upsert.sql
+ Upsert a Xero Credit Note into the database.
+
+ Note @param comments declare a template value for middleware replacement.
+ Note do _not_ use colons in sql or comments as it breaks the sqlx parser.
+*/
+
+WITH variables AS (
+    SELECT
+         'cn-001'            AS CreditNoteID     /* @param */
+         ,'CN-2025-001'      AS CreditNoteNumber /* @param */
+         ,'ACCRECCREDIT'     AS Type             /* @param */
+         ,'PAID'             AS Status           /* @param */
+         ,'Refund'           AS Reference        /* @param */
+         ,50.00              AS Total            /* @param */
+         ,0                  AS RemainingCredit  /* @param */
+         ,date('2025-05-01') AS Date             /* @param */
+         ,date('2026-01-01') AS Updated          /* @param */
+         ,'Test User'        AS Contact          /* @param */
+         ,'con-001'          AS ContactID        /* @param */
+         ,'tenant-a'         AS TenantID         /* @param */
+)
+INSERT INTO credit_notes (
+    id
+    ,credit_note_number
+    ,type
+    ,status
+    ,reference
+    ,total
+    ,remaining_credit
+    ,date
+    ,updated_at
+    ,contact
+    ,contact_id
+    ,tenant_id
+)
+SELECT
+    v.CreditNoteID
+    ,v.CreditNoteNumber
+    ,v.Type
+    ,v.Status
+    ,v.Reference
+    ,v.Total
+    ,v.RemainingCredit
+    ,v.Date
+    ,v.Updated
+    ,v.Contact
+    ,v.ContactID
+    ,v.TenantID
+FROM
+    variables v
+-- sqlite.org/lang_upsert.html PARSING AMBIGUITY
+WHERE
+    true
+ON CONFLICT (id) DO UPDATE SET
+    credit_note_number = excluded.credit_note_number
+    ,type              = excluded.type
+    ,status            = excluded.status
+    ,reference         = excluded.reference
+    ,total             = excluded.total
+    ,remaining_credit  = excluded.remaining_credit
+    ,date              = excluded.date
+    ,updated_at        = excluded.updated_at
+    ,contact           = excluded.contact
+    ,contact_id        = excluded.contact_id
+    ,tenant_id         = excluded.tenant_id
+;
@@ -0,0 +1,25 @@
+/*
+ Reconciler app SQL
+ donation_delete.sql
+ Soft delete a donation (salesforce opportunity) deleted in Salesforce.
+ Donations already deleted are left unchanged, so that the rows affected
+ count the donations newly removed.
+
+ Note @param comments declare a template value for middleware replacement.
+ Note do _not_ use colons in sql or comments as it breaks the sqlx parser.
+*/
+
+WITH variables AS (
+    SELECT
+         'sf-opp-003'           AS ID        /* @param */
+        ,'2025-06-02T10-00-00Z' AS DeletedAt /* @param */
+)
+
+UPDATE donations
+SET
+    deleted_at = (SELECT DeletedAt FROM variables)
+WHERE
+    id = (SELECT ID FROM variables)
+    AND
+    deleted_at IS NULL
+;
@@ -0,0 +1,31 @@
+/*
+ Reconciler app SQL
+ donation_linked.sql
+ Report if a donation (salesforce opportunity) is linked to the invoice
+ or bank transaction with the payout reference, checked before it is
+ unlinked. Deleted donations are not considered.
+
+ Note @param comments declare a template value for middleware replacement.
+ Note do _not_ use colons in sql or comments as it breaks the sqlx parser.
+*/
+
+WITH variables AS (
+    SELECT
+         'sf-opp-003'           AS ID              /* @param */
+        ,'JG-PAYOUT-2025-04-15' AS PayoutReference /* @param */
+)
+
+SELECT
+    EXISTS (
+        SELECT 1
+        FROM
+            donations d
+            ,variables v
+        WHERE
+            d.id = v.ID
+            AND
+            d.payout_reference_dfk = v.PayoutReference
+            AND
+            d.deleted_at IS NULL
+    ) AS linked
+;
@@ -0,0 +1,34 @@
+/*
+ Reconciler app SQL
+ donation_reference_update.sql
+ Set the payout reference of a donation (salesforce opportunity) after
+ it has been updated in Salesforce, linking it to the invoice or bank
+ transaction with the reference. An empty reference unlinks the
+ donation. If LinkedReference is not empty the donation is only
+ updated if it is linked to that reference, so that unlinking from one
+ invoice or bank transaction leaves donations linked to others alone.
+
+ Note @param comments declare a template value for middleware replacement.
+ Note do _not_ use colons in sql or comments as it breaks the sqlx parser.
+*/
+
+WITH variables AS (
+    SELECT
+         'sf-opp-003'           AS ID              /* @param */
+        ,'JG-PAYOUT-2025-04-15' AS PayoutReference /* @param */
+        ,''                     AS LinkedReference /* @param */
+)
+
+UPDATE donations
+SET
+    payout_reference_dfk = NULLIF((SELECT PayoutReference FROM variables), '')
+WHERE
+    id = (SELECT ID FROM variables)
+    AND
+    CASE
+        WHEN (SELECT LinkedReference FROM variables) = '' THEN
+            TRUE
+        ELSE
+            payout_reference_dfk = (SELECT LinkedReference FROM variables)
+        END
+;
@@ -19,6 +19,7 @@ WITH variables AS (
         ,datetime('2025-04-01') AS LastModifiedDate     /* @param */
         ,'User1'                AS LastModifiedBy       /* @param */
         ,''                     AS AdditionalFieldsJSON /* @param */
+        ,'Closed Won'           AS StageName            /* @param */
 )
 INSERT INTO donations (
     id
@@ -31,6 +32,7 @@ INSERT INTO donations (
     ,last_modified_date
     ,last_modified_by
     ,additional_fields_json
+    ,stage_name
 )
 SELECT
     v.ID
@@ -43,6 +45,7 @@ SELECT
     ,v.LastModifiedDate
     ,v.LastModifiedBy
     ,v.AdditionalFieldsJSON
+    ,v.StageName
 FROM
     variables v
 -- sqlite.org/lang_upsert.html PARSING AMBIGUITY
@@ -58,4 +61,7 @@ ON CONFLICT (id) DO UPDATE SET
     ,last_modified_date     = excluded.last_modified_date
     ,last_modified_by       = excluded.last_modified_by
     ,additional_fields_json = excluded.additional_fields_json
+    ,stage_name             = excluded.stage_name
+    -- a donation restored from the recycle bin is no longer removed
+    ,deleted_at             = NULL
 ;
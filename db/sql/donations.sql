@@ -41,6 +41,11 @@ WITH variables AS (
         AND 
         i.invoice_number IS NOT NULL
         AND
+        i.deleted_at IS NULL
+        AND
+        -- voided invoices are kept, but no longer link donations
+        COALESCE(i.status, '') <> 'VOIDED'
+        AND
         CASE
             WHEN PayoutReference = '' THEN
                 TRUE
@@ -62,6 +67,8 @@ WITH variables AS (
         AND 
         b.reference IS NOT NULL
         AND
+        b.deleted_at IS NULL
+        AND
         CASE
             WHEN PayoutReference = '' THEN
                 TRUE
@@ -100,6 +107,8 @@ WITH variables AS (
     WHERE
         s.close_date BETWEEN v.DateFrom AND v.DateTo
         AND
+        s.deleted_at IS NULL
+        AND
         CASE 
             -- Searching by v.PayoutReference doesn't make sense if
             -- v.LinkageStatus = 'NotLinked. If porting to plpgsql, check
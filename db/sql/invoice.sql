@@ -2,6 +2,7 @@
  Reconciler app SQL
  invoice.sql
  Detail view of an invoice with line items and donation total.
+ The donation total is net of credit notes allocated to the invoice.
 
  Note @param comments declare a template value for middleware replacement.
  Note do _not_ use colons in sql or comments as it breaks the sqlx parser.
@@ -11,6 +12,8 @@ WITH variables AS (
     SELECT
          'inv-unrec-04'  AS InvoiceID    /* @param */
         ,'^(53|55|57).*' AS AccountCodes /* @param */
+        -- refunded donations may be moved to the excluded stage
+        ,'Closed Lost' AS ExcludedStage  /* @param */
 )
 SELECT
     *
@@ -23,18 +26,22 @@ SELECT
 FROM (
     SELECT
         i.id
+        ,i.tenant_id
         ,i.invoice_number
         ,i.date
         ,i.type
         ,i.status
         ,i.reference
-        ,i.contact
+        -- the current contact name, falling back to the name when synced
+        ,COALESCE(c.name, i.contact) AS contact
         ,i.total
+        ,COALESCE(i.amount_paid, 0) AS amount_paid
         ,COALESCE(
             SUM(li.line_amount) 
             FILTER (WHERE li.account_code REGEXP variables.AccountCodes)
             OVER (PARTITION BY i.id)
-         , 0) AS donation_total
+         , 0) - COALESCE(ict.credited_sum, 0) AS donation_total
+        ,COALESCE(ict.credited_sum, 0) AS credited_total
         ,COALESCE(rds.donation_sum, 0) AS crms_total
         -- line items
         -- Note that some line items only have a description, which
@@ -55,19 +62,57 @@ FROM (
         invoices i
         ,variables
         LEFT OUTER JOIN invoice_line_items li ON (li.invoice_id = i.id)
-        LEFT OUTER JOIN accounts a ON (li.account_code = a.code)
+        -- account codes are only unique within a Xero organisation
+        LEFT OUTER JOIN accounts a ON (li.account_code = a.code AND a.tenant_id = i.tenant_id)
+        LEFT OUTER JOIN contacts c ON (c.id = i.contact_id)
+        -- invoice_credited_totals ict is the donation share of the credit
+        -- notes allocated to this invoice, such as a refunded donation.
+        LEFT OUTER JOIN (
+            SELECT
+                a.invoice_id
+                ,ROUND(SUM(a.amount * cnd.donation_amount / cn.total), 2) AS credited_sum
+            FROM
+                credit_note_allocations a
+                JOIN credit_notes cn ON (cn.id = a.credit_note_id)
+                JOIN (
+                    SELECT
+                        credit_note_id
+                        ,SUM(line_amount) AS donation_amount
+                    FROM
+                        credit_note_line_items
+                        ,variables
+                    WHERE
+                        account_code REGEXP variables.AccountCodes
+                    GROUP BY
+                        credit_note_id
+                ) cnd ON (cnd.credit_note_id = cn.id)
+            WHERE
+                cn.status NOT IN ('DELETED', 'VOIDED')
+                AND
+                cn.total <> 0
+            GROUP BY
+                a.invoice_id
+        ) ict ON (ict.invoice_id = i.id)
         -- reconciled_donations_summed rds is the total of
-        -- salesforce_opportunites for this invoice.
+        -- salesforce_opportunites for this invoice. Donations hold only
+        -- the payout reference, which is required to belong to one Xero
+        -- organisation when donations are linked.
         LEFT OUTER JOIN (
             SELECT
                 payout_reference_dfk
                 ,sum(amount) AS donation_sum
             FROM
                 donations
+            WHERE
+                deleted_at IS NULL
+                AND
+                COALESCE(stage_name, '') <> (SELECT ExcludedStage FROM variables)
             GROUP BY
                 payout_reference_dfk
         ) rds ON (rds.payout_reference_dfk = i.invoice_number)
     WHERE
         variables.InvoiceID = i.id
+        AND
+        i.deleted_at IS NULL
 ) x
 ;
@@ -0,0 +1,29 @@
+/*
+ Reconciler app SQL
+ invoice_delete.sql
+ Soft delete an invoice deleted in Xero, recording its final
+ status. Invoices already deleted are left unchanged, so that the rows
+ affected count the invoices newly removed.
+
+ Note @param comments declare a template value for middleware replacement.
+ Note do _not_ use colons in sql or comments as it breaks the sqlx parser.
+*/
+
+WITH variables AS (
+    SELECT
+         'inv-001'              AS InvoiceID /* @param */
+        ,'DELETED'              AS Status    /* @param */
+        ,'2025-06-01T10-00-00Z' AS Updated   /* @param */
+        ,'2025-06-02T10-00-00Z' AS DeletedAt /* @param */
+)
+
+UPDATE invoices
+SET
+    status      = (SELECT Status FROM variables)
+    ,updated_at = (SELECT Updated FROM variables)
+    ,deleted_at = (SELECT DeletedAt FROM variables)
+WHERE
+    id = (SELECT InvoiceID FROM variables)
+    AND
+    deleted_at IS NULL
+;
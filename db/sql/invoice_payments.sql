@@ -0,0 +1,32 @@
+/*
+ Reconciler app SQL
+ invoice_payments.sql
+ List the payments of an invoice with the bank account each was paid
+ into. Deleted payments are excluded.
+
+ Note @param comments declare a template value for middleware replacement.
+ Note do _not_ use colons in sql or comments as it breaks the sqlx parser.
+*/
+
+WITH variables AS (
+    SELECT
+        'inv-001' AS InvoiceID /* @param */
+)
+SELECT
+    p.id
+    ,p.date
+    ,p.amount
+    ,p.reference
+    ,p.is_reconciled
+    ,p.account_code
+    -- account codes are only unique within a Xero organisation
+    ,a.name AS account_name
+FROM
+    payments p
+    JOIN variables v ON (p.invoice_id = v.InvoiceID)
+    LEFT OUTER JOIN accounts a ON (a.code = p.account_code AND a.tenant_id = p.tenant_id)
+WHERE
+    p.status <> 'DELETED'
+ORDER BY
+    p.date ASC
+;
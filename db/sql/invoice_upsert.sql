@@ -18,7 +18,9 @@ WITH variables AS (
          ,498.98             AS AmountPaid    /* @param */
          ,date('2025-09-01') AS Date          /* @param */
          ,date('2026-01-01') AS Updated       /* @param */
-         ,'Test User'        AS Contact /* @param */
+         ,'Test User'        AS Contact       /* @param */
+         ,'con-001'          AS ContactID     /* @param */
+         ,'tenant-a'         AS TenantID      /* @param */
 )
 INSERT INTO invoices (
 	id
@@ -31,6 +33,8 @@ INSERT INTO invoices (
     ,date
     ,updated_at
     ,contact
+    ,contact_id
+    ,tenant_id
 )
 SELECT
     v.InvoiceID    
@@ -43,6 +47,8 @@ SELECT
     ,v.Date         
     ,v.Updated      
     ,v.Contact
+    ,v.ContactID
+    ,v.TenantID
 FROM
     variables v
 -- sqlite.org/lang_upsert.html PARSING AMBIGUITY
@@ -58,4 +64,8 @@ ON CONFLICT (id) DO UPDATE SET
     ,date           = excluded.date
     ,updated_at     = excluded.updated_at
     ,contact        = excluded.contact
+    ,contact_id     = excluded.contact_id
+    ,tenant_id      = excluded.tenant_id
+    -- an invoice returned by xero is no longer removed
+    ,deleted_at     = NULL
 ;
@@ -2,6 +2,8 @@
  Reconciler app SQL
  invoices.sql
  List of invoices with reconciliation status.
+ Invoices may be filtered by a tracking option, such as a campaign, in
+ which case the donations tagged with the option are totalled.
 
  Note @param comments declare a template value for middleware replacement.
  Note do _not_ use colons in sql or comments as it breaks the sqlx parser.
@@ -12,11 +14,20 @@ WITH variables AS (
         date('2025-04-01') AS DateFrom   /* @param */
         ,date('2026-03-31') AS DateTo    /* @param */
         ,'^(53|55|57).*' AS AccountCodes /* @param */
+        -- refunded donations may be moved to the excluded stage
+        ,'Closed Lost' AS ExcludedStage  /* @param */
+        -- the configured invoice types and statuses to list
+        ,'^(ACCREC)$' AS InvoiceTypes                 /* @param */
+        ,'^(AUTHORISED|PAID|VOIDED)$' AS InvoiceStatuses /* @param */
         -- All | Reconciled | NotReconciled
         ,'NotReconciled' AS ReconciliationStatus /* @param */
         ,'INV-2025.*Ex.*Corp' AS TextSearch      /* @param */
         ,10 AS HereLimit                         /* @param */
         ,0 AS HereOffset                         /* @param */
+        -- an empty tenant lists records for all Xero organisations
+        ,'' AS TenantID                          /* @param */
+        -- an empty tracking option lists invoices with any tracking
+        ,'' AS TrackingOptionID                  /* @param */
 )
 
 ,invoice_donation_totals AS (
@@ -29,11 +40,63 @@ WITH variables AS (
     WHERE
         account_code REGEXP variables.AccountCodes
         AND
-        i.status NOT IN ('DRAFT', 'DELETED', 'VOIDED')
+        COALESCE(i.type, '') REGEXP variables.InvoiceTypes
+        AND
+        i.status REGEXP variables.InvoiceStatuses
+        AND
+        i.status NOT IN ('DELETED', 'VOIDED')
+        AND
+        i.deleted_at IS NULL
         AND
         i.date BETWEEN variables.DateFrom AND variables.DateTo
     GROUP BY
         li.invoice_id
+)
+
+,invoice_credited_totals AS (
+    -- the donation share of credit notes allocated to each invoice, such as
+    -- a refunded donation, in proportion to the donation lines of the
+    -- credit note
+    SELECT
+        a.invoice_id
+        ,ROUND(SUM(a.amount * cnd.donation_amount / cn.total), 2) AS total_credited_amount
+    FROM credit_note_allocations a
+    JOIN credit_notes cn ON (cn.id = a.credit_note_id)
+    JOIN (
+        SELECT
+            credit_note_id
+            ,SUM(line_amount) AS donation_amount
+        FROM credit_note_line_items
+        ,variables
+        WHERE
+            account_code REGEXP variables.AccountCodes
+        GROUP BY
+            credit_note_id
+    ) cnd ON (cnd.credit_note_id = cn.id)
+    WHERE
+        cn.status NOT IN ('DELETED', 'VOIDED')
+        AND
+        cn.total <> 0
+    GROUP BY
+        a.invoice_id
+)
+
+,
+invoice_tracking_totals AS (
+    SELECT
+        li.invoice_id
+        ,SUM(li.line_amount) AS total_tracking_amount
+    FROM invoice_line_items li
+    JOIN line_item_tracking t ON (t.line_item_id = li.id)
+    ,variables
+    WHERE
+        variables.TrackingOptionID <> ''
+        AND
+        t.tracking_option_id = variables.TrackingOptionID
+        AND
+        li.account_code REGEXP variables.AccountCodes
+    GROUP BY
+        li.invoice_id
 ),
 
 crms_donation_totals AS (
@@ -45,6 +108,10 @@ crms_donation_totals AS (
     WHERE
         payout_reference_dfk IS NOT NULL
         AND
+        deleted_at IS NULL
+        AND
+        COALESCE(stage_name, '') <> variables.ExcludedStage
+        AND
         close_date BETWEEN date(variables.DateFrom,'-60 day') AND date(variables.DateTo, '+60 day')
     GROUP BY
         payout_reference_dfk
@@ -55,40 +122,61 @@ crms_donation_totals AS (
         i.id
         ,i.invoice_number
         ,i.date
-        ,i.contact
+        -- the current contact name, falling back to the name when synced
+        ,COALESCE(c.name, i.contact) AS contact
         ,i.status
         ,i.total
-        ,COALESCE(idt.total_donation_amount, 0) AS donation_total
+        ,COALESCE(idt.total_donation_amount, 0) - COALESCE(ict.total_credited_amount, 0) AS donation_total
         ,COALESCE(cdt.total_crms_amount, 0) AS crms_total
+        ,COALESCE(itt.total_tracking_amount, 0) AS tracking_total
+        ,SUM(COALESCE(itt.total_tracking_amount, 0)) OVER () AS tracking_sum
         ,COUNT(*) OVER () AS row_count
     FROM invoices i
     JOIN variables v ON i.date BETWEEN v.DateFrom AND v.DateTo
+    LEFT JOIN contacts c ON i.contact_id = c.id
     LEFT JOIN invoice_donation_totals idt ON i.id = idt.invoice_id
+    LEFT JOIN invoice_credited_totals ict ON i.id = ict.invoice_id
+    LEFT JOIN invoice_tracking_totals itt ON i.id = itt.invoice_id
+    -- donations hold only the payout reference, which is required to
+    -- belong to one Xero organisation when donations are linked, so the
+    -- donations are not joined by tenant
     LEFT JOIN crms_donation_totals cdt ON i.invoice_number = cdt.payout_reference_dfk
     WHERE
-        i.status NOT IN ('DRAFT', 'DELETED', 'VOIDED')
+        -- invoices of other types or statuses may have been synced before
+        -- the configuration was changed
+        COALESCE(i.type, '') REGEXP v.InvoiceTypes
+        AND
+        i.status REGEXP v.InvoiceStatuses
+        AND
+        i.status NOT IN ('DELETED', 'VOIDED')
+        AND
+        i.deleted_at IS NULL
         AND
         i.date >= v.DateFrom AND i.date <= v.DateTo
+        AND
+        (v.TenantID = '' OR i.tenant_id = v.TenantID)
+        AND
+        (v.TrackingOptionID = '' OR itt.invoice_id IS NOT NULL)
         AND (
             (v.ReconciliationStatus = 'All')
             OR
             (
                 v.ReconciliationStatus = 'Reconciled'
                  AND 
-                 COALESCE(idt.total_donation_amount, 0) = COALESCE(cdt.total_crms_amount, 0)
+                 COALESCE(idt.total_donation_amount, 0) - COALESCE(ict.total_credited_amount, 0) = COALESCE(cdt.total_crms_amount, 0)
             )
             OR
             (
                 v.ReconciliationStatus = 'NotReconciled'
                  AND 
-                 COALESCE(idt.total_donation_amount, 0) <> COALESCE(cdt.total_crms_amount, 0)
+                 COALESCE(idt.total_donation_amount, 0) - COALESCE(ict.total_credited_amount, 0) <> COALESCE(cdt.total_crms_amount, 0)
             )
         )
         AND
         idt.invoice_id IS NOT NULL
         AND CASE
             WHEN v.TextSearch = '' THEN true
-            ELSE LOWER(CONCAT(i.invoice_number, ' ', i.reference, ' ', i.contact)) REGEXP LOWER(v.TextSearch)
+            ELSE LOWER(CONCAT(i.invoice_number, ' ', i.reference, ' ', COALESCE(c.name, i.contact))) REGEXP LOWER(v.TextSearch)
             END
     ORDER BY
         i.date ASC
@@ -0,0 +1,21 @@
+/*
+ Reconciler app SQL
+ line_item_tracking_delete.sql
+ Delete the line item tracking of an invoice, credit note or bank
+ transaction by parent_id.
+
+ Note @param comments declare a template value for middleware replacement.
+ Note do _not_ use colons in sql or comments as it breaks the sqlx parser.
+*/
+
+WITH variables AS (
+    SELECT
+         'inv-002' AS ParentID /* @param */
+)
+DELETE FROM
+    line_item_tracking
+WHERE
+    parent_id = (
+        SELECT ParentID FROM variables
+    )
+;
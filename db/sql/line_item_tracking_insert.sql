@@ -0,0 +1,37 @@
+/*
+ Reconciler app SQL
+ line_item_tracking_insert.sql
+ Insert the tracking option of a line item of an invoice, credit note or
+ bank transaction.
+
+ Note @param comments declare a template value for middleware replacement.
+ Note do _not_ use colons in sql or comments as it breaks the sqlx parser.
+*/
+
+WITH variables AS (
+    SELECT
+         'inv-li-002c'          AS LineItemID         /* @param */
+         ,'inv-002'             AS ParentID           /* @param */
+         ,'tc-001'              AS TrackingCategoryID /* @param */
+         ,'to-001'              AS TrackingOptionID   /* @param */
+         ,'Campaign'            AS CategoryName       /* @param */
+         ,'Spring Appeal 2025'  AS OptionName         /* @param */
+)
+INSERT INTO line_item_tracking (
+    line_item_id
+    ,parent_id
+    ,tracking_category_id
+    ,tracking_option_id
+    ,category_name
+    ,option_name
+)
+SELECT
+    v.LineItemID
+    ,v.ParentID
+    ,v.TrackingCategoryID
+    ,v.TrackingOptionID
+    ,v.CategoryName
+    ,v.OptionName
+FROM
+    variables v
+;
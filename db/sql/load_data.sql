@@ -15,6 +15,14 @@ DELETE FROM invoices;
 DELETE FROM bank_transaction_line_items;
 DELETE FROM bank_transactions;
 DELETE FROM accounts;
+DELETE FROM payments;
+DELETE FROM credit_note_allocations;
+DELETE FROM credit_note_line_items;
+DELETE FROM credit_notes;
+DELETE FROM contacts;
+DELETE FROM line_item_tracking;
+DELETE FROM tracking_options;
+DELETE FROM tracking_categories;
 
 PRAGMA foreign_keys=OFF;
 BEGIN TRANSACTION;
@@ -29,7 +37,8 @@ INSERT INTO "accounts" (id, code, name, description, type, status) VALUES
 ('acc-5501', '5501', 'General Giving', 'Unrestricted donation income', 'REVENUE', 'ACTIVE'),
 ('acc-5701', '5701', 'Spring Campaign 2025', 'Restricted income for the Spring 2025 Campaign', 'REVENUE', 'ACTIVE'),
 ('acc-429', '429', 'Platform Fees', 'Fees deducted by payment processors like Stripe, JustGiving', 'EXPENSE', 'ACTIVE'),
-('acc-9999', '9999', 'Arbitrary', 'Arbitrary accounts', 'LIABILITY', 'ACTIVE')
+('acc-9999', '9999', 'Arbitrary', 'Arbitrary accounts', 'LIABILITY', 'ACTIVE'),
+('acc-090', '090', 'Business Bank Account', 'Current account deposits', 'BANK', 'ACTIVE')
 ;
 
 -- -----------------------------------------------------------------------------
@@ -38,14 +47,20 @@ INSERT INTO "accounts" (id, code, name, description, type, status) VALUES
 -- * a single invoice line item (no platform fees) 
 -- * a single salesforce donation
 -- -----------------------------------------------------------------------------
-INSERT INTO "invoices" (id, invoice_number, status, total, date, contact) VALUES
-('inv-001', 'INV-2025-101', 'PAID', 500.00, '2025-04-10T10:00:00Z', 'Example Corp Ltd');
+INSERT INTO "invoices" (id, type, invoice_number, status, total, date, contact) VALUES
+('inv-001', 'ACCREC', 'INV-2025-101', 'PAID', 500.00, '2025-04-10T10:00:00Z', 'Example Corp Ltd');
 INSERT INTO "invoice_line_items" (id, invoice_id, description, line_amount, account_code) VALUES
 ('inv-li-001', 'inv-001', 'Donation for Q1 2025', 500.00, '5501');
 
 INSERT INTO "donations" (id, name, amount, close_date, payout_reference_dfk) VALUES
 ('sf-opp-001', 'Example Corp Q1 Donation', 500.00, datetime('2025-04-08'), 'INV-2025-101');
 
+-- paid in two deposits, with a mistaken third payment deleted
+INSERT INTO "payments" (id, invoice_id, invoice_number, account_id, account_code, date, amount, bank_amount, reference, status, payment_type, is_reconciled) VALUES
+('pay-001a', 'inv-001', 'INV-2025-101', 'acc-090', '090', '2025-04-20T00:00:00Z', 300.00, 300.00, 'EXAMPLE CORP 1 OF 2', 'AUTHORISED', 'ACCRECPAYMENT', 1),
+('pay-001b', 'inv-001', 'INV-2025-101', 'acc-090', '090', '2025-04-27T00:00:00Z', 200.00, 200.00, 'EXAMPLE CORP 2 OF 2', 'AUTHORISED', 'ACCRECPAYMENT', 0),
+('pay-001c', 'inv-001', 'INV-2025-101', 'acc-090', '090', '2025-04-27T00:00:00Z', 200.00, 200.00, 'DUPLICATE', 'DELETED', 'ACCRECPAYMENT', 0);
+
 -- -----------------------------------------------------------------------------
 -- Invoice scenario 2
 -- A fully reconciled invoice
@@ -53,8 +68,8 @@ INSERT INTO "donations" (id, name, amount, close_date, payout_reference_dfk) VAL
 -- * one SF Opportunity.
 -- the SF donation amount should match the gross donation, not the invoice total.
 -- -----------------------------------------------------------------------------
-INSERT INTO "invoices" (id, invoice_number, status, total, date, contact) VALUES
-('inv-002', 'INV-2025-102', 'PAID', 196.50, '2025-04-12T11:00:00Z', 'Generous Individual');
+INSERT INTO "invoices" (id, type, invoice_number, status, total, date, contact) VALUES
+('inv-002', 'ACCREC', 'INV-2025-102', 'PAID', 196.50, '2025-04-12T11:00:00Z', 'Generous Individual');
 INSERT INTO "invoice_line_items" (id, invoice_id, description, line_amount, account_code) VALUES
 ('inv-li-002a', 'inv-002', 'Pledged donation via Stripe', 200.00, '5301'),
 ('inv-li-002b', 'inv-002', 'Stripe processing fee', -3.50, '429');
@@ -66,13 +81,13 @@ INSERT INTO "donations" (id, name, amount, close_date, payout_reference_dfk) VAL
 -- Invoice scenario 3
 -- Unreconciled items in the current financial year
 -- -----------------------------------------------------------------------------
-INSERT INTO "invoices" (id, invoice_number, status, total, date, contact) VALUES
-('inv-unrec-01', 'INV-2025-103', 'PAID', 1000.00, '2025-04-16T10:00:00Z', 'Another Corp'),
-('inv-unrec-02', 'INV-2025-104', 'PAID', 250.00, '2025-04-18T11:00:00Z', 'Local Business Ltd'),
-('inv-unrec-03', 'INV-2025-105', 'PAID', 750.00, '2025-04-21T12:00:00Z', 'Community Fund'),
-('inv-unrec-04', 'INV-2025-106', 'PAID', 50.00, '2025-04-25T13:00:00Z', 'Small Pledge'),
-('inv-unrec-05', 'INV-2025-107', 'PAID', 300.00, '2025-05-02T14:00:00Z', 'Grant Giver'),
-('inv-unrec-06', 'INV-2025-108', 'PAID', 2000.00, '2025-05-05T15:00:00Z', 'Major Donor Pledge');
+INSERT INTO "invoices" (id, type, invoice_number, status, total, date, contact) VALUES
+('inv-unrec-01', 'ACCREC', 'INV-2025-103', 'PAID', 1000.00, '2025-04-16T10:00:00Z', 'Another Corp'),
+('inv-unrec-02', 'ACCREC', 'INV-2025-104', 'PAID', 250.00, '2025-04-18T11:00:00Z', 'Local Business Ltd'),
+('inv-unrec-03', 'ACCREC', 'INV-2025-105', 'PAID', 750.00, '2025-04-21T12:00:00Z', 'Community Fund'),
+('inv-unrec-04', 'ACCREC', 'INV-2025-106', 'PAID', 50.00, '2025-04-25T13:00:00Z', 'Small Pledge'),
+('inv-unrec-05', 'ACCREC', 'INV-2025-107', 'PAID', 300.00, '2025-05-02T14:00:00Z', 'Grant Giver'),
+('inv-unrec-06', 'ACCREC', 'INV-2025-108', 'PAID', 2000.00, '2025-05-05T15:00:00Z', 'Major Donor Pledge');
 INSERT INTO "invoice_line_items" (id, invoice_id, description, line_amount, account_code) VALUES
 ('inv-li-unrec-01', 'inv-unrec-01', 'Corporate Partnership Donation', 1000.00, '5301'),
 ('inv-li-unrec-02', 'inv-unrec-02', 'Sponsorship Donation', 250.00, '5301'),
@@ -85,8 +100,8 @@ INSERT INTO "invoice_line_items" (id, invoice_id, description, line_amount, acco
 -- Invoice scenario 4
 -- Items from the previous financial year to test data filtering
 -- -----------------------------------------------------------------------------
-INSERT INTO "invoices" (id, invoice_number, status, total, date, contact) VALUES
-('inv-prev-fy-01', 'INV-2024-950', 'PAID', 150.00, '2025-03-25T10:00:00Z', 'Old Pledge Inc.');
+INSERT INTO "invoices" (id, type, invoice_number, status, total, date, contact) VALUES
+('inv-prev-fy-01', 'ACCREC', 'INV-2024-950', 'PAID', 150.00, '2025-03-25T10:00:00Z', 'Old Pledge Inc.');
 INSERT INTO "invoice_line_items" (id, invoice_id, description, line_amount, account_code) VALUES
 ('inv-li-prev-fy-01', 'inv-prev-fy-01', 'End of Year Donation', 150.00, '5501');
 
@@ -94,13 +109,13 @@ INSERT INTO "invoice_line_items" (id, invoice_id, description, line_amount, acco
 -- Invoice scenario 5
 -- Arbitrary invoices that have nothing to do with donations
 -- -----------------------------------------------------------------------------
-INSERT INTO "invoices" (id, invoice_number, status, total, date, contact) VALUES
-('inv-arb-01', 'INV-2025-110', 'DRAFT', 1.00, '2025-07-01T00:00:00Z', 'Future Invoices Inc.');
+INSERT INTO "invoices" (id, type, invoice_number, status, total, date, contact) VALUES
+('inv-arb-01', 'ACCREC', 'INV-2025-110', 'DRAFT', 1.00, '2025-07-01T00:00:00Z', 'Future Invoices Inc.');
 INSERT INTO "invoice_line_items" (id, invoice_id, description, line_amount, account_code) VALUES
 ('inv-li-arb-01-01', 'inv-arb-01', 'An arbitrary entry', 1.00, '9999');
 
-INSERT INTO "invoices" (id, invoice_number, status, total, date, contact) VALUES
-('inv-arb-02', 'INV-2025-111', 'AUTHORISED', 2.00, '2025-07-02T00:00:00Z', 'Future Invoices Inc.');
+INSERT INTO "invoices" (id, type, invoice_number, status, total, date, contact) VALUES
+('inv-arb-02', 'ACCREC', 'INV-2025-111', 'AUTHORISED', 2.00, '2025-07-02T00:00:00Z', 'Future Invoices Inc.');
 INSERT INTO "invoice_line_items" (id, invoice_id, description, line_amount, account_code) VALUES
 ('inv-li-arb-02-01', 'inv-arb-02', 'Another arbitrary entry', 2.00, '9999');
 
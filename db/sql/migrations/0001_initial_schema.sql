@@ -1,6 +1,10 @@
 /*
- SQLite Schema file
+ Reconciler app SQL migration
+ 0001_initial_schema.sql
  Tables for Xero and Salesforce data.
+
+ Migrations are applied in version order inside a transaction by
+ db.Migrate. Do not edit a migration once released; add a new one.
 */
 
 -- bank transactions holds Xero bank transactions.
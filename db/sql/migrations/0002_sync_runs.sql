@@ -0,0 +1,24 @@
+/*
+ Reconciler app SQL migration
+ 0002_sync_runs.sql
+ Record each sync of an entity from the Xero or Salesforce APIs.
+
+ The high_water_mark is the latest UpdatedDateUTC (Xero) or
+ LastModifiedDate (Salesforce) seen in the run, and is used as the
+ If-Modified-Since time of the next incremental sync.
+*/
+
+CREATE TABLE sync_runs (
+    id                  INTEGER PRIMARY KEY AUTOINCREMENT,
+    entity              TEXT NOT NULL, -- accounts, invoices, bank-transactions or donations
+    started_at          DATETIME NOT NULL,
+    finished_at         DATETIME, -- null while the run is in progress
+    full_sync           INTEGER DEFAULT 0, -- 1 if the high water mark was ignored
+    from_date           DATETIME,
+    if_modified_since   DATETIME,
+    records_fetched     INTEGER DEFAULT 0,
+    high_water_mark     DATETIME,
+    error               TEXT -- null on success
+);
+
+CREATE INDEX idx_sync_runs_entity ON sync_runs(entity, started_at);
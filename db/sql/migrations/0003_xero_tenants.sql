@@ -0,0 +1,21 @@
+/*
+ Reconciler app SQL migration
+ 0003_xero_tenants.sql
+ Record the Xero organisation (tenant) of each Xero record and sync run
+ so that several organisations can be held side by side.
+
+ Records synced before this migration have an empty tenant_id. They are
+ tagged with their tenant when next synced; as the high water marks are
+ also per tenant, the first sync of each tenant is a full sync.
+*/
+
+ALTER TABLE invoices ADD COLUMN tenant_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE bank_transactions ADD COLUMN tenant_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE accounts ADD COLUMN tenant_id TEXT NOT NULL DEFAULT '';
+
+-- Salesforce runs have an empty tenant_id.
+ALTER TABLE sync_runs ADD COLUMN tenant_id TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX idx_invoices_tenant ON invoices(tenant_id, date);
+CREATE INDEX idx_bank_transactions_tenant ON bank_transactions(tenant_id, date);
+CREATE INDEX idx_accounts_tenant ON accounts(tenant_id, code);
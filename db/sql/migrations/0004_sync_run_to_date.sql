@@ -0,0 +1,16 @@
+/*
+ Reconciler app SQL migration
+ 0004_sync_run_to_date.sql
+ Record the end of the date range of each sync run.
+
+ Before this migration each sync covered the year from its from_date, so
+ earlier runs are given that end date. A run's high water mark is only
+ used for later syncs of a date range it covers.
+*/
+
+ALTER TABLE sync_runs ADD COLUMN to_date DATETIME;
+
+-- Replace the date part of from_date, keeping its time and zone suffix.
+UPDATE sync_runs
+SET to_date = replace(from_date, substr(from_date, 1, 10), date(from_date, '+1 year', '-1 day'))
+WHERE from_date IS NOT NULL;
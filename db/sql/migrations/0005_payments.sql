@@ -0,0 +1,30 @@
+/*
+ Reconciler app SQL migration
+ 0005_payments.sql
+ Xero payments, linking each sales invoice to the bank account
+ deposit which paid it.
+
+ There is no foreign key to invoices as a payment may be synced before
+ the invoice it pays, for example when the invoice is dated outside the
+ synced date range.
+*/
+
+CREATE TABLE payments (
+    id              TEXT PRIMARY KEY,
+    invoice_id      TEXT NOT NULL,
+    invoice_number  TEXT,
+    account_id      TEXT, -- the bank account paid into
+    account_code    TEXT,
+    date            DATETIME,
+    amount          REAL,
+    bank_amount     REAL, -- the amount in the bank account currency
+    reference       TEXT,
+    status          TEXT, -- AUTHORISED or DELETED
+    payment_type    TEXT,
+    is_reconciled   INTEGER DEFAULT 0, -- 1 if reconciled to a bank statement line
+    updated_at      DATETIME,
+    tenant_id       TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX idx_payments_invoice ON payments(invoice_id);
+CREATE INDEX idx_payments_tenant ON payments(tenant_id, date);
@@ -0,0 +1,55 @@
+/*
+ Reconciler app SQL migration
+ 0006_credit_notes.sql
+ Xero credit notes, with their line items and their allocations to
+ invoices, so that refunded donations can be netted off the invoices
+ they refund.
+
+ The Salesforce opportunity stage is also recorded so that refunded
+ donations marked as closed lost can be excluded from the Salesforce
+ totals.
+*/
+
+-- Xero credit notes.
+CREATE TABLE credit_notes (
+    id                  TEXT PRIMARY KEY,
+    credit_note_number  TEXT,
+    type                TEXT,
+    status              TEXT,
+    reference           TEXT,
+    total               REAL,
+    remaining_credit    REAL,
+    date                DATETIME,
+    updated_at          DATETIME,
+    contact             TEXT,
+    tenant_id           TEXT NOT NULL DEFAULT ''
+);
+
+-- Xero credit note line items.
+CREATE TABLE credit_note_line_items (
+    id              TEXT PRIMARY KEY,
+    credit_note_id  TEXT,
+    description     TEXT,
+    quantity        REAL,
+    unit_amount     REAL,
+    line_amount     REAL,
+    account_code    TEXT,
+    tax_amount      REAL,
+    FOREIGN KEY(credit_note_id) REFERENCES credit_notes(id) ON DELETE CASCADE
+);
+
+-- The allocations of credit notes to invoices. There is no foreign key
+-- to invoices as the invoice may be dated outside the synced date range.
+CREATE TABLE credit_note_allocations (
+    id              TEXT PRIMARY KEY,
+    credit_note_id  TEXT,
+    invoice_id      TEXT NOT NULL,
+    amount          REAL,
+    date            DATETIME,
+    FOREIGN KEY(credit_note_id) REFERENCES credit_notes(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_credit_notes_tenant ON credit_notes(tenant_id, date);
+CREATE INDEX idx_credit_note_allocations_invoice ON credit_note_allocations(invoice_id);
+
+ALTER TABLE donations ADD COLUMN stage_name TEXT;
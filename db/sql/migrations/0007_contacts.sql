@@ -0,0 +1,36 @@
+/*
+ Reconciler app SQL migration
+ 0007_contacts.sql
+ Xero contacts, and the references of invoices, credit notes and bank
+ transactions to their contacts and bank accounts.
+
+ The contact name recorded with each record is the name at the time the
+ record was synced; the listing queries prefer the name in contacts so
+ that renamed contacts are shown by their current name.
+*/
+
+CREATE TABLE contacts (
+    id              TEXT PRIMARY KEY,
+    name            TEXT,
+    first_name      TEXT,
+    last_name       TEXT,
+    email_address   TEXT,
+    account_number  TEXT,
+    status          TEXT, -- ACTIVE, ARCHIVED or GDPRREQUEST
+    is_customer     INTEGER DEFAULT 0,
+    is_supplier     INTEGER DEFAULT 0,
+    updated_at      DATETIME,
+    tenant_id       TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX idx_contacts_tenant ON contacts(tenant_id, name);
+
+ALTER TABLE invoices ADD COLUMN contact_id TEXT;
+ALTER TABLE credit_notes ADD COLUMN contact_id TEXT;
+ALTER TABLE bank_transactions ADD COLUMN contact_id TEXT;
+ALTER TABLE bank_transactions ADD COLUMN bank_account_id TEXT;
+ALTER TABLE bank_transactions ADD COLUMN bank_account_code TEXT;
+
+CREATE INDEX idx_invoices_contact ON invoices(contact_id);
+CREATE INDEX idx_bank_transactions_contact ON bank_transactions(contact_id);
+CREATE INDEX idx_bank_transactions_bank_account ON bank_transactions(bank_account_id);
@@ -0,0 +1,39 @@
+/*
+ Reconciler app SQL migration
+ 0008_tracking.sql
+ Xero tracking categories and options, such as fundraising campaigns,
+ and the options with which invoice, credit note and bank transaction
+ line items are tagged.
+
+ line_item_tracking records the invoice, credit note or bank transaction
+ of each line item as its parent so that the tracking can be replaced
+ with the line items when the parent record is upserted.
+*/
+
+CREATE TABLE tracking_categories (
+    id          TEXT PRIMARY KEY,
+    name        TEXT,
+    status      TEXT,
+    tenant_id   TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE tracking_options (
+    id                      TEXT PRIMARY KEY,
+    tracking_category_id    TEXT NOT NULL,
+    name                    TEXT,
+    status                  TEXT,
+    FOREIGN KEY(tracking_category_id) REFERENCES tracking_categories(id) ON DELETE CASCADE
+);
+
+CREATE TABLE line_item_tracking (
+    line_item_id            TEXT NOT NULL,
+    parent_id               TEXT NOT NULL,
+    tracking_category_id    TEXT NOT NULL,
+    tracking_option_id      TEXT,
+    category_name           TEXT, -- the names when the line item was synced
+    option_name             TEXT,
+    PRIMARY KEY (line_item_id, tracking_category_id)
+);
+
+CREATE INDEX idx_line_item_tracking_parent ON line_item_tracking(parent_id);
+CREATE INDEX idx_line_item_tracking_option ON line_item_tracking(tracking_option_id);
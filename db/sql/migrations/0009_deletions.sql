@@ -0,0 +1,19 @@
+/*
+ Reconciler app SQL migration
+ 0009_deletions.sql
+ Soft deletion of invoices, bank transactions and donations deleted in
+ Xero or Salesforce. deleted_at records when the removal was seen by a
+ sync, and is cleared if the record is upserted again, for example after
+ being restored from the Salesforce recycle bin. Voided invoices are not
+ soft deleted, but kept with their status.
+
+ sync_runs records the number of records removed by each run.
+*/
+
+ALTER TABLE invoices ADD COLUMN deleted_at DATETIME;
+
+ALTER TABLE bank_transactions ADD COLUMN deleted_at DATETIME;
+
+ALTER TABLE donations ADD COLUMN deleted_at DATETIME;
+
+ALTER TABLE sync_runs ADD COLUMN records_deleted INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,76 @@
+/*
+ Reconciler app SQL
+ payment_upsert.sql
+ Upsert a Xero Payment into the database.
+
+ Note @param comments declare a template value for middleware replacement.
+ Note do _not_ use colons in sql or comments as it breaks the sqlx parser.
+*/
+WITH variables AS (
+    SELECT
+         'pay-001'                     AS PaymentID            /* @param */
+         ,'inv-001'                 AS InvoiceID            /* @param */
+         ,'INV-2025-101'               AS InvoiceNumber        /* @param */
+         ,'acc-090'                    AS AccountID            /* @param */
+         ,'090'                        AS AccountCode          /* @param */
+         ,date('2025-04-19')           AS Date                 /* @param */
+         ,120.00                       AS Amount               /* @param */
+         ,120.00                       AS BankAmount           /* @param */
+         ,'JG-PAYOUT-2025-04-19'       AS Reference            /* @param */
+         ,'AUTHORISED'                 AS Status               /* @param */
+         ,'ACCRECPAYMENT'              AS PaymentType          /* @param */
+         ,1                            AS IsReconciled         /* @param */
+         ,date('2025-04-19')           AS Updated              /* @param */
+         ,'tenant-a'                   AS TenantID             /* @param */
+)
+INSERT INTO payments (
+    id
+    ,invoice_id
+    ,invoice_number
+    ,account_id
+    ,account_code
+    ,date
+    ,amount
+    ,bank_amount
+    ,reference
+    ,status
+    ,payment_type
+    ,is_reconciled
+    ,updated_at
+    ,tenant_id
+)
+SELECT
+    v.PaymentID
+    ,v.InvoiceID
+    ,v.InvoiceNumber
+    ,v.AccountID
+    ,v.AccountCode
+    ,v.Date
+    ,v.Amount
+    ,v.BankAmount
+    ,v.Reference
+    ,v.Status
+    ,v.PaymentType
+    ,v.IsReconciled
+    ,v.Updated
+    ,v.TenantID
+FROM
+    variables v
+-- sqlite.org/lang_upsert.html PARSING AMBIGUITY
+WHERE
+    true
+ON CONFLICT (id) DO UPDATE SET
+    invoice_id      = excluded.invoice_id
+    ,invoice_number = excluded.invoice_number
+    ,account_id     = excluded.account_id
+    ,account_code   = excluded.account_code
+    ,date           = excluded.date
+    ,amount         = excluded.amount
+    ,bank_amount    = excluded.bank_amount
+    ,reference      = excluded.reference
+    ,status         = excluded.status
+    ,payment_type   = excluded.payment_type
+    ,is_reconciled  = excluded.is_reconciled
+    ,updated_at     = excluded.updated_at
+    ,tenant_id      = excluded.tenant_id
+;
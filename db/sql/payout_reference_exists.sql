@@ -0,0 +1,45 @@
+/*
+ Reconciler app SQL
+ payout_reference_exists.sql
+ Report if there is an invoice with the invoice number, or a bank
+ transaction with the reference, to which donations may be linked. The
+ RecordType is either 'invoice' or 'bank-transaction'. Deleted records
+ are not considered.
+
+ Note @param comments declare a template value for middleware replacement.
+ Note do _not_ use colons in sql or comments as it breaks the sqlx parser.
+*/
+
+WITH variables AS (
+    SELECT
+         'invoice'      AS RecordType /* @param */
+        ,'INV-2025-101' AS Reference  /* @param */
+)
+
+SELECT
+    EXISTS (
+        SELECT 1
+        FROM
+            invoices i
+            ,variables v
+        WHERE
+            v.RecordType = 'invoice'
+            AND
+            i.invoice_number = v.Reference
+            AND
+            i.deleted_at IS NULL
+    )
+    OR
+    EXISTS (
+        SELECT 1
+        FROM
+            bank_transactions b
+            ,variables v
+        WHERE
+            v.RecordType = 'bank-transaction'
+            AND
+            b.reference = v.Reference
+            AND
+            b.deleted_at IS NULL
+    ) AS found
+;
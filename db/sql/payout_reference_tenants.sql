@@ -0,0 +1,44 @@
+/*
+ Reconciler app SQL
+ payout_reference_tenants.sql
+ Count the Xero organisations (tenants) with an invoice with the
+ invoice number, or a bank transaction with the reference. Donations
+ are linked by the reference alone, so a reference must belong to a
+ single organisation for the donations to be counted towards only its
+ invoice or bank transaction. Deleted records are not considered.
+
+ Note @param comments declare a template value for middleware replacement.
+ Note do _not_ use colons in sql or comments as it breaks the sqlx parser.
+*/
+
+WITH variables AS (
+    SELECT
+        'INV-2025-101' AS Reference /* @param */
+)
+
+SELECT
+    COUNT(DISTINCT tenant_id) AS tenants
+FROM (
+    SELECT
+        i.tenant_id
+    FROM
+        invoices i
+        ,variables v
+    WHERE
+        i.invoice_number = v.Reference
+        AND
+        i.deleted_at IS NULL
+
+    UNION ALL
+
+    SELECT
+        b.tenant_id
+    FROM
+        bank_transactions b
+        ,variables v
+    WHERE
+        b.reference = v.Reference
+        AND
+        b.deleted_at IS NULL
+)
+;
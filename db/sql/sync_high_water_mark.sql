@@ -0,0 +1,40 @@
+/*
+ Reconciler app SQL
+ sync_high_water_mark.sql
+ The latest record modification time seen by a successful sync of an
+ entity for a Xero organisation (tenant), or for Salesforce with an
+ empty tenant. Only syncs whose date range covers the FromDate to ToDate
+ range are considered, as records outside a sync's range were not
+ fetched. Returns null if there has been no such sync recording a high
+ water mark.
+
+ Note @param comments declare a template value for middleware replacement.
+ Note do _not_ use colons in sql or comments as it breaks the sqlx parser.
+*/
+
+WITH variables AS (
+    SELECT
+        'invoices' AS Entity    /* @param */
+        ,'tenant-a' AS TenantID /* @param */
+        ,'2025-04-01T00-00-00Z' AS FromDate /* @param */
+        ,'2026-03-31T00-00-00Z' AS ToDate   /* @param */
+)
+
+SELECT
+    MAX(s.high_water_mark) AS high_water_mark
+FROM
+    sync_runs s
+    ,variables v
+WHERE
+    s.entity = v.Entity
+    AND
+    s.tenant_id = v.TenantID
+    AND
+    s.from_date <= v.FromDate
+    AND
+    s.to_date >= v.ToDate
+    AND
+    s.finished_at IS NOT NULL
+    AND
+    s.error IS NULL
+;
@@ -0,0 +1,29 @@
+/*
+ Reconciler app SQL
+ sync_run_finish.sql
+ Record the outcome of a sync run. A null ErrorMessage denotes success.
+
+ Note @param comments declare a template value for middleware replacement.
+ Note do _not_ use colons in sql or comments as it breaks the sqlx parser.
+*/
+
+WITH variables AS (
+    SELECT
+         1                      AS RunID          /* @param */
+        ,'2026-01-02T10-01-00Z' AS FinishedAt     /* @param */
+        ,10                     AS RecordsFetched /* @param */
+        ,0                      AS RecordsDeleted /* @param */
+        ,null                   AS HighWaterMark  /* @param */
+        ,null                   AS ErrorMessage   /* @param */
+)
+
+UPDATE sync_runs
+SET
+    finished_at      = (SELECT FinishedAt FROM variables)
+    ,records_fetched = (SELECT RecordsFetched FROM variables)
+    ,records_deleted = (SELECT RecordsDeleted FROM variables)
+    ,high_water_mark = (SELECT HighWaterMark FROM variables)
+    ,error           = (SELECT ErrorMessage FROM variables)
+WHERE
+    id = (SELECT RunID FROM variables)
+;
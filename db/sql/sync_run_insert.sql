@@ -0,0 +1,40 @@
+/*
+ Reconciler app SQL
+ sync_run_insert.sql
+ Record the start of a sync run.
+
+ Note @param comments declare a template value for middleware replacement.
+ Note do _not_ use colons in sql or comments as it breaks the sqlx parser.
+*/
+
+WITH variables AS (
+    SELECT
+         'invoices'             AS Entity          /* @param */
+        ,'tenant-a'             AS TenantID        /* @param */
+        ,'2026-01-02T10-00-00Z' AS StartedAt       /* @param */
+        ,0                      AS FullSync        /* @param */
+        ,'2025-04-01'           AS FromDate        /* @param */
+        ,'2026-03-31'           AS ToDate          /* @param */
+        ,null                   AS IfModifiedSince /* @param */
+)
+
+INSERT INTO sync_runs (
+    entity
+    ,tenant_id
+    ,started_at
+    ,full_sync
+    ,from_date
+    ,to_date
+    ,if_modified_since
+)
+SELECT
+    v.Entity
+    ,v.TenantID
+    ,v.StartedAt
+    ,v.FullSync
+    ,v.FromDate
+    ,v.ToDate
+    ,v.IfModifiedSince
+FROM
+    variables v
+;
@@ -0,0 +1,46 @@
+/*
+ Reconciler app SQL
+ sync_runs.sql
+ List sync runs, most recent first, optionally for a single entity.
+
+ Note @param comments declare a template value for middleware replacement.
+ Note do _not_ use colons in sql or comments as it breaks the sqlx parser.
+*/
+
+WITH variables AS (
+    SELECT
+        -- an empty entity lists runs for all entities
+        '' AS Entity     /* @param */
+        ,20 AS HereLimit /* @param */
+)
+
+SELECT
+    s.id
+    ,s.entity
+    ,s.tenant_id
+    ,s.started_at
+    ,s.finished_at
+    ,s.full_sync
+    ,s.from_date
+    ,s.to_date
+    ,s.if_modified_since
+    ,s.records_fetched
+    ,s.records_deleted
+    ,s.high_water_mark
+    ,s.error
+FROM
+    sync_runs s
+    ,variables v
+WHERE
+    CASE
+        WHEN v.Entity = '' THEN
+            TRUE
+        ELSE
+            s.entity = v.Entity
+    END
+ORDER BY
+    s.started_at DESC
+    ,s.id DESC
+LIMIT
+    (SELECT variables.HereLimit FROM variables)
+;
@@ -0,0 +1,38 @@
+/*
+ Reconciler app SQL
+ tracking_category_upsert.sql
+ Upsert a Xero Tracking Category into the database.
+
+ Note @param comments declare a template value for middleware replacement.
+ Note do _not_ use colons in sql or comments as it breaks the sqlx parser.
+*/
+
+WITH variables AS (
+    SELECT
+         'tc-001'       AS TrackingCategoryID /* @param */
+         ,'Campaign'    AS Name               /* @param */
+         ,'ACTIVE'      AS Status             /* @param */
+         ,'tenant-a'    AS TenantID           /* @param */
+)
+
+INSERT INTO tracking_categories (
+    id
+    ,name
+    ,status
+    ,tenant_id
+)
+SELECT
+    v.TrackingCategoryID
+    ,v.Name
+    ,v.Status
+    ,v.TenantID
+FROM
+    variables v
+-- sqlite.org/lang_upsert.html PARSING AMBIGUITY
+WHERE
+    true
+ON CONFLICT (id) DO UPDATE SET
+    name       = excluded.name
+    ,status    = excluded.status
+    ,tenant_id = excluded.tenant_id
+;
@@ -0,0 +1,30 @@
+/*
+ Reconciler app SQL
+ tracking_option_insert.sql
+ Insert a tracking category option.
+
+ Note @param comments declare a template value for middleware replacement.
+ Note do _not_ use colons in sql or comments as it breaks the sqlx parser.
+*/
+
+WITH variables AS (
+    SELECT
+         'to-001'               AS TrackingOptionID   /* @param */
+         ,'tc-001'              AS TrackingCategoryID /* @param */
+         ,'Spring Appeal 2025'  AS Name               /* @param */
+         ,'ACTIVE'              AS Status             /* @param */
+)
+INSERT INTO tracking_options (
+    id
+    ,tracking_category_id
+    ,name
+    ,status
+)
+SELECT
+    v.TrackingOptionID
+    ,v.TrackingCategoryID
+    ,v.Name
+    ,v.Status
+FROM
+    variables v
+;
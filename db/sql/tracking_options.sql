@@ -0,0 +1,33 @@
+/*
+ Reconciler app SQL
+ tracking_options.sql
+ List the tracking category options, such as fundraising campaigns, for
+ filtering the invoice and bank transaction listings.
+
+ Note @param comments declare a template value for middleware replacement.
+ Note do _not_ use colons in sql or comments as it breaks the sqlx parser.
+*/
+
+WITH variables AS (
+    SELECT
+        -- an empty tenant lists options for all Xero organisations
+        '' AS TenantID /* @param */
+)
+SELECT
+    o.id
+    ,c.name AS category_name
+    ,o.name
+    ,o.status
+FROM
+    tracking_options o
+    JOIN tracking_categories c ON (c.id = o.tracking_category_id)
+    ,variables v
+WHERE
+    c.status <> 'DELETED'
+    AND
+    o.status <> 'DELETED'
+    AND
+    (v.TenantID = '' OR c.tenant_id = v.TenantID)
+ORDER BY
+    c.name, o.name
+;
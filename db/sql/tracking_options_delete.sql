@@ -0,0 +1,20 @@
+/*
+ Reconciler app SQL
+ tracking_options_delete.sql
+ Delete tracking options by tracking_category_id.
+
+ Note @param comments declare a template value for middleware replacement.
+ Note do _not_ use colons in sql or comments as it breaks the sqlx parser.
+*/
+
+WITH variables AS (
+    SELECT
+         'tc-001' AS TrackingCategoryID /* @param */
+)
+DELETE FROM
+    tracking_options
+WHERE
+    tracking_category_id = (
+        SELECT TrackingCategoryID FROM variables
+    )
+;
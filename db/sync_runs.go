@@ -0,0 +1,147 @@
+package db
+
+// sync_runs.go records the history of syncs from the Xero and Salesforce APIs.
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// syncTimeFormat is the format used for recording sync run times.
+const syncTimeFormat = "2006-01-02T15:04:05Z"
+
+// SyncRun is the concrete type of each row returned by SyncRunsGet.
+type SyncRun struct {
+	ID              int64      `db:"id"`
+	Entity          string     `db:"entity"`
+	TenantID        string     `db:"tenant_id"`
+	StartedAt       time.Time  `db:"started_at"`
+	FinishedAt      *time.Time `db:"finished_at"`
+	FullSync        bool       `db:"full_sync"`
+	FromDate        *time.Time `db:"from_date"`
+	ToDate          *time.Time `db:"to_date"`
+	IfModifiedSince *time.Time `db:"if_modified_since"`
+	RecordsFetched  int        `db:"records_fetched"`
+	RecordsDeleted  int        `db:"records_deleted"`
+	HighWaterMark   *time.Time `db:"high_water_mark"`
+	Error           *string    `db:"error"`
+}
+
+// nullTime returns the formatted time, or nil for a zero time, for use as an sql
+// parameter.
+func nullTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(syncTimeFormat)
+}
+
+// SyncRunStart records the start of a sync of an entity for a Xero organisation
+// (tenant) over the inclusive date range, returning the id of the run for use with
+// SyncRunFinish. The tenant is empty for Salesforce entities.
+func (db *DB) SyncRunStart(ctx context.Context, entity, tenantID string, fullSync bool, fromDate, toDate, ifModifiedSince time.Time) (int64, error) {
+	stmt := db.syncRunInsertStmt
+	namedArgs := map[string]any{
+		"Entity":          entity,
+		"TenantID":        tenantID,
+		"StartedAt":       time.Now().UTC().Format(syncTimeFormat),
+		"FullSync":        fullSync,
+		"FromDate":        nullTime(fromDate),
+		"ToDate":          nullTime(toDate),
+		"IfModifiedSince": nullTime(ifModifiedSince),
+	}
+	if err := stmt.verifyArgs(namedArgs); err != nil {
+		return 0, fmt.Errorf("sync run start verify arguments error: %v", err)
+	}
+	result, err := stmt.ExecContext(ctx, namedArgs)
+	if err != nil {
+		db.logQuery("sync run start", stmt, namedArgs, err)
+		return 0, fmt.Errorf("failed to record start of %s sync: %w", entity, err)
+	}
+	return result.LastInsertId()
+}
+
+// SyncRunFinish records the outcome of a sync run, including the number of records
+// removed because they were deleted upstream. A zero highWaterMark is recorded as null,
+// as is a nil syncErr.
+func (db *DB) SyncRunFinish(ctx context.Context, runID int64, recordsFetched, recordsDeleted int, highWaterMark time.Time, syncErr error) error {
+	var errMsg any
+	if syncErr != nil {
+		errMsg = syncErr.Error()
+	}
+	stmt := db.syncRunFinishStmt
+	namedArgs := map[string]any{
+		"RunID":          runID,
+		"FinishedAt":     time.Now().UTC().Format(syncTimeFormat),
+		"RecordsFetched": recordsFetched,
+		"RecordsDeleted": recordsDeleted,
+		"HighWaterMark":  nullTime(highWaterMark),
+		"ErrorMessage":   errMsg,
+	}
+	if err := stmt.verifyArgs(namedArgs); err != nil {
+		return fmt.Errorf("sync run finish verify arguments error: %v", err)
+	}
+	_, err := stmt.ExecContext(ctx, namedArgs)
+	if err != nil {
+		db.logQuery("sync run finish", stmt, namedArgs, err)
+		return fmt.Errorf("failed to record finish of sync run %d: %w", runID, err)
+	}
+	return nil
+}
+
+// SyncHighWaterMark returns the latest record modification time seen by a successful
+// sync of the entity for the tenant whose date range covered fromDate to toDate. A
+// zero time is returned if there is none.
+func (db *DB) SyncHighWaterMark(ctx context.Context, entity, tenantID string, fromDate, toDate time.Time) (time.Time, error) {
+	stmt := db.syncHighWaterMarkStmt
+	namedArgs := map[string]any{
+		"Entity":   entity,
+		"TenantID": tenantID,
+		"FromDate": nullTime(fromDate),
+		"ToDate":   nullTime(toDate),
+	}
+	if err := stmt.verifyArgs(namedArgs); err != nil {
+		return time.Time{}, fmt.Errorf("sync high water mark verify arguments error: %v", err)
+	}
+
+	// The aggregate has no declared column type, so is returned as a string.
+	var mark sql.NullString
+	err := stmt.GetContext(ctx, &mark, namedArgs)
+	db.logQuery("sync high water mark", stmt, namedArgs, err)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("sync high water mark select error: %v", err)
+	}
+	if !mark.Valid {
+		return time.Time{}, nil
+	}
+	hwm, err := time.Parse(syncTimeFormat, mark.String)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid high water mark %q: %w", mark.String, err)
+	}
+	return hwm, nil
+}
+
+// SyncRunsGet lists the most recent sync runs, up to limit, for the provided entity or
+// for all entities if entity is empty.
+func (db *DB) SyncRunsGet(ctx context.Context, entity string, limit int) ([]SyncRun, error) {
+	stmt := db.syncRunsGetStmt
+	namedArgs := map[string]any{
+		"Entity":    entity,
+		"HereLimit": limit,
+	}
+	if err := stmt.verifyArgs(namedArgs); err != nil {
+		return nil, fmt.Errorf("sync runs verify arguments error: %v", err)
+	}
+	var runs []SyncRun
+	err := stmt.SelectContext(ctx, &runs, namedArgs)
+	db.logQuery("sync runs", stmt, namedArgs, err)
+	if err != nil {
+		return nil, fmt.Errorf("sync runs select error: %v", err)
+	}
+	if len(runs) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return runs, nil
+}
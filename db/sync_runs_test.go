@@ -0,0 +1,137 @@
+package db
+
+// tests for sync run history queries
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestSyncRuns tests recording sync runs and retrieving the high water mark.
+func TestSyncRuns(t *testing.T) {
+
+	testDB, closeDB := setupTestDB(t)
+	t.Cleanup(closeDB)
+	ctx := context.Background()
+
+	fromDate := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+	toDate := time.Date(2026, 3, 31, 0, 0, 0, 0, time.UTC)
+
+	// No runs.
+	hwm, err := testDB.SyncHighWaterMark(ctx, "invoices", "tenant-a", fromDate, toDate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hwm.IsZero() {
+		t.Errorf("expected zero high water mark, got %s", hwm)
+	}
+	if _, err := testDB.SyncRunsGet(ctx, "", 10); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+
+	runs := []struct {
+		entity  string
+		tenant  string
+		mark    time.Time
+		deleted int
+		err     error
+	}{
+		{"invoices", "tenant-a", time.Date(2025, 6, 1, 10, 0, 0, 0, time.UTC), 0, nil},
+		{"invoices", "tenant-a", time.Date(2025, 7, 1, 10, 0, 0, 0, time.UTC), 0, nil},
+		{"invoices", "tenant-a", time.Date(2025, 8, 1, 10, 0, 0, 0, time.UTC), 0, errors.New("failed")}, // ignored
+		{"invoices", "tenant-a", time.Time{}, 0, nil},                                                   // no records fetched
+		{"invoices", "tenant-b", time.Date(2025, 8, 2, 10, 0, 0, 0, time.UTC), 2, nil},                  // another organisation
+		{"donations", "", time.Date(2025, 9, 1, 10, 0, 0, 0, time.UTC), 0, nil},
+	}
+	for _, r := range runs {
+		id, err := testDB.SyncRunStart(ctx, r.entity, r.tenant, false, fromDate, toDate, time.Time{})
+		if err != nil {
+			t.Fatalf("start error: %v", err)
+		}
+		if err := testDB.SyncRunFinish(ctx, id, 1, r.deleted, r.mark, r.err); err != nil {
+			t.Fatalf("finish error: %v", err)
+		}
+	}
+
+	// An unfinished run is also ignored.
+	if _, err := testDB.SyncRunStart(ctx, "invoices", "tenant-a", true, fromDate, toDate, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	hwm, err = testDB.SyncHighWaterMark(ctx, "invoices", "tenant-a", fromDate, toDate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := hwm, runs[1].mark; !got.Equal(want) {
+		t.Errorf("got high water mark %s want %s", got, want)
+	}
+
+	history, err := testDB.SyncRunsGet(ctx, "invoices", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(history), 6; got != want {
+		t.Fatalf("got %d invoice runs want %d", got, want)
+	}
+	latest := history[0]
+	if latest.FinishedAt != nil || !latest.FullSync {
+		t.Errorf("expected the latest run to be an unfinished full sync, got %#v", latest)
+	}
+	if latest.FromDate == nil || !latest.FromDate.Equal(fromDate) {
+		t.Errorf("got from date %v want %s", latest.FromDate, fromDate)
+	}
+	if latest.ToDate == nil || !latest.ToDate.Equal(toDate) {
+		t.Errorf("got to date %v want %s", latest.ToDate, toDate)
+	}
+	if history[3].Error == nil || *history[3].Error != "failed" {
+		t.Errorf("expected failed run error, got %v", history[2].Error)
+	}
+
+	if got, want := history[1].TenantID, "tenant-b"; got != want {
+		t.Errorf("got tenant %q want %q", got, want)
+	}
+	if got, want := history[1].RecordsDeleted, 2; got != want {
+		t.Errorf("got %d records deleted want %d", got, want)
+	}
+
+	// The other organisation has its own high water mark.
+	hwm, err = testDB.SyncHighWaterMark(ctx, "invoices", "tenant-b", fromDate, toDate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := hwm, runs[4].mark; !got.Equal(want) {
+		t.Errorf("got tenant-b high water mark %s want %s", got, want)
+	}
+
+	// The runs do not cover an earlier year, or a range extending beyond theirs, but
+	// do cover a quarter within their year.
+	ranges := []struct {
+		name     string
+		from, to time.Time
+		want     time.Time
+	}{
+		{"earlier year", fromDate.AddDate(-1, 0, 0), toDate.AddDate(-1, 0, 0), time.Time{}},
+		{"longer range", fromDate, toDate.AddDate(1, 0, 0), time.Time{}},
+		{"quarter", fromDate.AddDate(0, 3, 0), fromDate.AddDate(0, 6, -1), runs[1].mark},
+	}
+	for _, r := range ranges {
+		hwm, err := testDB.SyncHighWaterMark(ctx, "invoices", "tenant-a", r.from, r.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !hwm.Equal(r.want) {
+			t.Errorf("%s: got high water mark %s want %s", r.name, hwm, r.want)
+		}
+	}
+
+	all, err := testDB.SyncRunsGet(ctx, "", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(all), 3; got != want {
+		t.Errorf("got %d runs want %d", got, want)
+	}
+}
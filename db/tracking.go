@@ -0,0 +1,126 @@
+package db
+
+// tracking.go records the Xero tracking categories, such as fundraising campaigns,
+// and the tracking options with which line items are tagged.
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"reconciler/apiclients/xero"
+)
+
+// TrackingOption is the concrete type of each row returned by TrackingOptionsGet.
+type TrackingOption struct {
+	ID           string `db:"id"`
+	CategoryName string `db:"category_name"`
+	Name         string `db:"name"`
+	Status       string `db:"status"`
+}
+
+// TrackingCategoriesUpsert upserts Xero tracking categories for the Xero organisation
+// (tenant), replacing the options of each category.
+func (db *DB) TrackingCategoriesUpsert(ctx context.Context, tenantID string, categories []xero.TrackingCategory) error {
+	if len(categories) == 0 {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no-op after commit.
+
+	// exec verifies the arguments to and executes the statement.
+	exec := func(stmt *parameterizedStmt, namedArgs map[string]any) error {
+		if err := stmt.verifyArgs(namedArgs); err != nil {
+			return fmt.Errorf("tracking categories upsert verify arguments error: %v", err)
+		}
+		_, err := stmt.ExecContext(ctx, namedArgs)
+		return err
+	}
+
+	for _, tc := range categories {
+		err := exec(db.trackingCategoryUpsertStmt, map[string]any{
+			"TrackingCategoryID": tc.TrackingCategoryID,
+			"Name":               tc.Name,
+			"Status":             tc.Status,
+			"TenantID":           tenantID,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to upsert tracking category %s: %w", tc.TrackingCategoryID, err)
+		}
+		err = exec(db.trackingOptionsDeleteStmt, map[string]any{"TrackingCategoryID": tc.TrackingCategoryID})
+		if err != nil {
+			return fmt.Errorf("failed to delete old options for tracking category %s: %w", tc.TrackingCategoryID, err)
+		}
+		for _, o := range tc.Options {
+			err := exec(db.trackingOptionInsertStmt, map[string]any{
+				"TrackingOptionID":   o.TrackingOptionID,
+				"TrackingCategoryID": tc.TrackingCategoryID,
+				"Name":               o.Name,
+				"Status":             o.Status,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to insert option %s for tracking category %s: %w", o.TrackingOptionID, tc.TrackingCategoryID, err)
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// TrackingOptionsGet lists the tracking options for the Xero organisation (tenant), or
+// for all organisations if tenantID is empty, ordered by category and option name.
+// Unlike the other listings no error is returned if there are no options.
+func (db *DB) TrackingOptionsGet(ctx context.Context, tenantID string) ([]TrackingOption, error) {
+	stmt := db.trackingOptionsGetStmt
+	namedArgs := map[string]any{
+		"TenantID": tenantID,
+	}
+	if err := stmt.verifyArgs(namedArgs); err != nil {
+		return nil, fmt.Errorf("tracking options verify arguments error: %v", err)
+	}
+	var options []TrackingOption
+	err := stmt.SelectContext(ctx, &options, namedArgs)
+	db.logQuery("tracking options", stmt, namedArgs, err)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("tracking options select error: %v", err)
+	}
+	return options, nil
+}
+
+// lineItemTrackingReplace replaces the tracking of the line items of the invoice,
+// credit note or bank transaction with the provided id.
+func (db *DB) lineItemTrackingReplace(ctx context.Context, parentID string, lineItems []xero.LineItem) error {
+	stmt := db.lineItemTrackingDeleteStmt
+	namedArgs := map[string]any{
+		"ParentID": parentID,
+	}
+	if err := stmt.verifyArgs(namedArgs); err != nil {
+		return fmt.Errorf("line item tracking verify arguments error: %v", err)
+	}
+	if _, err := stmt.ExecContext(ctx, namedArgs); err != nil {
+		return fmt.Errorf("failed to delete old line item tracking for %s: %w", parentID, err)
+	}
+
+	stmt = db.lineItemTrackingInsertStmt
+	for _, line := range lineItems {
+		for _, tr := range line.Tracking {
+			namedArgs := map[string]any{
+				"LineItemID":         line.LineItemID,
+				"ParentID":           parentID,
+				"TrackingCategoryID": tr.TrackingCategoryID,
+				"TrackingOptionID":   tr.TrackingOptionID,
+				"CategoryName":       tr.Name,
+				"OptionName":         tr.Option,
+			}
+			if err := stmt.verifyArgs(namedArgs); err != nil {
+				return fmt.Errorf("line item tracking verify arguments error: %v", err)
+			}
+			if _, err := stmt.ExecContext(ctx, namedArgs); err != nil {
+				return fmt.Errorf("failed to insert tracking for line item %s: %w", line.LineItemID, err)
+			}
+		}
+	}
+	return nil
+}
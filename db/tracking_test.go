@@ -0,0 +1,159 @@
+package db
+
+// tests for tracking category queries
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"reconciler/apiclients/xero"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// TestTracking tests recording tracking categories and filtering and totalling the
+// invoice and bank transaction listings by tracking option.
+func TestTracking(t *testing.T) {
+
+	testDB, closeDB := setupTestDB(t)
+	t.Cleanup(closeDB)
+	ctx := context.Background()
+
+	categories := []xero.TrackingCategory{
+		{
+			TrackingCategoryID: "tc-campaign",
+			Name:               "Campaign",
+			Status:             "ACTIVE",
+			Options: []xero.TrackingOption{
+				{TrackingOptionID: "to-spring", Name: "Spring Appeal", Status: "ACTIVE"},
+				{TrackingOptionID: "to-winter", Name: "Winter Appeal", Status: "ARCHIVED"},
+			},
+		},
+	}
+	// Upserting twice replaces the options.
+	for range 2 {
+		if err := testDB.TrackingCategoriesUpsert(ctx, "tenant-a", categories); err != nil {
+			t.Fatal(err)
+		}
+	}
+	options, err := testDB.TrackingOptionsGet(ctx, "tenant-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantOptions := []TrackingOption{
+		{ID: "to-spring", CategoryName: "Campaign", Name: "Spring Appeal", Status: "ACTIVE"},
+		{ID: "to-winter", CategoryName: "Campaign", Name: "Winter Appeal", Status: "ARCHIVED"},
+	}
+	if diff := cmp.Diff(wantOptions, options); diff != "" {
+		t.Errorf("tracking options diff:\n%s", diff)
+	}
+	if options, err := testDB.TrackingOptionsGet(ctx, "tenant-b"); err != nil || len(options) != 0 {
+		t.Errorf("expected no options for another organisation, got %v, %v", options, err)
+	}
+
+	date := time.Date(2025, 5, 2, 10, 0, 0, 0, time.UTC)
+	spring := []xero.LineItemTracking{{TrackingCategoryID: "tc-campaign", TrackingOptionID: "to-spring", Name: "Campaign", Option: "Spring Appeal"}}
+	invoices := []xero.Invoice{
+		{
+			InvoiceID:     "inv-tracking-01",
+			InvoiceNumber: "INV-TRACKING-01",
+			Type:          "ACCREC",
+			Status:        "AUTHORISED",
+			Total:         80,
+			Date:          xero.XeroDateTime{Time: date},
+			Updated:       xero.XeroDateTime{Time: date},
+			LineItems: []xero.LineItem{
+				{LineItemID: "inv-tracking-01-a", AccountCode: "5501", LineAmount: 50, Tracking: spring},
+				{LineItemID: "inv-tracking-01-b", AccountCode: "5501", LineAmount: 30},
+			},
+		},
+		{
+			InvoiceID:     "inv-tracking-02",
+			InvoiceNumber: "INV-TRACKING-02",
+			Type:          "ACCREC",
+			Status:        "AUTHORISED",
+			Total:         20,
+			Date:          xero.XeroDateTime{Time: date},
+			Updated:       xero.XeroDateTime{Time: date},
+			LineItems: []xero.LineItem{
+				{LineItemID: "inv-tracking-02-a", AccountCode: "5501", LineAmount: 20, Tracking: spring},
+			},
+		},
+	}
+	if err := testDB.InvoicesUpsert(ctx, "tenant-a", invoices); err != nil {
+		t.Fatal(err)
+	}
+	transactions := []xero.BankTransaction{{
+		BankTransactionID: "bt-tracking-01",
+		Type:              "SPEND",
+		Reference:         "TRACKING-REFUND",
+		Status:            "AUTHORISED",
+		Total:             15,
+		Date:              xero.XeroDateTime{Time: date},
+		Updated:           xero.XeroDateTime{Time: date},
+		LineItems: []xero.LineItem{
+			{LineItemID: "bt-tracking-01-a", AccountCode: "5501", LineAmount: 15, Tracking: spring},
+		},
+	}}
+	if err := testDB.BankTransactionsUpsert(ctx, "tenant-a", transactions); err != nil {
+		t.Fatal(err)
+	}
+
+	dateFrom := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+	dateTo := time.Date(2026, 3, 31, 0, 0, 0, 0, time.UTC)
+
+	listed, err := testDB.InvoicesGet(ctx, "tenant-a", "All", dateFrom, dateTo, "", "to-spring", 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type total struct {
+		ID            string
+		DonationTotal float64
+		TrackingTotal float64
+		TrackingSum   float64
+	}
+	var gotInvoices []total
+	for _, inv := range listed {
+		gotInvoices = append(gotInvoices, total{inv.InvoiceID, inv.DonationTotal, inv.TrackingTotal, inv.TrackingSum})
+	}
+	wantInvoices := []total{
+		{"inv-tracking-01", 80, 50, 70},
+		{"inv-tracking-02", 20, 20, 70},
+	}
+	if diff := cmp.Diff(wantInvoices, gotInvoices); diff != "" {
+		t.Errorf("invoices diff:\n%s", diff)
+	}
+
+	// Money paid out reduces the tracked total.
+	listedTransactions, err := testDB.BankTransactionsGet(ctx, "tenant-a", "All", dateFrom, dateTo, "", "to-spring", 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(listedTransactions), 1; got != want {
+		t.Fatalf("got %d bank transactions want %d", got, want)
+	}
+	if got, want := listedTransactions[0].TrackingTotal, -15.0; got != want {
+		t.Errorf("got bank transaction tracking total %.2f want %.2f", got, want)
+	}
+
+	// No records are tagged with the archived option.
+	if _, err := testDB.InvoicesGet(ctx, "tenant-a", "All", dateFrom, dateTo, "", "to-winter", 100, 0); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+
+	// Removing the tracking from an invoice in Xero removes it from the listing.
+	invoices[1].LineItems[0].Tracking = nil
+	if err := testDB.InvoicesUpsert(ctx, "tenant-a", invoices[1:]); err != nil {
+		t.Fatal(err)
+	}
+	listed, err = testDB.InvoicesGet(ctx, "tenant-a", "All", dateFrom, dateTo, "", "to-spring", 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(listed), 1; got != want {
+		t.Errorf("got %d invoices want %d", got, want)
+	}
+}
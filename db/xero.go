@@ -10,8 +10,8 @@ import (
 	"time"
 )
 
-// AccountsUpsert upserts Xero account records.
-func (db *DB) AccountsUpsert(ctx context.Context, accounts []xero.Account) error {
+// AccountsUpsert upserts Xero account records for the Xero organisation (tenant).
+func (db *DB) AccountsUpsert(ctx context.Context, tenantID string, accounts []xero.Account) error {
 	if len(accounts) == 0 {
 		return nil
 	}
@@ -35,6 +35,7 @@ func (db *DB) AccountsUpsert(ctx context.Context, accounts []xero.Account) error
 			"SystemAccount": acc.SystemAccount,
 			"CurrencyCode":  acc.CurrencyCode,
 			"Updated":       acc.Updated.Format("2006-01-02T15:04:05Z"),
+			"TenantID":      tenantID,
 		}
 		if err := stmt.verifyArgs(namedArgs); err != nil {
 			return fmt.Errorf("accounts upsert verify arguments error: %v", err)
@@ -48,6 +49,47 @@ func (db *DB) AccountsUpsert(ctx context.Context, accounts []xero.Account) error
 	return tx.Commit()
 }
 
+// ContactsUpsert upserts Xero contacts into the database. The listing queries show
+// the names of the contacts, so that a contact renamed in Xero is shown by its new
+// name for all its records.
+func (db *DB) ContactsUpsert(ctx context.Context, tenantID string, contacts []xero.Contact) error {
+	if len(contacts) == 0 {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no-op after commit.
+
+	stmt := db.contactUpsertStmt
+
+	for _, c := range contacts {
+		namedArgs := map[string]any{
+			"ContactID":     c.ContactID,
+			"Name":          c.Name,
+			"FirstName":     c.FirstName,
+			"LastName":      c.LastName,
+			"EmailAddress":  c.EmailAddress,
+			"AccountNumber": c.AccountNumber,
+			"Status":        c.ContactStatus,
+			"IsCustomer":    c.IsCustomer,
+			"IsSupplier":    c.IsSupplier,
+			"Updated":       c.Updated.Format("2006-01-02T15:04:05Z"),
+			"TenantID":      tenantID,
+		}
+		if err := stmt.verifyArgs(namedArgs); err != nil {
+			return fmt.Errorf("contacts upsert verify arguments error: %v", err)
+		}
+		_, err := stmt.ExecContext(ctx, namedArgs)
+		if err != nil {
+			db.logQuery("contacts", stmt, namedArgs, err)
+			return fmt.Errorf("failed to upsert contact %s: %w", c.ContactID, err)
+		}
+	}
+	return tx.Commit()
+}
+
 // Invoice is the concrete type of each row returned by InvoicesGet.
 type Invoice struct {
 	InvoiceID     string    `db:"id"`
@@ -59,14 +101,19 @@ type Invoice struct {
 	DonationTotal float64   `db:"donation_total"`
 	CRMSTotal     float64   `db:"crms_total"`
 	IsReconciled  bool      `db:"is_reconciled"`
+	TrackingTotal float64   `db:"tracking_total"` // donations tagged with the tracking option
+	TrackingSum   float64   `db:"tracking_sum"`   // TrackingTotal summed over all rows
 	RowCount      int       `db:"row_count"`
 	// Reference      string     `db:"Reference,omitempty"`
 	// AmountPaid     float64    `json:"AmountPaid"`
 }
 
-// InvoicesGet gets invoices with summed up line item and donation
-// values. It isn't necessary to run this query in a transaction.
-func (db *DB) InvoicesGet(ctx context.Context, reconciliationStatus string, dateFrom, dateTo time.Time, search string, limit, offset int) ([]Invoice, error) {
+// InvoicesGet gets invoices for the Xero organisation (tenant), or for all
+// organisations if tenantID is empty, with summed up line item and donation values. If
+// trackingOptionID is not empty only invoices with donations tagged with the tracking
+// option are returned, with those donations totalled. It isn't necessary to run this
+// query in a transaction.
+func (db *DB) InvoicesGet(ctx context.Context, tenantID, reconciliationStatus string, dateFrom, dateTo time.Time, search, trackingOptionID string, limit, offset int) ([]Invoice, error) {
 
 	// Set named statement and parameter list.
 	stmt := db.invoicesGetStmt
@@ -86,10 +133,15 @@ func (db *DB) InvoicesGet(ctx context.Context, reconciliationStatus string, date
 		"DateFrom":             dateFrom.Format("2006-01-02"),
 		"DateTo":               dateTo.Format("2006-01-02"),
 		"AccountCodes":         db.accountCodes,
+		"ExcludedStage":        db.excludedStage,
+		"InvoiceTypes":         db.invoiceTypes,
+		"InvoiceStatuses":      db.invoiceStatuses,
 		"ReconciliationStatus": reconciliationStatus,
 		"TextSearch":           search,
 		"HereLimit":            limit,
 		"HereOffset":           offset,
+		"TenantID":             tenantID,
+		"TrackingOptionID":     trackingOptionID,
 	}
 	if err := stmt.verifyArgs(namedArgs); err != nil {
 		db.logger.Warn(fmt.Sprintf("invoices verify args error: %v", err))
@@ -113,9 +165,10 @@ func (db *DB) InvoicesGet(ctx context.Context, reconciliationStatus string, date
 	return invoices, nil
 }
 
-// InvoicesUpsert performs a upserts for a slice of Invoices. It replaces all line items
-// for each invoice in the set to ensure consistency.
-func (db *DB) InvoicesUpsert(ctx context.Context, invoices []xero.Invoice) error {
+// InvoicesUpsert performs a upserts for a slice of Invoices from the Xero organisation
+// (tenant). It replaces all line items for each invoice in the set to ensure
+// consistency.
+func (db *DB) InvoicesUpsert(ctx context.Context, tenantID string, invoices []xero.Invoice) error {
 	if len(invoices) == 0 {
 		return nil
 	}
@@ -135,7 +188,7 @@ func (db *DB) InvoicesUpsert(ctx context.Context, invoices []xero.Invoice) error
 			"InvoiceID": inv.InvoiceID,
 		}
 		if err := stmt.verifyArgs(namedArgs); err != nil {
-			fmt.Errorf("invoices upsert verify arguments error: %v", err)
+			return fmt.Errorf("invoices upsert verify arguments error: %v", err)
 		}
 		_, err := stmt.ExecContext(ctx, namedArgs)
 		if err != nil {
@@ -154,7 +207,9 @@ func (db *DB) InvoicesUpsert(ctx context.Context, invoices []xero.Invoice) error
 			"AmountPaid":    inv.AmountPaid,
 			"Date":          inv.Date.Format("2006-01-02"),
 			"Updated":       inv.Updated.Format("2006-01-02T15:04:05Z"),
-			"Contact":       inv.Contact,
+			"Contact":       inv.Contact.Name,
+			"ContactID":     inv.Contact.ContactID,
+			"TenantID":      tenantID,
 		}
 		if err := stmt.verifyArgs(namedArgs); err != nil {
 			return fmt.Errorf("invoices upsert verify arguments error: %v", err)
@@ -185,11 +240,29 @@ func (db *DB) InvoicesUpsert(ctx context.Context, invoices []xero.Invoice) error
 				return fmt.Errorf("failed to upsert line item %s invoice %s: %w", line.LineItemID, inv.InvoiceID, err)
 			}
 		}
+		if err := db.lineItemTrackingReplace(ctx, inv.InvoiceID, inv.LineItems); err != nil {
+			return err
+		}
 	}
 
 	return tx.Commit()
 }
 
+// InvoicesDelete soft deletes invoices deleted in Xero, recording their final
+// status, and returns the number of invoices removed. Deleted invoices are excluded
+// from the invoice queries and no longer link donations.
+func (db *DB) InvoicesDelete(ctx context.Context, invoices []xero.Invoice) (int, error) {
+	argSets := make([]map[string]any, len(invoices))
+	for i, inv := range invoices {
+		argSets[i] = map[string]any{
+			"InvoiceID": inv.InvoiceID,
+			"Status":    inv.Status,
+			"Updated":   inv.Updated.Format("2006-01-02T15:04:05Z"),
+		}
+	}
+	return db.softDelete(ctx, "invoices delete", db.invoiceDeleteStmt, argSets)
+}
+
 // BankTransaction is the concrete type of each row returned by
 // BankTransactionsGet.
 type BankTransaction struct {
@@ -202,13 +275,18 @@ type BankTransaction struct {
 	DonationTotal float64   `db:"donation_total"`
 	CRMSTotal     float64   `db:"crms_total"`
 	IsReconciled  bool      `db:"is_reconciled"`
+	TrackingTotal float64   `db:"tracking_total"` // donations tagged with the tracking option
+	TrackingSum   float64   `db:"tracking_sum"`   // TrackingTotal summed over all rows
 	RowCount      int       `db:"row_count"`
 	// AmountPaid     float64    `json:"AmountPaid"`
 }
 
-// BankTransactionsGet gets bank transactions with summed up line item
-// and donation values. It isn't necessary to run this query in a transaction.
-func (db *DB) BankTransactionsGet(ctx context.Context, reconciliationStatus string, dateFrom, dateTo time.Time, search string, limit, offset int) ([]BankTransaction, error) {
+// BankTransactionsGet gets bank transactions for the Xero organisation (tenant), or
+// for all organisations if tenantID is empty, with summed up line item and donation
+// values. If trackingOptionID is not empty only transactions with donations tagged with
+// the tracking option are returned, with those donations totalled. It isn't necessary
+// to run this query in a transaction.
+func (db *DB) BankTransactionsGet(ctx context.Context, tenantID, reconciliationStatus string, dateFrom, dateTo time.Time, search, trackingOptionID string, limit, offset int) ([]BankTransaction, error) {
 
 	// Set named statement and parameter list.
 	stmt := db.bankTransactionsGetStmt
@@ -228,10 +306,13 @@ func (db *DB) BankTransactionsGet(ctx context.Context, reconciliationStatus stri
 		"DateFrom":             dateFrom.Format("2006-01-02"),
 		"DateTo":               dateTo.Format("2006-01-02"),
 		"AccountCodes":         db.accountCodes,
+		"ExcludedStage":        db.excludedStage,
 		"ReconciliationStatus": reconciliationStatus,
 		"TextSearch":           search,
 		"HereLimit":            limit,
 		"HereOffset":           offset,
+		"TenantID":             tenantID,
+		"TrackingOptionID":     trackingOptionID,
 	}
 	if err := stmt.verifyArgs(namedArgs); err != nil {
 		return nil, fmt.Errorf("bank transactions verify arguments error: %v", err)
@@ -252,10 +333,10 @@ func (db *DB) BankTransactionsGet(ctx context.Context, reconciliationStatus stri
 	return transactions, nil
 }
 
-// BankTransactionsUpsert performs upserts for a slice of BankTransactions. It replaces
-// all line items for each Bank Transaction (transaction) in the set to ensure
-// consistency.
-func (db *DB) BankTransactionsUpsert(ctx context.Context, transactions []xero.BankTransaction) error {
+// BankTransactionsUpsert performs upserts for a slice of BankTransactions from the Xero
+// organisation (tenant). It replaces all line items for each Bank Transaction
+// (transaction) in the set to ensure consistency.
+func (db *DB) BankTransactionsUpsert(ctx context.Context, tenantID string, transactions []xero.BankTransaction) error {
 	if len(transactions) == 0 {
 		return nil
 	}
@@ -293,8 +374,12 @@ func (db *DB) BankTransactionsUpsert(ctx context.Context, transactions []xero.Ba
 			"IsReconciled":      tr.IsReconciled,
 			"Date":              tr.Date.Format("2006-01-02"),
 			"Updated":           tr.Updated.Format("2006-01-02T15:04:05Z"),
-			"Contact":           tr.Contact,
-			"BankAccount":       tr.BankAccount,
+			"Contact":           tr.Contact.Name,
+			"ContactID":         tr.Contact.ContactID,
+			"BankAccount":       tr.BankAccount.Name,
+			"BankAccountID":     tr.BankAccount.AccountID,
+			"BankAccountCode":   tr.BankAccount.Code,
+			"TenantID":          tenantID,
 		}
 
 		_, err = stmt.ExecContext(ctx, namedArgs)
@@ -324,15 +409,35 @@ func (db *DB) BankTransactionsUpsert(ctx context.Context, transactions []xero.Ba
 				return fmt.Errorf("failed to insert line item %s for transaction %s: %w", line.LineItemID, tr.BankTransactionID, err)
 			}
 		}
+		if err := db.lineItemTrackingReplace(ctx, tr.BankTransactionID, tr.LineItems); err != nil {
+			return err
+		}
 	}
 
 	return tx.Commit()
 }
 
+// BankTransactionsDelete soft deletes bank transactions deleted in Xero, recording
+// their final status, and returns the number of transactions removed. Deleted
+// transactions are excluded from the bank transaction queries and no longer link
+// donations.
+func (db *DB) BankTransactionsDelete(ctx context.Context, transactions []xero.BankTransaction) (int, error) {
+	argSets := make([]map[string]any, len(transactions))
+	for i, tr := range transactions {
+		argSets[i] = map[string]any{
+			"BankTransactionID": tr.BankTransactionID,
+			"Status":            tr.Status,
+			"Updated":           tr.Updated.Format("2006-01-02T15:04:05Z"),
+		}
+	}
+	return db.softDelete(ctx, "bank transactions delete", db.bankTransactionDeleteStmt, argSets)
+}
+
 // WRInvoice is the invoice component of a wide rows invoice with line
 // items query.
 type WRInvoice struct {
 	ID               string    `db:"id"`
+	TenantID         string    `db:"tenant_id"`
 	InvoiceNumber    string    `db:"invoice_number"`
 	Date             time.Time `db:"date"`
 	Type             *string   `db:"type"`
@@ -340,12 +445,20 @@ type WRInvoice struct {
 	Reference        *string   `db:"reference"`
 	Contact          string    `db:"contact"`
 	Total            float64   `db:"total"`
-	DonationTotal    float64   `db:"donation_total"`
+	AmountPaid       float64   `db:"amount_paid"`
+	DonationTotal    float64   `db:"donation_total"` // net of CreditedTotal
+	CreditedTotal    float64   `db:"credited_total"`
 	CRMSTotal        float64   `db:"crms_total"`
 	TotalOutstanding float64   `db:"total_outstanding"`
 	IsReconciled     bool      `db:"is_reconciled"`
 }
 
+// DonationLinesTotal is the total of the donation line items of the invoice, before
+// deducting the donations credited by credit notes.
+func (w WRInvoice) DonationLinesTotal() float64 {
+	return w.DonationTotal + w.CreditedTotal
+}
+
 // WRLineItem is the line item component of a wide rows invoice with
 // line items query. All values could be null.
 type WRLineItem struct {
@@ -380,8 +493,9 @@ func (db *DB) InvoiceWRGet(ctx context.Context, invoiceID string) (WRInvoice, []
 
 	// Args uses sqlx's named query capability.
 	namedArgs := map[string]any{
-		"AccountCodes": db.accountCodes,
-		"InvoiceID":    invoiceID,
+		"AccountCodes":  db.accountCodes,
+		"ExcludedStage": db.excludedStage,
+		"InvoiceID":     invoiceID,
 	}
 	if err := stmt.verifyArgs(namedArgs); err != nil {
 		return invoice, nil, err
@@ -409,10 +523,176 @@ func (db *DB) InvoiceWRGet(ctx context.Context, invoiceID string) (WRInvoice, []
 	return invoice, lineItems, nil
 }
 
+// CreditNotesUpsert performs upserts for a slice of CreditNotes from the Xero
+// organisation (tenant). It replaces all line items and allocations for each credit
+// note in the set to ensure consistency.
+func (db *DB) CreditNotesUpsert(ctx context.Context, tenantID string, creditNotes []xero.CreditNote) error {
+	if len(creditNotes) == 0 {
+		return nil
+	}
+
+	// Start transaction.
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no-op after a commit.
+
+	// exec verifies the arguments to and executes the statement.
+	exec := func(stmt *parameterizedStmt, namedArgs map[string]any) error {
+		if err := stmt.verifyArgs(namedArgs); err != nil {
+			return fmt.Errorf("credit notes upsert verify arguments error: %v", err)
+		}
+		_, err := stmt.ExecContext(ctx, namedArgs)
+		return err
+	}
+
+	for _, cn := range creditNotes {
+
+		// Delete any existing line items and allocations for this credit note.
+		byID := map[string]any{"CreditNoteID": cn.CreditNoteID}
+		if err := exec(db.creditNoteLIDeleteStmt, byID); err != nil {
+			return fmt.Errorf("failed to delete old line items for credit note %s: %w", cn.CreditNoteID, err)
+		}
+		if err := exec(db.creditNoteAllocationsDeleteStmt, byID); err != nil {
+			return fmt.Errorf("failed to delete old allocations for credit note %s: %w", cn.CreditNoteID, err)
+		}
+
+		// Upsert the credit note record.
+		err := exec(db.creditNoteUpsertStmt, map[string]any{
+			"CreditNoteID":     cn.CreditNoteID,
+			"CreditNoteNumber": cn.CreditNoteNumber,
+			"Type":             cn.Type,
+			"Status":           cn.Status,
+			"Reference":        cn.Reference,
+			"Total":            cn.Total,
+			"RemainingCredit":  cn.RemainingCredit,
+			"Date":             cn.Date.Format("2006-01-02"),
+			"Updated":          cn.Updated.Format("2006-01-02T15:04:05Z"),
+			"Contact":          cn.Contact.Name,
+			"ContactID":        cn.Contact.ContactID,
+			"TenantID":         tenantID,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to upsert credit note %s: %w", cn.CreditNoteID, err)
+		}
+
+		// Add the related line items and allocations for this credit note.
+		for _, line := range cn.LineItems {
+			err := exec(db.creditNoteLIInsertStmt, map[string]any{
+				"LineItemID":   line.LineItemID,
+				"CreditNoteID": cn.CreditNoteID,
+				"Description":  line.Description,
+				"Quantity":     line.Quantity,
+				"UnitAmount":   line.UnitAmount,
+				"LineAmount":   line.LineAmount,
+				"AccountCode":  line.AccountCode,
+				"TaxAmount":    line.TaxAmount,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to insert line item %s for credit note %s: %w", line.LineItemID, cn.CreditNoteID, err)
+			}
+		}
+		for _, al := range cn.Allocations {
+			err := exec(db.creditNoteAllocationInsertStmt, map[string]any{
+				"AllocationID": al.AllocationID,
+				"CreditNoteID": cn.CreditNoteID,
+				"InvoiceID":    al.Invoice.InvoiceID,
+				"Amount":       al.Amount,
+				"Date":         al.Date.Format("2006-01-02"),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to insert allocation %s for credit note %s: %w", al.AllocationID, cn.CreditNoteID, err)
+			}
+		}
+		if err := db.lineItemTrackingReplace(ctx, cn.CreditNoteID, cn.LineItems); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// PaymentsUpsert upserts Xero payment records for the Xero organisation (tenant).
+func (db *DB) PaymentsUpsert(ctx context.Context, tenantID string, payments []xero.Payment) error {
+	if len(payments) == 0 {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no-op after commit.
+
+	stmt := db.paymentUpsertStmt
+
+	for _, p := range payments {
+		namedArgs := map[string]any{
+			"PaymentID":     p.PaymentID,
+			"InvoiceID":     p.Invoice.InvoiceID,
+			"InvoiceNumber": p.Invoice.InvoiceNumber,
+			"AccountID":     p.Account.AccountID,
+			"AccountCode":   p.Account.Code,
+			"Date":          p.Date.Format("2006-01-02"),
+			"Amount":        p.Amount,
+			"BankAmount":    p.BankAmount,
+			"Reference":     p.Reference,
+			"Status":        p.Status,
+			"PaymentType":   p.PaymentType,
+			"IsReconciled":  p.IsReconciled,
+			"Updated":       p.Updated.Format("2006-01-02T15:04:05Z"),
+			"TenantID":      tenantID,
+		}
+		if err := stmt.verifyArgs(namedArgs); err != nil {
+			return fmt.Errorf("payments upsert verify arguments error: %v", err)
+		}
+		_, err := stmt.ExecContext(ctx, namedArgs)
+		if err != nil {
+			db.logQuery("payments", stmt, namedArgs, err)
+			return fmt.Errorf("failed to upsert payment %s: %w", p.PaymentID, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Payment is the concrete type of each row returned by InvoicePaymentsGet. The account
+// is the bank account paid into; AccountName is nil if the account has not been
+// synced.
+type Payment struct {
+	ID           string    `db:"id"`
+	Date         time.Time `db:"date"`
+	Amount       float64   `db:"amount"`
+	Reference    *string   `db:"reference"`
+	IsReconciled bool      `db:"is_reconciled"`
+	AccountCode  *string   `db:"account_code"`
+	AccountName  *string   `db:"account_name"`
+}
+
+// InvoicePaymentsGet lists the payments of an invoice, excluding deleted payments, in
+// date order. Unlike the other get functions no error is returned if there are none,
+// as an unpaid invoice has no payments.
+func (db *DB) InvoicePaymentsGet(ctx context.Context, invoiceID string) ([]Payment, error) {
+	stmt := db.invoicePaymentsGetStmt
+	namedArgs := map[string]any{
+		"InvoiceID": invoiceID,
+	}
+	if err := stmt.verifyArgs(namedArgs); err != nil {
+		return nil, fmt.Errorf("invoice payments verify arguments error: %v", err)
+	}
+	var payments []Payment
+	err := stmt.SelectContext(ctx, &payments, namedArgs)
+	db.logQuery("invoice payments", stmt, namedArgs, err)
+	if err != nil {
+		return nil, fmt.Errorf("invoice payments select error: %v", err)
+	}
+	return payments, nil
+}
+
 // WRTransaction is the bank transaction component of a wide rows bank
 // transaction with line items query.
 type WRTransaction struct {
 	ID               string    `db:"id"`
+	TenantID         string    `db:"tenant_id"`
 	Reference        *string   `db:"reference"`
 	Date             time.Time `db:"date"`
 	Type             *string   `db:"type"`
@@ -449,6 +729,7 @@ func (db *DB) BankTransactionWRGet(ctx context.Context, transactionID string) (W
 	// Args uses sqlx's named query capability.
 	namedArgs := map[string]any{
 		"AccountCodes":      db.accountCodes,
+		"ExcludedStage":     db.excludedStage,
 		"BankTransactionID": transactionID,
 	}
 	if err := stmt.verifyArgs(namedArgs); err != nil {
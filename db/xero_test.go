@@ -8,7 +8,9 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"reconciler/apiclients/salesforce"
 	"reconciler/apiclients/xero"
+	"slices"
 	"testing"
 	"text/template"
 	"time"
@@ -19,13 +21,17 @@ import (
 // Index:
 // These tests test each testDB.go database funcion.
 //
-// Test01 AccountsUpsert(ctx context.Context, accounts []xero.Account) error
-// Test02 InvoicesGet(ctx context.Context, reconciliationStatus string, dateFrom, dateTo time.Time, search string, limit, offset int) ([]Invoice, error)
-// Test03 InvoicesUpsert(ctx context.Context, invoices []xero.Invoice) error
-// Test04 BankTransactionsGet(ctx context.Context, reconciliationStatus string, dateFrom, dateTo time.Time, search string, limit, offset int) ([]BankTransaction, error)
-// Test05 BankTransactionsUpsert(ctx context.Context, transactions []xero.BankTransaction) error
+// Test01 AccountsUpsert(ctx context.Context, tenantID string, accounts []xero.Account) error
+// Test02 InvoicesGet(ctx context.Context, tenantID, reconciliationStatus string, dateFrom, dateTo time.Time, search, trackingOptionID string, limit, offset int) ([]Invoice, error)
+// Test03 InvoicesUpsert(ctx context.Context, tenantID string, invoices []xero.Invoice) error
+// Test04 BankTransactionsGet(ctx context.Context, tenantID, reconciliationStatus string, dateFrom, dateTo time.Time, search, trackingOptionID string, limit, offset int) ([]BankTransaction, error)
+// Test05 BankTransactionsUpsert(ctx context.Context, tenantID string, transactions []xero.BankTransaction) error
 // Test07 InvoiceWRGet(ctx context.Context, invoiceID string) (WRInvoice, []WRLineItem, error)
 // Test08 BankTransactionWRGet(ctx context.Context, transactionID string) (WRTransaction, []WRLineItem, error)
+// Test09 records for several Xero organisations (tenants)
+// Test12 CreditNotesUpsert(ctx context.Context, tenantID string, creditNotes []xero.CreditNote) error
+// Test13 ContactsUpsert(ctx context.Context, tenantID string, contacts []xero.Contact) error
+// Test14 InvoicesDelete, BankTransactionsDelete and DonationsDelete soft deletes
 
 func Test01_AccountsUpsert(t *testing.T) {
 
@@ -62,7 +68,7 @@ func Test01_AccountsUpsert(t *testing.T) {
 		},
 	}
 
-	err := testDB.AccountsUpsert(ctx, accounts)
+	err := testDB.AccountsUpsert(ctx, "tenant-a", accounts)
 	if err != nil {
 		t.Errorf("unexpected accounts error: %v", err)
 	}
@@ -256,7 +262,7 @@ func Test02_InvoicesQuery(t *testing.T) {
 	for ii, tt := range tests {
 		t.Run(fmt.Sprintf("%d_%s", ii, tt.name), func(t *testing.T) {
 
-			invoices, err := testDB.InvoicesGet(ctx, tt.reconciliationStatus, tt.dateFrom, tt.dateTo, tt.searchString, tt.limit, tt.offset)
+			invoices, err := testDB.InvoicesGet(ctx, "", tt.reconciliationStatus, tt.dateFrom, tt.dateTo, tt.searchString, "", tt.limit, tt.offset)
 			if err != nil {
 				if err != tt.err {
 					t.Fatalf("got invoices error: %v", err)
@@ -288,9 +294,9 @@ func Test03_InvoicesUpsert(t *testing.T) {
 			Type:          "ACCREC",
 			InvoiceID:     "9fe6d963-fa41",
 			InvoiceNumber: "INV-TEST-01",
-			Contact:       "Contact Name",
-			Date:          xero.XeroDateTime{time.Now().Add(-2 * time.Hour)},
-			Updated:       xero.XeroDateTime{time.Now()},
+			Contact:       xero.Contact{Name: "Contact Name"},
+			Date:          xero.XeroDateTime{Time: time.Now().Add(-2 * time.Hour)},
+			Updated:       xero.XeroDateTime{Time: time.Now()},
 			Status:        "PAID",
 			Reference:     "A reference",
 			Total:         212.20,
@@ -318,13 +324,13 @@ func Test03_InvoicesUpsert(t *testing.T) {
 		},
 	}
 
-	err := testDB.InvoicesUpsert(ctx, invoices)
+	err := testDB.InvoicesUpsert(ctx, "tenant-a", invoices)
 	if err != nil {
 		t.Errorf("unexpected invoices error: %v", err)
 	}
 
 	// run a second time.
-	err = testDB.InvoicesUpsert(ctx, invoices)
+	err = testDB.InvoicesUpsert(ctx, "tenant-a", invoices)
 	if err != nil {
 		t.Errorf("unexpected invoices error: %v", err)
 	}
@@ -494,7 +500,7 @@ func Test04_BankTransactionsQuery(t *testing.T) {
 	for ii, tt := range tests {
 		t.Run(fmt.Sprintf("%d_%s", ii, tt.name), func(t *testing.T) {
 
-			transactions, err := testDB.BankTransactionsGet(ctx, tt.reconciliationStatus, tt.dateFrom, tt.dateTo, tt.searchString, tt.limit, tt.offset)
+			transactions, err := testDB.BankTransactionsGet(ctx, "", tt.reconciliationStatus, tt.dateFrom, tt.dateTo, tt.searchString, "", tt.limit, tt.offset)
 			if err != nil {
 				if err != tt.err {
 					t.Fatalf("got bank transactions error: %v", err)
@@ -526,14 +532,14 @@ func Test05_BankTransactionsUpsert(t *testing.T) {
 		xero.BankTransaction{
 			BankTransactionID: "27104cb7-fac4",
 			Type:              "RECEIVE",
-			Contact:           "Contact Name2",
+			Contact:           xero.Contact{Name: "Contact Name2"},
 			IsReconciled:      true, // most transactions will be
 			Reference:         "TEST-REF-20251101",
 			Status:            "AUTHORISED", // or DELETED
-			Date:              xero.XeroDateTime{time.Now()},
-			Updated:           xero.XeroDateTime{time.Now()},
+			Date:              xero.XeroDateTime{Time: time.Now()},
+			Updated:           xero.XeroDateTime{Time: time.Now()},
 			Total:             20.00,
-			BankAccount:       "current",
+			BankAccount:       xero.BankAccount{Name: "current"},
 			LineItems: []xero.LineItem{
 				xero.LineItem{
 					Description: "bank transaction line item",
@@ -548,13 +554,13 @@ func Test05_BankTransactionsUpsert(t *testing.T) {
 		},
 	}
 
-	err := testDB.BankTransactionsUpsert(ctx, transactions)
+	err := testDB.BankTransactionsUpsert(ctx, "tenant-a", transactions)
 	if err != nil {
 		t.Fatalf("could not upsert bank transactions: %v", err)
 	}
 
 	// run again
-	err = testDB.BankTransactionsUpsert(ctx, transactions)
+	err = testDB.BankTransactionsUpsert(ctx, "tenant-a", transactions)
 	if err != nil {
 		t.Fatalf("could not upsert bank transactions for the second time: %v", err)
 	}
@@ -597,7 +603,7 @@ func Test07_InvoiceWithLineItemsQuery(t *testing.T) {
 				ID:               "inv-002",
 				InvoiceNumber:    "INV-2025-102",
 				Date:             time.Date(2025, 4, 12, 11, 0, 0, 0, time.UTC),
-				Type:             nil,
+				Type:             ptrStr("ACCREC"),
 				Status:           "PAID",
 				Reference:        nil,
 				Contact:          "Generous Individual",
@@ -631,7 +637,7 @@ func Test07_InvoiceWithLineItemsQuery(t *testing.T) {
 				ID:               "inv-unrec-04",
 				InvoiceNumber:    "INV-2025-106",
 				Date:             time.Date(2025, 4, 25, 13, 0, 0, 0, time.UTC),
-				Type:             nil,
+				Type:             ptrStr("ACCREC"),
 				Status:           "PAID",
 				Reference:        nil,
 				Contact:          "Small Pledge",
@@ -772,3 +778,637 @@ Invoice: {{ .Invoice.ID }} No {{ .Invoice.InvoiceNumber }} {{ .Invoice.Total }}
 	}
 	parsedTemplate.Execute(os.Stdout, data)
 }
+
+// Test09_XeroTenants tests that records from several Xero organisations (tenants) are
+// listed separately, and that account names are taken from the record's organisation.
+func Test09_XeroTenants(t *testing.T) {
+
+	testDB, closeDB := setupTestDB(t)
+	t.Cleanup(closeDB)
+	ctx := context.Background()
+
+	date := time.Date(2025, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	// The same account code has a different name in the second organisation.
+	accounts := []xero.Account{{AccountID: "tenant-b-5501", Code: "5501", Name: "Charity B Giving", Updated: date}}
+	if err := testDB.AccountsUpsert(ctx, "tenant-b", accounts); err != nil {
+		t.Fatal(err)
+	}
+	invoices := []xero.Invoice{{
+		InvoiceID:     "tenant-b-inv-01",
+		InvoiceNumber: "B-INV-01",
+		Type:          "ACCREC",
+		Status:        "PAID",
+		Total:         50,
+		Date:          xero.XeroDateTime{Time: date},
+		Updated:       xero.XeroDateTime{Time: date},
+		LineItems: []xero.LineItem{
+			{LineItemID: "tenant-b-inv-01-a", AccountCode: "5501", LineAmount: 50},
+		},
+	}}
+	if err := testDB.InvoicesUpsert(ctx, "tenant-b", invoices); err != nil {
+		t.Fatal(err)
+	}
+	transactions := []xero.BankTransaction{{
+		BankTransactionID: "tenant-b-bt-01",
+		Reference:         "B-BT-01",
+		Status:            "AUTHORISED",
+		Total:             20,
+		Date:              xero.XeroDateTime{Time: date},
+		Updated:           xero.XeroDateTime{Time: date},
+		LineItems: []xero.LineItem{
+			{LineItemID: "tenant-b-bt-01-a", AccountCode: "5501", LineAmount: 20},
+		},
+	}}
+	if err := testDB.BankTransactionsUpsert(ctx, "tenant-b", transactions); err != nil {
+		t.Fatal(err)
+	}
+
+	dateFrom := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+	dateTo := time.Date(2026, 3, 31, 0, 0, 0, 0, time.UTC)
+
+	tenantInvoices, err := testDB.InvoicesGet(ctx, "tenant-b", "All", dateFrom, dateTo, "", "", 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(tenantInvoices), 1; got != want {
+		t.Fatalf("got %d tenant invoices want %d", got, want)
+	}
+	if got, want := tenantInvoices[0].InvoiceID, "tenant-b-inv-01"; got != want {
+		t.Errorf("got invoice %q want %q", got, want)
+	}
+	allInvoices, err := testDB.InvoicesGet(ctx, "", "All", dateFrom, dateTo, "", "", 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allInvoices) <= len(tenantInvoices) {
+		t.Errorf("expected invoices for all organisations, got %d", len(allInvoices))
+	}
+	if _, err := testDB.InvoicesGet(ctx, "tenant-c", "All", dateFrom, dateTo, "", "", 100, 0); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected no invoices for an unknown tenant, got %v", err)
+	}
+
+	tenantTransactions, err := testDB.BankTransactionsGet(ctx, "tenant-b", "All", dateFrom, dateTo, "", "", 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(tenantTransactions), 1; got != want {
+		t.Fatalf("got %d tenant bank transactions want %d", got, want)
+	}
+
+	_, lineItems, err := testDB.InvoiceWRGet(ctx, "tenant-b-inv-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lineItems[0].AccountName == nil || *lineItems[0].AccountName != "Charity B Giving" {
+		t.Errorf("expected the organisation's account name, got %v", lineItems[0].AccountName)
+	}
+}
+
+// Test10_Refunds tests that money paid out, such as a refunded donation, reduces the
+// donation total of a bank transaction.
+func Test10_Refunds(t *testing.T) {
+
+	testDB, closeDB := setupTestDB(t)
+	t.Cleanup(closeDB)
+	ctx := context.Background()
+
+	date := time.Date(2025, 5, 2, 10, 0, 0, 0, time.UTC)
+	transactions := []xero.BankTransaction{{
+		BankTransactionID: "bt-refund-01",
+		Type:              "SPEND",
+		Reference:         "REFUND-2025-05-02",
+		Status:            "AUTHORISED",
+		Total:             30,
+		Date:              xero.XeroDateTime{Time: date},
+		Updated:           xero.XeroDateTime{Time: date},
+		LineItems: []xero.LineItem{
+			{LineItemID: "bt-refund-01-a", AccountCode: "5501", LineAmount: 30},
+		},
+	}}
+	if err := testDB.BankTransactionsUpsert(ctx, "tenant-a", transactions); err != nil {
+		t.Fatal(err)
+	}
+
+	transaction, lineItems, err := testDB.BankTransactionWRGet(ctx, "bt-refund-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := transaction.DonationTotal, -30.0; got != want {
+		t.Errorf("got donation total %.2f want %.2f", got, want)
+	}
+	if got, want := *lineItems[0].DonationAmount, -30.0; got != want {
+		t.Errorf("got line item donation amount %.2f want %.2f", got, want)
+	}
+
+	dateFrom := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+	dateTo := time.Date(2026, 3, 31, 0, 0, 0, 0, time.UTC)
+	listed, err := testDB.BankTransactionsGet(ctx, "tenant-a", "All", dateFrom, dateTo, "REFUND", "", 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := listed[0].DonationTotal, -30.0; got != want {
+		t.Errorf("got listed donation total %.2f want %.2f", got, want)
+	}
+}
+
+// Test11_Payments tests upserting payments and listing the payments of an invoice with
+// the bank accounts paid into.
+func Test11_Payments(t *testing.T) {
+
+	testDB, closeDB := setupTestDB(t)
+	t.Cleanup(closeDB)
+	ctx := context.Background()
+
+	// The deleted payment is excluded.
+	payments, err := testDB.InvoicePaymentsGet(ctx, "inv-001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Payment{
+		{
+			ID:           "pay-001a",
+			Date:         time.Date(2025, 4, 20, 0, 0, 0, 0, time.UTC),
+			Amount:       300,
+			Reference:    ptrStr("EXAMPLE CORP 1 OF 2"),
+			IsReconciled: true,
+			AccountCode:  ptrStr("090"),
+			AccountName:  ptrStr("Business Bank Account"),
+		},
+		{
+			ID:          "pay-001b",
+			Date:        time.Date(2025, 4, 27, 0, 0, 0, 0, time.UTC),
+			Amount:      200,
+			Reference:   ptrStr("EXAMPLE CORP 2 OF 2"),
+			AccountCode: ptrStr("090"),
+			AccountName: ptrStr("Business Bank Account"),
+		},
+	}
+	if diff := cmp.Diff(want, payments); diff != "" {
+		t.Errorf("payments diff:\n%s", diff)
+	}
+
+	// Upserting a payment for an invoice adds it, and upserting it again once deleted
+	// in Xero removes it from the list.
+	date := time.Date(2025, 5, 2, 0, 0, 0, 0, time.UTC)
+	payment := xero.Payment{
+		PaymentID: "pay-002",
+		Date:      xero.XeroDateTime{Time: date},
+		Updated:   xero.XeroDateTime{Time: date},
+		Amount:    196.50,
+		Reference: "STRIPE-2025-05-02",
+		Status:    "AUTHORISED",
+		Invoice:   xero.PaymentInvoice{InvoiceID: "inv-002", InvoiceNumber: "INV-2025-102"},
+		Account:   xero.PaymentAccount{AccountID: "acc-090", Code: "090"},
+	}
+	if err := testDB.PaymentsUpsert(ctx, "", []xero.Payment{payment}); err != nil {
+		t.Fatal(err)
+	}
+	payments, err = testDB.InvoicePaymentsGet(ctx, "inv-002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(payments), 1; got != want {
+		t.Fatalf("got %d payments want %d", got, want)
+	}
+
+	payment.Status = "DELETED"
+	if err := testDB.PaymentsUpsert(ctx, "", []xero.Payment{payment}); err != nil {
+		t.Fatal(err)
+	}
+	payments, err = testDB.InvoicePaymentsGet(ctx, "inv-002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(payments), 0; got != want {
+		t.Errorf("got %d payments want %d", got, want)
+	}
+}
+
+// Test12_CreditNotes tests that credit notes allocated to an invoice, such as a refund,
+// are netted off the invoice donation total, and that closed lost donations are
+// excluded from the Salesforce total.
+func Test12_CreditNotes(t *testing.T) {
+
+	testDB, closeDB := setupTestDB(t)
+	t.Cleanup(closeDB)
+	ctx := context.Background()
+
+	date := time.Date(2025, 5, 2, 10, 0, 0, 0, time.UTC)
+	invoices := []xero.Invoice{{
+		InvoiceID:     "inv-refund-01",
+		InvoiceNumber: "INV-2025-901",
+		Type:          "ACCREC",
+		Status:        "PAID",
+		Total:         150,
+		Date:          xero.XeroDateTime{Time: date},
+		Updated:       xero.XeroDateTime{Time: date},
+		LineItems: []xero.LineItem{
+			{LineItemID: "inv-refund-01-a", AccountCode: "5501", LineAmount: 100},
+			{LineItemID: "inv-refund-01-b", AccountCode: "5501", LineAmount: 50},
+		},
+	}}
+	if err := testDB.InvoicesUpsert(ctx, "", invoices); err != nil {
+		t.Fatal(err)
+	}
+
+	// The refunded donation is marked as closed lost in Salesforce.
+	donation := func(id, stage string, amount float64) salesforce.Donation {
+		return salesforce.Donation{CoreFields: salesforce.CoreFields{
+			ID:               id,
+			Name:             "Refund test donation",
+			Amount:           amount,
+			StageName:        stage,
+			CloseDate:        salesforce.SalesforceDate{Time: date},
+			CreatedDate:      salesforce.SalesforceTime{Time: date},
+			LastModifiedDate: salesforce.SalesforceTime{Time: date},
+			PayoutReference:  ptrStr("INV-2025-901"),
+		}}
+	}
+	donations := []salesforce.Donation{
+		donation("sf-refund-01", "Closed Won", 100),
+		donation("sf-refund-02", "Closed Lost", 50),
+	}
+	if err := testDB.UpsertDonations(ctx, donations); err != nil {
+		t.Fatal(err)
+	}
+
+	creditNote := xero.CreditNote{
+		CreditNoteID:     "cn-refund-01",
+		CreditNoteNumber: "CN-2025-901",
+		Type:             "ACCRECCREDIT",
+		Status:           "PAID",
+		Total:            50,
+		Date:             xero.XeroDateTime{Time: date},
+		Updated:          xero.XeroDateTime{Time: date},
+		LineItems: []xero.LineItem{
+			{LineItemID: "cn-refund-01-a", AccountCode: "5501", LineAmount: 50},
+		},
+		Allocations: []xero.Allocation{
+			{AllocationID: "cn-refund-01-al", Amount: 50, Date: xero.XeroDateTime{Time: date}, Invoice: xero.PaymentInvoice{InvoiceID: "inv-refund-01"}},
+		},
+	}
+
+	dateFrom := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+	dateTo := time.Date(2026, 3, 31, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name              string
+		status            string
+		wantDonationTotal float64
+		wantCredited      float64
+		wantReconciled    bool
+	}{
+		{"credited", "PAID", 100, 50, true},
+		{"voided credit note", "VOIDED", 150, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			creditNote.Status = tt.status
+			// Upserting twice replaces the line items and allocations.
+			for range 2 {
+				if err := testDB.CreditNotesUpsert(ctx, "", []xero.CreditNote{creditNote}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			invoice, _, err := testDB.InvoiceWRGet(ctx, "inv-refund-01")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := invoice.DonationTotal, tt.wantDonationTotal; got != want {
+				t.Errorf("got donation total %.2f want %.2f", got, want)
+			}
+			if got, want := invoice.CreditedTotal, tt.wantCredited; got != want {
+				t.Errorf("got credited total %.2f want %.2f", got, want)
+			}
+			if got, want := invoice.CRMSTotal, 100.0; got != want {
+				t.Errorf("got salesforce total %.2f want %.2f", got, want)
+			}
+			if got, want := invoice.IsReconciled, tt.wantReconciled; got != want {
+				t.Errorf("got reconciled %t want %t", got, want)
+			}
+
+			listed, err := testDB.InvoicesGet(ctx, "", "All", dateFrom, dateTo, "INV-2025-901", "", 100, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := listed[0].DonationTotal, tt.wantDonationTotal; got != want {
+				t.Errorf("got listed donation total %.2f want %.2f", got, want)
+			}
+			if got, want := listed[0].IsReconciled, tt.wantReconciled; got != want {
+				t.Errorf("got listed reconciled %t want %t", got, want)
+			}
+		})
+	}
+
+	// NPSP orgs may use another stage for refunded donations.
+	testDB.excludedStage = "Refunded"
+	invoice, _, err := testDB.InvoiceWRGet(ctx, "inv-refund-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := invoice.CRMSTotal, 150.0; got != want {
+		t.Errorf("got salesforce total %.2f want %.2f", got, want)
+	}
+	listed, err := testDB.InvoicesGet(ctx, "", "All", dateFrom, dateTo, "INV-2025-901", "", 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := listed[0].CRMSTotal, 150.0; got != want {
+		t.Errorf("got listed salesforce total %.2f want %.2f", got, want)
+	}
+}
+
+// Test13_Contacts tests that invoices and bank transactions are listed with the
+// current name of their contact, falling back to the name recorded when they were
+// synced.
+func Test13_Contacts(t *testing.T) {
+
+	testDB, closeDB := setupTestDB(t)
+	t.Cleanup(closeDB)
+	ctx := context.Background()
+
+	date := time.Date(2025, 5, 2, 10, 0, 0, 0, time.UTC)
+	contact := xero.Contact{ContactID: "con-rename-01", Name: "Old Name Trust"}
+	invoices := []xero.Invoice{{
+		InvoiceID:     "inv-contact-01",
+		InvoiceNumber: "INV-2025-951",
+		Type:          "ACCREC",
+		Status:        "AUTHORISED",
+		Contact:       contact,
+		Total:         10,
+		Date:          xero.XeroDateTime{Time: date},
+		Updated:       xero.XeroDateTime{Time: date},
+		LineItems:     []xero.LineItem{{LineItemID: "inv-contact-01-a", AccountCode: "5501", LineAmount: 10}},
+	}}
+	if err := testDB.InvoicesUpsert(ctx, "", invoices); err != nil {
+		t.Fatal(err)
+	}
+	transactions := []xero.BankTransaction{{
+		BankTransactionID: "bt-contact-01",
+		Type:              "RECEIVE",
+		Reference:         "CONTACT-2025-05-02",
+		Status:            "AUTHORISED",
+		Contact:           contact,
+		BankAccount:       xero.BankAccount{AccountID: "acc-090", Code: "090", Name: "Business Bank Account"},
+		Total:             10,
+		Date:              xero.XeroDateTime{Time: date},
+		Updated:           xero.XeroDateTime{Time: date},
+		LineItems:         []xero.LineItem{{LineItemID: "bt-contact-01-a", AccountCode: "5501", LineAmount: 10}},
+	}}
+	if err := testDB.BankTransactionsUpsert(ctx, "", transactions); err != nil {
+		t.Fatal(err)
+	}
+
+	var bankAccountCode string
+	if err := testDB.GetContext(ctx, &bankAccountCode, "SELECT bank_account_code FROM bank_transactions WHERE bank_account_id = 'acc-090'"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := bankAccountCode, "090"; got != want {
+		t.Errorf("got bank account code %q want %q", got, want)
+	}
+
+	dateFrom := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+	dateTo := time.Date(2026, 3, 31, 0, 0, 0, 0, time.UTC)
+
+	// checkContact checks the contact name of the invoice and bank transaction, each
+	// found by searching for the name.
+	checkContact := func(t *testing.T, name string) {
+		t.Helper()
+		invoice, _, err := testDB.InvoiceWRGet(ctx, "inv-contact-01")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := invoice.Contact, name; got != want {
+			t.Errorf("got invoice contact %q want %q", got, want)
+		}
+		listed, err := testDB.InvoicesGet(ctx, "", "All", dateFrom, dateTo, name, "", 100, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(listed) != 1 || listed[0].Contact != name {
+			t.Errorf("got listed invoices %v want one with contact %q", listed, name)
+		}
+		transaction, _, err := testDB.BankTransactionWRGet(ctx, "bt-contact-01")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := transaction.Contact, name; got != want {
+			t.Errorf("got bank transaction contact %q want %q", got, want)
+		}
+		listedTransactions, err := testDB.BankTransactionsGet(ctx, "", "All", dateFrom, dateTo, name, "", 100, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(listedTransactions) != 1 || listedTransactions[0].Contact != name {
+			t.Errorf("got listed bank transactions %v want one with contact %q", listedTransactions, name)
+		}
+	}
+
+	// Before the contacts are synced the name recorded with each record is used.
+	checkContact(t, "Old Name Trust")
+
+	// The contact is renamed in Xero.
+	renamed := xero.Contact{ContactID: "con-rename-01", Name: "New Name Foundation", ContactStatus: "ACTIVE", IsCustomer: true}
+	if err := testDB.ContactsUpsert(ctx, "", []xero.Contact{renamed}); err != nil {
+		t.Fatal(err)
+	}
+	checkContact(t, "New Name Foundation")
+}
+
+// Test14_SoftDeletes tests that invoices, bank transactions and donations removed
+// upstream are excluded from the queries, are only counted when first removed, and
+// are restored if upserted again.
+func Test14_SoftDeletes(t *testing.T) {
+
+	testDB, closeDB := setupTestDB(t)
+	t.Cleanup(closeDB)
+	ctx := context.Background()
+
+	date := time.Date(2025, 5, 3, 10, 0, 0, 0, time.UTC)
+	invoice := xero.Invoice{
+		InvoiceID:     "inv-removed-01",
+		InvoiceNumber: "INV-2025-961",
+		Type:          "ACCREC",
+		Status:        "AUTHORISED",
+		Total:         10,
+		Date:          xero.XeroDateTime{Time: date},
+		Updated:       xero.XeroDateTime{Time: date},
+		LineItems:     []xero.LineItem{{LineItemID: "inv-removed-01-a", AccountCode: "5501", LineAmount: 10}},
+	}
+	transaction := xero.BankTransaction{
+		BankTransactionID: "bt-removed-01",
+		Type:              "RECEIVE",
+		Reference:         "REMOVED-2025-05-03",
+		Status:            "AUTHORISED",
+		Total:             10,
+		Date:              xero.XeroDateTime{Time: date},
+		Updated:           xero.XeroDateTime{Time: date},
+		LineItems:         []xero.LineItem{{LineItemID: "bt-removed-01-a", AccountCode: "5501", LineAmount: 10}},
+	}
+	donation := salesforce.Donation{CoreFields: salesforce.CoreFields{
+		ID:              "sf-removed-01",
+		Name:            "Removed Donation",
+		Amount:          10,
+		CloseDate:       salesforce.SalesforceDate{Time: date},
+		PayoutReference: ptrStr("INV-2025-961"),
+	}}
+	if err := testDB.InvoicesUpsert(ctx, "", []xero.Invoice{invoice}); err != nil {
+		t.Fatal(err)
+	}
+	if err := testDB.BankTransactionsUpsert(ctx, "", []xero.BankTransaction{transaction}); err != nil {
+		t.Fatal(err)
+	}
+	if err := testDB.UpsertDonations(ctx, []salesforce.Donation{donation}); err != nil {
+		t.Fatal(err)
+	}
+
+	dateFrom := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+	dateTo := time.Date(2026, 3, 31, 0, 0, 0, 0, time.UTC)
+
+	// The donation deleted in Salesforce no longer counts towards the invoice.
+	for i, want := range []int{1, 0} {
+		n, err := testDB.DonationsDelete(ctx, []string{"sf-removed-01", "sf-unknown-01"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("removal %d: got %d donations deleted want %d", i+1, n, want)
+		}
+	}
+	got, _, err := testDB.InvoiceWRGet(ctx, "inv-removed-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.CRMSTotal != 0 {
+		t.Errorf("got crms total %.2f want 0", got.CRMSTotal)
+	}
+	if _, err := testDB.DonationsGet(ctx, dateFrom, dateTo, "All", "", "Removed Donation", -1, 0); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected the deleted donation not to be listed, got %v", err)
+	}
+
+	// The deleted invoice and transaction are no longer found.
+	invoice.Status = "DELETED"
+	transaction.Status = "DELETED"
+	tests := []struct {
+		name   string
+		remove func() (int, error)
+		get    func() error
+		list   func() error
+	}{
+		{
+			name:   "invoice",
+			remove: func() (int, error) { return testDB.InvoicesDelete(ctx, []xero.Invoice{invoice}) },
+			get: func() error {
+				_, _, err := testDB.InvoiceWRGet(ctx, "inv-removed-01")
+				return err
+			},
+			list: func() error {
+				_, err := testDB.InvoicesGet(ctx, "", "All", dateFrom, dateTo, "INV-2025-961", "", 100, 0)
+				return err
+			},
+		},
+		{
+			name:   "bank transaction",
+			remove: func() (int, error) { return testDB.BankTransactionsDelete(ctx, []xero.BankTransaction{transaction}) },
+			get: func() error {
+				_, _, err := testDB.BankTransactionWRGet(ctx, "bt-removed-01")
+				return err
+			},
+			list: func() error {
+				_, err := testDB.BankTransactionsGet(ctx, "", "All", dateFrom, dateTo, "REMOVED-2025-05-03", "", 100, 0)
+				return err
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, want := range []int{1, 0} {
+				n, err := tt.remove()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != want {
+					t.Errorf("removal %d: got %d deleted want %d", i+1, n, want)
+				}
+			}
+			if err := tt.get(); !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("expected sql.ErrNoRows getting the record, got %v", err)
+			}
+			if err := tt.list(); !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("expected sql.ErrNoRows listing the record, got %v", err)
+			}
+		})
+	}
+
+	// An invoice upserted again is restored.
+	invoice.Status = "AUTHORISED"
+	if err := testDB.InvoicesUpsert(ctx, "", []xero.Invoice{invoice}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := testDB.InvoiceWRGet(ctx, "inv-removed-01"); err != nil {
+		t.Errorf("expected the restored invoice, got %v", err)
+	}
+}
+
+// Test15_InvoiceTypes tests that only invoices of the configured types and statuses
+// are listed, so that bills and draft invoices are listed only if configured.
+func Test15_InvoiceTypes(t *testing.T) {
+
+	testDB, closeDB := setupTestDB(t)
+	t.Cleanup(closeDB)
+	ctx := context.Background()
+
+	date := xero.XeroDateTime{Time: time.Date(2025, 5, 4, 10, 0, 0, 0, time.UTC)}
+	var invoices []xero.Invoice
+	for _, inv := range []struct{ id, invoiceType, status string }{
+		{"inv-types-01", "ACCREC", "AUTHORISED"},
+		{"inv-types-02", "ACCPAY", "AUTHORISED"},
+		{"inv-types-03", "ACCREC", "DRAFT"},
+	} {
+		invoices = append(invoices, xero.Invoice{
+			InvoiceID:     inv.id,
+			InvoiceNumber: "TYPES-" + inv.id,
+			Type:          inv.invoiceType,
+			Status:        inv.status,
+			Total:         10,
+			Date:          date,
+			Updated:       date,
+			LineItems:     []xero.LineItem{{LineItemID: inv.id + "-a", AccountCode: "5501", LineAmount: 10}},
+		})
+	}
+	if err := testDB.InvoicesUpsert(ctx, "tenant-a", invoices); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		types    string
+		statuses string
+		want     []string
+	}{
+		{"default", "^(ACCREC)$", "^(AUTHORISED|PAID|VOIDED)$", []string{"inv-types-01"}},
+		{"drafts", "^(ACCREC)$", "^(DRAFT|AUTHORISED|PAID|VOIDED)$", []string{"inv-types-01", "inv-types-03"}},
+		{"bills", "^(ACCREC|ACCPAY)$", "^(AUTHORISED|PAID|VOIDED)$", []string{"inv-types-01", "inv-types-02"}},
+	}
+	dateFrom := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+	dateTo := time.Date(2026, 3, 31, 0, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testDB.invoiceTypes, testDB.invoiceStatuses = tt.types, tt.statuses
+			listed, err := testDB.InvoicesGet(ctx, "tenant-a", "All", dateFrom, dateTo, "TYPES-", "", 100, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, invoice := range listed {
+				ids = append(ids, invoice.InvoiceID)
+			}
+			slices.Sort(ids)
+			if diff := cmp.Diff(tt.want, ids); diff != "" {
+				t.Errorf("listed invoices diff:\n%s", diff)
+			}
+		})
+	}
+}
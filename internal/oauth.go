@@ -0,0 +1,18 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+)
+
+// NewOAuthState returns a random OAuth2 state value. A new state should be used for
+// each authorization request and checked in the callback, to guard against cross-site
+// request forgery.
+func NewOAuthState() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate oauth2 state: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
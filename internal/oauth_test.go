@@ -0,0 +1,20 @@
+package internal
+
+import "testing"
+
+func TestNewOAuthState(t *testing.T) {
+	seen := map[string]bool{}
+	for range 10 {
+		state, err := NewOAuthState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(state), 43; got != want {
+			t.Errorf("got state length %d want %d", got, want)
+		}
+		if seen[state] {
+			t.Errorf("state %q repeated", state)
+		}
+		seen[state] = true
+	}
+}
@@ -0,0 +1,50 @@
+// Package usermsg explains errors from the Xero and Salesforce APIs to users,
+// suggesting how they might be resolved, rather than showing the raw API response.
+package usermsg
+
+import (
+	"errors"
+	"fmt"
+
+	"reconciler/apiclients/salesforce"
+
+	"golang.org/x/oauth2"
+)
+
+// The services whose errors are explained, named as in the login command.
+const (
+	Xero       = "xero"
+	Salesforce = "salesforce"
+)
+
+var serviceNames = map[string]string{
+	Xero:       "Xero",
+	Salesforce: "Salesforce",
+}
+
+// UserMessage returns an explanation of an error from the service, or false if the
+// error is not recognised. The service is empty where it is not known, such as for an
+// error from a command.
+func UserMessage(service string, err error) (string, bool) {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) && retrieveErr.ErrorCode == "invalid_grant" {
+		name, ok := serviceNames[service]
+		if !ok {
+			return "The saved login is no longer valid. Reconnect on the Connect page, or run 'login xero' or 'login salesforce'.", true
+		}
+		return fmt.Sprintf("The %s login is no longer valid. Reconnect to %s on the Connect page, or run 'login %s'.", name, name, service), true
+	}
+	if service == Xero {
+		return "", false
+	}
+	return salesforce.UserMessage(err)
+}
+
+// ErrorMessage returns the message to show a user for an error from the service, being
+// its UserMessage for a recognised error or otherwise the error itself.
+func ErrorMessage(service string, err error) string {
+	if msg, ok := UserMessage(service, err); ok {
+		return msg
+	}
+	return err.Error()
+}
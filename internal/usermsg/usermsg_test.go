@@ -0,0 +1,68 @@
+package usermsg
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"reconciler/apiclients/salesforce"
+
+	"golang.org/x/oauth2"
+)
+
+func TestErrorMessage(t *testing.T) {
+
+	invalidGrant := fmt.Errorf("refresh: %w", &oauth2.RetrieveError{ErrorCode: "invalid_grant"})
+	sessionExpired := &salesforce.APIError{StatusCode: 401, Code: "INVALID_SESSION_ID", Message: "Session expired or invalid"}
+
+	tests := []struct {
+		name    string
+		service string
+		err     error
+		want    string
+	}{
+		{
+			name:    "xero revoked refresh token",
+			service: Xero,
+			err:     invalidGrant,
+			want:    "The Xero login is no longer valid. Reconnect to Xero on the Connect page, or run 'login xero'.",
+		},
+		{
+			name:    "salesforce revoked refresh token",
+			service: Salesforce,
+			err:     invalidGrant,
+			want:    "The Salesforce login is no longer valid. Reconnect to Salesforce on the Connect page, or run 'login salesforce'.",
+		},
+		{
+			name: "unknown service revoked refresh token",
+			err:  invalidGrant,
+			want: "The saved login is no longer valid. Reconnect on the Connect page, or run 'login xero' or 'login salesforce'.",
+		},
+		{
+			name:    "salesforce session",
+			service: Salesforce,
+			err:     sessionExpired,
+			want:    "Reconnect to Salesforce",
+		},
+		{
+			name: "unknown service salesforce session",
+			err:  sessionExpired,
+			want: "Reconnect to Salesforce",
+		},
+		{
+			name:    "other xero error",
+			service: Xero,
+			err:     errors.New("xero: 500 internal server error"),
+			want:    "xero: 500 internal server error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ErrorMessage(tt.service, tt.err); !strings.Contains(got, tt.want) {
+				t.Errorf("message %q does not contain %q", got, tt.want)
+			}
+		})
+	}
+}
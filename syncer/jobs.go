@@ -0,0 +1,148 @@
+package syncer
+
+// jobs.go runs syncs in the background, for example from the web server, recording the
+// progress of the latest job for each entity.
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrJobRunning is returned when a sync is requested for an entity which is already
+// being synchronised.
+var ErrJobRunning = errors.New("a sync is already running")
+
+// JobState describes the state of a background sync job.
+type JobState string
+
+const (
+	JobIdle      JobState = "idle" // no job has been run
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+)
+
+// JobStatus reports the progress of the latest sync job for an entity.
+type JobStatus struct {
+	Entity   Entity
+	State    JobState
+	Started  time.Time
+	Finished time.Time
+	Result   Result
+	Err      error
+}
+
+// Elapsed returns the duration of the job, or the time since it started if it is
+// still running.
+func (j JobStatus) Elapsed() time.Duration {
+	switch {
+	case j.Started.IsZero():
+		return 0
+	case j.Finished.IsZero():
+		return time.Since(j.Started).Round(time.Second)
+	}
+	return j.Finished.Sub(j.Started).Round(time.Second)
+}
+
+// Runner syncs an entity. It is satisfied by Syncer.
+type Runner interface {
+	Sync(ctx context.Context, entity Entity, opts Options) (Result, error)
+}
+
+// Jobs runs background sync jobs, allowing only one job per entity at a time. Jobs
+// for different entities may run concurrently.
+type Jobs struct {
+	runner Runner
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	statuses map[Entity]JobStatus
+}
+
+// NewJobs creates a new Jobs using the provided runner. Close should be called to stop
+// any running jobs.
+func NewJobs(runner Runner) *Jobs {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Jobs{
+		runner:   runner,
+		ctx:      ctx,
+		cancel:   cancel,
+		statuses: map[Entity]JobStatus{},
+	}
+}
+
+// Start starts a background sync of the entity, returning ErrJobRunning if a sync of
+// the entity is already running.
+func (j *Jobs) Start(entity Entity, opts Options) error {
+	if _, err := ParseEntity(string(entity)); err != nil {
+		return err
+	}
+	if err := j.ctx.Err(); err != nil {
+		return errors.New("sync jobs have been stopped")
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.statuses[entity].State == JobRunning {
+		return ErrJobRunning
+	}
+	j.statuses[entity] = JobStatus{
+		Entity:  entity,
+		State:   JobRunning,
+		Started: time.Now(),
+	}
+
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		result, err := j.runner.Sync(j.ctx, entity, opts)
+		if err != nil {
+			log.Printf("background %s sync error: %v", entity, err)
+		}
+
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		status := j.statuses[entity]
+		status.Finished = time.Now()
+		status.Result = result
+		status.Err = err
+		status.State = JobSucceeded
+		if err != nil {
+			status.State = JobFailed
+		}
+		j.statuses[entity] = status
+	}()
+	return nil
+}
+
+// Status returns the status of the latest sync job for the entity.
+func (j *Jobs) Status(entity Entity) JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status, ok := j.statuses[entity]
+	if !ok {
+		return JobStatus{Entity: entity, State: JobIdle}
+	}
+	return status
+}
+
+// Statuses returns the status of the latest sync job for each entity, in the order of
+// Entities.
+func (j *Jobs) Statuses() []JobStatus {
+	statuses := make([]JobStatus, len(Entities))
+	for i, e := range Entities {
+		statuses[i] = j.Status(e)
+	}
+	return statuses
+}
+
+// Close cancels any running jobs and waits for them to finish.
+func (j *Jobs) Close() {
+	j.cancel()
+	j.wg.Wait()
+}
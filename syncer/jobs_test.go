@@ -0,0 +1,103 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// blockingRunner is a Runner which blocks until released.
+type blockingRunner struct {
+	release chan struct{}
+	err     error
+}
+
+func (b *blockingRunner) Sync(ctx context.Context, entity Entity, opts Options) (Result, error) {
+	select {
+	case <-b.release:
+	case <-ctx.Done():
+		return Result{Entity: entity}, ctx.Err()
+	}
+	return Result{Entity: entity, Fetched: 3}, b.err
+}
+
+// waitForState waits for the job for entity to reach the provided state.
+func waitForState(t *testing.T, jobs *Jobs, entity Entity, state JobState) JobStatus {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if status := jobs.Status(entity); status.State == state {
+			return status
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %s to be %s, got %s", entity, state, jobs.Status(entity).State)
+	return JobStatus{}
+}
+
+func TestJobs(t *testing.T) {
+
+	runner := &blockingRunner{release: make(chan struct{})}
+	jobs := NewJobs(runner)
+	t.Cleanup(jobs.Close)
+
+	if got, want := jobs.Status(Invoices).State, JobIdle; got != want {
+		t.Errorf("got state %s want %s", got, want)
+	}
+
+	if err := jobs.Start(Invoices, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := jobs.Status(Invoices).State, JobRunning; got != want {
+		t.Errorf("got state %s want %s", got, want)
+	}
+
+	// A second sync of the same entity is refused, but other entities may run.
+	if err := jobs.Start(Invoices, Options{}); !errors.Is(err, ErrJobRunning) {
+		t.Errorf("expected ErrJobRunning, got %v", err)
+	}
+	if err := jobs.Start(Donations, Options{}); err != nil {
+		t.Errorf("unexpected error starting another entity: %v", err)
+	}
+	if err := jobs.Start("journals", Options{}); err == nil {
+		t.Error("expected an error for an unknown entity")
+	}
+
+	close(runner.release)
+	status := waitForState(t, jobs, Invoices, JobSucceeded)
+	if got, want := status.Result.Fetched, 3; got != want {
+		t.Errorf("got %d fetched want %d", got, want)
+	}
+	_ = waitForState(t, jobs, Donations, JobSucceeded)
+
+	// A finished entity can be run again.
+	runner.err = errors.New("simulated")
+	if err := jobs.Start(Invoices, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	status = waitForState(t, jobs, Invoices, JobFailed)
+	if status.Err == nil {
+		t.Error("expected the job error to be recorded")
+	}
+
+	if got, want := len(jobs.Statuses()), len(Entities); got != want {
+		t.Errorf("got %d statuses want %d", got, want)
+	}
+}
+
+func TestJobsClose(t *testing.T) {
+
+	jobs := NewJobs(&blockingRunner{release: make(chan struct{})})
+	if err := jobs.Start(Accounts, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	jobs.Close() // cancels the blocked job
+
+	if got, want := jobs.Status(Accounts).State, JobFailed; got != want {
+		t.Errorf("got state %s want %s", got, want)
+	}
+	if err := jobs.Start(Accounts, Options{}); err == nil {
+		t.Error("expected an error starting a job after close")
+	}
+}
@@ -0,0 +1,507 @@
+// Package syncer retrieves records from the Xero and Salesforce APIs and stores them in
+// the reconciler database.
+//
+// The syncer is used by both the command line application and the web server, so it
+// holds no presentation logic; each sync reports its outcome as a Result.
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"reconciler/apiclients/salesforce"
+	"reconciler/apiclients/xero"
+	"reconciler/config"
+	"reconciler/db"
+)
+
+// Entity is a type of record which can be synchronised.
+type Entity string
+
+const (
+	Accounts           Entity = "accounts"
+	Contacts           Entity = "contacts"
+	TrackingCategories Entity = "tracking-categories"
+	Invoices           Entity = "invoices"
+	Payments           Entity = "payments"
+	CreditNotes        Entity = "credit-notes"
+	BankTransactions   Entity = "bank-transactions"
+	Donations          Entity = "donations"
+)
+
+// Entities lists all the synchronisable entities in the order in which they should be
+// run. Accounts, contacts and tracking categories are run first as the invoice, payment
+// and bank transaction queries join on them.
+var Entities = []Entity{Accounts, Contacts, TrackingCategories, Invoices, Payments, CreditNotes, BankTransactions, Donations}
+
+// ParseEntity returns the Entity for the provided name.
+func ParseEntity(name string) (Entity, error) {
+	for _, e := range Entities {
+		if string(e) == name {
+			return e, nil
+		}
+	}
+	valid := make([]string, len(Entities))
+	for i, e := range Entities {
+		valid[i] = string(e)
+	}
+	return "", fmt.Errorf("unknown entity %q, expected one of %s", name, strings.Join(valid, ", "))
+}
+
+// xero reports whether the entity is synchronised from Xero.
+func (e Entity) xero() bool {
+	return e != Donations
+}
+
+// XeroClient is the subset of xero.APIClient methods used for synchronisation. Each
+// client is for a single Xero organisation (tenant).
+type XeroClient interface {
+	TenantID() string
+	Stats() xero.Stats
+	GetAccounts(ctx context.Context, ifModifiedSince time.Time) ([]xero.Account, error)
+	GetInvoices(ctx context.Context, fromDate, toDate, ifModifiedSince time.Time) ([]xero.Invoice, error)
+	GetContacts(ctx context.Context, ifModifiedSince time.Time) ([]xero.Contact, error)
+	GetTrackingCategories(ctx context.Context, ifModifiedSince time.Time) ([]xero.TrackingCategory, error)
+	GetPayments(ctx context.Context, fromDate, toDate, ifModifiedSince time.Time) ([]xero.Payment, error)
+	GetCreditNotes(ctx context.Context, fromDate, toDate, ifModifiedSince time.Time) ([]xero.CreditNote, error)
+	GetBankTransactions(ctx context.Context, fromDate, toDate, ifModifiedSince time.Time) ([]xero.BankTransaction, error)
+}
+
+// SalesforceClient is the subset of salesforce.Client methods used for
+// synchronisation.
+type SalesforceClient interface {
+	GetOpportunities(ctx context.Context, fromDate, toDate, ifModifiedSince time.Time) ([]salesforce.Donation, error)
+	GetDeletedOpportunityIDs(ctx context.Context, since time.Time) ([]string, error)
+}
+
+// Options sets out the parameters of a sync. Records dated from FromDate up to and
+// including ToDate are retrieved. A zero FromDate defaults to the configured data start
+// date, and a zero ToDate to the day before the anniversary of FromDate, so that a
+// year is retrieved. Ranges longer than a year are retrieved a year at a time.
+//
+// A zero IfModifiedSince defaults to the high water mark of the last successful sync of
+// the entity, so that only records modified since then are retrieved. Setting Full
+// ignores the high water mark and retrieves all records.
+//
+// Tenant is the id or name of the Xero organisation to sync. If empty, the organisation
+// is selected from the configuration as set out in xero.SelectTenant. Tenant is
+// ignored for Salesforce entities.
+type Options struct {
+	FromDate        time.Time
+	ToDate          time.Time
+	IfModifiedSince time.Time
+	Full            bool
+	Tenant          string
+}
+
+// Result reports the outcome of syncing an entity. FromDate and ToDate are the date
+// range synchronised. Deleted is the number of records removed because they were
+// deleted upstream. HighWaterMark is the latest record modification time seen, and is
+// zero if no records were fetched. TenantID is the id
+// of the Xero organisation synchronised, and is empty for Salesforce entities.
+// XeroStats reports the API usage of the Xero client, including the calls remaining
+// within the rate limits, and is nil for Salesforce entities.
+type Result struct {
+	Entity          Entity
+	TenantID        string
+	FromDate        time.Time
+	ToDate          time.Time
+	Fetched         int
+	Deleted         int
+	IfModifiedSince time.Time
+	HighWaterMark   time.Time
+	XeroStats       *xero.Stats
+}
+
+// Syncer synchronises records from the Xero and Salesforce APIs to the database.
+type Syncer struct {
+	cfg *config.Config
+	db  *db.DB
+
+	// Client constructors, which may be overridden for testing.
+	newXeroClient       func(ctx context.Context, tenant string) (XeroClient, error)
+	newSalesforceClient func(ctx context.Context) (SalesforceClient, error)
+
+	// Clients are created on first use and then reused. Xero clients are keyed by the
+	// requested tenant.
+	mu               sync.Mutex
+	xeroClients      map[string]XeroClient
+	salesforceClient SalesforceClient
+}
+
+// New creates a new Syncer. The API clients are authenticated on first use from the
+// saved tokens, so the relevant `login` command needs to have been run beforehand.
+func New(cfg *config.Config, database *db.DB) *Syncer {
+	return &Syncer{
+		cfg: cfg,
+		db:  database,
+		newXeroClient: func(ctx context.Context, tenant string) (XeroClient, error) {
+			return xero.NewClientForTenant(ctx, cfg, tenant)
+		},
+		newSalesforceClient: func(ctx context.Context) (SalesforceClient, error) {
+			return salesforce.NewClient(ctx, cfg)
+		},
+	}
+}
+
+// getXeroClient returns the cached Xero client for the tenant, creating it if
+// necessary.
+func (s *Syncer) getXeroClient(ctx context.Context, tenant string) (XeroClient, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if client, ok := s.xeroClients[tenant]; ok {
+		return client, nil
+	}
+	client, err := s.newXeroClient(ctx, tenant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create xero client: %w", err)
+	}
+	if s.xeroClients == nil {
+		s.xeroClients = map[string]XeroClient{}
+	}
+	s.xeroClients[tenant] = client
+	return client, nil
+}
+
+// getSalesforceClient returns the cached Salesforce client, creating it if necessary.
+func (s *Syncer) getSalesforceClient(ctx context.Context) (SalesforceClient, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.salesforceClient == nil {
+		client, err := s.newSalesforceClient(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create salesforce client: %w", err)
+		}
+		s.salesforceClient = client
+	}
+	return s.salesforceClient, nil
+}
+
+// ResetClients discards the cached API clients so that they are recreated from the
+// saved tokens on next use, for example after connecting to or disconnecting from a
+// service.
+func (s *Syncer) ResetClients() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.xeroClients = nil
+	s.salesforceClient = nil
+}
+
+// Sync retrieves the records for the provided entity and upserts them to the database.
+// Each sync is recorded as a run in the database, together with the high water mark
+// used as the starting point of the next incremental sync. High water marks are kept
+// separately for each Xero organisation.
+func (s *Syncer) Sync(ctx context.Context, entity Entity, opts Options) (Result, error) {
+	result := Result{Entity: entity}
+
+	if _, err := ParseEntity(string(entity)); err != nil {
+		return result, fmt.Errorf("unknown entity for sync: %q", entity)
+	}
+	if opts.FromDate.IsZero() {
+		opts.FromDate = s.cfg.DataStartDate
+	}
+	if opts.ToDate.IsZero() {
+		opts.ToDate = opts.FromDate.AddDate(1, 0, -1)
+	}
+	if opts.ToDate.Before(opts.FromDate) {
+		return result, fmt.Errorf("sync to date %s is before the from date %s", opts.ToDate.Format("2006-01-02"), opts.FromDate.Format("2006-01-02"))
+	}
+	result.FromDate, result.ToDate = opts.FromDate, opts.ToDate
+
+	// The Xero organisation is determined from the client, so that a tenant provided
+	// by name is recorded by its id.
+	if entity.xero() {
+		client, err := s.getXeroClient(ctx, opts.Tenant)
+		if err != nil {
+			return result, err
+		}
+		result.TenantID = client.TenantID()
+	}
+
+	if opts.Full {
+		opts.IfModifiedSince = time.Time{}
+	} else if opts.IfModifiedSince.IsZero() {
+		hwm, err := s.db.SyncHighWaterMark(ctx, string(entity), result.TenantID, opts.FromDate, opts.ToDate)
+		if err != nil {
+			return result, err
+		}
+		opts.IfModifiedSince = hwm
+	}
+	result.IfModifiedSince = opts.IfModifiedSince
+
+	runID, err := s.db.SyncRunStart(ctx, string(entity), result.TenantID, opts.Full, opts.FromDate, opts.ToDate, opts.IfModifiedSince)
+	if err != nil {
+		return result, err
+	}
+
+	result.Fetched, result.Deleted, result.HighWaterMark, err = s.fetch(ctx, entity, opts)
+	if entity.xero() {
+		if client, cErr := s.getXeroClient(ctx, opts.Tenant); cErr == nil {
+			stats := client.Stats()
+			result.XeroStats = &stats
+			log.Printf("Xero API usage: %s.", stats)
+		}
+	}
+
+	// Record the run outcome, preferring to report the sync error.
+	finishErr := s.db.SyncRunFinish(ctx, runID, result.Fetched, result.Deleted, result.HighWaterMark, err)
+	if err != nil {
+		return result, err
+	}
+	if finishErr != nil {
+		return result, finishErr
+	}
+
+	log.Printf("Synced %d %s.", result.Fetched, entity)
+	if result.Deleted > 0 {
+		log.Printf("Removed %d %s deleted upstream.", result.Deleted, entity)
+	}
+	return result, nil
+}
+
+// dateWindow is an inclusive range of dates.
+type dateWindow struct {
+	from, to time.Time
+}
+
+func (w dateWindow) String() string {
+	return w.from.Format("2006-01-02") + " to " + w.to.Format("2006-01-02")
+}
+
+// windowMonths is the length of the windows into which long sync date ranges are split.
+const windowMonths = 12
+
+// dateWindows splits the inclusive date range into consecutive windows of at most
+// windowMonths.
+func dateWindows(from, to time.Time) []dateWindow {
+	var windows []dateWindow
+	for start := from; !start.After(to); {
+		end := start.AddDate(0, windowMonths, -1)
+		if end.After(to) {
+			end = to
+		}
+		windows = append(windows, dateWindow{start, end})
+		start = end.AddDate(0, 0, 1)
+	}
+	return windows
+}
+
+// fetch retrieves and upserts the records for the provided entity, returning the
+// number of records fetched, the number of records removed because they were deleted
+// upstream, and the latest modification time seen.
+//
+// Dated records are fetched a window at a time, with each window saved before the next
+// is fetched, so that a failure part way through a long range keeps the records
+// already fetched.
+func (s *Syncer) fetch(ctx context.Context, entity Entity, opts Options) (int, int, time.Time, error) {
+	var hwm time.Time
+	latest := func(t time.Time) {
+		if t.After(hwm) {
+			hwm = t
+		}
+	}
+	windows := dateWindows(opts.FromDate, opts.ToDate)
+	logWindow := func(w dateWindow) {
+		if len(windows) > 1 {
+			log.Printf("Fetching %s dated %s...", entity, w)
+		}
+	}
+	var fetched, deleted int
+
+	switch entity {
+	case Accounts:
+		client, err := s.getXeroClient(ctx, opts.Tenant)
+		if err != nil {
+			return 0, 0, hwm, err
+		}
+		records, err := client.GetAccounts(ctx, opts.IfModifiedSince)
+		if err != nil {
+			return 0, 0, hwm, fmt.Errorf("failed to get accounts: %w", err)
+		}
+		if err := s.db.AccountsUpsert(ctx, client.TenantID(), records); err != nil {
+			return len(records), 0, hwm, fmt.Errorf("failed to upsert accounts: %w", err)
+		}
+		for _, r := range records {
+			latest(r.Updated)
+		}
+		return len(records), 0, hwm, nil
+
+	case Contacts:
+		client, err := s.getXeroClient(ctx, opts.Tenant)
+		if err != nil {
+			return 0, 0, hwm, err
+		}
+		records, err := client.GetContacts(ctx, opts.IfModifiedSince)
+		if err != nil {
+			return 0, 0, hwm, fmt.Errorf("failed to get contacts: %w", err)
+		}
+		if err := s.db.ContactsUpsert(ctx, client.TenantID(), records); err != nil {
+			return len(records), 0, hwm, fmt.Errorf("failed to upsert contacts: %w", err)
+		}
+		for _, r := range records {
+			latest(r.Updated.Time)
+		}
+		return len(records), 0, hwm, nil
+
+	case TrackingCategories:
+		client, err := s.getXeroClient(ctx, opts.Tenant)
+		if err != nil {
+			return 0, 0, hwm, err
+		}
+		records, err := client.GetTrackingCategories(ctx, opts.IfModifiedSince)
+		if err != nil {
+			return 0, 0, hwm, fmt.Errorf("failed to get tracking categories: %w", err)
+		}
+		if err := s.db.TrackingCategoriesUpsert(ctx, client.TenantID(), records); err != nil {
+			return len(records), 0, hwm, fmt.Errorf("failed to upsert tracking categories: %w", err)
+		}
+		return len(records), 0, hwm, nil
+
+	case Invoices:
+		client, err := s.getXeroClient(ctx, opts.Tenant)
+		if err != nil {
+			return 0, 0, hwm, err
+		}
+		for _, w := range windows {
+			logWindow(w)
+			records, err := client.GetInvoices(ctx, w.from, w.to, opts.IfModifiedSince)
+			if err != nil {
+				return fetched, deleted, hwm, fmt.Errorf("failed to get invoices dated %s: %w", w, err)
+			}
+			fetched += len(records)
+			removed, current := partition(records, xero.Invoice.Removed)
+			if err := s.db.InvoicesUpsert(ctx, client.TenantID(), current); err != nil {
+				return fetched, deleted, hwm, fmt.Errorf("failed to upsert invoices: %w", err)
+			}
+			n, err := s.db.InvoicesDelete(ctx, removed)
+			deleted += n
+			if err != nil {
+				return fetched, deleted, hwm, fmt.Errorf("failed to remove invoices: %w", err)
+			}
+			for _, r := range records {
+				latest(r.Updated.Time)
+			}
+		}
+		return fetched, deleted, hwm, nil
+
+	case Payments:
+		client, err := s.getXeroClient(ctx, opts.Tenant)
+		if err != nil {
+			return 0, 0, hwm, err
+		}
+		for _, w := range windows {
+			logWindow(w)
+			records, err := client.GetPayments(ctx, w.from, w.to, opts.IfModifiedSince)
+			if err != nil {
+				return fetched, deleted, hwm, fmt.Errorf("failed to get payments dated %s: %w", w, err)
+			}
+			fetched += len(records)
+			if err := s.db.PaymentsUpsert(ctx, client.TenantID(), records); err != nil {
+				return fetched, deleted, hwm, fmt.Errorf("failed to upsert payments: %w", err)
+			}
+			for _, r := range records {
+				latest(r.Updated.Time)
+			}
+		}
+		return fetched, deleted, hwm, nil
+
+	case CreditNotes:
+		client, err := s.getXeroClient(ctx, opts.Tenant)
+		if err != nil {
+			return 0, 0, hwm, err
+		}
+		for _, w := range windows {
+			logWindow(w)
+			records, err := client.GetCreditNotes(ctx, w.from, w.to, opts.IfModifiedSince)
+			if err != nil {
+				return fetched, deleted, hwm, fmt.Errorf("failed to get credit notes dated %s: %w", w, err)
+			}
+			fetched += len(records)
+			if err := s.db.CreditNotesUpsert(ctx, client.TenantID(), records); err != nil {
+				return fetched, deleted, hwm, fmt.Errorf("failed to upsert credit notes: %w", err)
+			}
+			for _, r := range records {
+				latest(r.Updated.Time)
+			}
+		}
+		return fetched, deleted, hwm, nil
+
+	case BankTransactions:
+		client, err := s.getXeroClient(ctx, opts.Tenant)
+		if err != nil {
+			return 0, 0, hwm, err
+		}
+		for _, w := range windows {
+			logWindow(w)
+			records, err := client.GetBankTransactions(ctx, w.from, w.to, opts.IfModifiedSince)
+			if err != nil {
+				return fetched, deleted, hwm, fmt.Errorf("failed to get bank transactions dated %s: %w", w, err)
+			}
+			fetched += len(records)
+			removed, current := partition(records, xero.BankTransaction.Removed)
+			if err := s.db.BankTransactionsUpsert(ctx, client.TenantID(), current); err != nil {
+				return fetched, deleted, hwm, fmt.Errorf("failed to upsert bank transactions: %w", err)
+			}
+			n, err := s.db.BankTransactionsDelete(ctx, removed)
+			deleted += n
+			if err != nil {
+				return fetched, deleted, hwm, fmt.Errorf("failed to remove bank transactions: %w", err)
+			}
+			for _, r := range records {
+				latest(r.Updated.Time)
+			}
+		}
+		return fetched, deleted, hwm, nil
+
+	case Donations:
+		client, err := s.getSalesforceClient(ctx)
+		if err != nil {
+			return 0, 0, hwm, err
+		}
+		for _, w := range windows {
+			logWindow(w)
+			records, err := client.GetOpportunities(ctx, w.from, w.to, opts.IfModifiedSince)
+			if err != nil {
+				return fetched, deleted, hwm, fmt.Errorf("failed to get donations dated %s: %w", w, err)
+			}
+			fetched += len(records)
+			if err := s.db.UpsertDonations(ctx, records); err != nil {
+				return fetched, deleted, hwm, fmt.Errorf("failed to upsert donations: %w", err)
+			}
+			for _, r := range records {
+				latest(r.LastModifiedDate.Time)
+			}
+		}
+
+		// Deleted opportunities are not returned by the query, so are listed
+		// separately. Deletions are not dated by close date, so those since the last
+		// sync are removed whatever the date range.
+		ids, err := client.GetDeletedOpportunityIDs(ctx, opts.IfModifiedSince)
+		if err != nil {
+			return fetched, deleted, hwm, fmt.Errorf("failed to get deleted donations: %w", err)
+		}
+		deleted, err = s.db.DonationsDelete(ctx, ids)
+		if err != nil {
+			return fetched, deleted, hwm, fmt.Errorf("failed to remove donations: %w", err)
+		}
+		return fetched, deleted, hwm, nil
+	}
+	return 0, 0, hwm, fmt.Errorf("unknown entity for sync: %q", entity)
+}
+
+// partition splits the records into those for which match reports true and the
+// others, preserving their order.
+func partition[T any](records []T, match func(T) bool) (matched, others []T) {
+	for _, r := range records {
+		if match(r) {
+			matched = append(matched, r)
+		} else {
+			others = append(others, r)
+		}
+	}
+	return matched, others
+}
@@ -0,0 +1,438 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"reconciler/apiclients/salesforce"
+	"reconciler/apiclients/xero"
+	"reconciler/config"
+	"reconciler/db"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// invoiceUpdated is the latest modification time of the fake invoices.
+var invoiceUpdated = time.Date(2025, 6, 1, 12, 30, 0, 0, time.UTC)
+
+// fakeXero is a fake XeroClient.
+type fakeXero struct {
+	tenantID        string
+	windows         []string // the date ranges requested
+	fromDate        time.Time
+	ifModifiedSince time.Time
+	statuses        map[string]string // the statuses of invoices returned, by id
+	err             error
+}
+
+func (f *fakeXero) TenantID() string {
+	if f.tenantID == "" {
+		return "tenant-a"
+	}
+	return f.tenantID
+}
+
+func (f *fakeXero) Stats() xero.Stats {
+	return xero.Stats{Requests: 1, MinuteRemaining: 59, DayRemaining: 4999}
+}
+
+func (f *fakeXero) GetAccounts(ctx context.Context, ifModifiedSince time.Time) ([]xero.Account, error) {
+	return []xero.Account{{AccountID: "acc-test-01", Code: "5999", Name: "Test"}}, f.err
+}
+
+func (f *fakeXero) GetInvoices(ctx context.Context, fromDate, toDate, ifModifiedSince time.Time) ([]xero.Invoice, error) {
+	f.windows = append(f.windows, dateWindow{fromDate, toDate}.String())
+	f.fromDate = fromDate
+	f.ifModifiedSince = ifModifiedSince
+	invoices := []xero.Invoice{
+		{InvoiceID: "inv-test-01", Status: "AUTHORISED", Updated: xero.XeroDateTime{Time: invoiceUpdated.Add(-time.Hour)}},
+		{InvoiceID: "inv-test-02", Status: "AUTHORISED", Updated: xero.XeroDateTime{Time: invoiceUpdated}},
+	}
+	for i, inv := range invoices {
+		if status, ok := f.statuses[inv.InvoiceID]; ok {
+			invoices[i].Status = status
+		}
+	}
+	return invoices, f.err
+}
+
+func (f *fakeXero) GetContacts(ctx context.Context, ifModifiedSince time.Time) ([]xero.Contact, error) {
+	return []xero.Contact{{ContactID: "con-test-01", Name: "Test"}}, f.err
+}
+
+func (f *fakeXero) GetTrackingCategories(ctx context.Context, ifModifiedSince time.Time) ([]xero.TrackingCategory, error) {
+	return []xero.TrackingCategory{{TrackingCategoryID: "tc-test-01", Name: "Campaign"}}, f.err
+}
+
+func (f *fakeXero) GetPayments(ctx context.Context, fromDate, toDate, ifModifiedSince time.Time) ([]xero.Payment, error) {
+	return []xero.Payment{{PaymentID: "pay-test-01", Invoice: xero.PaymentInvoice{InvoiceID: "inv-test-01"}}}, f.err
+}
+
+func (f *fakeXero) GetCreditNotes(ctx context.Context, fromDate, toDate, ifModifiedSince time.Time) ([]xero.CreditNote, error) {
+	return []xero.CreditNote{{CreditNoteID: "cn-test-01"}}, f.err
+}
+
+func (f *fakeXero) GetBankTransactions(ctx context.Context, fromDate, toDate, ifModifiedSince time.Time) ([]xero.BankTransaction, error) {
+	f.fromDate = fromDate
+	return []xero.BankTransaction{{BankTransactionID: "bt-test-01"}}, f.err
+}
+
+// fakeSalesforce is a fake SalesforceClient.
+type fakeSalesforce struct {
+	deleted []string // ids of deleted opportunities
+}
+
+func (f *fakeSalesforce) GetOpportunities(ctx context.Context, fromDate, toDate, ifModifiedSince time.Time) ([]salesforce.Donation, error) {
+	return []salesforce.Donation{{CoreFields: salesforce.CoreFields{ID: "sf-test-01"}}}, nil
+}
+
+func (f *fakeSalesforce) GetDeletedOpportunityIDs(ctx context.Context, since time.Time) ([]string, error) {
+	return f.deleted, nil
+}
+
+// setupSyncer returns a Syncer using the fake clients and a test database.
+func setupSyncer(t *testing.T, fx *fakeXero) *Syncer {
+	t.Helper()
+
+	testDB, err := db.NewConnectionInTestMode("file::memory:?cache=shared", "", "^(53|55|57)", "Closed Lost", "^(ACCREC)$", "^(AUTHORISED|PAID|VOIDED)$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = testDB.Close() })
+
+	cfg := &config.Config{
+		DataStartDate: time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC),
+	}
+	s := New(cfg, testDB)
+	s.newXeroClient = func(ctx context.Context, tenant string) (XeroClient, error) {
+		return fx, nil
+	}
+	s.newSalesforceClient = func(ctx context.Context) (SalesforceClient, error) {
+		return &fakeSalesforce{}, nil
+	}
+	return s
+}
+
+func TestSync(t *testing.T) {
+
+	fx := &fakeXero{}
+	s := setupSyncer(t, fx)
+	ctx := context.Background()
+
+	wantFetched := map[Entity]int{
+		Accounts:           1,
+		Contacts:           1,
+		TrackingCategories: 1,
+		Invoices:           2,
+		Payments:           1,
+		CreditNotes:        1,
+		BankTransactions:   1,
+		Donations:          1,
+	}
+	for _, entity := range Entities {
+		result, err := s.Sync(ctx, entity, Options{})
+		if err != nil {
+			t.Fatalf("sync %s error: %v", entity, err)
+		}
+		if got, want := result.Fetched, wantFetched[entity]; got != want {
+			t.Errorf("%s: got %d fetched want %d", entity, got, want)
+		}
+	}
+
+	// The Xero API usage is reported.
+	result, err := s.Sync(ctx, Accounts, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.XeroStats == nil || result.XeroStats.MinuteRemaining != 59 {
+		t.Errorf("expected the xero api usage to be reported, got %v", result.XeroStats)
+	}
+
+	// The default from date is the configured data start date.
+	if got, want := fx.fromDate, s.cfg.DataStartDate; !got.Equal(want) {
+		t.Errorf("got from date %s want %s", got, want)
+	}
+
+	var count int
+	if err := s.db.GetContext(ctx, &count, "SELECT COUNT(*) FROM invoices WHERE id LIKE 'inv-test-%'"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := count, 2; got != want {
+		t.Errorf("got %d invoices want %d", got, want)
+	}
+}
+
+func TestSyncHighWaterMark(t *testing.T) {
+
+	fx := &fakeXero{}
+	s := setupSyncer(t, fx)
+	ctx := context.Background()
+
+	tests := []struct {
+		name                string
+		opts                Options
+		wantIfModifiedSince time.Time
+	}{
+		{"first sync", Options{}, time.Time{}},
+		{"incremental", Options{}, invoiceUpdated},
+		{"full", Options{Full: true}, time.Time{}},
+		{"explicit", Options{IfModifiedSince: invoiceUpdated.Add(-24 * time.Hour)}, invoiceUpdated.Add(-24 * time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := s.Sync(ctx, Invoices, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := fx.ifModifiedSince, tt.wantIfModifiedSince; !got.Equal(want) {
+				t.Errorf("got if modified since %s want %s", got, want)
+			}
+			if got, want := result.HighWaterMark, invoiceUpdated; !got.Equal(want) {
+				t.Errorf("got high water mark %s want %s", got, want)
+			}
+		})
+	}
+
+	runs, err := s.db.SyncRunsGet(ctx, string(Invoices), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(runs), len(tests); got != want {
+		t.Errorf("got %d sync runs want %d", got, want)
+	}
+}
+
+// TestSyncTenants tests syncing several Xero organisations, each with its own records
+// and high water mark.
+func TestSyncTenants(t *testing.T) {
+
+	tenants := map[string]*fakeXero{
+		"":          {tenantID: "tenant-a"}, // the default organisation
+		"Charity B": {tenantID: "tenant-b"},
+	}
+	s := setupSyncer(t, nil)
+	s.newXeroClient = func(ctx context.Context, tenant string) (XeroClient, error) {
+		fx, ok := tenants[tenant]
+		if !ok {
+			return nil, errors.New("unknown tenant")
+		}
+		return fx, nil
+	}
+	ctx := context.Background()
+
+	result, err := s.Sync(ctx, Invoices, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := result.TenantID, "tenant-a"; got != want {
+		t.Errorf("got tenant %q want %q", got, want)
+	}
+
+	// The first sync of the second organisation is not limited by the first
+	// organisation's high water mark.
+	result, err = s.Sync(ctx, Invoices, Options{Tenant: "Charity B"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := result.TenantID, "tenant-b"; got != want {
+		t.Errorf("got tenant %q want %q", got, want)
+	}
+	if got := tenants["Charity B"].ifModifiedSince; !got.IsZero() {
+		t.Errorf("expected a full first sync of the second organisation, got %s", got)
+	}
+
+	var tenantID string
+	if err := s.db.GetContext(ctx, &tenantID, "SELECT tenant_id FROM invoices WHERE id = 'inv-test-01'"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tenantID, "tenant-b"; got != want {
+		t.Errorf("got invoice tenant %q want %q", got, want)
+	}
+
+	if _, err := s.Sync(ctx, Invoices, Options{Tenant: "Charity C"}); err == nil {
+		t.Error("expected an error for an unknown organisation")
+	}
+}
+
+// TestSyncDateRange tests syncing explicit date ranges, with long ranges split into
+// windows of a year.
+func TestSyncDateRange(t *testing.T) {
+
+	date := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name        string
+		opts        Options
+		wantWindows []string
+		wantFetched int
+		isErr       bool
+	}{
+		{
+			name:        "default year",
+			opts:        Options{},
+			wantWindows: []string{"2025-04-01 to 2026-03-31"},
+			wantFetched: 2,
+		},
+		{
+			name:        "quarter",
+			opts:        Options{FromDate: date(2025, 7, 1), ToDate: date(2025, 9, 30)},
+			wantWindows: []string{"2025-07-01 to 2025-09-30"},
+			wantFetched: 2,
+		},
+		{
+			name: "several years",
+			opts: Options{FromDate: date(2022, 4, 1), ToDate: date(2025, 6, 30)},
+			wantWindows: []string{
+				"2022-04-01 to 2023-03-31",
+				"2023-04-01 to 2024-03-31",
+				"2024-04-01 to 2025-03-31",
+				"2025-04-01 to 2025-06-30",
+			},
+			wantFetched: 8,
+		},
+		{
+			name:  "reversed",
+			opts:  Options{FromDate: date(2025, 7, 1), ToDate: date(2025, 6, 30)},
+			isErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fx := &fakeXero{}
+			s := setupSyncer(t, fx)
+			result, err := s.Sync(context.Background(), Invoices, tt.opts)
+			if tt.isErr {
+				if err == nil {
+					t.Fatal("expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.wantWindows, fx.windows); diff != "" {
+				t.Errorf("windows diff:\n%s", diff)
+			}
+			if got, want := result.Fetched, tt.wantFetched; got != want {
+				t.Errorf("got %d fetched want %d", got, want)
+			}
+		})
+	}
+}
+
+// TestSyncRemoved tests that records deleted upstream are soft deleted, with the
+// number removed reported and recorded, and that voided invoices are kept.
+func TestSyncRemoved(t *testing.T) {
+
+	fx := &fakeXero{}
+	s := setupSyncer(t, fx)
+	sf := &fakeSalesforce{deleted: []string{"sf-test-01", "sf-test-99"}}
+	s.newSalesforceClient = func(ctx context.Context) (SalesforceClient, error) {
+		return sf, nil
+	}
+	ctx := context.Background()
+
+	deletedAt := func(query string) *string {
+		var at *string
+		if err := s.db.GetContext(ctx, &at, query); err != nil {
+			t.Fatal(err)
+		}
+		return at
+	}
+
+	tests := []struct {
+		name        string
+		entity      Entity
+		statuses    map[string]string
+		wantDeleted int
+	}{
+		{"current", Invoices, nil, 0},
+		{"voided", Invoices, map[string]string{"inv-test-01": "VOIDED"}, 0},
+		{"deleted", Invoices, map[string]string{"inv-test-01": "VOIDED", "inv-test-02": "DELETED"}, 1},
+		{"already removed", Invoices, map[string]string{"inv-test-01": "VOIDED", "inv-test-02": "DELETED"}, 0},
+		// The unknown deleted opportunity is ignored.
+		{"donations", Donations, nil, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fx.statuses = tt.statuses
+			result, err := s.Sync(ctx, tt.entity, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := result.Deleted, tt.wantDeleted; got != want {
+				t.Errorf("got %d deleted want %d", got, want)
+			}
+			runs, err := s.db.SyncRunsGet(ctx, string(tt.entity), 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := runs[0].RecordsDeleted, tt.wantDeleted; got != want {
+				t.Errorf("got %d deleted recorded want %d", got, want)
+			}
+		})
+	}
+
+	if deletedAt("SELECT deleted_at FROM invoices WHERE id = 'inv-test-01'") != nil {
+		t.Error("expected the voided invoice not to be deleted")
+	}
+	var status string
+	if err := s.db.GetContext(ctx, &status, "SELECT status FROM invoices WHERE id = 'inv-test-01'"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := status, "VOIDED"; got != want {
+		t.Errorf("got voided invoice status %q want %q", got, want)
+	}
+	if deletedAt("SELECT deleted_at FROM invoices WHERE id = 'inv-test-02'") == nil {
+		t.Error("expected the deleted invoice to be deleted")
+	}
+	if deletedAt("SELECT deleted_at FROM donations WHERE id = 'sf-test-01'") == nil {
+		t.Error("expected the deleted donation to be deleted")
+	}
+
+	// A record returned again, such as a donation restored from the recycle bin, is
+	// no longer deleted.
+	sf.deleted = nil
+	if _, err := s.Sync(ctx, Donations, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if deletedAt("SELECT deleted_at FROM donations WHERE id = 'sf-test-01'") != nil {
+		t.Error("expected the restored donation not to be deleted")
+	}
+}
+
+func TestSyncError(t *testing.T) {
+
+	fx := &fakeXero{err: errors.New("simulated")}
+	s := setupSyncer(t, fx)
+
+	_, err := s.Sync(context.Background(), Invoices, Options{})
+	if err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+	if !strings.Contains(err.Error(), "simulated") {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// The failed run is recorded.
+	runs, err := s.db.SyncRunsGet(context.Background(), string(Invoices), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runs[0].Error == nil || !strings.Contains(*runs[0].Error, "simulated") {
+		t.Errorf("expected the run error to be recorded, got %v", runs[0].Error)
+	}
+}
+
+func TestParseEntity(t *testing.T) {
+	if _, err := ParseEntity("invoices"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := ParseEntity("journals"); err == nil {
+		t.Error("expected an error for an unknown entity")
+	}
+}
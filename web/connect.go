@@ -0,0 +1,368 @@
+package web
+
+// This file sets out the handlers for connecting to, and disconnecting from, Xero and
+// Salesforce using the OAuth2 authorization code flow with PKCE.
+//
+// The flow is started at /connect/{service}, which redirects the user to the service
+// to authorize this application. The service then redirects back to the configured
+// callback path with an authorization code, which is exchanged for a token. A random
+// state value is recorded for each flow so that only callbacks for flows started by
+// this server are accepted.
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"reconciler/apiclients/salesforce"
+	"reconciler/apiclients/xero"
+	"reconciler/internal"
+	"reconciler/internal/usermsg"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+)
+
+// authStateTimeout is the time allowed for a user to complete an OAuth2 flow.
+const authStateTimeout = 10 * time.Minute
+
+// authState records a pending OAuth2 flow.
+type authState struct {
+	service  string // "xero" or "salesforce"
+	verifier string // the PKCE verifier
+	created  time.Time
+}
+
+// authStates holds the pending OAuth2 flows, keyed by state.
+type authStates struct {
+	mu     sync.Mutex
+	states map[string]authState
+}
+
+// newAuthStates creates a new authStates.
+func newAuthStates() *authStates {
+	return &authStates{states: map[string]authState{}}
+}
+
+// add records a new flow for the service, returning its random state.
+func (a *authStates) add(service, verifier string) (string, error) {
+	state, err := internal.NewOAuthState()
+	if err != nil {
+		return "", err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// Discard expired flows.
+	for k, v := range a.states {
+		if time.Since(v.created) > authStateTimeout {
+			delete(a.states, k)
+		}
+	}
+	a.states[state] = authState{service: service, verifier: verifier, created: time.Now()}
+	return state, nil
+}
+
+// take removes and returns the flow for the state, which must be for the provided
+// service and not have expired.
+func (a *authStates) take(state, service string) (authState, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.states[state]
+	if !ok {
+		return authState{}, false
+	}
+	delete(a.states, state)
+	if s.service != service || time.Since(s.created) > authStateTimeout {
+		return authState{}, false
+	}
+	return s, true
+}
+
+// tenantSelection holds the id of the Xero organisation (tenant) selected for the
+// listings and refreshes. An empty id selects all organisations.
+type tenantSelection struct {
+	mu sync.Mutex
+	id string
+}
+
+// get returns the selected tenant id.
+func (t *tenantSelection) get() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.id
+}
+
+// set selects the tenant id.
+func (t *tenantSelection) set(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.id = id
+}
+
+// viewTenant is a view of a connected Xero organisation.
+type viewTenant struct {
+	ID       string
+	Name     string
+	Selected bool
+}
+
+// viewConnection is a view of the connection status of a service.
+type viewConnection struct {
+	Service   string
+	Name      string
+	Connected bool
+	Detail    string // the Xero organisation name or Salesforce instance url
+	Expiry    string
+	Error     string
+	Tenants   []viewTenant // the connected Xero organisations
+}
+
+// newViewConnection returns a viewConnection for the service, with the error, if any,
+// from determining its status.
+func newViewConnection(service, name string, connected bool, detail string, expiry time.Time, err error) viewConnection {
+	v := viewConnection{
+		Service:   service,
+		Name:      name,
+		Connected: connected,
+		Detail:    detail,
+	}
+	if !expiry.IsZero() {
+		v.Expiry = expiry.Local().Format("02/01/2006 15:04")
+	}
+	if err != nil {
+		v.Error = usermsg.ErrorMessage(service, err)
+	}
+	return v
+}
+
+// connectionStatuses returns the connection status of Xero and Salesforce.
+func (web *WebApp) connectionStatuses(ctx context.Context) []viewConnection {
+	xs, xErr := xero.Status(ctx, web.cfg)
+	ss, sErr := salesforce.Status(web.cfg)
+
+	xv := newViewConnection("xero", "Xero", xs.Connected, xs.TenantName, xs.Expiry, xErr)
+	selected := web.tenant.get()
+	for _, c := range xs.Connections {
+		xv.Tenants = append(xv.Tenants, viewTenant{
+			ID:       c.TenantID,
+			Name:     c.TenantName,
+			Selected: c.TenantID == selected,
+		})
+	}
+	if xv.Detail == "" && len(xv.Tenants) > 1 {
+		xv.Detail = fmt.Sprintf("%d organisations", len(xv.Tenants))
+	}
+
+	return []viewConnection{
+		xv,
+		newViewConnection("salesforce", "Salesforce", ss.Connected, ss.InstanceURL, ss.Expiry, sErr),
+	}
+}
+
+// handleConnect serves the /connect endpoint, showing the status of the Xero and
+// Salesforce connections.
+func (web *WebApp) handleConnect() http.Handler {
+
+	name := "connect.html"
+	tpls := []string{"base.html", "connect.html"}
+	templates := template.Must(template.ParseFS(web.templateFS, tpls...))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		data := struct {
+			PageTitle    string
+			Connections  []viewConnection
+			AllConnected bool
+		}{
+			PageTitle:    "Connect",
+			Connections:  web.connectionStatuses(r.Context()),
+			AllConnected: true,
+		}
+		for _, c := range data.Connections {
+			if !c.Connected || c.Error != "" {
+				data.AllConnected = false
+			}
+		}
+
+		web.render(w, r, templates, name, data)
+	})
+}
+
+// handleConnectStart starts the OAuth2 flow for a service by redirecting to the
+// service's authorization url.
+func (web *WebApp) handleConnectStart() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		vars, err := validMuxVars(mux.Vars(r), "service")
+		if err != nil {
+			web.clientError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		service := vars["service"]
+
+		verifier := oauth2.GenerateVerifier()
+		state, err := web.authStates.add(service, verifier)
+		if err != nil {
+			web.serverError(w, r, err)
+			return
+		}
+
+		var authURL string
+		switch service {
+		case "xero":
+			authURL = xero.AuthCodeURL(web.cfg, state, verifier)
+		case "salesforce":
+			authURL = salesforce.AuthCodeURL(web.cfg, state, verifier)
+		default:
+			web.notFound(w, r, fmt.Sprintf("unknown service %q", service))
+			return
+		}
+		http.Redirect(w, r, authURL, http.StatusFound)
+	})
+}
+
+// handleConnectCallback serves the OAuth2 callback for the service, exchanging the
+// authorization code for a token before redirecting to /connect.
+func (web *WebApp) handleConnectCallback(service string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		query := r.URL.Query()
+
+		// The service reports errors, such as the user declining access, as url
+		// parameters.
+		if e := query.Get("error"); e != "" {
+			web.clientError(w, fmt.Sprintf("%s authorization failed: %s %s", service, e, query.Get("error_description")), http.StatusBadRequest)
+			return
+		}
+
+		flow, ok := web.authStates.take(query.Get("state"), service)
+		if !ok {
+			web.clientError(w, "invalid or expired authorization state; please connect again", http.StatusBadRequest)
+			return
+		}
+		code := query.Get("code")
+		if code == "" {
+			web.clientError(w, "did not receive authorization code in callback", http.StatusBadRequest)
+			return
+		}
+
+		var err error
+		switch service {
+		case "xero":
+			err = xero.Exchange(r.Context(), web.cfg, code, flow.verifier)
+		case "salesforce":
+			err = salesforce.Exchange(r.Context(), web.cfg, code, flow.verifier)
+		default:
+			err = fmt.Errorf("unknown service %q", service)
+		}
+		if err != nil {
+			web.serverError(w, r, err)
+			return
+		}
+
+		web.syncer.ResetClients()
+		if service == "xero" {
+			web.selectConfiguredTenant(r.Context())
+		}
+		web.log.Printf("connected to %s", service)
+		http.Redirect(w, r, "/connect", http.StatusSeeOther)
+	})
+}
+
+// selectConfiguredTenant selects the organisation named by xero.tenant_name once Xero
+// is connected, if the name could not be resolved to an id when the server started.
+func (web *WebApp) selectConfiguredTenant(ctx context.Context) {
+	if web.tenant.get() != "" || web.cfg.Xero.TenantName == "" {
+		return
+	}
+	connections, err := xero.Connections(ctx, web.cfg)
+	if err != nil {
+		web.log.Printf("failed to select xero organisation %q: %v", web.cfg.Xero.TenantName, err)
+		return
+	}
+	connection, err := xero.SelectTenant(connections, web.cfg, "")
+	if err != nil {
+		web.log.Printf("failed to select xero organisation %q: %v", web.cfg.Xero.TenantName, err)
+		return
+	}
+	web.tenant.set(connection.TenantID)
+}
+
+// handleSelectTenant selects the Xero organisation used by the invoice and bank
+// transaction listings and by refreshes, from the form value "tenant". An empty value
+// selects all organisations for the listings, with refreshes using the configured
+// organisation.
+func (web *WebApp) handleSelectTenant() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if err := r.ParseForm(); err != nil {
+			web.clientError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id := r.PostForm.Get("tenant")
+
+		if id != "" {
+			connections, err := xero.Connections(r.Context(), web.cfg)
+			if err != nil {
+				web.serverError(w, r, err)
+				return
+			}
+			found := false
+			for _, c := range connections {
+				if c.TenantID == id {
+					found = true
+					break
+				}
+			}
+			if !found {
+				web.clientError(w, fmt.Sprintf("unknown Xero organisation %q", id), http.StatusBadRequest)
+				return
+			}
+		}
+
+		web.tenant.set(id)
+		web.log.Printf("selected xero organisation %q", id)
+		http.Redirect(w, r, "/connect", http.StatusSeeOther)
+	})
+}
+
+// handleDisconnect revokes and deletes the saved token for a service. A revocation
+// failure is logged, as the local token is removed regardless.
+func (web *WebApp) handleDisconnect() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		vars, err := validMuxVars(mux.Vars(r), "service")
+		if err != nil {
+			web.clientError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var tokenPath string
+		switch vars["service"] {
+		case "xero":
+			err = xero.RevokeAndDeleteToken(r.Context(), web.cfg)
+			tokenPath = web.cfg.Xero.TokenFilePath
+		case "salesforce":
+			err = salesforce.RevokeAndDeleteToken(r.Context(), web.cfg)
+			tokenPath = web.cfg.Salesforce.TokenFilePath
+		default:
+			web.notFound(w, r, fmt.Sprintf("unknown service %q", vars["service"]))
+			return
+		}
+		if err != nil {
+			web.log.Printf("%s disconnect error: %v", vars["service"], err)
+			if _, statErr := os.Stat(tokenPath); statErr == nil {
+				web.serverError(w, r, fmt.Errorf("%s disconnect error: %w", vars["service"], err))
+				return
+			}
+		}
+
+		web.syncer.ResetClients()
+		web.log.Printf("disconnected from %s", vars["service"])
+		http.Redirect(w, r, "/connect", http.StatusSeeOther)
+	})
+}
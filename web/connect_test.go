@@ -0,0 +1,215 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reconciler/config"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestAuthStates(t *testing.T) {
+
+	states := newAuthStates()
+
+	state, err := states.add("salesforce", "verifier-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := states.take(state, "xero"); ok {
+		t.Error("expected a state for another service to be refused")
+	}
+	// The state is single use, so is no longer available even for the right service.
+	if _, ok := states.take(state, "salesforce"); ok {
+		t.Error("expected a taken state to be refused")
+	}
+
+	state, _ = states.add("salesforce", "verifier-2")
+	flow, ok := states.take(state, "salesforce")
+	if !ok {
+		t.Fatal("expected state to be accepted")
+	}
+	if got, want := flow.verifier, "verifier-2"; got != want {
+		t.Errorf("got verifier %q want %q", got, want)
+	}
+
+	// Expired states are refused.
+	state, _ = states.add("xero", "")
+	expired := states.states[state]
+	expired.created = time.Now().Add(-2 * authStateTimeout)
+	states.states[state] = expired
+	if _, ok := states.take(state, "xero"); ok {
+		t.Error("expected an expired state to be refused")
+	}
+}
+
+// TestConnect tests the connect, callback and disconnect endpoints without a
+// connection to the services.
+func TestConnect(t *testing.T) {
+
+	// The Salesforce token revocation endpoint.
+	var revoked bool
+	revokeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		revoked = r.URL.Path == "/oauth2/revoke"
+	}))
+	t.Cleanup(revokeServer.Close)
+
+	dir := t.TempDir()
+	sfTokenPath := filepath.Join(dir, "salesforce.json")
+	cfg := &config.Config{
+		Web: config.WebConfig{
+			ListenAddress:      "127.0.0.1:8000",
+			XeroCallBack:       "/callback/xero",
+			SalesforceCallBack: "/callback/salesforce",
+		},
+		Xero: config.XeroConfig{
+			TokenFilePath: filepath.Join(dir, "xero.json"),
+			OAuth2Config: &oauth2.Config{
+				ClientID: "xero-client-id",
+				Endpoint: oauth2.Endpoint{AuthURL: "https://login.example.com/authorize"},
+			},
+		},
+		Salesforce: config.SalesforceConfig{
+			TokenFilePath: sfTokenPath,
+			OAuth2Config: &oauth2.Config{
+				ClientID: "sf-client-id",
+				Endpoint: oauth2.Endpoint{
+					AuthURL:  "https://sf.example.com/authorize",
+					TokenURL: revokeServer.URL + "/oauth2/token",
+				},
+			},
+		},
+	}
+	webApp := newTestWebApp(t, cfg)
+	handler := webApp.routes()
+
+	request := func(method, target string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, target, nil)
+		r.Header.Set("Origin", "http://example.com")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// Neither service is connected.
+	w := request("GET", "/connect")
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("got status %d want %d", got, want)
+	}
+	if got, want := strings.Count(w.Body.String(), "Not connected."), 2; got != want {
+		t.Errorf("got %d not connected services want %d", got, want)
+	}
+
+	// Starting a flow redirects to the service with a state and a PKCE challenge.
+	w = request("GET", "/connect/salesforce")
+	if got, want := w.Code, http.StatusFound; got != want {
+		t.Fatalf("got status %d want %d", got, want)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := location.Host, "sf.example.com"; got != want {
+		t.Errorf("got redirect host %q want %q", got, want)
+	}
+	state := location.Query().Get("state")
+	if state == "" || location.Query().Get("code_challenge") == "" {
+		t.Errorf("expected state and code challenge in %s", location)
+	}
+
+	// A callback for the other service, or with an unknown state, is refused.
+	w = request("GET", "/callback/xero?code=abc&state="+state)
+	if got, want := w.Code, http.StatusBadRequest; got != want {
+		t.Errorf("got status %d want %d", got, want)
+	}
+	w = request("GET", "/callback/salesforce?code=abc&state=unknown")
+	if got, want := w.Code, http.StatusBadRequest; got != want {
+		t.Errorf("got status %d want %d", got, want)
+	}
+
+	// Errors from the service are reported.
+	w = request("GET", "/callback/xero?error=access_denied&error_description=declined")
+	if got, want := w.Code, http.StatusBadRequest; got != want {
+		t.Errorf("got status %d want %d", got, want)
+	}
+	if !strings.Contains(w.Body.String(), "access_denied") {
+		t.Errorf("expected the service error to be reported, got %q", w.Body.String())
+	}
+
+	// Disconnecting revokes the token and removes the token file.
+	token := `{"token": {"access_token": "a", "refresh_token": "r"}, "instance_url": "https://sf.example.com"}`
+	if err := os.WriteFile(sfTokenPath, []byte(token), 0600); err != nil {
+		t.Fatal(err)
+	}
+	w = request("POST", "/disconnect/salesforce")
+	if got, want := w.Code, http.StatusSeeOther; got != want {
+		t.Errorf("got status %d want %d", got, want)
+	}
+	if !revoked {
+		t.Error("expected the salesforce token to be revoked")
+	}
+	if _, err := os.Stat(sfTokenPath); !os.IsNotExist(err) {
+		t.Error("expected the salesforce token file to be deleted")
+	}
+}
+
+// TestSelectTenant tests selecting the Xero organisation shown in the listings.
+func TestSelectTenant(t *testing.T) {
+
+	cfg := &config.Config{
+		Web: config.WebConfig{ListenAddress: "127.0.0.1:8000"},
+		Xero: config.XeroConfig{
+			TokenFilePath: filepath.Join(t.TempDir(), "xero.json"),
+			OAuth2Config:  &oauth2.Config{ClientID: "xero-client-id"},
+		},
+	}
+	webApp := newTestWebApp(t, cfg)
+	handler := webApp.routes()
+
+	request := func(method, target string, body url.Values) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, target, strings.NewReader(body.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Origin", "http://example.com")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// The test invoices have no organisation, so are shown when all organisations
+	// are selected but not when another is.
+	invoicesURL := "/invoices?status=All&date-from=2025-04-01&date-to=2026-03-31"
+	if body := request("GET", invoicesURL, nil).Body.String(); !strings.Contains(body, "INV-2025-101") {
+		t.Error("expected the invoices of all organisations to be listed")
+	}
+	webApp.tenant.set("tenant-b")
+	if body := request("GET", invoicesURL, nil).Body.String(); strings.Contains(body, "INV-2025-101") {
+		t.Error("expected only the invoices of the selected organisation to be listed")
+	}
+
+	// Selecting all organisations does not need a Xero connection.
+	w := request("POST", "/xero/tenant", url.Values{"tenant": {""}})
+	if got, want := w.Code, http.StatusSeeOther; got != want {
+		t.Errorf("got status %d want %d", got, want)
+	}
+	if got := webApp.tenant.get(); got != "" {
+		t.Errorf("got selected tenant %q want all", got)
+	}
+
+	// An organisation is checked against the Xero connections, which fails when not
+	// connected, leaving the selection unchanged.
+	w = request("POST", "/xero/tenant", url.Values{"tenant": {"tenant-c"}})
+	if got, want := w.Code, http.StatusInternalServerError; got != want {
+		t.Errorf("got status %d want %d", got, want)
+	}
+	if got := webApp.tenant.get(); got != "" {
+		t.Errorf("got selected tenant %q want all", got)
+	}
+}
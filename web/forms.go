@@ -57,7 +57,8 @@ func (v *Validator) FieldError(field string) bool {
 // ------------------------------------------------------------------------------
 
 // validQuery checks the url query parameters for the desired keys returning a
-// url.Values map and error.
+// url.Values map and error. An error is returned if any of the keys is missing.
+// Parameters other than the keys are not an error, and are returned with the keys.
 func validQuery(thisURL *url.URL, keys ...string) (url.Values, error) {
 	vq, err := url.ParseQuery(thisURL.RawQuery)
 	if err != nil {
@@ -99,6 +100,8 @@ type SearchForm struct {
 	DateFrom             time.Time `schema:"date-from"`
 	DateTo               time.Time `schema:"date-to"`
 	SearchString         string    `schema:"search"`
+	TrackingOption       string    `schema:"tracking"` // a tracking option id, or empty for any
+	EditReferences       bool      `schema:"edit"`     // show editable bank transaction references
 	Page                 int       `schema:"page"`
 }
 
@@ -194,17 +194,19 @@ func TestURLParse(t *testing.T) {
 			hasErr: nil,
 		},
 		{
+			// Parameters other than the keys are returned too.
 			name: "ok extraneous argument",
 			url:  "http://test.com?hi=there&ok=fine&not=needed",
 			keys: []string{"hi", "ok"},
 			vals: url.Values{
-				"hi": []string{"there"},
-				"ok": []string{"fine"},
+				"hi":  []string{"there"},
+				"ok":  []string{"fine"},
+				"not": []string{"needed"},
 			},
 			hasErr: nil,
 		},
 		{
-			name:   "two parameters ok",
+			name:   "missing parameter",
 			url:    "http://test.com?hi=there",
 			keys:   []string{"hi", "ok"},
 			hasErr: errors.New(`"ok" not in url`),
@@ -228,7 +230,7 @@ func TestURLParse(t *testing.T) {
 				return
 			}
 			if diff := cmp.Diff(tt.vals, vq); diff != "" {
-				fmt.Errorf("unexpected diff %v", diff)
+				t.Errorf("unexpected diff %v", diff)
 			}
 
 		})
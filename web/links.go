@@ -0,0 +1,152 @@
+package web
+
+// links.go links and unlinks Salesforce donations from the web interface.
+//
+// A donation is linked to an invoice or bank transaction by the payout reference
+// recorded in the configured Salesforce linking field, being the invoice number or
+// bank transaction reference. Linking and unlinking writes the field in Salesforce for
+// the selected donations, then updates the local records so that the reconciliation
+// totals change without waiting for the next sync. Only donations linked to an invoice
+// or bank transaction can be unlinked from it.
+//
+// Donations are linked by the reference alone, so a payout reference must belong to
+// one Xero organisation; donations are not linked to a reference used by several.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reconciler/apiclients/salesforce"
+	"reconciler/db"
+	"reconciler/internal/usermsg"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// maxLinkDonations is the most donations which can be linked or unlinked at once, being
+// the size limit of a Salesforce sObject Collections update.
+const maxLinkDonations = 200
+
+// donationsChangedEvent is the htmx event triggered by linking or unlinking donations,
+// on which the linked and find donation tabs reload.
+const donationsChangedEvent = "donations-changed"
+
+// errDonationsRejected reports that Salesforce did not accept the update of one or more
+// donations.
+var errDonationsRejected = errors.New("salesforce did not accept the donation update")
+
+// salesforceUpdater is the part of the Salesforce API client used to update donations.
+type salesforceUpdater interface {
+	BatchUpdateOpportunityRefs(ctx context.Context, reference string, ids []string, allOrNone bool) (salesforce.CollectionsUpdateResponse, error)
+}
+
+// updateDonationReferences sets the linking field of the donations with the ids to the
+// reference in Salesforce, or clears it if the reference is empty, and then updates
+// the local donations. The update is all or none, so that a donation rejected by
+// Salesforce leaves all the donations unchanged. If linkedReference is not empty the
+// donations must be linked to it, and none are updated if any are not.
+func (web *WebApp) updateDonationReferences(ctx context.Context, reference, linkedReference string, ids []string) error {
+	if linkedReference != "" {
+		notLinked, err := web.db.DonationsNotLinked(ctx, linkedReference, ids)
+		if err != nil {
+			return err
+		}
+		if len(notLinked) > 0 {
+			return fmt.Errorf("%w %q: %s", db.ErrDonationsNotLinked, linkedReference, strings.Join(notLinked, ", "))
+		}
+	}
+	client, err := web.newSalesforceClient(ctx)
+	if err != nil {
+		return fmt.Errorf("salesforce client error: %w", err)
+	}
+	response, err := client.BatchUpdateOpportunityRefs(ctx, reference, ids, true)
+	if err != nil {
+		// Rejected records are reported in the response.
+		if response != nil {
+			return fmt.Errorf("%w: %w", errDonationsRejected, err)
+		}
+		return fmt.Errorf("failed to update donations in salesforce: %w", err)
+	}
+	return web.db.DonationsPayoutReferenceUpdate(ctx, reference, linkedReference, ids)
+}
+
+// handleDonationsLink is the htmx endpoint for linking the donations selected in the
+// form values "donation" to the invoice or bank transaction with the payout reference
+// at /partials/donations-link/<type>/<reference>, or unlinking them at
+// /partials/donations-unlink/<type>/<reference> if link is false. A reference without
+// a local invoice or bank transaction is not found, donations cannot be linked to a
+// reference of more than one Xero organisation, and donations not linked to the
+// reference cannot be unlinked from it; in each case Salesforce is not updated.
+//
+// A successful update has no content, and triggers the donations changed event so that
+// the linked and find tabs reload their donations.
+func (web *WebApp) handleDonationsLink(link bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		vars, err := validMuxVars(mux.Vars(r), "type", "id")
+		if err != nil {
+			web.clientError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		typer, id := vars["type"], vars["id"]
+		found, err := web.db.PayoutReferenceExists(r.Context(), typer, id)
+		if err != nil {
+			web.serverError(w, r, err)
+			return
+		}
+		if !found {
+			web.notFound(w, r, fmt.Sprintf("%s %q not found", typer, id))
+			return
+		}
+		if link {
+			tenants, err := web.db.PayoutReferenceTenants(r.Context(), id)
+			if err != nil {
+				web.serverError(w, r, err)
+				return
+			}
+			if tenants > 1 {
+				web.clientError(w, fmt.Sprintf("%q is used by %d Xero organisations, so donations cannot be linked to it", id, tenants), http.StatusConflict)
+				return
+			}
+		}
+		if err := r.ParseForm(); err != nil {
+			web.clientError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ids := r.PostForm["donation"]
+		switch {
+		case len(ids) == 0:
+			web.clientError(w, "no donations were selected", http.StatusBadRequest)
+			return
+		case len(ids) > maxLinkDonations:
+			web.clientError(w, fmt.Sprintf("no more than %d donations can be updated at once", maxLinkDonations), http.StatusBadRequest)
+			return
+		}
+
+		reference, linkedReference, action := id, "", "linked %d donations to %q"
+		if !link {
+			reference, linkedReference, action = "", id, "unlinked %d donations from %q"
+		}
+		if err := web.updateDonationReferences(r.Context(), reference, linkedReference, ids); err != nil {
+			if msg, ok := usermsg.UserMessage(usermsg.Salesforce, err); ok {
+				web.clientError(w, msg, http.StatusBadGateway)
+				return
+			}
+			if errors.Is(err, db.ErrDonationsNotLinked) {
+				web.clientError(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if errors.Is(err, errDonationsRejected) {
+				web.clientError(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			web.serverError(w, r, err)
+			return
+		}
+		web.log.Printf(action, len(ids), id)
+		w.Header().Set("HX-Trigger", donationsChangedEvent)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,204 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reconciler/apiclients/salesforce"
+	"reconciler/apiclients/xero"
+	"reconciler/config"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeSalesforceUpdater is a salesforceUpdater recording the updates made.
+type fakeSalesforceUpdater struct {
+	rejected map[string]bool // ids of donations rejected by Salesforce
+	updates  []string        // the reference and ids of each update
+}
+
+func (f *fakeSalesforceUpdater) BatchUpdateOpportunityRefs(ctx context.Context, reference string, ids []string, allOrNone bool) (salesforce.CollectionsUpdateResponse, error) {
+	if !allOrNone {
+		return nil, fmt.Errorf("expected an all or none update")
+	}
+	f.updates = append(f.updates, reference+":"+strings.Join(ids, ","))
+	var response salesforce.CollectionsUpdateResponse
+	var rejected bool
+	for _, id := range ids {
+		result := salesforce.SaveResult{ID: id, Success: !f.rejected[id]}
+		if f.rejected[id] {
+			rejected = true
+			result.Errors = []salesforce.ErrorDetail{{Message: "entity is locked", ErrorCode: "ENTITY_IS_LOCKED"}}
+		}
+		response = append(response, result)
+	}
+	if rejected {
+		return response, fmt.Errorf("one or more donations failed to update")
+	}
+	return response, nil
+}
+
+// TestDonationsLink tests linking and unlinking donations to an invoice, with the
+// linking field written to Salesforce before the local donations are updated, and the
+// donation tabs reloaded by the donations changed event. Donations can only be
+// unlinked from the invoice they are linked to, and cannot be linked to an invoice
+// number used by more than one Xero organisation.
+func TestDonationsLink(t *testing.T) {
+
+	webApp := newTestWebApp(t, &config.Config{
+		Web: config.WebConfig{
+			ListenAddress: "127.0.0.1:8000",
+		},
+	})
+	handler := webApp.routes()
+	ctx := context.Background()
+
+	date := time.Date(2025, 5, 6, 0, 0, 0, 0, time.UTC)
+	var invoices []xero.Invoice
+	for _, n := range []string{"01", "02"} {
+		invoices = append(invoices, xero.Invoice{
+			InvoiceID:     "inv-link-" + n,
+			InvoiceNumber: "INV-LINK-" + n,
+			Type:          "ACCREC",
+			Status:        "AUTHORISED",
+			Total:         30,
+			Date:          xero.XeroDateTime{Time: date},
+			Updated:       xero.XeroDateTime{Time: date},
+			LineItems:     []xero.LineItem{{LineItemID: "inv-link-" + n + "-a", AccountCode: "5501", LineAmount: 30}},
+		})
+	}
+	if err := webApp.db.InvoicesUpsert(ctx, "", invoices); err != nil {
+		t.Fatal(err)
+	}
+	// INV-LINK-03 is the number of an invoice in each of two organisations.
+	for _, tenantID := range []string{"tenant-a", "tenant-b"} {
+		invoice := invoices[0]
+		invoice.InvoiceID, invoice.InvoiceNumber = tenantID+"-inv-link-03", "INV-LINK-03"
+		invoice.LineItems = []xero.LineItem{{LineItemID: tenantID + "-inv-link-03-a", AccountCode: "5501", LineAmount: 30}}
+		if err := webApp.db.InvoicesUpsert(ctx, tenantID, []xero.Invoice{invoice}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var donations []salesforce.Donation
+	for _, id := range []string{"sf-link-01", "sf-link-02"} {
+		donations = append(donations, salesforce.Donation{CoreFields: salesforce.CoreFields{
+			ID:        id,
+			Name:      "Link Test " + id,
+			Amount:    15,
+			CloseDate: salesforce.SalesforceDate{Time: date},
+		}})
+	}
+	if err := webApp.db.UpsertDonations(ctx, donations); err != nil {
+		t.Fatal(err)
+	}
+	fs := &fakeSalesforceUpdater{}
+	webApp.newSalesforceClient = func(ctx context.Context) (salesforceUpdater, error) {
+		return fs, nil
+	}
+
+	// references returns the local payout references of the donations, empty for none.
+	references := func() []string {
+		var refs []string
+		for _, id := range []string{"sf-link-01", "sf-link-02"} {
+			var ref *string
+			if err := webApp.db.GetContext(ctx, &ref, "SELECT payout_reference_dfk FROM donations WHERE id = ?", id); err != nil {
+				t.Fatal(err)
+			}
+			if ref == nil {
+				refs = append(refs, "")
+				continue
+			}
+			refs = append(refs, *ref)
+		}
+		return refs
+	}
+
+	tests := []struct {
+		name           string
+		path           string
+		donations      []string
+		rejected       bool
+		wantStatus     int
+		wantReferences []string // of sf-link-01 and sf-link-02
+	}{
+		{"none selected", "/partials/donations-link/invoice/INV-LINK-01", nil, false, http.StatusBadRequest, []string{"", ""}},
+		{"unknown invoice", "/partials/donations-link/invoice/INV-LINK-99", []string{"sf-link-02"}, false, http.StatusNotFound, []string{"", ""}},
+		{"unknown bank transaction", "/partials/donations-link/bank-transaction/INV-LINK-01", []string{"sf-link-02"}, false, http.StatusNotFound, []string{"", ""}},
+		{"invoice number of two organisations", "/partials/donations-link/invoice/INV-LINK-03", []string{"sf-link-02"}, false, http.StatusConflict, []string{"", ""}},
+		{"link", "/partials/donations-link/invoice/INV-LINK-01", []string{"sf-link-01", "sf-link-02"}, false, http.StatusNoContent, []string{"INV-LINK-01", "INV-LINK-01"}},
+		{"unlink from other invoice", "/partials/donations-unlink/invoice/INV-LINK-02", []string{"sf-link-02"}, false, http.StatusConflict, []string{"INV-LINK-01", "INV-LINK-01"}},
+		{"unlink rejected", "/partials/donations-unlink/invoice/INV-LINK-01", []string{"sf-link-02"}, true, http.StatusUnprocessableEntity, []string{"INV-LINK-01", "INV-LINK-01"}},
+		{"unlink", "/partials/donations-unlink/invoice/INV-LINK-01", []string{"sf-link-02"}, false, http.StatusNoContent, []string{"INV-LINK-01", ""}},
+		{"unlink not linked", "/partials/donations-unlink/invoice/INV-LINK-01", []string{"sf-link-01", "sf-link-02"}, false, http.StatusConflict, []string{"INV-LINK-01", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs.rejected = map[string]bool{"sf-link-02": tt.rejected}
+			form := url.Values{"donation": tt.donations}
+			r := httptest.NewRequest("POST", tt.path, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("HX-Request", "true")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if got, want := w.Code, tt.wantStatus; got != want {
+				t.Fatalf("got status %d want %d: %s", got, want, w.Body.String())
+			}
+			wantTrigger := ""
+			if tt.wantStatus == http.StatusNoContent {
+				wantTrigger = donationsChangedEvent
+			}
+			if got := w.Header().Get("HX-Trigger"); got != wantTrigger {
+				t.Errorf("got trigger %q want %q", got, wantTrigger)
+			}
+			if diff := cmp.Diff(tt.wantReferences, references()); diff != "" {
+				t.Errorf("references diff:\n%s", diff)
+			}
+		})
+	}
+
+	want := []string{
+		"INV-LINK-01:sf-link-01,sf-link-02",
+		":sf-link-02",
+		":sf-link-02",
+	}
+	if diff := cmp.Diff(want, fs.updates); diff != "" {
+		t.Errorf("updates diff:\n%s", diff)
+	}
+
+	// The linked tab shows the donation still linked, with the unlink form, and reloads
+	// when donations are linked or unlinked.
+	r := httptest.NewRequest("GET", "/partials/donations-linked/invoice/INV-LINK-01", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("got status %d want %d", got, want)
+	}
+	body := w.Body.String()
+	for _, s := range []string{`hx-post="/partials/donations-unlink/invoice/INV-LINK-01"`, `value="sf-link-01"`, `hx-trigger="donations-changed from:body"`} {
+		if !strings.Contains(body, s) {
+			t.Errorf("linked tab does not contain %q", s)
+		}
+	}
+	if strings.Contains(body, `value="sf-link-02"`) {
+		t.Error("expected the unlinked donation not to be shown")
+	}
+
+	// The find tab offers the unlinked donation for linking.
+	r = httptest.NewRequest("GET", "/partials/donations-find/invoice/INV-LINK-01?status=NotLinked&date-from=2025-04-01&date-to=2026-03-31&search=Link+Test", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("got status %d want %d", got, want)
+	}
+	body = w.Body.String()
+	for _, s := range []string{`hx-post="/partials/donations-link/invoice/INV-LINK-01"`, `hx-include="#donations-search-form"`, `hx-trigger="donations-changed from:body"`, `value="sf-link-02"`} {
+		if !strings.Contains(body, s) {
+			t.Errorf("find tab does not contain %q", s)
+		}
+	}
+}
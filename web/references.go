@@ -0,0 +1,221 @@
+package web
+
+// references.go writes corrected references back to Xero from the web interface.
+//
+// Bank transactions are linked to Salesforce donations by their payout reference, and
+// invoice references often record a platform payout id. A corrected reference is
+// posted to Xero through the API, and the local record is refreshed from the record
+// Xero returns, so that donations are linked without waiting for the next sync.
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"reconciler/apiclients/xero"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// maxReferenceLen is the longest reference accepted by Xero.
+const maxReferenceLen = 255
+
+// xeroUpdater is the part of the Xero API client used to update Xero records.
+type xeroUpdater interface {
+	TenantID() string
+	UpdateBankTransactionReferences(ctx context.Context, updates []xero.ReferenceUpdate) ([]xero.BankTransaction, error)
+	UpdateInvoiceReference(ctx context.Context, id, reference string) (xero.Invoice, error)
+}
+
+// updateBankTransactionReferences writes the references, keyed by bank transaction id,
+// to Xero with a single update for each Xero organisation, refreshing the local
+// records from the transactions Xero returns. It returns the number of transactions
+// updated. Transactions rejected by Xero are reported in a *xero.ValidationError once
+// the others have been updated.
+func (web *WebApp) updateBankTransactionReferences(ctx context.Context, references map[string]string) (int, error) {
+
+	// Group the transactions by Xero organisation.
+	byTenant := map[string][]string{}
+	for _, id := range slices.Sorted(maps.Keys(references)) {
+		transaction, _, err := web.db.BankTransactionWRGet(ctx, id)
+		if err != nil {
+			return 0, fmt.Errorf("bank transaction %q: %w", id, err)
+		}
+		byTenant[transaction.TenantID] = append(byTenant[transaction.TenantID], id)
+	}
+
+	var updated int
+	var errs []error
+	for _, tenantID := range slices.Sorted(maps.Keys(byTenant)) {
+		// Records synced before organisations were recorded use the default
+		// organisation.
+		client, err := web.newXeroClient(ctx, tenantID)
+		if err != nil {
+			return updated, fmt.Errorf("xero client error: %w", err)
+		}
+
+		var updates []xero.ReferenceUpdate
+		for _, id := range byTenant[tenantID] {
+			updates = append(updates, xero.ReferenceUpdate{ID: id, Reference: references[id]})
+		}
+
+		result, err := client.UpdateBankTransactionReferences(ctx, updates)
+		var validationErr *xero.ValidationError
+		if err != nil && !errors.As(err, &validationErr) {
+			return updated, fmt.Errorf("failed to update bank transactions in xero: %w", err)
+		}
+		if validationErr != nil {
+			errs = append(errs, validationErr)
+		}
+		if err := web.db.BankTransactionsUpsert(ctx, client.TenantID(), result); err != nil {
+			return updated, err
+		}
+		updated += len(result)
+	}
+	return updated, errors.Join(errs...)
+}
+
+// updateInvoiceReference writes the reference of the invoice with the id to Xero,
+// refreshing the local record from the invoice Xero returns.
+func (web *WebApp) updateInvoiceReference(ctx context.Context, id, reference string) error {
+	invoice, _, err := web.db.InvoiceWRGet(ctx, id)
+	if err != nil {
+		return fmt.Errorf("invoice %q: %w", id, err)
+	}
+	client, err := web.newXeroClient(ctx, invoice.TenantID)
+	if err != nil {
+		return fmt.Errorf("xero client error: %w", err)
+	}
+	updated, err := client.UpdateInvoiceReference(ctx, id, reference)
+	if err != nil {
+		return fmt.Errorf("failed to update invoice %q in xero: %w", id, err)
+	}
+	return web.db.InvoicesUpsert(ctx, client.TenantID(), []xero.Invoice{updated})
+}
+
+// referenceUpdateError writes the response for a failed reference update, showing the
+// reasons given by Xero for rejecting an update.
+func (web *WebApp) referenceUpdateError(w http.ResponseWriter, r *http.Request, err error) {
+	var validationErr *xero.ValidationError
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		web.notFound(w, r, err.Error())
+	case errors.As(err, &validationErr):
+		web.clientError(w, "Xero did not accept the reference update: "+validationErr.Error(), http.StatusUnprocessableEntity)
+	default:
+		web.serverError(w, r, err)
+	}
+}
+
+// handleBankTransactionReference updates the reference of the bank transaction at
+// /bank-transaction/<id> from the form value "reference", redirecting back to the
+// bank transaction.
+func (web *WebApp) handleBankTransactionReference() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		vars, err := validMuxVars(mux.Vars(r), "id")
+		if err != nil {
+			web.clientError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id := vars["id"]
+		if err := r.ParseForm(); err != nil {
+			web.clientError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reference := strings.TrimSpace(r.PostForm.Get("reference"))
+		if len(reference) > maxReferenceLen {
+			web.clientError(w, fmt.Sprintf("the reference is longer than %d characters", maxReferenceLen), http.StatusBadRequest)
+			return
+		}
+
+		if _, err := web.updateBankTransactionReferences(r.Context(), map[string]string{id: reference}); err != nil {
+			web.referenceUpdateError(w, r, err)
+			return
+		}
+		web.log.Printf("updated reference of bank transaction %q to %q", id, reference)
+		http.Redirect(w, r, "/bank-transaction/"+id, http.StatusSeeOther)
+	})
+}
+
+// handleInvoiceReference updates the reference of the invoice at /invoice/<id> from
+// the form value "reference", redirecting back to the invoice.
+func (web *WebApp) handleInvoiceReference() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		vars, err := validMuxVars(mux.Vars(r), "id")
+		if err != nil {
+			web.clientError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id := vars["id"]
+		if err := r.ParseForm(); err != nil {
+			web.clientError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reference := strings.TrimSpace(r.PostForm.Get("reference"))
+		if len(reference) > maxReferenceLen {
+			web.clientError(w, fmt.Sprintf("the reference is longer than %d characters", maxReferenceLen), http.StatusBadRequest)
+			return
+		}
+
+		if err := web.updateInvoiceReference(r.Context(), id, reference); err != nil {
+			web.referenceUpdateError(w, r, err)
+			return
+		}
+		web.log.Printf("updated reference of invoice %q to %q", id, reference)
+		http.Redirect(w, r, "/invoice/"+id, http.StatusSeeOther)
+	})
+}
+
+// handleBankTransactionReferences updates the references of several bank transactions
+// in one request to Xero. The form holds repeated "id", "reference" and "original"
+// values, the last being the reference shown when the form was rendered; only changed
+// references are sent. The form value "return" is the listing page to redirect back
+// to.
+func (web *WebApp) handleBankTransactionReferences() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if err := r.ParseForm(); err != nil {
+			web.clientError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ids, references, originals := r.PostForm["id"], r.PostForm["reference"], r.PostForm["original"]
+		if len(references) != len(ids) || len(originals) != len(ids) {
+			web.clientError(w, "each bank transaction requires a reference and original reference", http.StatusBadRequest)
+			return
+		}
+
+		changed := map[string]string{}
+		for i, id := range ids {
+			reference := strings.TrimSpace(references[i])
+			if len(reference) > maxReferenceLen {
+				web.clientError(w, fmt.Sprintf("the reference for %q is longer than %d characters", id, maxReferenceLen), http.StatusBadRequest)
+				return
+			}
+			if reference != originals[i] {
+				changed[id] = reference
+			}
+		}
+
+		if len(changed) > 0 {
+			updated, err := web.updateBankTransactionReferences(r.Context(), changed)
+			if err != nil {
+				web.referenceUpdateError(w, r, err)
+				return
+			}
+			web.log.Printf("updated references of %d bank transactions", updated)
+		}
+
+		// Only redirect to the bank transactions listing.
+		returnURL := r.PostForm.Get("return")
+		if returnURL != "/bank-transactions" && !strings.HasPrefix(returnURL, "/bank-transactions?") {
+			returnURL = "/bank-transactions"
+		}
+		http.Redirect(w, r, returnURL, http.StatusSeeOther)
+	})
+}
@@ -0,0 +1,270 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reconciler/apiclients/xero"
+	"reconciler/config"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeXeroUpdater is a xeroUpdater holding bank transactions and invoices in memory.
+type fakeXeroUpdater struct {
+	tenantID     string
+	transactions map[string]xero.BankTransaction
+	invoices     map[string]xero.Invoice
+	rejected     map[string]bool // ids of records rejected by Xero
+	updates      [][]string      // the ids of the records in each update
+}
+
+func (f *fakeXeroUpdater) TenantID() string {
+	return f.tenantID
+}
+
+func (f *fakeXeroUpdater) UpdateBankTransactionReferences(ctx context.Context, updates []xero.ReferenceUpdate) ([]xero.BankTransaction, error) {
+	var ids []string
+	var updated []xero.BankTransaction
+	validationErr := &xero.ValidationError{Records: map[string][]string{}}
+	for _, u := range updates {
+		ids = append(ids, u.ID)
+		tx, ok := f.transactions[u.ID]
+		if !ok {
+			return nil, errors.New("not found")
+		}
+		if f.rejected[u.ID] {
+			validationErr.Records[u.ID] = []string{"The transaction is locked"}
+			continue
+		}
+		// Xero returns the complete transaction, with its line items unchanged.
+		tx.Reference = u.Reference
+		f.transactions[u.ID] = tx
+		updated = append(updated, tx)
+	}
+	f.updates = append(f.updates, ids)
+	if len(validationErr.Records) > 0 {
+		return updated, validationErr
+	}
+	return updated, nil
+}
+
+func (f *fakeXeroUpdater) UpdateInvoiceReference(ctx context.Context, id, reference string) (xero.Invoice, error) {
+	f.updates = append(f.updates, []string{id})
+	invoice, ok := f.invoices[id]
+	if !ok {
+		return xero.Invoice{}, errors.New("not found")
+	}
+	if f.rejected[id] {
+		return xero.Invoice{}, &xero.ValidationError{Records: map[string][]string{id: {"The invoice is locked"}}}
+	}
+	invoice.Reference = reference
+	f.invoices[id] = invoice
+	return invoice, nil
+}
+
+// TestBankTransactionReferences tests updating the references of bank transactions in
+// Xero, singly from the detail page and in a batch from the listing.
+func TestBankTransactionReferences(t *testing.T) {
+
+	webApp := newTestWebApp(t, &config.Config{
+		Web: config.WebConfig{
+			ListenAddress: "127.0.0.1:8000",
+		},
+	})
+	handler := webApp.routes()
+	ctx := context.Background()
+
+	date := xero.XeroDateTime{Time: time.Date(2025, 5, 6, 0, 0, 0, 0, time.UTC)}
+	fx := &fakeXeroUpdater{tenantID: "tenant-a", transactions: map[string]xero.BankTransaction{}}
+	var transactions []xero.BankTransaction
+	for _, id := range []string{"bt-ref-01", "bt-ref-02", "bt-ref-03"} {
+		tx := xero.BankTransaction{
+			BankTransactionID: id,
+			Type:              "RECEIVE",
+			Reference:         "UNKNOWN",
+			Status:            "AUTHORISED",
+			Total:             50,
+			Date:              date,
+			Updated:           date,
+			LineItems:         []xero.LineItem{{LineItemID: id + "-a", AccountCode: "5501", LineAmount: 50}},
+		}
+		transactions = append(transactions, tx)
+		fx.transactions[id] = tx
+	}
+	if err := webApp.db.BankTransactionsUpsert(ctx, "tenant-a", transactions); err != nil {
+		t.Fatal(err)
+	}
+	var tenants []string
+	webApp.newXeroClient = func(ctx context.Context, tenant string) (xeroUpdater, error) {
+		tenants = append(tenants, tenant)
+		return fx, nil
+	}
+
+	post := func(path string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Origin", "http://example.com")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	reference := func(id string) string {
+		transaction, _, err := webApp.db.BankTransactionWRGet(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *transaction.Reference
+	}
+
+	// A single transaction is updated from its detail page.
+	w := post("/bank-transaction/bt-ref-01/reference", url.Values{"reference": {" JG-PAYOUT-2025-05-06 "}})
+	if got, want := w.Code, http.StatusSeeOther; got != want {
+		t.Fatalf("got status %d want %d: %s", got, want, w.Body.String())
+	}
+	if got, want := w.Header().Get("Location"), "/bank-transaction/bt-ref-01"; got != want {
+		t.Errorf("got redirect %q want %q", got, want)
+	}
+	if got, want := reference("bt-ref-01"), "JG-PAYOUT-2025-05-06"; got != want {
+		t.Errorf("got local reference %q want %q", got, want)
+	}
+
+	// Only the changed references in a batch are sent, in one update.
+	w = post("/bank-transactions/references", url.Values{
+		"id":        {"bt-ref-01", "bt-ref-02", "bt-ref-03"},
+		"reference": {"JG-PAYOUT-2025-05-06", "STRIPE-PAYOUT-2025-05-06", "CAF-PAYOUT-2025-05-06"},
+		"original":  {"JG-PAYOUT-2025-05-06", "UNKNOWN", "UNKNOWN"},
+		"return":    {"/bank-transactions?edit=true&status=All"},
+	})
+	if got, want := w.Code, http.StatusSeeOther; got != want {
+		t.Fatalf("got status %d want %d: %s", got, want, w.Body.String())
+	}
+	if got, want := w.Header().Get("Location"), "/bank-transactions?edit=true&status=All"; got != want {
+		t.Errorf("got redirect %q want %q", got, want)
+	}
+	want := [][]string{{"bt-ref-01"}, {"bt-ref-02", "bt-ref-03"}}
+	if diff := cmp.Diff(want, fx.updates); diff != "" {
+		t.Errorf("updates diff:\n%s", diff)
+	}
+	if got, want := reference("bt-ref-03"), "CAF-PAYOUT-2025-05-06"; got != want {
+		t.Errorf("got local reference %q want %q", got, want)
+	}
+	if diff := cmp.Diff([]string{"tenant-a", "tenant-a"}, tenants); diff != "" {
+		t.Errorf("tenants diff:\n%s", diff)
+	}
+
+	// Transactions rejected by Xero are reported, with the others updated.
+	fx.rejected = map[string]bool{"bt-ref-02": true}
+	w = post("/bank-transactions/references", url.Values{
+		"id":        {"bt-ref-02", "bt-ref-03"},
+		"reference": {"REJECTED", "ENTHUSE-PAYOUT-2025-05-06"},
+		"original":  {"STRIPE-PAYOUT-2025-05-06", "CAF-PAYOUT-2025-05-06"},
+		"return":    {"https://example.com/"},
+	})
+	if got, want := w.Code, http.StatusUnprocessableEntity; got != want {
+		t.Fatalf("got status %d want %d", got, want)
+	}
+	if !strings.Contains(w.Body.String(), "The transaction is locked") {
+		t.Errorf("expected the Xero validation message, got %q", w.Body.String())
+	}
+	if got, want := reference("bt-ref-02"), "STRIPE-PAYOUT-2025-05-06"; got != want {
+		t.Errorf("got rejected local reference %q want %q", got, want)
+	}
+	if got, want := reference("bt-ref-03"), "ENTHUSE-PAYOUT-2025-05-06"; got != want {
+		t.Errorf("got local reference %q want %q", got, want)
+	}
+
+	// An unknown transaction is not found.
+	w = post("/bank-transaction/bt-ref-99/reference", url.Values{"reference": {"X"}})
+	if got, want := w.Code, http.StatusNotFound; got != want {
+		t.Errorf("got status %d want %d", got, want)
+	}
+
+	// The listing in edit mode shows the references as form fields.
+	r := httptest.NewRequest("GET", "/bank-transactions?status=All&date-from=2025-04-01&date-to=2026-03-31&search=PAYOUT-2025-05-06&edit=true", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("got status %d want %d", got, want)
+	}
+	for _, s := range []string{`id="references-form"`, `value="ENTHUSE-PAYOUT-2025-05-06"`, "Save references to Xero"} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("listing does not contain %q", s)
+		}
+	}
+}
+
+// TestInvoiceReference tests updating the reference of an invoice in Xero from the
+// invoice detail page.
+func TestInvoiceReference(t *testing.T) {
+
+	webApp := newTestWebApp(t, &config.Config{
+		Web: config.WebConfig{
+			ListenAddress: "127.0.0.1:8000",
+		},
+	})
+	handler := webApp.routes()
+	ctx := context.Background()
+
+	date := xero.XeroDateTime{Time: time.Date(2025, 5, 6, 0, 0, 0, 0, time.UTC)}
+	invoice := xero.Invoice{
+		InvoiceID:     "inv-ref-01",
+		InvoiceNumber: "INV-REF-01",
+		Type:          "ACCREC",
+		Status:        "AUTHORISED",
+		Total:         50,
+		Date:          date,
+		Updated:       date,
+		LineItems:     []xero.LineItem{{LineItemID: "inv-ref-01-a", AccountCode: "5501", LineAmount: 50}},
+	}
+	if err := webApp.db.InvoicesUpsert(ctx, "tenant-a", []xero.Invoice{invoice}); err != nil {
+		t.Fatal(err)
+	}
+	fx := &fakeXeroUpdater{tenantID: "tenant-a", invoices: map[string]xero.Invoice{invoice.InvoiceID: invoice}}
+	webApp.newXeroClient = func(ctx context.Context, tenant string) (xeroUpdater, error) {
+		if tenant != "tenant-a" {
+			t.Errorf("got tenant %q want tenant-a", tenant)
+		}
+		return fx, nil
+	}
+
+	tests := []struct {
+		name          string
+		url           string
+		reference     string
+		rejected      bool
+		wantStatus    int
+		wantReference string
+	}{
+		{"updated", "/invoice/inv-ref-01/reference", "JG-PAYOUT-2025-05-06", false, http.StatusSeeOther, "JG-PAYOUT-2025-05-06"},
+		{"rejected", "/invoice/inv-ref-01/reference", "LOCKED", true, http.StatusUnprocessableEntity, "JG-PAYOUT-2025-05-06"},
+		{"too long", "/invoice/inv-ref-01/reference", strings.Repeat("x", 256), false, http.StatusBadRequest, "JG-PAYOUT-2025-05-06"},
+		{"unknown", "/invoice/inv-ref-99/reference", "X", false, http.StatusNotFound, "JG-PAYOUT-2025-05-06"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fx.rejected = map[string]bool{"inv-ref-01": tt.rejected}
+			form := url.Values{"reference": {tt.reference}}
+			r := httptest.NewRequest("POST", tt.url, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("Origin", "http://example.com")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if got, want := w.Code, tt.wantStatus; got != want {
+				t.Fatalf("got status %d want %d: %s", got, want, w.Body.String())
+			}
+			got, _, err := webApp.db.InvoiceWRGet(ctx, "inv-ref-01")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Reference == nil || *got.Reference != tt.wantReference {
+				t.Errorf("got local reference %v want %q", got.Reference, tt.wantReference)
+			}
+		})
+	}
+}
@@ -20,6 +20,7 @@ package web
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"embed"
 	"errors"
@@ -28,9 +29,14 @@ import (
 	"io/fs"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"reconciler/apiclients/salesforce"
+	"reconciler/apiclients/xero"
 	"reconciler/config"
 	"reconciler/db"
+	"reconciler/internal"
+	"reconciler/syncer"
 	"time"
 
 	"github.com/gorilla/handlers"
@@ -56,6 +62,16 @@ type WebApp struct {
 	defaultStartDate time.Time
 	defaultEndDate   time.Time
 	server           *http.Server
+	syncer           *syncer.Syncer
+	jobs             *syncer.Jobs // background Xero and Salesforce syncs.
+	authStates       *authStates  // pending OAuth2 connections.
+	tenant           *tenantSelection
+
+	// newXeroClient returns a client for updating records in the Xero organisation
+	// with the tenant id or name, and newSalesforceClient a client for updating
+	// donations. They may be replaced for testing.
+	newXeroClient       func(ctx context.Context, tenant string) (xeroUpdater, error)
+	newSalesforceClient func(ctx context.Context) (salesforceUpdater, error)
 }
 
 // New initialises a WebApp. An error type is returned for future use.
@@ -72,6 +88,8 @@ func New(logger *log.Logger, cfg *config.Config, db *db.DB, staticFS, templateFS
 		MaxHeaderBytes:    1 << 19, // 100k ish
 	}
 
+	dataSyncer := syncer.New(cfg, db)
+
 	webApp := &WebApp{
 		log:              logger, // this conflicts with the gorilla logging middleware; also how about slog?
 		cfg:              cfg,
@@ -81,10 +99,40 @@ func New(logger *log.Logger, cfg *config.Config, db *db.DB, staticFS, templateFS
 		defaultStartDate: start,
 		defaultEndDate:   end,
 		server:           server,
+		syncer:           dataSyncer,
+		jobs:             syncer.NewJobs(dataSyncer),
+		authStates:       newAuthStates(),
+		tenant:           &tenantSelection{id: cfg.Xero.TenantID},
+		newXeroClient: func(ctx context.Context, tenant string) (xeroUpdater, error) {
+			return xero.NewClientForTenant(ctx, cfg, tenant)
+		},
+		newSalesforceClient: func(ctx context.Context) (salesforceUpdater, error) {
+			return salesforce.NewClient(ctx, cfg)
+		},
 	}
 	return webApp, nil
 }
 
+// FileMounts returns the static and template file mounts for the web server. In
+// development mode the mounts are made from the configured on-disk paths so that
+// templates and css can be edited without recompilation, otherwise the embedded
+// filesystems are used.
+func FileMounts(cfg *config.Config) (staticFS, templatesFS fs.FS, err error) {
+	var staticPath, templatesPath string
+	if cfg.Web.DevMode {
+		staticPath, templatesPath = cfg.Web.StaticPath, cfg.Web.TemplatesPath
+	}
+	staticFS, err = internal.NewFileMount("static", staticEmbeddedFS, staticPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("static mount error: %w", err)
+	}
+	templatesFS, err = internal.NewFileMount("templates", templatesEmbeddedFS, templatesPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("templates mount error: %w", err)
+	}
+	return staticFS, templatesFS, nil
+}
+
 // StartServer starts a WebApp.
 func (web *WebApp) StartServer() error {
 	web.server.Handler = web.routes()
@@ -92,17 +140,36 @@ func (web *WebApp) StartServer() error {
 	return web.server.ListenAndServe()
 }
 
+// Shutdown gracefully stops a running WebApp, cancelling any running background syncs.
+func (web *WebApp) Shutdown(ctx context.Context) error {
+	err := web.server.Shutdown(ctx)
+	web.jobs.Close()
+	return err
+}
+
 // routes connects all of the endpoints and provides middleware.
 func (web *WebApp) routes() http.Handler {
 
 	r := mux.NewRouter()
+	r.Use(web.sameOrigin)
 
 	fs := http.FileServerFS(web.staticFS)
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", fs))
 
 	r.Handle("/", web.handleRoot())
-	r.Handle("/connect", web.handleConnect())
-	r.Handle("/refresh", web.handleRefresh())
+	r.Handle("/connect", web.handleConnect()).Methods("GET")
+	r.Handle("/connect/{service:(?:xero|salesforce)}", web.handleConnectStart()).Methods("GET")
+	r.Handle("/disconnect/{service:(?:xero|salesforce)}", web.handleDisconnect()).Methods("POST")
+	r.Handle("/xero/tenant", web.handleSelectTenant()).Methods("POST")
+	// OAuth2 callbacks are served at the configured paths.
+	if web.cfg.Web.XeroCallBack != "" {
+		r.Handle(web.cfg.Web.XeroCallBack, web.handleConnectCallback("xero")).Methods("GET")
+	}
+	if web.cfg.Web.SalesforceCallBack != "" {
+		r.Handle(web.cfg.Web.SalesforceCallBack, web.handleConnectCallback("salesforce")).Methods("GET")
+	}
+	r.Handle("/refresh", web.handleRefresh()).Methods("GET")
+	r.Handle("/refresh/{entity}", web.handleRefreshStart()).Methods("POST")
 	r.Handle("/home", web.handleHome()) // redirect to handleInvoices.
 
 	// Main listing pages.
@@ -114,18 +181,51 @@ func (web *WebApp) routes() http.Handler {
 	// Detail pages.
 	// Note that the regexp works for uuids and the system test data.
 	r.Handle("/invoice/{id:[A-Za-z0-9_-]+}", web.handleInvoiceDetail())
+	r.Handle("/invoice/{id:[A-Za-z0-9_-]+}/reference", web.handleInvoiceReference()).Methods("POST")
 	r.Handle("/bank-transaction/{id:[A-Za-z0-9_-]+}", web.handleBankTransactionDetail())
+	r.Handle("/bank-transaction/{id:[A-Za-z0-9_-]+}/reference", web.handleBankTransactionReference()).Methods("POST")
+	r.Handle("/bank-transactions/references", web.handleBankTransactionReferences()).Methods("POST")
 	// Todo: donation detail page.
 
 	// Partial pages.
 	// These are HTMX partials showing donation listings in "linked" and "find to link" modes.
 	r.Handle("/partials/donations-linked/{type:(?:invoice|bank-transaction)}/{id}", web.handlePartialDonationsLinked())
 	r.Handle("/partials/donations-find/{type:(?:invoice|bank-transaction)}/{id}", web.handlePartialDonationsFind())
+	r.Handle("/partials/donations-link/{type:(?:invoice|bank-transaction)}/{id}", web.handleDonationsLink(true)).Methods("POST")
+	r.Handle("/partials/donations-unlink/{type:(?:invoice|bank-transaction)}/{id}", web.handleDonationsLink(false)).Methods("POST")
+	// Polled by the refresh page for the progress of a background sync.
+	r.Handle("/partials/refresh-status/{entity}", web.handlePartialRefreshStatus())
 
 	logging := handlers.LoggingHandler(os.Stdout, r)
 	return logging
 }
 
+// sameOrigin is middleware refusing POST requests from other sites, which would
+// otherwise be able to change references, link donations or disconnect a service. A
+// request with an Origin header must come from this site. A request without one must
+// be an htmx request, as another site cannot set the HX-Request header.
+func (web *WebApp) sameOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+		origin := r.Header.Get("Origin")
+		if origin == "" && r.Header.Get("HX-Request") == "" {
+			web.clientError(w, "request origin is missing", http.StatusForbidden)
+			return
+		}
+		if origin != "" {
+			if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+				web.log.Printf("refused %s %s from origin %q", r.Method, r.URL.Path, origin)
+				web.clientError(w, "cross-site request refused", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // handleRoot deals with http calls to "/" by redirecting to "/connect".
 func (web *WebApp) handleRoot() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -137,27 +237,131 @@ func (web *WebApp) handleRoot() http.Handler {
 	})
 }
 
-// handleConnect serves the /connect endpoint.
-func (web *WebApp) handleConnect() http.Handler {
+// handleRefresh serves the /refresh page, showing the status of the Xero and
+// Salesforce syncs.
+func (web *WebApp) handleRefresh() http.Handler {
 
-	name := "connect.html"
-	tpls := []string{"base.html", "connect.html"}
+	name := "refresh.html"
+	tpls := []string{"base.html", "partial-refresh-status.html", "refresh.html"}
 	templates := template.Must(template.ParseFS(web.templateFS, tpls...))
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		web.render(w, r, templates, name, nil)
+
+		ctx := r.Context()
+
+		data := struct {
+			PageTitle  string
+			DateFrom   string
+			DateTo     string
+			Xero       []viewSyncStatus
+			Salesforce []viewSyncStatus
+		}{
+			PageTitle: "Refresh Data",
+			DateFrom:  web.defaultStartDate.Format("02/01/2006"),
+			DateTo:    web.defaultEndDate.Format("02/01/2006"),
+		}
+
+		for _, entity := range syncer.Entities {
+			status, err := web.syncStatus(ctx, entity)
+			if err != nil {
+				web.serverError(w, r, err)
+				return
+			}
+			if entity == syncer.Donations {
+				data.Salesforce = append(data.Salesforce, status)
+			} else {
+				data.Xero = append(data.Xero, status)
+			}
+		}
+
+		web.render(w, r, templates, name, data)
 	})
 }
 
-// handleRefresh serves the /refresh page.
-func (web *WebApp) handleRefresh() http.Handler {
+// handleRefreshStart starts a background sync of an entity, returning the status
+// partial for the entity. A refresh of an entity which is already being synchronised is
+// refused with a notice. Setting the form value "full" to "true" retrieves all records
+// rather than only those modified since the last sync.
+func (web *WebApp) handleRefreshStart() http.Handler {
 
-	name := "refresh.html"
-	tpls := []string{"base.html", "refresh.html"}
+	name := "partial-refresh-status"
+	tpls := []string{"partial-refresh-status.html"}
+	templates := template.Must(template.ParseFS(web.templateFS, tpls...))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		ctx := r.Context()
+
+		vars, err := validMuxVars(mux.Vars(r), "entity")
+		if err != nil {
+			web.clientError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		entity, err := syncer.ParseEntity(vars["entity"])
+		if err != nil {
+			web.notFound(w, r, err.Error())
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			web.clientError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// The date range for the sync defaults to the configured data start date. Xero
+		// records are fetched for the selected organisation, or for the configured
+		// organisation if all are selected.
+		opts := syncer.Options{
+			Full:   r.PostForm.Get("full") == "true",
+			Tenant: web.tenant.get(),
+		}
+
+		var notice string
+		err = web.jobs.Start(entity, opts)
+		switch {
+		case errors.Is(err, syncer.ErrJobRunning):
+			notice = fmt.Sprintf("A refresh of %s is already running.", syncEntityLabels[entity])
+		case err != nil:
+			web.serverError(w, r, err)
+			return
+		}
+
+		status, err := web.syncStatus(ctx, entity)
+		if err != nil {
+			web.serverError(w, r, err)
+			return
+		}
+		status.Notice = notice
+		web.render(w, r, templates, name, status)
+	})
+}
+
+// handlePartialRefreshStatus is the partial htmx endpoint for polling the status of a
+// background sync.
+func (web *WebApp) handlePartialRefreshStatus() http.Handler {
+
+	name := "partial-refresh-status"
+	tpls := []string{"partial-refresh-status.html"}
 	templates := template.Must(template.ParseFS(web.templateFS, tpls...))
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		web.render(w, r, templates, name, nil)
+
+		vars, err := validMuxVars(mux.Vars(r), "entity")
+		if err != nil {
+			web.clientError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		entity, err := syncer.ParseEntity(vars["entity"])
+		if err != nil {
+			web.notFound(w, r, err.Error())
+			return
+		}
+
+		status, err := web.syncStatus(r.Context(), entity)
+		if err != nil {
+			web.serverError(w, r, err)
+			return
+		}
+		web.render(w, r, templates, name, status)
 	})
 }
 
@@ -172,7 +376,7 @@ func (web *WebApp) handleHome() http.Handler {
 func (web *WebApp) handleInvoices() http.Handler {
 
 	name := "invoices.html"
-	tpls := []string{"base.html", "partial-listingTabs.html", "invoices.html"}
+	tpls := []string{"base.html", "partial-listingTabs.html", "partial-trackingSelect.html", "invoices.html"}
 	templates := template.Must(template.ParseFS(web.templateFS, tpls...))
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -195,12 +399,14 @@ func (web *WebApp) handleInvoices() http.Handler {
 		// Prepare data for the template, allowing passing of validation
 		// errors back to the template if necessary.
 		data := struct {
-			PageTitle   string
-			Invoices    []db.Invoice
-			Form        *SearchForm
-			Validator   *Validator
-			Pagination  *Pagination
-			CurrentPage string
+			PageTitle       string
+			Invoices        []db.Invoice
+			TrackingOptions []db.TrackingOption
+			TrackingSum     float64
+			Form            *SearchForm
+			Validator       *Validator
+			Pagination      *Pagination
+			CurrentPage     string
 		}{
 			PageTitle:   "Invoices",
 			Form:        form,
@@ -209,6 +415,14 @@ func (web *WebApp) handleInvoices() http.Handler {
 			CurrentPage: "invoices",
 		}
 
+		// The tracking options, such as campaigns, by which the listing can be filtered.
+		options, err := web.db.TrackingOptionsGet(ctx, web.tenant.get())
+		if err != nil {
+			web.serverError(w, r, err)
+			return
+		}
+		data.TrackingOptions = options
+
 		// Render template with errors and return if the form is invalid.
 		if !validator.Valid() {
 			web.render(w, r, templates, name, data)
@@ -217,10 +431,12 @@ func (web *WebApp) handleInvoices() http.Handler {
 
 		invoices, err := web.db.InvoicesGet(
 			ctx,
+			web.tenant.get(),
 			form.ReconciliationStatus,
 			form.DateFrom,
 			form.DateTo,
 			form.SearchString,
+			form.TrackingOption,
 			pageLen,
 			form.Offset(),
 		)
@@ -240,6 +456,7 @@ func (web *WebApp) handleInvoices() http.Handler {
 			recordsNo = 1
 		} else {
 			recordsNo = data.Invoices[0].RowCount
+			data.TrackingSum = data.Invoices[0].TrackingSum
 		}
 		data.Pagination, err = NewPagination(pageLen, recordsNo, form.Page, r.URL.Query())
 		if err != nil {
@@ -254,7 +471,7 @@ func (web *WebApp) handleInvoices() http.Handler {
 func (web *WebApp) handleBankTransactions() http.Handler {
 
 	name := "bank_transactions.html"
-	tpls := []string{"base.html", "partial-listingTabs.html", "bank_transactions.html"}
+	tpls := []string{"base.html", "partial-listingTabs.html", "partial-trackingSelect.html", "bank_transactions.html"}
 	templates := template.Must(template.ParseFS(web.templateFS, tpls...))
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -279,10 +496,14 @@ func (web *WebApp) handleBankTransactions() http.Handler {
 		data := struct {
 			PageTitle        string
 			BankTransactions []db.BankTransaction
+			TrackingOptions  []db.TrackingOption
+			TrackingSum      float64
 			Form             *SearchForm
 			Validator        *Validator
 			Pagination       *Pagination
 			CurrentPage      string
+			EditURL          string // the listing with editable references
+			ListingURL       string // the listing without editable references
 		}{
 			PageTitle:   "Bank Transactions",
 			Form:        form,
@@ -291,6 +512,24 @@ func (web *WebApp) handleBankTransactions() http.Handler {
 			CurrentPage: "bank-transactions",
 		}
 
+		// The references shown may be edited and saved to Xero together.
+		query := r.URL.Query()
+		query.Set("edit", "true")
+		data.EditURL = "/bank-transactions?" + query.Encode()
+		query.Del("edit")
+		data.ListingURL = "/bank-transactions"
+		if len(query) > 0 {
+			data.ListingURL += "?" + query.Encode()
+		}
+
+		// The tracking options, such as campaigns, by which the listing can be filtered.
+		options, err := web.db.TrackingOptionsGet(ctx, web.tenant.get())
+		if err != nil {
+			web.serverError(w, r, err)
+			return
+		}
+		data.TrackingOptions = options
+
 		// Render template with errors and return if the form is invalid.
 		if !validator.Valid() {
 			web.render(w, r, templates, name, data)
@@ -299,10 +538,12 @@ func (web *WebApp) handleBankTransactions() http.Handler {
 
 		transactions, err := web.db.BankTransactionsGet(
 			ctx,
+			web.tenant.get(),
 			form.ReconciliationStatus,
 			form.DateFrom,
 			form.DateTo,
 			form.SearchString,
+			form.TrackingOption,
 			pageLen,
 			form.Offset(),
 		)
@@ -322,6 +563,7 @@ func (web *WebApp) handleBankTransactions() http.Handler {
 			recordsNo = 1
 		} else {
 			recordsNo = data.BankTransactions[0].RowCount
+			data.TrackingSum = data.BankTransactions[0].TrackingSum
 		}
 		data.Pagination, err = NewPagination(pageLen, recordsNo, form.Page, r.URL.Query())
 		if err != nil {
@@ -446,6 +688,7 @@ func (web *WebApp) handleInvoiceDetail() http.Handler {
 			PageTitle string
 			Invoice   db.WRInvoice
 			LineItems []viewLineItem
+			Payments  []viewPayment
 			ID        string
 			TabType   string
 		}{
@@ -469,6 +712,14 @@ func (web *WebApp) handleInvoiceDetail() http.Handler {
 			return
 		}
 
+		// Show the bank deposits which paid the invoice.
+		payments, err := web.db.InvoicePaymentsGet(ctx, invoiceID)
+		if err != nil {
+			web.serverError(w, r, err)
+			return
+		}
+		data.Payments = newViewPayments(payments)
+
 		web.render(w, r, templates, name, data)
 	})
 }
@@ -723,6 +974,15 @@ func (web *WebApp) handlePartialDonationsFind() http.Handler {
 // Helpers
 /* -------------------------------------------------------------------------- */
 
+// syncStatus returns the view of the background sync status for an entity.
+func (web *WebApp) syncStatus(ctx context.Context, entity syncer.Entity) (viewSyncStatus, error) {
+	runs, err := web.db.SyncRunsGet(ctx, string(entity), 10)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return viewSyncStatus{}, err
+	}
+	return newViewSyncStatus(web.jobs.Status(entity), runs), nil
+}
+
 // render renders the specified template.
 func (web *WebApp) render(w http.ResponseWriter, r *http.Request, template *template.Template, filename string, data any) {
 	buf := new(bytes.Buffer)
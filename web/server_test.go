@@ -3,11 +3,17 @@ package web
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/http/httptest"
+	"reconciler/apiclients/salesforce"
+	"reconciler/apiclients/xero"
 	"reconciler/config"
 	"reconciler/db"
 	"reconciler/internal"
+	"reconciler/syncer"
+	"strings"
 	"testing"
 	"time"
 )
@@ -25,7 +31,7 @@ func TestWebAppToRun(t *testing.T) {
 		},
 	}
 	accountCodes := "^(53|55|57)"
-	db, err := db.NewConnectionInTestMode("file::memory:?cache=shared", "", accountCodes)
+	db, err := db.NewConnectionInTestMode("file::memory:?cache=shared", "", accountCodes, "Closed Lost", "^(ACCREC)$", "^(AUTHORISED|PAID|VOIDED)$")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -64,7 +70,7 @@ func TestWebAppAndShutdown(t *testing.T) {
 		},
 	}
 	accountCodes := "^(53|55|57)"
-	db, err := db.NewConnectionInTestMode("file::memory:?cache=shared", "", accountCodes)
+	db, err := db.NewConnectionInTestMode("file::memory:?cache=shared", "", accountCodes, "Closed Lost", "^(ACCREC)$", "^(AUTHORISED|PAID|VOIDED)$")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -99,3 +105,323 @@ func TestWebAppAndShutdown(t *testing.T) {
 		t.Fatalf("server error: %T %v", err, err)
 	}
 }
+
+// newTestWebApp returns a WebApp using a test database for testing handlers.
+func newTestWebApp(t *testing.T, cfg *config.Config) *WebApp {
+	t.Helper()
+
+	db, err := db.NewConnectionInTestMode("file::memory:?cache=shared", "", "^(53|55|57)", "Closed Lost", "^(ACCREC)$", "^(AUTHORISED|PAID|VOIDED)$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	staticFS, err := internal.NewFileMount("static", staticEmbeddedFS, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	templatesFS, err := internal.NewFileMount("templates", templatesEmbeddedFS, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startDate := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+	endDate := time.Date(2026, 3, 31, 0, 0, 0, 0, time.UTC)
+	webApp, err := New(log.Default(), cfg, db, staticFS, templatesFS, startDate, endDate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(webApp.jobs.Close)
+	return webApp
+}
+
+// fakeRunner is a syncer.Runner which blocks until released.
+type fakeRunner struct {
+	release chan struct{}
+	err     error
+}
+
+func (f *fakeRunner) Sync(ctx context.Context, entity syncer.Entity, opts syncer.Options) (syncer.Result, error) {
+	<-f.release
+	if f.err != nil {
+		return syncer.Result{Entity: entity}, f.err
+	}
+	return syncer.Result{Entity: entity, Fetched: 7, Deleted: 2}, nil
+}
+
+// TestRefresh tests starting background syncs from the refresh endpoints.
+func TestRefresh(t *testing.T) {
+
+	webApp := newTestWebApp(t, &config.Config{
+		Web: config.WebConfig{
+			ListenAddress: "127.0.0.1:8000",
+		},
+	})
+	runner := &fakeRunner{release: make(chan struct{})}
+	webApp.jobs = syncer.NewJobs(runner)
+	t.Cleanup(webApp.jobs.Close)
+
+	handler := webApp.routes()
+	request := func(method, url string) (int, string) {
+		t.Helper()
+		r := httptest.NewRequest(method, url, nil)
+		r.Header.Set("HX-Request", "true")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		status   int
+		contains string
+	}{
+		{"page", "GET", "/refresh", http.StatusOK, "01/04/2025"},
+		{"start", "POST", "/refresh/invoices", http.StatusOK, `hx-trigger="every 1s"`},
+		{"already running", "POST", "/refresh/invoices", http.StatusOK, "already running"},
+		{"poll", "GET", "/partials/refresh-status/invoices", http.StatusOK, "Refreshing"},
+		{"unknown entity", "POST", "/refresh/journals", http.StatusNotFound, "unknown entity"},
+		{"get not allowed", "GET", "/refresh/invoices", http.StatusMethodNotAllowed, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := request(tt.method, tt.url)
+			if got, want := status, tt.status; got != want {
+				t.Fatalf("got status %d want %d", got, want)
+			}
+			if !strings.Contains(body, tt.contains) {
+				t.Errorf("body does not contain %q:\n%s", tt.contains, body)
+			}
+		})
+	}
+
+	// Once finished, polling stops and the result is shown.
+	close(runner.release)
+	deadline := time.Now().Add(2 * time.Second)
+	for webApp.jobs.Status(syncer.Invoices).State == syncer.JobRunning {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for sync to finish")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	_, body := request("GET", "/partials/refresh-status/invoices")
+	if strings.Contains(body, "hx-trigger") || !strings.Contains(body, "Refreshed 7 records") || !strings.Contains(body, "Removed 2 deleted upstream") {
+		t.Errorf("unexpected finished status:\n%s", body)
+	}
+}
+
+// TestRefreshError tests that a failed refresh explains Salesforce errors rather than
+// showing the raw API response.
+func TestRefreshError(t *testing.T) {
+
+	webApp := newTestWebApp(t, &config.Config{
+		Web: config.WebConfig{
+			ListenAddress: "127.0.0.1:8000",
+		},
+	})
+	runner := &fakeRunner{
+		release: make(chan struct{}),
+		err: fmt.Errorf("failed to get donations: %w", &salesforce.APIError{
+			StatusCode: http.StatusUnauthorized,
+			Code:       "INVALID_SESSION_ID",
+			Body:       `[{"message": "Session expired or invalid", "errorCode": "INVALID_SESSION_ID"}]`,
+		}),
+	}
+	close(runner.release)
+	webApp.jobs = syncer.NewJobs(runner)
+	t.Cleanup(webApp.jobs.Close)
+
+	if err := webApp.jobs.Start(syncer.Donations, syncer.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for webApp.jobs.Status(syncer.Donations).State == syncer.JobRunning {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for sync to finish")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	r := httptest.NewRequest("GET", "/partials/refresh-status/donations", nil)
+	w := httptest.NewRecorder()
+	webApp.routes().ServeHTTP(w, r)
+	body := w.Body.String()
+	if !strings.Contains(body, "Reconnect to Salesforce") || strings.Contains(body, "errorCode") {
+		t.Errorf("expected an explanation of the error, got:\n%s", body)
+	}
+}
+
+// TestInvoicePayments tests that the invoice detail page shows the bank deposits which
+// paid the invoice.
+func TestInvoicePayments(t *testing.T) {
+
+	webApp := newTestWebApp(t, &config.Config{
+		Web: config.WebConfig{
+			ListenAddress: "127.0.0.1:8000",
+		},
+	})
+	handler := webApp.routes()
+
+	tests := []struct {
+		name        string
+		url         string
+		contains    []string
+		notContains string
+	}{
+		{
+			name:        "paid",
+			url:         "/invoice/inv-001",
+			contains:    []string{"Business Bank Account", "EXAMPLE CORP 1 OF 2", "27 Apr 2025", "200.00"},
+			notContains: "DUPLICATE",
+		},
+		{
+			name:     "unpaid",
+			url:      "/invoice/inv-002",
+			contains: []string{"No payments have been recorded"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.url, nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if got, want := w.Code, http.StatusOK; got != want {
+				t.Fatalf("got status %d want %d", got, want)
+			}
+			body := w.Body.String()
+			for _, s := range tt.contains {
+				if !strings.Contains(body, s) {
+					t.Errorf("body does not contain %q", s)
+				}
+			}
+			if tt.notContains != "" && strings.Contains(body, tt.notContains) {
+				t.Errorf("body should not contain %q", tt.notContains)
+			}
+		})
+	}
+}
+
+// TestListingTracking tests filtering and totalling the invoice listing by tracking
+// option.
+func TestListingTracking(t *testing.T) {
+
+	webApp := newTestWebApp(t, &config.Config{
+		Web: config.WebConfig{
+			ListenAddress: "127.0.0.1:8000",
+		},
+	})
+	handler := webApp.routes()
+	ctx := context.Background()
+
+	categories := []xero.TrackingCategory{{
+		TrackingCategoryID: "tc-campaign",
+		Name:               "Campaign",
+		Status:             "ACTIVE",
+		Options:            []xero.TrackingOption{{TrackingOptionID: "to-spring", Name: "Spring Appeal", Status: "ACTIVE"}},
+	}}
+	if err := webApp.db.TrackingCategoriesUpsert(ctx, "", categories); err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2025, 5, 2, 0, 0, 0, 0, time.UTC)
+	invoices := []xero.Invoice{{
+		InvoiceID:     "inv-tracking-01",
+		InvoiceNumber: "INV-TRACKING-01",
+		Type:          "ACCREC",
+		Status:        "AUTHORISED",
+		Total:         80,
+		Date:          xero.XeroDateTime{Time: date},
+		Updated:       xero.XeroDateTime{Time: date},
+		LineItems: []xero.LineItem{
+			{LineItemID: "inv-tracking-01-a", AccountCode: "5501", LineAmount: 54.32, Tracking: []xero.LineItemTracking{
+				{TrackingCategoryID: "tc-campaign", TrackingOptionID: "to-spring", Name: "Campaign", Option: "Spring Appeal"},
+			}},
+			{LineItemID: "inv-tracking-01-b", AccountCode: "5501", LineAmount: 25.68},
+		},
+	}}
+	if err := webApp.db.InvoicesUpsert(ctx, "", invoices); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		url         string
+		contains    []string
+		notContains string
+	}{
+		{
+			name:        "any",
+			url:         "/invoices?status=All&date-from=2025-04-01&date-to=2026-03-31",
+			contains:    []string{"Campaign: Spring Appeal", "INV-TRACKING-01", "INV-2025-101"},
+			notContains: "Tracked",
+		},
+		{
+			name:        "tracked",
+			url:         "/invoices?status=All&date-from=2025-04-01&date-to=2026-03-31&tracking=to-spring",
+			contains:    []string{"INV-TRACKING-01", "Tracked", "54.32", "£54.32"},
+			notContains: "INV-2025-101",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.url, nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if got, want := w.Code, http.StatusOK; got != want {
+				t.Fatalf("got status %d want %d", got, want)
+			}
+			body := w.Body.String()
+			for _, s := range tt.contains {
+				if !strings.Contains(body, s) {
+					t.Errorf("body does not contain %q", s)
+				}
+			}
+			if tt.notContains != "" && strings.Contains(body, tt.notContains) {
+				t.Errorf("body should not contain %q", tt.notContains)
+			}
+		})
+	}
+}
+
+// TestSameOrigin tests that POST requests from other sites are refused.
+func TestSameOrigin(t *testing.T) {
+
+	webApp := newTestWebApp(t, &config.Config{
+		Web: config.WebConfig{
+			ListenAddress: "127.0.0.1:8000",
+		},
+	})
+	handler := webApp.sameOrigin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		status  int
+	}{
+		{"get", "GET", nil, http.StatusNoContent},
+		{"same origin form", "POST", map[string]string{"Origin": "http://example.com"}, http.StatusNoContent},
+		{"htmx", "POST", map[string]string{"HX-Request": "true"}, http.StatusNoContent},
+		{"same origin htmx", "POST", map[string]string{"Origin": "http://example.com", "HX-Request": "true"}, http.StatusNoContent},
+		{"no origin", "POST", nil, http.StatusForbidden},
+		{"other site", "POST", map[string]string{"Origin": "https://attacker.example"}, http.StatusForbidden},
+		{"other site htmx", "POST", map[string]string{"Origin": "https://attacker.example", "HX-Request": "true"}, http.StatusForbidden},
+		{"null origin", "POST", map[string]string{"Origin": "null"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/bank-transactions/references", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if got, want := w.Code, tt.status; got != want {
+				t.Errorf("got status %d want %d", got, want)
+			}
+		})
+	}
+}
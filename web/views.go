@@ -3,8 +3,12 @@ package web
 /* view types for the web server */
 
 import (
+	"fmt"
 	"html/template"
 	"reconciler/db"
+	"reconciler/internal/usermsg"
+	"reconciler/syncer"
+	"time"
 )
 
 // viewDonation  is a view version of the db.Donations type,
@@ -94,3 +98,93 @@ func newViewLineItems(lineItems []db.WRLineItem) []viewLineItem {
 	}
 	return viewItems
 }
+
+// viewPayment is a view version of the db.Payment with non-pointer fields.
+// BankAccount is the name of the bank account paid into, or its code if the account
+// has not been synced.
+type viewPayment struct {
+	Date         time.Time
+	Amount       float64
+	Reference    string
+	BankAccount  string
+	IsReconciled bool
+}
+
+// newViewPayments converts a slice of db.Payment to a slice of viewPayment.
+func newViewPayments(payments []db.Payment) []viewPayment {
+	viewPayments := make([]viewPayment, len(payments))
+	for i, p := range payments {
+		viewPayments[i] = viewPayment{
+			Date:         p.Date,
+			Amount:       p.Amount,
+			IsReconciled: p.IsReconciled,
+		}
+		if p.Reference != nil {
+			viewPayments[i].Reference = *p.Reference
+		}
+		switch {
+		case p.AccountName != nil:
+			viewPayments[i].BankAccount = *p.AccountName
+		case p.AccountCode != nil:
+			viewPayments[i].BankAccount = *p.AccountCode
+		}
+	}
+	return viewPayments
+}
+
+// viewSyncStatus is a view of the latest background sync job for an entity, together
+// with the last recorded sync run.
+type viewSyncStatus struct {
+	Entity     string
+	Label      string
+	State      string
+	Running    bool
+	Fetched    int
+	Deleted    int // the records removed because they were deleted upstream
+	Elapsed    string
+	Error      string
+	LastSynced string // the finish time of the last successful sync run
+	Notice     string // a message for the user, such as a refused refresh
+	Quota      string // the Xero API calls remaining after the sync, if known
+}
+
+// syncEntityLabels are the display names of the sync entities.
+var syncEntityLabels = map[syncer.Entity]string{
+	syncer.Accounts:         "Accounts",
+	syncer.Invoices:         "Invoices",
+	syncer.BankTransactions: "Bank transactions",
+	syncer.Donations:        "Donations",
+}
+
+// newViewSyncStatus maps a job status and the most recent sync runs for the entity to
+// a viewSyncStatus.
+func newViewSyncStatus(status syncer.JobStatus, runs []db.SyncRun) viewSyncStatus {
+	v := viewSyncStatus{
+		Entity:  string(status.Entity),
+		Label:   syncEntityLabels[status.Entity],
+		State:   string(status.State),
+		Running: status.State == syncer.JobRunning,
+		Fetched: status.Result.Fetched,
+		Deleted: status.Result.Deleted,
+	}
+	if status.State != syncer.JobIdle {
+		v.Elapsed = status.Elapsed().String()
+	}
+	if status.Err != nil {
+		service := usermsg.Xero
+		if status.Entity == syncer.Donations {
+			service = usermsg.Salesforce
+		}
+		v.Error = usermsg.ErrorMessage(service, status.Err)
+	}
+	if s := status.Result.XeroStats; s != nil && s.MinuteRemaining >= 0 && s.DayRemaining >= 0 {
+		v.Quota = fmt.Sprintf("Xero API calls remaining: %d this minute, %d today.", s.MinuteRemaining, s.DayRemaining)
+	}
+	for _, r := range runs {
+		if r.Error == nil && r.FinishedAt != nil {
+			v.LastSynced = r.FinishedAt.Local().Format("02/01/2006 15:04")
+			break
+		}
+	}
+	return v
+}